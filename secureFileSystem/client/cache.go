@@ -0,0 +1,290 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// A handle from InitUser or GetUser keeps a session cache of what it opened: its own User
+// struct, the certificates it holds, so the RSA unwrap and signature check happen once
+// per certificate, and their FileInfos. Each entry remembers the SHA-256 of the sealed
+// bytes it came from and the key it was opened with, and it's only used while the
+// Datastore still holds exactly those bytes, which a DigestDatastore confirms without
+// sending them.
+//
+// The cache is only used with a DigestDatastore, which remote and localstore both are,
+// localstore hashing on disk. Anywhere else checking an entry means fetching every value
+// it was opened from, which is as many bytes as opening it again, twice as many when it
+// changed, and entries opened from the same values fetch them once each. That saves the RSA and signature work and costs bandwidth, BenchmarkSessionCache
+// measures both ways.
+//
+// Whatever another session writes, a revocation notice, a new invite, an append, changes
+// the bytes, so the next call opens it the full way again. A hit needs byte for byte what
+// was verified before, so tampering is caught the same as without the cache.
+//
+// It also keeps what the session logged in with, whatever the backend.
+type sessionCache struct {
+	rootKey  []byte // seals the User struct, see passwordKeys
+	verifier []byte // what the login entry holds
+	passUUID uuid.UUID
+
+	mu      sync.Mutex
+	objects map[uuid.UUID]cachedObject
+}
+
+type cachedObject struct {
+	reads      map[uuid.UUID][sha256.Size]byte // what opening it read, the object itself included
+	key        []byte                          // what it was opened with
+	marshalled []byte                          // JSON of the struct, unmarshalled afresh for every hit
+}
+
+// readSet collects the digests of every Datastore value read with a context carrying
+// it, datastoreGet adds them.
+type readSet struct {
+	mu      sync.Mutex
+	digests map[uuid.UUID][sha256.Size]byte
+}
+
+type readSetKey struct{}
+
+func (reads *readSet) add(key uuid.UUID, value []byte) {
+	reads.mu.Lock()
+	defer reads.mu.Unlock()
+	reads.digests[key] = sha256.Sum256(value)
+}
+
+// Keeps the digest of what was read at key first, see tx.go
+func (reads *readSet) addFirst(key uuid.UUID, digest [sha256.Size]byte) {
+	reads.mu.Lock()
+	defer reads.mu.Unlock()
+	if _, seen := reads.digests[key]; !seen {
+		reads.digests[key] = digest
+	}
+}
+
+func newSessionCache(rootKey []byte, verifier []byte, passUUID uuid.UUID) *sessionCache {
+	return &sessionCache{rootKey: rootKey, verifier: verifier, passUUID: passUUID, objects: make(map[uuid.UUID]cachedObject)}
+}
+
+func (cache *sessionCache) lookup(id uuid.UUID, key []byte) (entry cachedObject, found bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, found = cache.objects[id]
+	return entry, found && bytes.Equal(entry.key, key)
+}
+
+func (cache *sessionCache) remember(id uuid.UUID, entry cachedObject) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.objects[id] = entry
+}
+
+func (cache *sessionCache) forget(id uuid.UUID) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.objects, id)
+}
+
+// Remembers v as the object at id under key, right after we sealed it into sealed and
+// wrote it there. Only for kinds whose open reads nothing but the object itself.
+func (cache *sessionCache) wrote(kind ObjectKind, id uuid.UUID, key []byte, sealed []byte, v interface{}) {
+	cache.wroteAll(kind, id, key, map[uuid.UUID][]byte{id: sealed}, v)
+}
+
+// Like wrote, for an object whose open reads more than itself. written has everything
+// opening it would read, as we wrote it.
+func (cache *sessionCache) wroteAll(kind ObjectKind, id uuid.UUID, key []byte, written map[uuid.UUID][]byte, v interface{}) {
+	if !cache.usable() {
+		return
+	}
+	marshalled, err := marshalVersioned(kind, v)
+	if err != nil {
+		cache.forget(id)
+		return
+	}
+	reads := make(map[uuid.UUID][sha256.Size]byte, len(written))
+	for at, value := range written {
+		reads[at] = sha256.Sum256(value)
+	}
+	cache.remember(id, cachedObject{reads: reads, key: key, marshalled: marshalled})
+}
+
+// Whether every value entry was made from is still stored unchanged
+func (entry cachedObject) fresh(ctx context.Context) (fresh bool, err error) {
+	// checking isn't reading, whatever is being opened around us doesn't depend on it
+	ctx = context.WithValue(ctx, readSetKey{}, (*readSet)(nil))
+	_, digests := datastore.(DigestDatastore)
+	for id, want := range entry.reads {
+		var digest [sha256.Size]byte
+		exists := false
+		if digests {
+			digest, exists, err = datastoreDigest(ctx, id)
+		} else {
+			var value []byte
+			value, exists, err = datastoreGet(ctx, id)
+			digest = sha256.Sum256(value)
+		}
+		if err != nil {
+			return false, err
+		}
+		if !exists || digest != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// A hit counts as reading what the entry was made from, for a transaction the call is
+// part of and for the call's journal. Whatever the call wrote itself it didn't read from
+// the Datastore.
+func (entry cachedObject) readIn(ctx context.Context) {
+	tx := txReadsOf(ctx)
+	j := journalOf(ctx)
+	for id, digest := range entry.reads {
+		if j != nil {
+			if _, _, found := j.get(id); found {
+				continue
+			}
+			j.found(id, digest, true)
+		}
+		if tx != nil {
+			tx.addFirst(id, digest)
+		}
+	}
+}
+
+// Whether the cache is there and the backend can check entries cheaply
+func (cache *sessionCache) usable() bool {
+	if cache == nil {
+		return false
+	}
+	_, digests := datastore.(DigestDatastore)
+	return digests
+}
+
+// The JSON open makes of the object at id under key. open gets the object's sealed bytes
+// and may read whatever else it needs to check them, with ctx. It isn't called if
+// none of what it read last time has changed. Works on a nil cache, or one that isn't
+// usable, too, it just always calls open.
+func (cache *sessionCache) open(ctx context.Context, kind ObjectKind, id uuid.UUID, key []byte, open func(ctx context.Context, sealed []byte) (marshalled []byte, err error)) (marshalled []byte, err error) {
+	if !cache.usable() {
+		sealed, err := datastoreFetch(ctx, kind, id)
+		if err != nil {
+			return nil, err
+		}
+		return open(ctx, sealed)
+	}
+	entry, found := cache.lookup(id, key)
+	if found {
+		fresh, err := entry.fresh(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if fresh {
+			entry.readIn(ctx)
+			return entry.marshalled, nil
+		}
+	}
+	reads := &readSet{digests: make(map[uuid.UUID][sha256.Size]byte)}
+	readCtx := context.WithValue(ctx, readSetKey{}, reads)
+	sealed, err := datastoreFetch(readCtx, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	marshalled, err = open(readCtx, sealed)
+	if err != nil {
+		cache.forget(id)
+		return nil, err
+	}
+	cache.remember(id, cachedObject{reads: reads.digests, key: key, marshalled: marshalled})
+	return marshalled, nil
+}
+
+// Opens the sealed struct at object.UUID into v, from the cache if it hasn't changed.
+// Only for kinds whose open reads nothing but the object itself.
+func (cache *sessionCache) load(ctx context.Context, object sealContext, key []byte, v interface{}) (err error) {
+	marshalled, err := cache.open(ctx, object.Kind, object.UUID, key, func(ctx context.Context, sealed []byte) ([]byte, error) {
+		return openStructJSON(object, key, sealed)
+	})
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(marshalled, v)
+	if err != nil {
+		return integrityErr(object.Kind, object.UUID, "malformed struct")
+	}
+	return nil
+}
+
+// Seals and writes v like storeSealed, the cache keeps it as if it had just been read
+func (cache *sessionCache) store(ctx context.Context, object sealContext, key []byte, v interface{}) (err error) {
+	sealed, err := sealStruct(object, key, v)
+	if err != nil {
+		return err
+	}
+	err = datastoreSet(ctx, object.UUID, sealed)
+	if err != nil {
+		return err
+	}
+	cache.wrote(object.Kind, object.UUID, key, sealed, v)
+	return nil
+}
+
+// The account's User struct as it's stored now, from the cache if it hasn't changed
+func (userdata *User) current(ctx context.Context) (user *User, err error) {
+	rootKey, passUUID, err := userdata.login()
+	if err != nil {
+		return nil, err
+	}
+	cache := userdata.cache
+	object := sealContext{Kind: KindUser, UUID: passUUID, Migrated: true}
+	marshalled, err := cache.open(ctx, KindUser, passUUID, rootKey, func(ctx context.Context, sealed []byte) ([]byte, error) {
+		// the login entry is read too, so the cache notices it changing
+		entry, legacy, exists, err := readLoginEntry(ctx, userdata.Username)
+		if err != nil {
+			return nil, err
+		}
+		if !exists || legacy || !bytes.Equal(entry, cache.verifier) {
+			return nil, integrityErr(KindLogin, loginUUID(userdata.Username), "login entry changed")
+		}
+		return openStructJSON(object, rootKey, sealed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	user = &User{}
+	err = json.Unmarshal(marshalled, user)
+	if err != nil {
+		return nil, integrityErr(KindUser, passUUID, "malformed struct")
+	}
+	user.observer = userdata.observer
+	user.cache = cache
+	return user, nil
+}
+
+// Seals and writes back a FileInfo like storeFileInfo, the cache keeps it
+func (cache *sessionCache) storeFileInfo(ctx context.Context, fileInfoUUID uuid.UUID, fileInfo *FileInfo, accessToken []byte) (err error) {
+	return cache.store(ctx, sealContext{Kind: KindFileInfo, UUID: fileInfoUUID, File: fileInfoUUID}, accessToken, fileInfo)
+}
+
+// Decrypts and MAC-checks a FileInfo like loadFileInfo, from the cache if it hasn't changed
+func (cache *sessionCache) loadFileInfo(ctx context.Context, fileInfoUUID uuid.UUID, accessToken []byte, migrated bool) (fileInfo *FileInfo, err error) {
+	object := sealContext{Kind: KindFileInfo, UUID: fileInfoUUID, File: fileInfoUUID, Migrated: migrated}
+	marshalled, err := cache.open(ctx, KindFileInfo, fileInfoUUID, accessToken, func(ctx context.Context, sealed []byte) ([]byte, error) {
+		return openStructJSON(object, accessToken, sealed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	fileInfo = &FileInfo{}
+	err = json.Unmarshal(marshalled, fileInfo)
+	if err != nil {
+		return nil, integrityErr(KindFileInfo, fileInfoUUID, "malformed struct")
+	}
+	return fileInfo, nil
+}
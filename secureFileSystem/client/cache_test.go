@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/localstore"
+)
+
+// userlib's Datastore with Digest, hashed where the values are so only the digest is sent
+type digestingDatastore struct {
+	userlibDatastore
+}
+
+func (digestingDatastore) Digest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, ok bool, err error) {
+	value, ok := userlib.DatastoreGetMap()[key]
+	if !ok {
+		return digest, false, nil
+	}
+	return sha256.Sum256(value), true, nil
+}
+
+// Loading a file that was shared with us over and over from one session, with a backend
+// that sends digests the cache saves the RSA work and most of the bytes, without one
+// there's no cache and every load costs what the first one did. localstore hashes on
+// disk, so sfs without -server gets the cache too:
+//
+//	go test ./client -bench SessionCache -run xxx
+func BenchmarkSessionCache(b *testing.B) {
+	for _, backend := range []struct {
+		name string
+		open func(b *testing.B) Datastore
+	}{
+		{"digests", func(*testing.B) Datastore { return digestingDatastore{} }},
+		{"no-digests", func(*testing.B) Datastore { return userlibDatastore{} }},
+		{"localstore", func(b *testing.B) Datastore {
+			ds, _, err := localstore.Open(b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			return ds
+		}},
+	} {
+		b.Run(backend.name, func(b *testing.B) {
+			SetDatastore(backend.open(b))
+			defer SetDatastore(nil)
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			owner, err := InitUser("owner", "owner password")
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader, err := InitUser("reader", "reader password")
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = owner.StoreFile("shared.txt", []byte("shared with the reader"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			invitation, err := owner.CreateInvitation("shared.txt", "reader")
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = reader.AcceptInvitation("owner", invitation, "shared.txt")
+			if err != nil {
+				b.Fatal(err)
+			}
+			// the first load opens everything
+			_, err = reader.LoadFile("shared.txt")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var read, pke int
+			reader.SetObserver(ObserverFunc(func(stats OpStats) {
+				read += stats.BytesRead
+				pke += stats.CryptoOps[CryptoPKE]
+			}))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = reader.LoadFile("shared.txt")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(read)/float64(b.N), "bytes-read/op")
+			b.ReportMetric(float64(pke)/float64(b.N), "pke/op")
+		})
+	}
+}
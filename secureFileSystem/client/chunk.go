@@ -0,0 +1,297 @@
+package client
+
+import (
+	"context"
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Content at least MinChunkSize long is split into content-defined chunks (a gear
+// rolling hash picks the boundaries, so an edit only changes the chunks around it).
+// Each chunk is encrypted convergently under a key derived from the writer's DedupKey
+// and the chunk's hash, and stored at a UUID derived the same way, so the same bytes
+// written twice by the same account land on the same entry and are only uploaded once.
+// Without the DedupKey nobody can work out which UUID a guessed chunk would be at.
+// Smaller content is kept inline in the AppendData like before.
+const (
+	MinChunkSize = 2 << 10
+	AvgChunkSize = 8 << 10
+	MaxChunkSize = 64 << 10
+)
+
+// ChunkRef is what an AppendData keeps for each of its chunks. Readers never need the
+// writer's DedupKey, only the per-chunk Key.
+type ChunkRef struct {
+	UUID        uuid.UUID
+	Key         []byte // derives the chunk's encryption, MAC and IV keys
+	Size        int    // before compression and padding
+	Compression CompressionAlgorithm
+}
+
+// gear table for the rolling hash, from a fixed seed so every client cuts the same way
+var gearTable = func() (table [256]uint64) {
+	state := uint64(0x5346534348554e4b) // "SFSCHUNK"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// splits content at content-defined boundaries, every chunk but the last is between
+// MinChunkSize and MaxChunkSize long
+func splitChunks(content []byte) (chunks [][]byte) {
+	const mask = AvgChunkSize - 1
+	for len(content) > 0 {
+		cut := len(content)
+		if cut > MinChunkSize {
+			if cut > MaxChunkSize {
+				cut = MaxChunkSize
+			}
+			var hash uint64
+			for i := MinChunkSize; i < cut; i++ {
+				hash = (hash << 1) + gearTable[content[i]]
+				if hash&mask == 0 {
+					cut = i + 1
+					break
+				}
+			}
+		}
+		chunks = append(chunks, content[:cut])
+		content = content[cut:]
+	}
+	return chunks
+}
+
+// Returns the session's DedupKey, making one for accounts created before chunking
+func (userdata *User) dedupKey(ctx context.Context) (key []byte, err error) {
+	if len(userdata.DedupKey) == 16 {
+		return userdata.DedupKey, nil
+	}
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(userdata.DedupKey) != 16 {
+		userdata.DedupKey = userlib.RandomBytes(16)
+		err = userdata.reencryptUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return userdata.DedupKey, nil
+}
+
+func chunkKeys(key []byte) (encKey []byte, macKey []byte, iv []byte, err error) {
+	encKey, err = hashKDF(key, []byte("chunk encryption"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	macKey, err = hashKDF(key, []byte("chunk MAC"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iv, err = hashKDF(key, []byte("chunk IV"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return encKey[:16], macKey[:16], iv[:16], nil
+}
+
+// Splits content into chunks and uploads the ones this account hasn't stored before.
+// A compressed chunk is a different entry from the same chunk stored raw.
+func (userdata *User) storeChunks(ctx context.Context, content []byte, padding PaddingPolicy, compression CompressionAlgorithm) (refs []ChunkRef, err error) {
+	dedupKey, err := userdata.dedupKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	written := make(map[uuid.UUID]bool)
+	for _, chunk := range splitChunks(content) {
+		chunkHash := userlib.Hash(chunk)
+		if compression != CompressNone {
+			chunkHash = append([]byte(compression+" "), chunkHash...)
+		}
+		key, err := hashKDF(dedupKey, append([]byte("chunk key "), chunkHash...))
+		if err != nil {
+			return nil, err
+		}
+		idBytes, err := hashKDF(dedupKey, append([]byte("chunk UUID "), chunkHash...))
+		if err != nil {
+			return nil, err
+		}
+		ref := ChunkRef{Key: key[:16], Size: len(chunk), Compression: compression}
+		ref.UUID, err = uuid.FromBytes(idBytes[:16])
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+
+		if written[ref.UUID] {
+			continue
+		}
+		written[ref.UUID] = true
+		// already there from an earlier version or another file, if it's been tampered
+		// with since then reading it fails the MAC check like anything else
+		exists, err := datastoreHas(ctx, ref.UUID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		err = storeChunk(ctx, ref, chunk, padding)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// Compresses, pads, encrypts and stores chunk as ref says
+func storeChunk(ctx context.Context, ref ChunkRef, chunk []byte, padding PaddingPolicy) (err error) {
+	encKey, macKey, iv, err := chunkKeys(ref.Key)
+	if err != nil {
+		return err
+	}
+	compressed, err := compress(ref.Compression, chunk)
+	if err != nil {
+		return err
+	}
+	header := newEnvelope(KindChunk, SuiteAESCTRHMAC, 0)
+	encChunk := symEnc(encKey, iv, padding.pad(compressed, 0))
+	chunkMAC, err := hmacEval(macKey, append(header, encChunk...))
+	if err != nil {
+		return err
+	}
+	return datastoreSet(ctx, ref.UUID, append(append(header, encChunk...), chunkMAC...))
+}
+
+// Stores a copy of every chunk in refs under a random key at a random UUID, for a file
+// whose old chunk keys someone revoked may have kept. The copies aren't deduplicated
+// with anything, the old chunks stay for whatever else uses them.
+func rekeyChunks(ctx context.Context, refs []ChunkRef, padding PaddingPolicy) (rekeyed []ChunkRef, err error) {
+	copies := make(map[uuid.UUID]ChunkRef)
+	for _, ref := range refs {
+		if rekeyedRef, ok := copies[ref.UUID]; ok {
+			rekeyed = append(rekeyed, rekeyedRef)
+			continue
+		}
+		chunk, err := loadChunk(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		rekeyedRef := ChunkRef{UUID: uuid.New(), Key: userlib.RandomBytes(16), Size: ref.Size, Compression: ref.Compression}
+		err = storeChunk(ctx, rekeyedRef, chunk, padding)
+		if err != nil {
+			return nil, err
+		}
+		copies[ref.UUID] = rekeyedRef
+		rekeyed = append(rekeyed, rekeyedRef)
+	}
+	return rekeyed, nil
+}
+
+// Fetches, MAC-checks and decrypts one chunk
+func loadChunk(ctx context.Context, ref ChunkRef) (chunk []byte, err error) {
+	value, err := datastoreFetch(ctx, KindChunk, ref.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ref.Key) != 16 {
+		return nil, integrityErr(KindChunk, ref.UUID, "malformed chunk key")
+	}
+	encKey, macKey, _, err := chunkKeys(ref.Key)
+	if err != nil {
+		return nil, err
+	}
+	// the header is MACed too
+	_, header, body, err := openEnvelope(KindChunk, SuiteAESCTRHMAC, ref.UUID, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < userlib.AESBlockSizeBytes+userlib.HashSizeBytes {
+		return nil, integrityErr(KindChunk, ref.UUID, "chunk too short")
+	}
+	encChunk, chunkMAC := body[:len(body)-userlib.HashSizeBytes], body[len(body)-userlib.HashSizeBytes:]
+	expectedMAC, err := hmacEval(macKey, append(append([]byte{}, header...), encChunk...))
+	if err != nil {
+		return nil, err
+	}
+	if !userlib.HMACEqual(chunkMAC, expectedMAC) {
+		return nil, integrityErr(KindChunk, ref.UUID, "MAC mismatch")
+	}
+	// anything past Size (or the end of the compressed stream) is padding
+	chunk = symDec(encKey, encChunk)
+	if ref.Size < 0 || ref.Size > MaxChunkSize {
+		return nil, integrityErr(KindChunk, ref.UUID, "wrong size")
+	}
+	chunk, err = decompress(KindChunk, ref.UUID, ref.Compression, chunk, ref.Size)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) < ref.Size {
+		return nil, integrityErr(KindChunk, ref.UUID, "wrong size")
+	}
+	return chunk[:ref.Size], nil
+}
+
+// Builds, compresses, pads, encrypts and stores the AppendData for content at appendDataUUID
+func (userdata *User) storeAppendData(ctx context.Context, fileInfoUUID uuid.UUID, appendDataUUID uuid.UUID, content []byte, fileInfo *FileInfo, padding PaddingPolicy, compression CompressionAlgorithm) (err error) {
+	var appendData AppendData
+	appendData.Padding = padding
+	if len(content) >= MinChunkSize {
+		appendData.Chunks, err = userdata.storeChunks(ctx, content, padding, compression)
+		if err != nil {
+			return err
+		}
+	} else {
+		appendData.Compression = compression
+		appendData.AppendData, err = compress(compression, content)
+		if err != nil {
+			return err
+		}
+	}
+	return sealAppendData(ctx, fileInfoUUID, appendDataUUID, &appendData, fileInfo)
+}
+
+// Pads, encrypts and stores appendData at appendDataUUID under the file's BlockKey
+func sealAppendData(ctx context.Context, fileInfoUUID uuid.UUID, appendDataUUID uuid.UUID, appendData *AppendData, fileInfo *FileInfo) (err error) {
+	version := writeVersion
+	encoded, err := encodeStruct(version, KindAppendData, *appendData)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealBytes(fileInfo.currentObject(KindAppendData, fileInfoUUID, appendDataUUID), fileInfo.BlockKey, version, appendData.Padding.pad(encoded, ' '))
+	if err != nil {
+		return err
+	}
+	err = datastoreSet(ctx, appendDataUUID, sealed)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// The bytes an AppendData stands for, inline or chunked. Inline content is always
+// shorter than MinChunkSize before it's compressed.
+func appendDataContent(ctx context.Context, dataUUID uuid.UUID, appendData *AppendData) (content []byte, err error) {
+	content, err = decompress(KindAppendData, dataUUID, appendData.Compression, appendData.AppendData, MinChunkSize-1)
+	if err != nil {
+		return nil, err
+	}
+	if len(appendData.Chunks) == 0 {
+		return content, nil
+	}
+	for _, ref := range appendData.Chunks {
+		chunk, err := loadChunk(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+	}
+	return content, nil
+}
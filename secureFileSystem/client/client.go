@@ -2,20 +2,15 @@ package client
 
 // CS 161 Project 2
 
-// Only the following imports are allowed! ANY additional imports
-// may break the autograder!
-// - bytes
-// - encoding/hex
-// - encoding/json
-// - errors
-// - fmt
-// - github.com/cs161-staff/project2-userlib
-// - github.com/google/uuid
-// - strconv
-// - strings
+// The autograder only allowed bytes, encoding/hex, encoding/json, errors, fmt, strconv,
+// strings, userlib and uuid. The package has outgrown that list, its files also use
+// context, sync, time, compress/flate, crypto/sha256 for Datastore digests, crypto/x509
+// to encode keys, net/http and more, so it doesn't build under the autograder anymore.
+// Encryption, MACs and signatures still come from userlib.
 
 import (
 	// "bytes"
+	"context"
 	"encoding/json"
 
 	userlib "github.com/cs161-staff/project2-userlib"
@@ -107,93 +102,22 @@ func someUsefulThings() {
 
 // HELPER FUNCTIONS :
 
-// Computes the HMAC for User struct --> doesnt cover encryption
-func UserMAC(user User, salt []byte, key []byte) (HMAC []byte, err error) {
-	userTemp := user.MAC
-	user.MAC = nil
-	marshalledStruct, err := json.Marshal(user)
+// Grabs an entry from the Datastore. Everything we look up this way is referenced by
+// something we already verified, so a missing entry means it was deleted out from under us.
+func datastoreFetch(ctx context.Context, kind ObjectKind, id uuid.UUID) (value []byte, err error) {
+	value, exists, err := datastoreGet(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	encStruct := userlib.SymEnc(key, salt, marshalledStruct)
-	userMAC, err := userlib.HMACEval(key, encStruct)
-	if err != nil {
-		return nil, err
-	}
-	user.MAC = userTemp
-	return userMAC, nil
-}
-
-// Computes the HMAC for AppendBlock struct --> doesnt cover encryption
-func AppendMAC(append AppendBlock, salt []byte, blockKey []byte) (HMAC []byte, err error) {
-	appendTemp := append.MAC
-	append.MAC = nil
-	marshalledStruct, err := json.Marshal(append)
-	if err != nil {
-		return nil, err
-	}
-	encStruct := userlib.SymEnc(blockKey, salt, marshalledStruct)
-	appendMAC, err := userlib.HMACEval(blockKey, encStruct)
-	if err != nil {
-		return nil, err
-	}
-	append.MAC = appendTemp
-	return appendMAC, nil
-}
-
-// Computes the HMAC for FileInfo struct --> doesnt cover encryption
-func FileMAC(file FileInfo, salt []byte, key []byte) (HMAC []byte, err error) {
-	structTemp := file.MAC
-	file.MAC = nil
-	marshalledStruct, err := json.Marshal(file)
-	if err != nil {
-		return nil, err
-	}
-	encStruct := userlib.SymEnc(key, salt, marshalledStruct)
-	fileMAC, err := userlib.HMACEval(key, encStruct)
-	if err != nil {
-		return nil, err
-	}
-	file.MAC = structTemp
-	return fileMAC, nil
-}
-
-// Computes the HMAC for the Certificate struct --> doesnt cover encryption NEED FIXING !!!!
-func CertMAC(cert Certificates, key []byte) (HMAC []byte, err error) {
-	structTemp := cert.MAC
-	cert.MAC = nil
-	marshalledCert, err := json.Marshal(cert)
-	if err != nil {
-		return nil, err
-	}
-	encCert := userlib.SymEnc(key, cert.Salt, marshalledCert)
-	CertMAC, err := userlib.HMACEval(key, encCert)
-	if err != nil {
-		return nil, err
-	}
-	cert.MAC = structTemp
-	return CertMAC, nil
-}
-
-func AppendDataMAC(appendData AppendData, key []byte) (HMAC []byte, err error) {
-	structTemp := appendData.MAC
-	appendData.MAC = nil
-	marshalledAppendData, err := json.Marshal(appendData)
-	if err != nil {
-		return nil, err
-	}
-	encData := userlib.SymEnc(key, appendData.Salt, marshalledAppendData)
-	CertData, err := userlib.HMACEval(key, encData)
-	if err != nil {
-		return nil, err
+	if !exists {
+		return nil, integrityErr(kind, id, reasonMissing)
 	}
-	appendData.MAC = structTemp
-	return CertData, err
+	return value, nil
 }
 
 func hybridGetEncKey(publicKey userlib.PKEEncKey, symKey []byte) (encSymKey []byte, err error) {
 	// encrypt symKey with public key
-	encSymKey, err = userlib.PKEEnc(publicKey, symKey)
+	encSymKey, err = pkeEnc(publicKey, symKey)
 	if err != nil {
 		return nil, err
 	}
@@ -202,7 +126,7 @@ func hybridGetEncKey(publicKey userlib.PKEEncKey, symKey []byte) (encSymKey []by
 
 func hybridGetSymKey(privateKey userlib.PKEDecKey, encSymKey []byte) (symKey []byte, err error) {
 	// decrypt symKey with private key
-	symKey, err = userlib.PKEDec(privateKey, encSymKey)
+	symKey, err = pkeDec(privateKey, encSymKey)
 	if err != nil {
 		return nil, err
 	}
@@ -219,44 +143,35 @@ func getCertStructKeyUUID(sender string, recipient string, certPtr userlib.UUID)
 }
 
 // called by sender to create a encrypted cert struct
-func (userdata *User) certificateEncryption(sender string, recipient string, fileName string, cert Certificates) (encCertStruct []byte, encCertStructUUID uuid.UUID, err error) {
+func (userdata *User) certificateEncryption(ctx context.Context, sender string, recipient string, fileName string, cert Certificates) (encCertStruct []byte, encCertStructUUID uuid.UUID, err error) {
 	symKey := userlib.RandomBytes(16)
-	encKey, exists := userlib.KeystoreGet(recipient + " encKey")
-	if !exists {
-		return nil, uuid.Nil, errors.New("Could not find key")
-	}
-	// encrypt the symKey with recipient's public key
-	encSymKey, err := hybridGetEncKey(encKey, symKey)
+	encSymKey, keySig, err := userdata.wrapKey(ctx, recipient, symKey)
 	if err != nil {
 		return nil, uuid.Nil, err
 	}
-	// sign the enc key and save the signature in keySig
-	keySig, err := userlib.DSSign(userdata.SignKey, encSymKey)
+	// store signature in Datastore w/ arbitrary UUID, unless the caller already picked one
+	signatureUUID := cert.SignatureUUID
+	if signatureUUID == uuid.Nil {
+		signatureUUID = uuid.New()
+	}
+	err = datastoreSetEnvelope(ctx, KindSignature, SuiteRSASign, signatureUUID, keySig)
 	if err != nil {
 		return nil, uuid.Nil, err
 	}
-	// store signature in Datastore w/ arbitrary UUID
-	signatureUUID := uuid.New()
-	userlib.DatastoreSet(signatureUUID, keySig)
 
-	// update this info in the Cert struct before marshal
+	// update this info in the Cert struct before sealing it
 	cert.SignatureUUID = signatureUUID
-	cert.MAC, err = CertMAC(cert, symKey)
+	encCertStructUUID = uuid.New()
+	// seal the cert struct with symKey
+	encCert, err := sealStruct(sealContext{Kind: KindCertificate, UUID: encCertStructUUID}, symKey, cert)
 	if err != nil {
 		return nil, uuid.Nil, err
 	}
-
-	// marshal the Cert Struct
-	certBytes, err := json.Marshal(cert)
+	// Store encrypted struct at encCertStructUUID
+	err = datastoreSet(ctx, encCertStructUUID, encCert)
 	if err != nil {
 		return nil, uuid.Nil, err
 	}
-	// encrypt the cert struct with symKey
-	encCert := userlib.SymEnc(symKey, cert.Salt, certBytes)
-
-	encCertStructUUID = uuid.New()
-	// Store encrypted struct at encCertStructUUID
-	userlib.DatastoreSet(encCertStructUUID, encCert)
 
 	// get CertStruct Key UUID
 	structKeyUUID, err := getCertStructKeyUUID(sender, recipient, encCertStructUUID)
@@ -264,432 +179,523 @@ func (userdata *User) certificateEncryption(sender string, recipient string, fil
 		return nil, uuid.Nil, err
 	}
 	// Store encrypted key at structKeyUUID
-	userlib.DatastoreSet(structKeyUUID, encSymKey)
-
-	userdata.Invites[fileName] = sender
+	err = datastoreSetEnvelope(ctx, KindCertKey, SuiteRSAOAEP, structKeyUUID, encSymKey)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
 
+	// our own certificate, the session goes on using it without unwrapping it again
+	if sender == userdata.Username && recipient == userdata.Username {
+		userdata.cache.wroteAll(KindCertificate, encCertStructUUID, []byte(sender+" to "+recipient), map[uuid.UUID][]byte{
+			encCertStructUUID: encCert,
+			structKeyUUID:     append(newEnvelope(KindCertKey, SuiteRSAOAEP, 0), encSymKey...),
+			signatureUUID:     append(newEnvelope(KindSignature, SuiteRSASign, 0), keySig...),
+		}, cert)
+	}
 	return encCert, encCertStructUUID, nil
 }
 
-func (userdata *User) certificateReencryption(sender string, recipient string, fileName string, certUUID uuid.UUID, cert Certificates) (encCertStruct []byte, err error) {
+// Encrypts symKey with recipient's public key and signs the result with ours
+func (userdata *User) wrapKey(ctx context.Context, recipient string, symKey []byte) (encSymKey []byte, keySig []byte, err error) {
+	encKey, exists, err := keystoreGet(ctx, recipient+" encKey")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, wrapErr(ErrNotFound, "encryption key of user %q", recipient)
+	}
+	encSymKey, err = hybridGetEncKey(encKey, symKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keySig, err = dsSign(userdata.SignKey, encSymKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encSymKey, keySig, nil
+}
+
+func (userdata *User) certificateReencryption(ctx context.Context, sender string, recipient string, fileName string, certUUID uuid.UUID, cert Certificates) (encCertStruct []byte, err error) {
 	structKeyUUID, err := getCertStructKeyUUID(sender, recipient, certUUID)
 	if err != nil {
 		return nil, err
 	}
 	// grab the decryption key
 	decKey := userdata.DecryptKey
-	encSymKey, exists := userlib.DatastoreGet(structKeyUUID)
-	if !exists {
-		return nil, errors.New("Error finding Encrypted SymKey in Datastore")
+	encSymKey, err := datastoreFetchEnvelope(ctx, KindCertKey, SuiteRSAOAEP, structKeyUUID)
+	if err != nil {
+		return nil, err
 	}
 	// decrypt the encSymKey with private key
 	symKey, err := hybridGetSymKey(decKey, encSymKey)
 	if err != nil {
-		return nil, err
+		return nil, integrityErr(KindCertKey, structKeyUUID, "could not unwrap key")
 	}
-	// REMAC certificate struct and update it in Datastore
-	cert.MAC, err = CertMAC(cert, symKey)
+	// reseal certificate struct and update it in Datastore
+	encCert, err := sealStruct(sealContext{Kind: KindCertificate, UUID: certUUID}, symKey, cert)
 	if err != nil {
 		return nil, err
 	}
-	certBytes, err := json.Marshal(cert)
+
+	// Store encrypted struct at encCertStructUUID
+	err = datastoreSet(ctx, certUUID, encCert)
 	if err != nil {
 		return nil, err
 	}
-	// encrypt the Certificate Struct
-	encCert := userlib.SymEnc(symKey, cert.Salt, certBytes)
-
-	// Store encrypted struct at encCertStructUUID
-	userlib.DatastoreSet(certUUID, encCert)
-
-	userdata.Invites[fileName] = sender
 
 	return encCert, nil
 }
 
 // called by the recipient to decrypt the certificate struct
-func (userdata *User) certificateDecryption(sender string, recipient string, fileName string, certPtr uuid.UUID) (decCertStruct []byte, err error) {
-	userdata, err = usernameToUserStruct(userdata.Username)
+func (userdata *User) certificateDecryption(ctx context.Context, sender string, recipient string, fileName string, certPtr uuid.UUID) (decCertStruct []byte, err error) {
+	userdata, err = userdata.current(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	// if user owns the file
 	if sender == "" && fileName != "" {
-		_, exists := userdata.Invites[fileName]
+		var exists bool
+		_, sender, exists, err = userdata.lookupFile(ctx, fileName)
+		if err != nil {
+			return nil, err
+		}
 		if !exists {
-			return nil, errors.New("File Name not in Invites")
+			return nil, wrapErr(ErrNotFound, "file %q", fileName)
 		}
-		sender = userdata.Invites[fileName]
 	}
 
-	structKeyUUID, err := getCertStructKeyUUID(sender, recipient, certPtr)
+	certStruct, _, err := userdata.openCertificate(ctx, sender, recipient, certPtr)
 	if err != nil {
 		return nil, err
 	}
+	return json.Marshal(certStruct)
+}
 
-	// grab the decryption key
-	decKey := userdata.DecryptKey
-	encSymKey, exists := userlib.DatastoreGet(structKeyUUID)
-	if !exists {
-		return nil, errors.New("Error finding Encrypted SymKey in Datastore")
+// Opens the certificate at certPtr that sender made for recipient and the FileInfo it
+// grants access to. The unwrapped key and signature check are skipped if the session
+// cache opened the same certificate before.
+func (userdata *User) openCertificate(ctx context.Context, sender string, recipient string, certPtr uuid.UUID) (cert *Certificates, fileInfo *FileInfo, err error) {
+	marshalled, err := userdata.cache.open(ctx, KindCertificate, certPtr, []byte(sender+" to "+recipient), func(ctx context.Context, sealed []byte) ([]byte, error) {
+		if isRevocationNotice(ctx, certPtr, sealed) {
+			return nil, wrapErr(ErrRevoked, "certificate %s", certPtr)
+		}
+		encSymKey, symKey, err := loadCertKey(ctx, sender, recipient, certPtr, userdata.DecryptKey)
+		if err != nil {
+			return nil, err
+		}
+		marshalled, err := openStructJSON(sealContext{Kind: KindCertificate, UUID: certPtr, Migrated: userdata.Migrated}, symKey, sealed)
+		if err != nil {
+			return nil, err
+		}
+		var certStruct Certificates
+		err = json.Unmarshal(marshalled, &certStruct)
+		if err != nil {
+			return nil, integrityErr(KindCertificate, certPtr, "malformed struct")
+		}
+		// verify no tampering with File, a stale AccessToken or a leaf that was taken out
+		// of the key tree looks just like tampering so check whether someone up the
+		// sharing chain got revoked before reporting it
+		token, err := certStruct.fileToken(ctx, userdata.cache)
+		if err == nil {
+			fileInfo, err = userdata.cache.loadFileInfo(ctx, certStruct.FileInfo, token, userdata.Migrated)
+		}
+		// the file may have moved onto a key tree, leaving us a leaf
+		var leaf *KeyLeaf
+		if err != nil && certStruct.Leaf == nil && certStruct.KeyTree == nil {
+			var grantErr error
+			leaf, grantErr = userdata.loadLeafGrant(ctx, sender, certPtr, certStruct.FileInfo)
+			if grantErr != nil || leaf != nil {
+				err = grantErr
+			}
+			if err == nil {
+				token, _, err = leafToken(ctx, userdata.cache, certStruct.FileInfo, leaf)
+			}
+			if err == nil {
+				fileInfo, err = userdata.cache.loadFileInfo(ctx, certStruct.FileInfo, token, userdata.Migrated)
+			}
+		}
+		if err != nil {
+			return nil, checkLineage(ctx, certStruct.Lineage, err)
+		}
+		err = verifyCertSignature(ctx, &certStruct, sender, encSymKey)
+		if err != nil {
+			return nil, err
+		}
+		if leaf != nil {
+			err = userdata.takeLeafGrant(ctx, sender, certPtr, symKey, &certStruct, leaf)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(&certStruct)
+		}
+		return marshalled, nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	// decrypt the encSymKey with private key
-	symKey, err := hybridGetSymKey(decKey, encSymKey)
+	cert = &Certificates{}
+	err = json.Unmarshal(marshalled, cert)
 	if err != nil {
-		return nil, err
+		return nil, nil, integrityErr(KindCertificate, certPtr, "malformed struct")
 	}
-	// grab the encrypted cert struct from Datastore
-	encCertStruct, exists := userlib.DatastoreGet(certPtr)
-	if !exists {
-		return nil, errors.New("Error finding Encrypted Certificate Struct in Datastore")
+	// the certificate may have come from the cache, the key tree and FileInfo may still have changed
+	cert.token, err = cert.fileToken(ctx, userdata.cache)
+	if err == nil && fileInfo == nil {
+		fileInfo, err = userdata.cache.loadFileInfo(ctx, cert.FileInfo, cert.token, userdata.Migrated)
 	}
-	// decrypt the cert struct with symKey
-	decCertStructBytes := userlib.SymDec(symKey, encCertStruct)
-	var certStruct Certificates
-	err = json.Unmarshal(decCertStructBytes, &certStruct)
 	if err != nil {
-		return nil, err
+		return nil, nil, checkLineage(ctx, cert.Lineage, err)
 	}
-	// verify no tampering with MAC
-	certStructMAC, err := CertMAC(certStruct, symKey)
+	return cert, fileInfo, nil
+}
+
+// Grabs the certificate symKey wrapped for recipient and unwraps it with their private key
+func loadCertKey(ctx context.Context, sender string, recipient string, certPtr uuid.UUID, decKey userlib.PKEDecKey) (encSymKey []byte, symKey []byte, err error) {
+	structKeyUUID, err := getCertStructKeyUUID(sender, recipient, certPtr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	// verify the MAC
-	hmacCheck := userlib.HMACEqual(certStructMAC, certStruct.MAC)
-	if !(hmacCheck) {
-		return nil, errors.New("Error verifying MAC of Certificate Struct")
+	encSymKey, err = datastoreFetchEnvelope(ctx, KindCertKey, SuiteRSAOAEP, structKeyUUID)
+	if err != nil {
+		return nil, nil, err
 	}
-	// verify no tampering with File
-	fileInfoUUID := certStruct.FileInfo
-	encFileInfo, exists := userlib.DatastoreGet(fileInfoUUID)
-	if !exists {
-		return nil, errors.New("Error finding FileInfo Struct in Datastore")
+	// decrypt the encSymKey with private key
+	symKey, err = hybridGetSymKey(decKey, encSymKey)
+	if err != nil {
+		return nil, nil, integrityErr(KindCertKey, structKeyUUID, "could not unwrap key")
 	}
-	// use Access Token to decrypt fileinfo struct
-	accessToken := certStruct.AccessToken
-	decFileInfo := userlib.SymDec(accessToken, encFileInfo)
-	// need to error if the accessToken is wrong
-	var fileInfo FileInfo
-	err = json.Unmarshal(decFileInfo, &fileInfo)
+	return encSymKey, symKey, nil
+}
+
+// Decrypts and MAC-checks a certificate, the owner may have replaced it with a revocation
+// notice. migrated is the account's User.Migrated.
+func loadCertificate(ctx context.Context, certPtr uuid.UUID, symKey []byte, migrated bool) (cert *Certificates, err error) {
+	encCertStruct, err := datastoreFetch(ctx, KindCertificate, certPtr)
 	if err != nil {
 		return nil, err
 	}
-	// verify no tampering with MAC
-	fileInfoMAC, err := FileMAC(fileInfo, fileInfo.Salt, accessToken)
+	if isRevocationNotice(ctx, certPtr, encCertStruct) {
+		return nil, wrapErr(ErrRevoked, "certificate %s", certPtr)
+	}
+	var certStruct Certificates
+	err = openStruct(sealContext{Kind: KindCertificate, UUID: certPtr, Migrated: migrated}, symKey, encCertStruct, &certStruct)
 	if err != nil {
 		return nil, err
 	}
-	// verify the MAC
-	hmacCheck = userlib.HMACEqual(fileInfoMAC, fileInfo.MAC)
-	if !(hmacCheck) {
-		return nil, errors.New("Error verifying MAC of FileInfo Struct")
-	}
+	return &certStruct, nil
+}
 
-	// grab the signature
-	signature, exists := userlib.DatastoreGet(certStruct.SignatureUUID)
-	if !exists {
-		return nil, errors.New("Error finding Certificate Struct Signature in Datastore")
+// Checks the sender's signature over the wrapped certificate key
+func verifyCertSignature(ctx context.Context, cert *Certificates, sender string, encSymKey []byte) (err error) {
+	return verifyKeySignature(ctx, sender, encSymKey, cert.SignatureUUID)
+}
+
+// Checks the signature at signatureUUID is sender's over encSymKey
+func verifyKeySignature(ctx context.Context, sender string, encSymKey []byte, signatureUUID uuid.UUID) (err error) {
+	signature, err := datastoreFetchEnvelope(ctx, KindSignature, SuiteRSASign, signatureUUID)
+	if err != nil {
+		return err
+	}
+	verifyKey, exists, err := keystoreGet(ctx, sender+" verifyKey")
+	if err != nil {
+		return err
 	}
-	// verify the signature w/ public key
-	verifyKey, exists := userlib.KeystoreGet(sender + " verifyKey")
 	if !exists {
-		return nil, errors.New("Error finding Verify Key in Keystore")
+		return wrapErr(ErrNotFound, "verify key of user %q", sender)
+	}
+	err = dsVerify(verifyKey, encSymKey, signature)
+	if err != nil {
+		return integrityErr(KindSignature, signatureUUID, "bad signature")
 	}
-	userlib.DSVerify(verifyKey, encSymKey, signature) // is there a realistic point to this if u can make it here?
-	return decCertStructBytes, nil
+	return nil
 }
 
-// Checks every AppendBlock MAC in the chain to verify integrity
-func traverseAppendBlock(firstAppendBlock uuid.UUID, blockKey []byte) error {
-	currUUID := firstAppendBlock
-	// read the filedata from start append, until last append, using next append field.
-	for currUUID != uuid.Nil {
-		encCurrAppend, exists := userlib.DatastoreGet(currUUID)
-		if !exists {
-			return errors.New("Error getting CurrAppend from Datastore")
-		}
-
-		decCurrAppend := userlib.SymDec(blockKey, encCurrAppend)
+// Decrypts and MAC-checks a FileInfo with the AccessToken from a certificate. migrated is
+// the User.Migrated of the account reading it.
+func loadFileInfo(ctx context.Context, fileInfoUUID uuid.UUID, accessToken []byte, migrated bool) (fileInfo *FileInfo, err error) {
+	var fileInfoStruct FileInfo
+	err = loadSealed(ctx, sealContext{Kind: KindFileInfo, UUID: fileInfoUUID, File: fileInfoUUID, Migrated: migrated}, accessToken, &fileInfoStruct)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfoStruct, nil
+}
 
-		var currAppendBlock AppendBlock
-		err := json.Unmarshal(decCurrAppend, &currAppendBlock)
-		if err != nil {
-			return err
-		}
-		correctCurrHMAC, err := AppendMAC(currAppendBlock, currAppendBlock.Salt, blockKey)
-		if err != nil {
-			return err
-		}
-		currAppendBlockHMAC := currAppendBlock.MAC
-		hmacCheckBlock := userlib.HMACEqual(currAppendBlockHMAC, correctCurrHMAC)
-		if !(hmacCheckBlock) {
-			return errors.New("Failed verification test on Append Block Struct")
-		}
-		currAppendDataBytes, exists := userlib.DatastoreGet(currAppendBlock.FileData)
-		if !exists {
-			return errors.New("Couldn't find AppendData in Datastore")
-		}
-		currAppendDataDec := userlib.SymDec(blockKey, currAppendDataBytes)
-		var currAppendData AppendData
-		err = json.Unmarshal(currAppendDataDec, &currAppendData)
-		if err != nil {
-			return err
-		}
-		currAppendDataMAC := currAppendData.MAC
-		currAppendDataHMAC, err := AppendDataMAC(currAppendData, blockKey)
-		if err != nil {
-			return err
-		}
-		hmacCheckData := userlib.HMACEqual(currAppendDataMAC, currAppendDataHMAC)
-		if !(hmacCheckData) {
-			return errors.New("Failed verification test on Append Data Struct")
-		}
+// Seals and writes back a FileInfo
+func storeFileInfo(ctx context.Context, fileInfoUUID uuid.UUID, fileInfo *FileInfo, accessToken []byte) (err error) {
+	return storeSealed(ctx, sealContext{Kind: KindFileInfo, UUID: fileInfoUUID, File: fileInfoUUID}, accessToken, fileInfo)
+}
 
-		currUUID = currAppendBlock.NextAppend
+// Decrypts and MAC-checks one AppendBlock of a chain, with whichever of the file's keys it's under
+func loadAppendBlock(ctx context.Context, fileInfoUUID uuid.UUID, blockUUID uuid.UUID, fileInfo *FileInfo) (block *AppendBlock, err error) {
+	sealed, err := datastoreFetch(ctx, KindAppendBlock, blockUUID)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	object, key, err := fileInfo.blockObject(KindAppendBlock, fileInfoUUID, blockUUID, sealed)
+	if err != nil {
+		return nil, err
+	}
+	var appendBlock AppendBlock
+	err = openStruct(object, key, sealed, &appendBlock)
+	if err != nil {
+		return nil, err
+	}
+	return &appendBlock, nil
 }
 
-// Using the username, grab the User Struct from the Datastore, grab its Cert Struct and update the AccessToken
-func (userdata *User) updateToken(username string, parentname string, certificateUUID uuid.UUID, newAccessToken []byte) (err error) {
-	// grab the user struct from the Datastore
-	recipientHash := userlib.Hash([]byte(username))[:16]
-	recipientUUID, err := uuid.FromBytes(recipientHash)
+// Seals and writes an AppendBlock of the file at fileInfoUUID under its current BlockKey
+func storeAppendBlock(ctx context.Context, fileInfoUUID uuid.UUID, blockUUID uuid.UUID, block *AppendBlock, fileInfo *FileInfo) (err error) {
+	return storeSealed(ctx, fileInfo.currentObject(KindAppendBlock, fileInfoUUID, blockUUID), fileInfo.BlockKey, block)
+}
+
+// Decrypts and MAC-checks the AppendData an AppendBlock points to
+func loadAppendData(ctx context.Context, fileInfoUUID uuid.UUID, dataUUID uuid.UUID, fileInfo *FileInfo) (data *AppendData, err error) {
+	encData, err := datastoreFetch(ctx, KindAppendData, dataUUID)
 	if err != nil {
-		return err
-	}
-	recipientEncPassword, exists := userlib.DatastoreGet(recipientUUID)
-	if !exists {
-		return errors.New("Error finding User Struct in Datastore")
+		return nil, err
 	}
-	// find the UUID of the encrypted user struct
-	recipientPassHKDF, err := userlib.HashKDF(recipientEncPassword[:16], []byte("UUID"))
+	object, key, err := fileInfo.blockObject(KindAppendData, fileInfoUUID, dataUUID, encData)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	recipientPassUUID, err := uuid.FromBytes(recipientPassHKDF)
+	plaintext, version, _, err := openSealed(object, key, encData)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// grab the encrypted user struct
-	recipientEncUser, exists := userlib.DatastoreGet(recipientPassUUID)
-	if !exists {
-		return errors.New("Error finding User Struct in Datastore")
+	marshalled, n, err := structJSON(KindAppendData, dataUUID, version, plaintext)
+	if err != nil {
+		return nil, err
 	}
-	// decrypt the user struct
-	decUserStruct := userlib.SymDec(recipientEncPassword, recipientEncUser)
-	var recipientUser User
-	err = json.Unmarshal(decUserStruct, &recipientUser)
+	var appendData AppendData
+	err = unmarshalVersioned(KindAppendData, dataUUID, marshalled, &appendData)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// grab the recipient's certificate struct
-	recipientEncCertStruct, exists := userlib.DatastoreGet(certificateUUID)
-	if !exists {
-		return errors.New("Error finding Certificate Struct in Datastore")
+	err = checkAppendDataPadding(dataUUID, &appendData, n, len(plaintext))
+	if err != nil {
+		return nil, err
 	}
+	return &appendData, nil
+}
 
-	// decrypt the certificate struct using private decKey
-	decCertStruct, err := userdata.certificateDecryption(parentname, userdata.Username, "", certificateUUID)
+// RevokeAccess overwrites the revoked recipient's certificate with a signed notice so the
+// recipient gets ErrRevoked instead of an integrity failure.
+const revocationPrefix = "revoked:"
+
+type RevocationNotice struct {
+	Revoker   string
+	Signature []byte // Revoker's signature over revocationMessage(certificate UUID)
+}
+
+func revocationMessage(certUUID uuid.UUID) []byte {
+	return []byte(revocationPrefix + certUUID.String())
+}
+
+func (userdata *User) writeRevocationNotice(ctx context.Context, certUUID uuid.UUID) (err error) {
+	var notice RevocationNotice
+	notice.Revoker = userdata.Username
+	notice.Signature, err = dsSign(userdata.SignKey, revocationMessage(certUUID))
 	if err != nil {
 		return err
 	}
-
-	var recipientCertStruct Certificates
-	err = json.Unmarshal(decCertStruct, &recipientCertStruct)
+	noticeBytes, err := json.Marshal(notice)
 	if err != nil {
 		return err
 	}
+	err = datastoreSetEnvelope(ctx, KindRevocation, SuiteRSASign, certUUID, noticeBytes)
+	if err != nil {
+		return err
+	}
+	return nil
+}
 
-	// check the signature inside the cefrtificate struct
-	// grab verification key
-	verifyKey, exists := userlib.KeystoreGet(parentname + " verifyKey")
-	if !exists {
-		return errors.New("Error finding Verify Key in Keystore")
+// only counts as a notice if the signature checks out, otherwise it's just a tampered certificate
+func isRevocationNotice(ctx context.Context, certUUID uuid.UUID, value []byte) bool {
+	_, _, body, err := openEnvelope(KindRevocation, SuiteRSASign, certUUID, value)
+	if err != nil {
+		return false
 	}
-	// grab the signature
-	signature, exists := userlib.DatastoreGet(recipientCertStruct.SignatureUUID)
-	if !exists {
-		return errors.New("Error finding Certificate Struct Signature in Datastore")
+	var notice RevocationNotice
+	err = json.Unmarshal(body, &notice)
+	if err != nil {
+		return false
 	}
-	// verify signature using verifyKey
-	verified := userlib.DSVerify(verifyKey, recipientEncCertStruct, signature)
-	if verified != nil {
-		return errors.New("Error verifying digital signature")
+	verifyKey, exists, err := keystoreGet(ctx, notice.Revoker+" verifyKey")
+	if err != nil || !exists {
+		return false
 	}
-	for username, certificateUUID := range recipientCertStruct.Recipients {
-		// grab the user struct for each username
-		var recipientUser User
-		err = recipientUser.updateToken(username, recipientUser.Username, certificateUUID, newAccessToken)
+	return dsVerify(verifyKey, revocationMessage(certUUID), notice.Signature) == nil
+}
+
+// Returns ErrRevoked if any certificate we were shared through has been revoked, verifyErr otherwise
+func checkLineage(ctx context.Context, lineage []uuid.UUID, verifyErr error) error {
+	for _, certUUID := range lineage {
+		value, exists, err := datastoreGet(ctx, certUUID)
 		if err != nil {
 			return err
 		}
+		if exists && isRevocationNotice(ctx, certUUID, value) {
+			return wrapErr(ErrRevoked, "certificate %s", certUUID)
+		}
 	}
+	return verifyErr
+}
 
-	//setup new struct to replace old one in DataStore
-	recipientCertStruct.AccessToken = newAccessToken
-
-	// reencrypt certificate struct and put in Datastore (does a new signature need to be created?)
-	newCertStruct, err := recipientUser.certificateReencryption(parentname, username, "", certificateUUID, recipientCertStruct)
-	if err != nil {
-		return err
-	}
-	userlib.DatastoreSet(certificateUUID, newCertStruct)
-
-	return nil
+// Checks every AppendBlock MAC in the chain to verify integrity
+func traverseAppendBlock(ctx context.Context, fileInfoUUID uuid.UUID, fileInfo *FileInfo) error {
+	return readChain(ctx, fileInfoUUID, fileInfo, func(context.Context, *AppendBlock, *AppendData) error { return nil })
 }
 
 // Go from the Name to the FileInfo Struct ???
-func (userdata *User) nameToFileInfo(filename string) (fileInfo *FileInfo, certificate *Certificates, err error) {
-	userdata, err = usernameToUserStruct(userdata.Username)
+func (userdata *User) nameToFileInfo(ctx context.Context, filename string) (fileInfo *FileInfo, certificate *Certificates, err error) {
+	userdata, err = userdata.current(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	certificateUUID, sender, exists, err := userdata.lookupFile(ctx, filename)
 	if err != nil {
 		return nil, nil, err
 	}
-	certificateUUID, exists := userdata.Certificates[filename]
 	if exists {
-		// decrypt the certificate struct using private decKey
-		sender, exists := userdata.Invites[filename]
-		if !exists {
-			return nil, nil, errors.New("Error finding sender in Invites")
-		}
-		decCertStruct, err := userdata.certificateDecryption(sender, userdata.Username, filename, certificateUUID) // 6
-		if err != nil {
-			return nil, nil, err
-		}
-
-		var certificateStruct Certificates
-		err = json.Unmarshal(decCertStruct, &certificateStruct)
-		if err != nil {
-			return nil, nil, err
-		}
-		// possibly need to check MAC
-		// grabbing corresponding FileInfo from decrypted Certificate struct
-		fileInfoUUID := certificateStruct.FileInfo
-		encFileInfo, exists := userlib.DatastoreGet(fileInfoUUID)
-		if !exists {
-			return nil, nil, errors.New("Error finding FileInfo Struct in Datastore")
-		}
-
-		// use Access Token to decrypt fileinfo struct
-		accessToken := certificateStruct.AccessToken
-		decFileInfo := userlib.SymDec(accessToken, encFileInfo)
-		// need to error if the accessToken is wrong
-
-		var fileInfo FileInfo
-		err = json.Unmarshal(decFileInfo, &fileInfo)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		currentFileMAC, err := FileMAC(fileInfo, fileInfo.Salt, accessToken)
+		// grabbing corresponding FileInfo along with the Certificate
+		certificate, fileInfo, err = userdata.openCertificate(ctx, sender, userdata.Username, certificateUUID)
 		if err != nil {
 			return nil, nil, err
 		}
-
-		hmacCheck := userlib.HMACEqual(fileInfo.MAC, currentFileMAC)
-		if !(hmacCheck) {
-			return nil, nil, errors.New("Failed verification test on FileInfo Struct")
-		}
-		return &fileInfo, &certificateStruct, nil
+		return fileInfo, certificate, nil
 	} else {
 		return nil, nil, nil
 	}
 }
 
-// Go from the username to the UserStruct
-func usernameToUserStruct(username string) (user *User, err error) {
-	// grab the user struct from the Datastore
-	userHash := userlib.Hash([]byte(username))[:16]
-	userUUID, err := uuid.FromBytes(userHash)
+// UUID of the login entry, the root of a user's account
+func loginUUID(username string) uuid.UUID {
+	userHash := userlib.Hash([]byte(username))
+	userUUID, _ := uuid.FromBytes(userHash[:16])
+	return userUUID
+}
+
+// Everything an account's keys come from is the Argon2 key of its password, which is
+// never stored. The root key seals the User struct and the journal and decides where
+// they are, the login entry only holds a verifier, derived from the Argon2 key apart
+// from the root key, so reading it tells GetUser whether a password is right and nothing
+// else. The first client's accounts keep Hash(Argon2 key) in the login entry and derive
+// everything from that, see upgradeLogin.
+func passwordKeys(username string, password string) (rootKey []byte, verifier []byte, passUUID uuid.UUID, err error) {
+	argonKey := argon2Key([]byte(password), []byte(username), 16)
+	rootKey, err = hashKDF(argonKey, []byte("root key"))
 	if err != nil {
-		return nil, err
-	}
-	passHash, exists := userlib.DatastoreGet(userUUID)
-	if !exists {
-		return nil, errors.New("Error finding User Hashed Password in Datastore")
+		return nil, nil, uuid.Nil, err
 	}
-
-	passHKDF, err := userlib.HashKDF(passHash, []byte("UUID"))
+	verifier, err = hashKDF(argonKey, []byte("login verifier"))
 	if err != nil {
-		return nil, err
+		return nil, nil, uuid.Nil, err
 	}
-
-	passUUID, err := uuid.FromBytes(passHKDF[:16])
+	passUUID, err = userStructUUID(rootKey[:16])
 	if err != nil {
-		return nil, err
+		return nil, nil, uuid.Nil, err
 	}
+	return rootKey[:16], verifier[:16], passUUID, nil
+}
 
-	// grab the encrypted user struct
-	userEncUser, exists := userlib.DatastoreGet(passUUID)
-	if !exists {
-		return nil, errors.New("Error finding User Struct in Datastore")
-	}
+// The password hash the first client's accounts keep in their login entry
+func legacyPassHash(username string, password string) []byte {
+	return userlib.Hash(argon2Key([]byte(password), []byte(username), 16))[:16]
+}
 
-	// decrypt the user struct
-	var userStruct User
-	decUserStruct := userlib.SymDec(passHash, userEncUser)
-	err = json.Unmarshal(decUserStruct, &userStruct)
+// Where the User struct sealed under key is
+func userStructUUID(key []byte) (passUUID uuid.UUID, err error) {
+	passHKDF, err := hashKDF(key, []byte("UUID"))
 	if err != nil {
-		return nil, err
+		return uuid.Nil, err
 	}
+	return uuid.FromBytes(passHKDF[:16])
+}
 
-	// HMAC verification
-	currUserMAC := userStruct.MAC
-	decUserMAC, err := UserMAC(userStruct, userStruct.Salt, passHash)
+// The account's login entry, legacy if it's the password hash the first client kept
+// rather than a verifier
+func readLoginEntry(ctx context.Context, username string) (entry []byte, legacy bool, exists bool, err error) {
+	id := loginUUID(username)
+	value, exists, err := datastoreGet(ctx, id)
+	if err != nil || !exists {
+		return nil, false, exists, err
+	}
+	header, _, entry, err := openEnvelope(KindLogin, SuiteLoginVerifier, id, value)
 	if err != nil {
-		return nil, err
+		return nil, false, true, err
 	}
-
-	hmacCheck := userlib.HMACEqual(currUserMAC, decUserMAC)
-	if !(hmacCheck) {
-		return nil, errors.New("Failed verification test on User Struct")
+	if len(entry) != 16 {
+		return nil, false, true, integrityErr(KindLogin, id, "malformed login entry")
 	}
-
-	return &userStruct, nil
+	return entry, header.Version == 0, true, nil
 }
 
-func (userdata *User) reencryptUser() (err error) {
-	// get Hash(username)[:16]
-	userHash := userlib.Hash([]byte(userdata.Username))[:16]
-	// get the UUID over the computed Hash
-	userUUID, err := uuid.FromBytes(userHash)
+// Moves one of the first client's accounts onto passwordKeys: the User struct is sealed under
+// the root key at the UUID that derives, the login entry gets the verifier, and the User
+// struct under the old password hash goes. What the old login entry let anyone read up
+// to now stays known to them, the private keys in the User struct included, since the
+// Keystore can't take new public keys. Sessions logged in before have to log in again.
+func upgradeLogin(ctx context.Context, username string, passHash []byte, rootKey []byte, verifier []byte, passUUID uuid.UUID) (err error) {
+	oldUUID, err := userStructUUID(passHash)
 	if err != nil {
 		return err
 	}
-
-	passHash, exists := userlib.DatastoreGet(userUUID)
-	if !exists {
-		return errors.New("Error getting the Enc Pass from User in Datastore")
+	var user User
+	err = loadSealed(ctx, sealContext{Kind: KindUser, UUID: oldUUID}, passHash, &user)
+	if err != nil {
+		return err
 	}
-
-	passHKDF, err := userlib.HashKDF(passHash, []byte("UUID"))
+	// in this order a crash leaves the old login working, and the new User struct gets
+	// written again
+	err = storeSealed(ctx, sealContext{Kind: KindUser, UUID: passUUID}, rootKey, &user)
 	if err != nil {
 		return err
 	}
-
-	passUUID, err := uuid.FromBytes(passHKDF[:16])
+	err = datastoreSetEnvelope(ctx, KindLogin, SuiteLoginVerifier, loginUUID(username), verifier)
 	if err != nil {
 		return err
 	}
+	return datastoreDelete(ctx, oldUUID)
+}
 
-	userdata.MAC, err = UserMAC(*userdata, userdata.Salt, passHash)
+// Reloads the User struct so we don't clobber what other sessions wrote when we write it back
+func (userdata *User) refresh(ctx context.Context) (err error) {
+	fresh, err := userdata.current(ctx)
 	if err != nil {
 		return err
 	}
+	*userdata = *fresh
+	return nil
+}
 
-	marshalledStruct, err := json.Marshal(userdata)
+func (userdata *User) reencryptUser(ctx context.Context) (err error) {
+	rootKey, passUUID, err := userdata.login()
 	if err != nil {
 		return err
 	}
-
-	encUserStruct := userlib.SymEnc(passHash, userdata.Salt, marshalledStruct)
-
-	userlib.DatastoreSet(passUUID, encUserStruct)
+	object := sealContext{Kind: KindUser, UUID: passUUID}
+	sealed, err := sealStruct(object, rootKey, userdata)
+	if err != nil {
+		return err
+	}
+	err = datastoreSet(ctx, passUUID, sealed)
+	if err != nil {
+		return err
+	}
+	userdata.cache.forget(passUUID)
 	return nil
 }
 
+// The account's root key and where it keeps its User struct, from when the session logged in
+func (userdata *User) login() (rootKey []byte, passUUID uuid.UUID, err error) {
+	if userdata.cache == nil {
+		return nil, uuid.Nil, wrapErr(ErrAuth, "user %q isn't logged in", userdata.Username)
+	}
+	return userdata.cache.rootKey, userdata.cache.passUUID, nil
+}
+
 // END OF HELPER FUNCTIONS
 
 // This is the type definition for the User struct.
@@ -697,34 +703,51 @@ func (userdata *User) reencryptUser() (err error) {
 // (e.g. like the Username attribute) and methods (e.g. like the StoreFile method below).
 type User struct {
 	Username     string
-	Password     string
-	SignKey      userlib.DSSignKey    // sign privately and verify publicly
-	DecryptKey   userlib.PKEDecKey    // encrypt publicly and decrypt privately
-	Certificates map[string]uuid.UUID // filename : UUID of Certificate
-	Invites      map[string]string    // file that was shared to user : username of person who shared it
-	MAC          []byte               // MAC to verify struct integrity
-	Salt         []byte               // IV for HMAC Verification and Enc/Dec
+	SignKey      userlib.DSSignKey        // sign privately and verify publicly
+	DecryptKey   userlib.PKEDecKey        // encrypt publicly and decrypt privately
+	Namespace    *Namespace               // where our files are, see namespace.go
+	Certificates map[string]uuid.UUID     // before Namespace, filename : UUID of Certificate
+	Invites      map[string]string        // before Namespace, file that was shared to user : username of person who shared it
+	Invitations  map[uuid.UUID]Invitation // invitations we created : who they're for, until they expire
+	DedupKey     []byte                   // derives chunk keys and UUIDs so our identical chunks are stored once
+	Padding      PaddingPolicy            // default padding for what we write
+	Ledger       *LedgerRef               // our quota and what our files take up, see quota.go
+	Migrated     bool                     // MigrateKeys sealed what the first client stored, see sealContext
+
+	observer Observer      // not stored, see SetObserver
+	cache    *sessionCache // not stored, see cache.go
 }
 
 type AppendData struct {
-	AppendData []byte
-	MAC        []byte
-	Salt       []byte
+	AppendData  []byte               // the content itself if it's small
+	Chunks      []ChunkRef           // otherwise where its chunks are
+	Padding     PaddingPolicy        // what this was padded with before encryption
+	Compression CompressionAlgorithm // what AppendData was compressed with, chunks say for themselves
 }
 
 type AppendBlock struct {
 	FileData   uuid.UUID // UUID of the Append Data
 	NextAppend uuid.UUID
-	MAC        []byte
-	Salt       []byte
+	RunSeed    []byte // set on the first block of a run, see prefetch.go
 }
 
 type FileInfo struct {
 	StartAppend uuid.UUID
 	EndAppend   uuid.UUID
-	BlockKey    []byte // Key that encrypts blocks
-	MAC         []byte
-	Salt        []byte
+	BlockKey    []byte             // Key that encrypts blocks
+	Padding     *PaddingPolicy     // overrides the writer's account policy if set
+	Compression *CompressionPolicy // off if nil
+	RunSeed     []byte             // the run the next append goes in, see prefetch.go
+	RunLength   int                // how many blocks it has so far
+
+	KeyEpoch     uint32            // which epoch BlockKey is, see rekey.go
+	OldBlockKeys map[uint32][]byte // keys of earlier epochs that blocks may still be under
+	Rekey        uuid.UUID         // the next block lazy re-encryption gets to, Nil if there's none
+
+	Ledger *LedgerRef // the owner's, whose quota the file counts against, see quota.go
+	Size   int64      // bytes of content in the chain, only kept once Ledger is set
+
+	Migrated bool // nothing in the chain is the first client's anymore, see sealContext
 }
 
 type Certificates struct {
@@ -732,140 +755,278 @@ type Certificates struct {
 	FileInfo       uuid.UUID
 	SignatureUUID  uuid.UUID            // UUID of the Certificate's signature
 	Recipients     map[string]uuid.UUID // username : UUID of Certificate
-	AccessToken    []byte               // might just keep AccessToken, no need for SEAToken ? // encrypts files
-	Salt           []byte
-	MAC            []byte
+	AccessToken    []byte               // encrypts FileInfo, only in certificates from before key trees
+	Lineage        []uuid.UUID          // certificates this one was shared through, owner's first
+	KeyTree        []byte               // the owner's, seals the file's key tree, see keytree.go
+	Leaf           *KeyLeaf             // everyone else's place in the key tree
+	Reencrypt      ReencryptMode        // the owner's, what a revocation does with blocks already written
+
+	token []byte // not stored, the AccessToken as of when the certificate was opened
 }
 
 func InitUser(username string, password string) (userdataptr *User, err error) {
+	return InitUserContext(context.Background(), username, password)
+}
+
+// InitUserContext is like InitUser but gives up once ctx is done, see context.go.
+func InitUserContext(ctx context.Context, username string, password string) (userdataptr *User, err error) {
+	defer observe(defaultObserver, OpInitUser, username)(&err)
 	// error if username is empty string
 	if len(username) == 0 {
-		return nil, errors.New("Username cannot be zero characters long")
+		return nil, wrapErr(ErrAuth, "username cannot be zero characters long")
+	}
+	// get Hash(username)[:16]
+	userHash := userlib.Hash([]byte(username))
+	// get the UUID over the computed Hash
+	userUUID, err := uuid.FromBytes(userHash[:16])
+	if err != nil {
+		return nil, err // error getting the UUID from userHash
+	}
+	// error if username exists
+	_, exists, err := datastoreGet(ctx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, wrapErr(ErrExists, "user %q", username)
+	}
+
+	// the root key and the verifier, from Argon2Key(password, username), see passwordKeys
+	rootKey, verifier, passUUID, err := passwordKeys(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// an InitUser of ours that died after it got to the Keystore left everything else
+	// behind too, that one is finished instead of starting over
+	userdata, err := resumeInitUser(ctx, username, rootKey, verifier, passUUID)
+	if err != nil {
+		return nil, err
+	}
+	if userdata == nil {
+		userdata, err = newUser(ctx, username, password, rootKey, verifier, passUUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keystore entries can't be taken back, so from here on we finish. A client that
+	// dies before the login entry is written has taken the name, the next InitUser with
+	// the same password finishes the account.
+	ctx, err = commit(ctx)
+	if err != nil {
+		return nil, err
 	}
-	// get Hash(username)[:16]
-	userHash := userlib.Hash([]byte(username))
-	// get the UUID over the computed Hash
-	userUUID, err := uuid.FromBytes(userHash[:16])
+	err = keystoreSetOnce(ctx, userdata.Username+" verifyKey", userlib.PublicKeyType{KeyType: "DS", PubKey: userdata.SignKey.PrivKey.PublicKey})
 	if err != nil {
-		return nil, err // error getting the UUID from userHash
+		return nil, err
 	}
-	// error if username exists
-	_, exists := userlib.DatastoreGet(userUUID)
-	if exists {
-		return nil, errors.New("This Username already exists")
+	err = keystoreSetOnce(ctx, userdata.Username+" encKey", userlib.PublicKeyType{KeyType: "PKE", PubKey: userdata.DecryptKey.PrivKey.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+
+	// DatastoreSet(Hashed Username UUID, verifier), last so the account is only there
+	// once everything it needs is
+	err = datastoreSetEnvelope(ctx, KindLogin, SuiteLoginVerifier, userUUID, verifier)
+	if err != nil {
+		return nil, err
 	}
-	encKey, decKey, err := userlib.PKEKeyGen()
+
+	return userdata, nil
+}
+
+// Makes the keys, User struct, namespace and Ledger of a new account. Nothing refers to
+// them until the login entry is written.
+func newUser(ctx context.Context, username string, password string, rootKey []byte, verifier []byte, passUUID uuid.UUID) (userdata *User, err error) {
+	_, decKey, err := pkeKeyGen()
 	if err != nil {
 		return nil, err
 	}
-	signKey, verifyKey, err := userlib.DSKeyGen()
+	signKey, _, err := dsKeyGen()
 	if err != nil {
 		return nil, err
 	}
 
-	var userdata User
+	userdata = &User{}
 	userdata.Username = username
-	userdata.Password = password
 	userdata.SignKey = signKey
 	userdata.DecryptKey = decKey
-	userdata.Certificates = make(map[string]uuid.UUID)
-	userdata.Invites = make(map[string]string)
-	userdata.Salt = userlib.RandomBytes(16)
+	userdata.Invitations = make(map[uuid.UUID]Invitation)
+	userdata.DedupKey = userlib.RandomBytes(16)
+	userdata.Migrated = true
+	userdata.observer = defaultObserver
 
-	userlib.KeystoreSet(userdata.Username+" verifyKey", verifyKey)
-	userlib.KeystoreSet(userdata.Username+" encKey", encKey)
-
-	// Argon2Key(password, username)
-	encryptedPass := userlib.Argon2Key([]byte(password), []byte(username), 16)
-	// Encrypted Password --> Hash the Argon2Key
-	hashedEncPass := userlib.Hash(encryptedPass)[:16]
-	// setting the MAC of the new User Struct with the hashedEncPass
-	userdata.MAC, err = UserMAC(userdata, userdata.Salt, hashedEncPass)
+	err = userdata.createNamespace(ctx)
 	if err != nil {
 		return nil, err
 	}
-	// DatastoreSet(Hashed Username UUID, Encrypted Password)
-	userlib.DatastoreSet(userUUID, hashedEncPass)
-
-	// HKDF(Encrypted Password[:16], 'UUID')[:16]
-	passHKDF, err := userlib.HashKDF(hashedEncPass, []byte("UUID"))
+	// DatastoreSet(HKDF(root key, "UUID"), seal(root key, Marshal(UserStruct)))
+	userdata.cache = newSessionCache(rootKey, verifier, passUUID)
+	err = userdata.createLedger(ctx)
 	if err != nil {
 		return nil, err
 	}
+	err = userdata.reencryptUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return userdata, nil
+}
 
-	passUUID, err := uuid.FromBytes(passHKDF[:16])
+// The account an earlier InitUser with the same password got as far as the Keystore with,
+// nil if the name has no Keystore entries yet. ErrExists if it has some that aren't ours.
+func resumeInitUser(ctx context.Context, username string, rootKey []byte, verifier []byte, passUUID uuid.UUID) (userdata *User, err error) {
+	verifyKey, verifyKeyExists, err := keystoreGet(ctx, username+" verifyKey")
 	if err != nil {
 		return nil, err
 	}
-	// Encrypted User Struct --> SymEnc(Encrypted Password, UUID, Marshall(UserStruct))
-	marshalledStruct, err := json.Marshal(userdata)
+	encKey, encKeyExists, err := keystoreGet(ctx, username+" encKey")
 	if err != nil {
 		return nil, err
 	}
-
-	encUserStruct := userlib.SymEnc(hashedEncPass, userdata.Salt, marshalledStruct)
-
-	// DatastoreSet(Hashed and Encrypted Password, Ecrypted User Struct)
-	userlib.DatastoreSet(passUUID, encUserStruct)
-
-	return &userdata, nil
+	if !verifyKeyExists && !encKeyExists {
+		return nil, nil
+	}
+	userdata = &User{}
+	err = loadSealed(ctx, sealContext{Kind: KindUser, UUID: passUUID, Migrated: true}, rootKey, userdata)
+	if err != nil || userdata.Username != username {
+		// another password's, or something else's
+		return nil, wrapErr(ErrExists, "user %q", username)
+	}
+	if verifyKeyExists && !verifyKey.PubKey.Equal(&userdata.SignKey.PrivKey.PublicKey) ||
+		encKeyExists && !encKey.PubKey.Equal(&userdata.DecryptKey.PrivKey.PublicKey) {
+		return nil, wrapErr(ErrExists, "user %q", username)
+	}
+	userdata.observer = defaultObserver
+	userdata.cache = newSessionCache(rootKey, verifier, passUUID)
+	return userdata, nil
 }
 
 func GetUser(username string, password string) (userdataptr *User, err error) {
-	var userdata User
-	userdataptr = &userdata
+	return GetUserContext(context.Background(), username, password)
+}
 
-	// use Hash(username)[:16] to grab the appropriate login entry UUID.
-	userHash := userlib.Hash([]byte(username))[:16]
-	userUUID, err := uuid.FromBytes(userHash)
+// GetUserContext is like GetUser but gives up once ctx is done, see context.go.
+func GetUserContext(ctx context.Context, username string, password string) (userdataptr *User, err error) {
+	defer observe(defaultObserver, OpGetUser, username)(&err)
+	// the login entry at Hash(username)[:16]
+	entry, legacy, exists, err := readLoginEntry(ctx, username)
 	if err != nil {
-		return nil, err // error getting the UUID from userHash
+		return nil, err
 	}
-	// check if userUUID exists, if yes,
-	userHashedEncPass, exists := userlib.DatastoreGet(userUUID)
 	if !exists {
-		return nil, errors.New("Error finding Encrypted Password in Datastore")
+		return nil, wrapErr(ErrNotFound, "user %q", username)
+	}
+	// has to be the verifier of the password, or its hash for one of the first client's accounts
+	rootKey, verifier, passUUID, err := passwordKeys(username, password)
+	if err != nil {
+		return nil, err
+	}
+	expected := verifier
+	if legacy {
+		expected = legacyPassHash(username, password)
+	}
+	if !userlib.HMACEqual(entry, expected) {
+		return nil, wrapErr(ErrAuth, "wrong password for user %q", username)
 	}
-	// use the same process of HMAC(Argon2Key(username, password))
-	encryptedPass := userlib.Argon2Key([]byte(password), []byte(username), 16)
-	hashedEncPass := userlib.Hash(encryptedPass)[:16]
-	// check that UUID - EncPass and hashedEncPass are the same, if not return err. // do we even need to do this ?
-	hmacCheck := userlib.HMACEqual(userHashedEncPass, hashedEncPass)
-	if !(hmacCheck) {
-		return nil, errors.New("Failed verification test on User Struct")
+	if legacy {
+		err = upgradeLogin(ctx, username, expected, rootKey, verifier, passUUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return openSession(ctx, username, rootKey, verifier, passUUID)
+}
+
+// SessionCredential is what this session logged in with, derived from the password.
+// ResumeSession opens the account with it like GetUser does with the password, so it
+// has to be kept as safe as the password, but it doesn't give the password away.
+func (userdata *User) SessionCredential() (credential []byte, err error) {
+	rootKey, _, err := userdata.login()
+	if err != nil {
+		return nil, err
 	}
+	return append(append([]byte{}, rootKey...), userdata.cache.verifier...), nil
+}
 
-	// HashKDF(encrypted password, “UUID”)[:16]
-	passHKDF, err := userlib.HashKDF(hashedEncPass, []byte("UUID"))
+// ServiceSecret is a secret for a service that has the user sign requests with a shared
+// key, like the S3 gateway. It's derived from the root key apart from everything else for
+// each service, so it stays the same across sessions and giving it to the service gives
+// away nothing else, the password and the session credential included.
+func (userdata *User) ServiceSecret(service string) (secret []byte, err error) {
+	rootKey, _, err := userdata.login()
+	if err != nil {
+		return nil, err
+	}
+	secret, err = hashKDF(rootKey, []byte("service secret "+service))
 	if err != nil {
 		return nil, err
 	}
-	passUUID, err := uuid.FromBytes(passHKDF[:16])
+	return secret[:20], nil
+}
+
+// ResumeSession logs in like GetUser, with a credential from SessionCredential instead of
+// the password.
+func ResumeSession(username string, credential []byte) (userdataptr *User, err error) {
+	return ResumeSessionContext(context.Background(), username, credential)
+}
+
+// ResumeSessionContext is like ResumeSession but gives up once ctx is done, see context.go.
+func ResumeSessionContext(ctx context.Context, username string, credential []byte) (userdataptr *User, err error) {
+	defer observe(defaultObserver, OpGetUser, username)(&err)
+	entry, legacy, exists, err := readLoginEntry(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	// grab the appropriate UUID for the encrypted User struct
-	userHashedEncStruct, exists := userlib.DatastoreGet(passUUID)
-	// if exists decrypt encrypted user struct
 	if !exists {
-		return nil, errors.New("Error finding User Struct in Datastore")
+		return nil, wrapErr(ErrNotFound, "user %q", username)
 	}
-	decUserStruct := userlib.SymDec(userHashedEncPass, userHashedEncStruct)
-	err = json.Unmarshal(decUserStruct, userdataptr)
+	// an account still on its password hash has never given out a credential
+	if legacy || len(credential) != 32 || !userlib.HMACEqual(entry, credential[16:]) {
+		return nil, wrapErr(ErrAuth, "wrong session credential for user %q", username)
+	}
+	rootKey, verifier := credential[:16], credential[16:]
+	passUUID, err := userStructUUID(rootKey)
 	if err != nil {
 		return nil, err
 	}
+	return openSession(ctx, username, rootKey, verifier, passUUID)
+}
 
-	decUserStructMAC, err := UserMAC(*userdataptr, userdata.Salt, hashedEncPass)
+// Starts a session of an account whose login entry holds verifier
+func openSession(ctx context.Context, username string, rootKey []byte, verifier []byte, passUUID uuid.UUID) (userdataptr *User, err error) {
+	var userdata User
+	userdata.observer = defaultObserver
+	// finish whatever a session of ours didn't get to, see journal.go
+	err = recoverJournal(ctx, rootKey)
 	if err != nil {
 		return nil, err
 	}
-	hmacCheck = userlib.HMACEqual(userdataptr.MAC, decUserStructMAC)
-	if !(hmacCheck) {
-		return nil, errors.New("Failed verification test on User Struct")
+	// grab the encrypted User struct, MAC-check and decrypt it, which starts off the session cache
+	userdata.Username = username
+	userdata.cache = newSessionCache(rootKey, verifier, passUUID)
+	user, err := userdata.current(ctx)
+	if err != nil {
+		return nil, err
 	}
-
-	return userdataptr, nil
+	// and the roots of the namespace, they're next whatever the session does, and the
+	// ledger and quota every write goes through
+	err = user.checkNamespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user.Ledger != nil {
+		_, err = user.loadLedger(ctx, user.Ledger)
+		if err != nil {
+			return nil, err
+		}
+		_, err = user.loadQuota(ctx, user.Ledger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
 }
 
 /*
@@ -873,162 +1034,161 @@ Case 1: New file completely and need to set up file and first append block
 Case 2: Wipe existing appends blocks except first and add new content
 */
 func (userdata *User) StoreFile(filename string, content []byte) (err error) {
-	fileInfo, certificate, err := userdata.nameToFileInfo(filename)
+	return userdata.StoreFileContext(context.Background(), filename, content)
+}
+
+// StoreFileContext is like StoreFile but gives up once ctx is done, see context.go.
+func (userdata *User) StoreFileContext(ctx context.Context, filename string, content []byte) (err error) {
+	defer observe(userdata.observer, OpStoreFile, userdata.Username)(&err)
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
+	fileInfo, certificate, err := userdata.nameToFileInfo(ctx, filename)
 	if err != nil {
 		return err
 	}
 	if fileInfo != nil {
 		// overwrite EXISTING file in Datastore
-		accessToken := certificate.AccessToken
+		accessToken := certificate.token
 		fileInfoUUID := certificate.FileInfo
-		firstAppendUUID := fileInfo.StartAppend
-		blockKey := fileInfo.BlockKey
 
 		// Check if anything has been tampered with
-		err := traverseAppendBlock(firstAppendUUID, blockKey)
+		err := traverseAppendBlock(ctx, fileInfoUUID, fileInfo)
 		if err != nil {
 			return err
 		}
 
-		// create new AppendData to represent content of data in the append block
-		var appendData AppendData
-		appendDataUUID := uuid.New()
-		appendData.AppendData = content
-		appendData.Salt = userlib.RandomBytes(16)
-		appendData.MAC, err = AppendDataMAC(appendData, blockKey)
+		// the new content replaces the old as far as the owner's quota goes
+		if fileInfo.Ledger == nil {
+			_, err = userdata.meterFile(ctx, filename, fileInfo)
+			if err != nil {
+				return err
+			}
+		}
+		ledger, err := userdata.resizeFile(ctx, fileInfo, int64(len(content)))
 		if err != nil {
 			return err
 		}
 
-		// reencrypt and store new AppendBlock in Datastore
-		marshalledNewAppendData, err := json.Marshal(appendData)
+		// the new chain gets a fresh blockKey so the old blocks can't be spliced back in, and starts a new run
+		fileInfo.newChain()
+		appendBlockUUID, appendDataUUID, runSeed, err := fileInfo.nextSlot()
 		if err != nil {
 			return err
 		}
-		encNewAppendData := userlib.SymEnc(blockKey, appendData.Salt, marshalledNewAppendData)
-		userlib.DatastoreSet(appendDataUUID, encNewAppendData)
 
-		// create new AppendBlock to represent new file
-		var appendBlock AppendBlock
-		appendBlockUUID := uuid.New()
-		appendBlock.FileData = appendBlockUUID
-		appendBlock.NextAppend = uuid.Nil
-		appendBlock.Salt = userlib.RandomBytes(16)
-		appendBlock.MAC, err = AppendMAC(appendBlock, appendBlock.Salt, blockKey)
+		// create new AppendData to represent content of data in the append block
+		err = userdata.storeAppendData(ctx, fileInfoUUID, appendDataUUID, content, fileInfo, userdata.paddingFor(fileInfo), userdata.compressionFor(filename, fileInfo, certificate))
 		if err != nil {
 			return err
 		}
 
-		// reencrypt and store new AppendBlock in Datastore
-		marshalledNewAppendBlock, err := json.Marshal(appendBlock)
+		// create new AppendBlock to represent new file
+		var appendBlock AppendBlock
+		appendBlock.FileData = appendDataUUID
+		appendBlock.NextAppend = uuid.Nil
+		appendBlock.RunSeed = runSeed
+
+		// seal and store new AppendBlock in Datastore
+		err = storeAppendBlock(ctx, fileInfoUUID, appendBlockUUID, &appendBlock, fileInfo)
 		if err != nil {
 			return err
 		}
-		encNewAppendBlock := userlib.SymEnc(blockKey, appendBlock.Salt, marshalledNewAppendBlock)
-		userlib.DatastoreSet(appendBlockUUID, encNewAppendBlock)
 
 		// "delete" previous AppendBlock and reset the "append chain"
 		fileInfo.StartAppend = appendBlockUUID
 		fileInfo.EndAppend = appendBlockUUID
-		fileInfo.BlockKey = userlib.RandomBytes(16)
-		fileInfo.MAC, err = FileMAC(*fileInfo, fileInfo.Salt, accessToken)
+
+		// reseal fileInfo and update it on Datastore, this is what makes the new chain visible
+		ctx, err = commit(ctx)
 		if err != nil {
 			return err
 		}
-
-		// reencrypt fileInfo and update it on Datastore
-		marshalledFile, err := json.Marshal(fileInfo)
+		err = userdata.cache.storeFileInfo(ctx, fileInfoUUID, fileInfo, accessToken)
+		if err != nil {
+			return err
+		}
+		err = userdata.storeLedger(ctx, ledger)
 		if err != nil {
 			return err
 		}
-		encFileInfo := userlib.SymEnc(accessToken, fileInfo.Salt, marshalledFile)
-		userlib.DatastoreSet(fileInfoUUID, encFileInfo)
 	} else {
 		// overwrite EXISTING file in Datastore
-		blockKey := userlib.RandomBytes(16) // create new blockKey
-		var appendData AppendData
-		appendDataUUID := uuid.New()
-		appendData.AppendData = content
-		appendData.Salt = userlib.RandomBytes(16)
-		appendData.MAC, err = AppendDataMAC(appendData, blockKey)
+		FileUUID := uuid.New() // everything in the file is bound to its FileInfo UUID
+		var fileInfo FileInfo
+		// create new blockKey, the file starts in the first key epoch
+		fileInfo.BlockKey = userlib.RandomBytes(16)
+		fileInfo.Migrated = true
+		// and counts against our quota
+		fileInfo.Ledger, err = userdata.ledger(ctx)
+		if err != nil {
+			return err
+		}
+		ledger, err := userdata.resizeFile(ctx, &fileInfo, int64(len(content)))
 		if err != nil {
 			return err
 		}
-		// reencrypt and store new AppendBlock in Datastore
-		marshalledNewAppendData, err := json.Marshal(appendData)
+		appendUUID, appendDataUUID, runSeed, err := fileInfo.nextSlot() // where the first block goes
+		if err != nil {
+			return err
+		}
+		err = userdata.storeAppendData(ctx, FileUUID, appendDataUUID, content, &fileInfo, userdata.paddingFor(nil), CompressNone)
 		if err != nil {
 			return err
 		}
-		encNewAppendData := userlib.SymEnc(blockKey, appendData.Salt, marshalledNewAppendData)
-		userlib.DatastoreSet(appendDataUUID, encNewAppendData)
 
 		var appendBlock AppendBlock
-		appendUUID := uuid.New()              // create a UUID for the corresponding AppendBlock
 		appendBlock.FileData = appendDataUUID // set new File to have input content as filedata
 		appendBlock.NextAppend = uuid.Nil     // has no nextappend since its first append in chain.
-		appendBlock.Salt = userlib.RandomBytes(16)
-		appendBlock.MAC, err = AppendMAC(appendBlock, appendBlock.Salt, blockKey)
-		if err != nil {
-			return err
-		}
+		appendBlock.RunSeed = runSeed
 
-		// need to store in dataStore
-		marshalledAppend, err := json.Marshal(appendBlock)
+		// seal and store in dataStore
+		err = storeAppendBlock(ctx, FileUUID, appendUUID, &appendBlock, &fileInfo)
 		if err != nil {
 			return err
 		}
-		// encrypting the marshalled Struct
-		encNewAppend := userlib.SymEnc(blockKey, appendBlock.Salt, marshalledAppend)
+
+		// the AccessToken is the root of the file's key tree, which has room for a couple of recipients to start with
+		tree, keys, err := createKeyTree(ctx, userdata.cache, FileUUID, 2)
 		if err != nil {
 			return err
 		}
+		accessToken := keys.Root
 
-		// store the computed encrypt-then-MAC, and store encrypted Struct in Datastore
-		userlib.DatastoreSet(appendUUID, encNewAppend)
-
-		var fileInfo FileInfo
 		// Both Start and End must point to same AppendBlock
-		accessToken := userlib.RandomBytes(16)
-		FileUUID := uuid.New()
 		fileInfo.StartAppend = appendUUID
 		fileInfo.EndAppend = appendUUID
-		fileInfo.BlockKey = blockKey
-		fileInfo.Salt = userlib.RandomBytes(16)
-		fileInfo.MAC, err = FileMAC(fileInfo, fileInfo.Salt, accessToken)
-		if err != nil {
-			return err
-		}
 
-		marshalledFile, err := json.Marshal(fileInfo)
+		// seal the struct and store it in Datastore
+		err = userdata.cache.storeFileInfo(ctx, FileUUID, &fileInfo, accessToken)
 		if err != nil {
 			return err
 		}
-		// encrypting the marshalled Struct
-		encNewFile := userlib.SymEnc(accessToken, fileInfo.Salt, marshalledFile)
+
+		// need to update the User struct with info on new file created:
+		err = userdata.refresh(ctx)
 		if err != nil {
 			return err
 		}
-
-		// store the computed encrypt-then-MAC, and store encrypted Struct in Datastore
-		userlib.DatastoreSet(FileUUID, encNewFile)
-
-		// need to update the User struct with info on new file created:
 		var certificate Certificates
 		certificate.FileInfo = FileUUID
 		certificate.Recipients = make(map[string]uuid.UUID)
-		certificate.AccessToken = accessToken
+		certificate.KeyTree = tree.key
 		certificate.ParentFilename = filename
-		certificate.Salt = userlib.RandomBytes(16)
 
-		_, certificateUUID, err := userdata.certificateEncryption(userdata.Username, userdata.Username, filename, certificate)
+		_, certificateUUID, err := userdata.certificateEncryption(ctx, userdata.Username, userdata.Username, filename, certificate)
 		if err != nil {
 			return err
 		}
 
-		userdata.Certificates[filename] = certificateUUID
-		userdata.Invites[filename] = userdata.Username
-
-		err = userdata.reencryptUser()
+		ctx, err = commit(ctx)
+		if err != nil {
+			return err
+		}
+		err = userdata.addFile(ctx, filename, certificateUUID, userdata.Username)
+		if err != nil {
+			return err
+		}
+		err = userdata.storeLedger(ctx, ledger)
 		if err != nil {
 			return err
 		}
@@ -1037,163 +1197,152 @@ func (userdata *User) StoreFile(filename string, content []byte) (err error) {
 	return nil
 }
 
-func (userdata *User) AppendToFile(filename string, content []byte) error {
+func (userdata *User) AppendToFile(filename string, content []byte) (err error) {
+	return userdata.AppendToFileContext(context.Background(), filename, content)
+}
+
+// AppendToFileContext is like AppendToFile but gives up once ctx is done, see context.go.
+func (userdata *User) AppendToFileContext(ctx context.Context, filename string, content []byte) (err error) {
+	defer observe(userdata.observer, OpAppendToFile, userdata.Username)(&err)
+	// no journal, linking the new block in is the one write that makes the append, see
+	// catchUp for what's written after it
 	// have to find endAppend (previous block in the AppendBlock chain)
-	decFileInfo, decCertStruct, err := userdata.nameToFileInfo(filename)
+	decFileInfo, decCertStruct, err := userdata.nameToFileInfo(ctx, filename)
 	if err != nil {
 		return err
 	}
 	if decFileInfo == nil {
-		return errors.New("File Doesnt Exist in Users Namespace")
+		return wrapErr(ErrNotFound, "file %q", filename)
 	}
 
 	// set nextAppend in endAppend to newAppendBlock.
 	endUUID := decFileInfo.EndAppend
-	blockKey := decFileInfo.BlockKey
-	accessToken := decCertStruct.AccessToken
+	accessToken := decCertStruct.token
 	fileInfoUUID := decCertStruct.FileInfo
-	encEndAppend, exists := userlib.DatastoreGet(endUUID)
-	if !exists {
-		return errors.New("Error finding End Append in Datastore")
+	endAppend, err := loadAppendBlock(ctx, fileInfoUUID, endUUID, decFileInfo)
+	if err != nil {
+		return err
+	}
+	// someone else appended after we read FileInfo, or died before they recorded it
+	endUUID, endAppend, err = decFileInfo.catchUp(ctx, fileInfoUUID, endUUID, endAppend)
+	if err != nil {
+		return err
 	}
 
-	var endAppend AppendBlock
-	decEndAppend := userlib.SymDec(blockKey, encEndAppend)
-	err = json.Unmarshal(decEndAppend, &endAppend) // how to decrypt ?
+	// the content counts against the owner's quota, files from before quotas do from the
+	// owner's first write on
+	if decFileInfo.Ledger == nil {
+		metered, err := userdata.meterFile(ctx, filename, decFileInfo)
+		if err != nil {
+			return err
+		}
+		if metered {
+			decFileInfo.Size, err = chainSize(ctx, fileInfoUUID, decFileInfo)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	ledger, err := userdata.resizeFile(ctx, decFileInfo, decFileInfo.Size+int64(len(content)))
 	if err != nil {
 		return err
 	}
 
-	// creating AppendData
-	var appendData AppendData
-	appendDataUUID := uuid.New()
-	appendData.AppendData = content
-	appendData.Salt = userlib.RandomBytes(16)
-	appendData.MAC, err = AppendDataMAC(appendData, blockKey)
+	// lazy re-encryption gets through a few more of the blocks from before the last revocation
+	if decFileInfo.Rekey != uuid.Nil {
+		decFileInfo.Rekey, err = decFileInfo.rekeyChain(ctx, fileInfoUUID, decFileInfo.Rekey, rekeyPerAppend, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the next slot of the file's current run, or the first of a new one
+	currAppendUUID, appendDataUUID, runSeed, err := decFileInfo.nextSlot()
 	if err != nil {
 		return err
 	}
 
-	// reencrypt and store new AppendBlock in Datastore
-	marshalledNewAppendData, err := json.Marshal(appendData)
+	// creating AppendData
+	err = userdata.storeAppendData(ctx, fileInfoUUID, appendDataUUID, content, decFileInfo, userdata.paddingFor(decFileInfo), userdata.compressionFor(filename, decFileInfo, decCertStruct))
 	if err != nil {
 		return err
 	}
-	encNewAppendData := userlib.SymEnc(blockKey, appendData.Salt, marshalledNewAppendData)
-	userlib.DatastoreSet(appendDataUUID, encNewAppendData)
 
 	// creating AppendBlock with new data
 	var appendBlock AppendBlock
 	appendBlock.FileData = appendDataUUID
 	appendBlock.NextAppend = uuid.Nil
-	appendBlock.Salt = userlib.RandomBytes(16)
-	appendBlock.MAC, err = AppendMAC(appendBlock, appendBlock.Salt, blockKey)
-	if err != nil {
-		return err
-	}
+	appendBlock.RunSeed = runSeed
 
-	// need to encrypt and store new AppendBlock in Datastore
-	currAppendUUID := uuid.New() // UUID for new AppendBlock
-	marshalledAppend, err := json.Marshal(appendBlock)
+	// need to seal with block key and store new AppendBlock in Datastore
+	err = storeAppendBlock(ctx, fileInfoUUID, currAppendUUID, &appendBlock, decFileInfo)
 	if err != nil {
 		return err
 	}
-	// encrypt with block key
-	encNewAppend := userlib.SymEnc(blockKey, appendBlock.Salt, marshalledAppend)
-	userlib.DatastoreSet(currAppendUUID, encNewAppend)
 
-	// update end append's next append to the curr append
+	// update end append's next append to the curr append, and reseal it in the datastore.
+	// From here on the content is in the file.
 	endAppend.NextAppend = currAppendUUID
-	endAppend.MAC, err = AppendMAC(endAppend, endAppend.Salt, blockKey)
+	ctx, err = commit(ctx)
 	if err != nil {
 		return err
 	}
-
-	// marshal and reencrypt endAppendBlock
-	marshalledEndAppend, err := json.Marshal(endAppend)
+	err = storeAppendBlock(ctx, fileInfoUUID, endUUID, endAppend, decFileInfo)
 	if err != nil {
 		return err
 	}
 
-	encEndAppend = userlib.SymEnc(blockKey, endAppend.Salt, marshalledEndAppend)
-
-	// update the previous AppendBlock in datastore to have new nextAppend.
-	userlib.DatastoreSet(endUUID, encEndAppend)
-
-	// update and reencrypt FileInfo
+	// update FileInfo in datastore to have new endAppend.
 	decFileInfo.EndAppend = currAppendUUID
-	decFileInfo.MAC, err = FileMAC(*decFileInfo, decFileInfo.Salt, accessToken)
+	err = userdata.cache.storeFileInfo(ctx, fileInfoUUID, decFileInfo, accessToken)
 	if err != nil {
 		return err
 	}
-	marshalledFileInfo, err := json.Marshal(decFileInfo)
-	if err != nil {
-		return err
-	}
-
-	encFileInfo := userlib.SymEnc(accessToken, decFileInfo.Salt, marshalledFileInfo)
-
-	// update FileInfo in datastore to have new endAppend.
-	userlib.DatastoreSet(fileInfoUUID, encFileInfo)
-
-	return nil
+	return userdata.storeLedger(ctx, ledger)
 }
 
 func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	return userdata.LoadFileContext(context.Background(), filename)
+}
+
+// LoadFileContext is like LoadFile but gives up once ctx is done, see context.go.
+func (userdata *User) LoadFileContext(ctx context.Context, filename string) (content []byte, err error) {
+	defer observe(userdata.observer, OpLoadFile, userdata.Username)(&err)
 	// find certificate and use keys to get access token to decrypt fileinfo struct
-	decFileInfo, _, err := userdata.nameToFileInfo(filename)
+	decFileInfo, decCertStruct, err := userdata.nameToFileInfo(ctx, filename)
 	if err != nil {
 		return nil, err
 	}
 	if decFileInfo == nil {
-		return nil, errors.New("File Doesnt Exist in Users Namespace")
-	}
-
-	currUUID := decFileInfo.StartAppend
-	blockKey := decFileInfo.BlockKey
-
-	// check integrity of the AppendBlock
-	err = traverseAppendBlock(currUUID, blockKey)
-	if err != nil {
-		return nil, err
+		return nil, wrapErr(ErrNotFound, "file %q", filename)
 	}
 
 	// read the filedata from start append, until last append, using next append field.
-	for currUUID != uuid.Nil {
-		encCurrAppend, exists := userlib.DatastoreGet(currUUID)
-		if !exists {
-			return nil, errors.New("Error Finding Current Append Block Struct in Datastore") // value doesnt exist
-		}
-
-		var currAppend AppendBlock
-		decCurrAppend := userlib.SymDec(blockKey, encCurrAppend)
-		err = json.Unmarshal(decCurrAppend, &currAppend)
-		if err != nil {
-			return nil, err
-		}
-
-		currContentUUID := currAppend.FileData
-		encAppendData, exists := userlib.DatastoreGet(currContentUUID)
-		if !exists {
-			return nil, errors.New("Error finding Append Data Struct in Datastore")
-		}
-
-		var appendData AppendData
-		decCurrAppendData := userlib.SymDec(blockKey, encAppendData)
-		err = json.Unmarshal(decCurrAppendData, &appendData)
+	// every block and its data is MAC checked before anything is returned
+	err = readChain(ctx, decCertStruct.FileInfo, decFileInfo, func(ctx context.Context, block *AppendBlock, appendData *AppendData) error {
+		appendContent, err := appendDataContent(ctx, block.FileData, appendData)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		currContent := appendData.AppendData
-		content = append(content, currContent...)
-		currUUID = currAppend.NextAppend
+		content = append(content, appendContent...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return content, nil
 }
 
 func (userdata *User) CreateInvitation(filename string, recipientUsername string) (invitationPtr uuid.UUID, err error) {
+	return userdata.CreateInvitationContext(context.Background(), filename, recipientUsername)
+}
+
+// CreateInvitationContext is like CreateInvitation but gives up once ctx is done, see context.go.
+func (userdata *User) CreateInvitationContext(ctx context.Context, filename string, recipientUsername string) (invitationPtr uuid.UUID, err error) {
+	defer observe(userdata.observer, OpCreateInvitation, userdata.Username)(&err)
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
 	// check if recipientUsername exists
 	recipientHash := userlib.Hash([]byte(recipientUsername))[:16]
 	// get the UUID over the computed Hash of recipientUsername
@@ -1202,22 +1351,28 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 		return uuid.Nil, err
 	}
 	// checking that the recipient Exists ?
-	_, exists := userlib.DatastoreGet(recipientUUID)
+	_, exists, err := datastoreGet(ctx, recipientUUID)
+	if err != nil {
+		return uuid.Nil, err
+	}
 	if !exists {
-		return uuid.Nil, errors.New("Recipient does not exist")
+		return uuid.Nil, wrapErr(ErrNotFound, "user %q", recipientUsername)
 	}
 	// Grabbing the User Struct
-	ownerUser, err := usernameToUserStruct(userdata.Username)
+	ownerUser, err := userdata.current(ctx)
 	if err != nil {
 		return uuid.Nil, err
 	}
 	// check if user has certificate of file then if user is owner of file
-	certificateUUID, exists := ownerUser.Certificates[filename]
+	certificateUUID, certificateSender, exists, err := ownerUser.lookupFile(ctx, filename)
+	if err != nil {
+		return uuid.Nil, err
+	}
 	if !exists {
-		return uuid.Nil, errors.New("User does not have file")
+		return uuid.Nil, wrapErr(ErrNotFound, "file %q", filename)
 	}
 	// decrypt the certificate struct using private decKey
-	decCert, err := userdata.certificateDecryption("", userdata.Username, filename, certificateUUID)
+	decCert, err := userdata.certificateDecryption(ctx, "", userdata.Username, filename, certificateUUID)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -1230,12 +1385,59 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 	var newCertificate Certificates
 	newCertificate.FileInfo = ownerCert.FileInfo //gives UUID of the given file
 	newCertificate.Recipients = make(map[string]uuid.UUID)
-	newCertificate.AccessToken = ownerCert.AccessToken
 	newCertificate.SignatureUUID = uuid.New() // careful of circular logic here
 	newCertificate.ParentFilename = filename
-	newCertificate.Salt = userlib.RandomBytes(16)
+	newCertificate.Lineage = append(append([]uuid.UUID{}, ownerCert.Lineage...), certificateUUID)
+	// the owner hands out a leaf of the key tree, everyone else passes on their own
+	newCertificate.AccessToken = ownerCert.AccessToken
+	newCertificate.Leaf = ownerCert.Leaf
+	if ownerCert.KeyTree != nil {
+		// a full tree grows, which reseals FileInfo
+		ctx, err = commit(ctx)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		newCertificate.Leaf, err = userdata.keyTree(&ownerCert).join(ctx)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	_, encCertUUID, err := userdata.certificateEncryption(ctx, userdata.Username, recipientUsername, filename, newCertificate)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if ownerCert.KeyTree != nil {
+		err = userdata.keyTree(&ownerCert).assign(ctx, encCertUUID, newCertificate.Leaf)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	// our certificate lists who we shared with, for RevokeAccess and for moving them onto
+	// a key tree, the recipient doesn't have to touch it when they accept
+	ctx, err = commit(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if ownerCert.Recipients == nil {
+		ownerCert.Recipients = make(map[string]uuid.UUID)
+	}
+	ownerCert.Recipients[recipientUsername] = encCertUUID
+	_, err = userdata.certificateReencryption(ctx, certificateSender, userdata.Username, filename, certificateUUID, ownerCert)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	// the recipient's account may have been migrated, then it only opens a sealed FileInfo
+	if ownerCert.KeyTree == nil && ownerCert.Leaf == nil {
+		_, err = resealLegacy(ctx, sealContext{Kind: KindFileInfo, UUID: ownerCert.FileInfo, File: ownerCert.FileInfo}, ownerCert.AccessToken)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
 
-	_, encCertUUID, err := userdata.certificateEncryption(userdata.Username, recipientUsername, filename, newCertificate)
+	// remember the invitation so the garbage collector keeps it around until it's accepted or expires
+	err = ownerUser.recordInvitation(ctx, encCertUUID, recipientUsername, filename, newCertificate.SignatureUUID)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -1244,7 +1446,15 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 	return encCertUUID, nil
 }
 
-func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
+func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) (err error) {
+	return userdata.AcceptInvitationContext(context.Background(), senderUsername, invitationPtr, filename)
+}
+
+// AcceptInvitationContext is like AcceptInvitation but gives up once ctx is done, see context.go.
+func (userdata *User) AcceptInvitationContext(ctx context.Context, senderUsername string, invitationPtr uuid.UUID, filename string) (err error) {
+	defer observe(userdata.observer, OpAcceptInvitation, userdata.Username)(&err)
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
 	// check if senderUsername exists
 	userHash := userlib.Hash([]byte(senderUsername))[:16]
 	// get the UUID over the computed Hash of recipientUsername
@@ -1252,65 +1462,57 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 	if err != nil {
 		return err // error getting the UUID from userHash
 	}
-	_, exists := userlib.DatastoreGet(userUUID)
+	_, exists, err := datastoreGet(ctx, userUUID)
+	if err != nil {
+		return err
+	}
 	if !exists {
-		return errors.New("Sender does not exist")
+		return wrapErr(ErrNotFound, "user %q", senderUsername)
 	}
 
 	// check that a file with filename doesnt exist in users namespace
-	_, exists = userdata.Certificates[filename]
-	if exists {
-		return errors.New("File with this name already exists")
-	}
-
-	decCertStructBytes, err := userdata.certificateDecryption(senderUsername, userdata.Username, filename, invitationPtr)
+	err = userdata.refresh(ctx)
 	if err != nil {
 		return err
 	}
-
-	var certInfo Certificates
-	err = json.Unmarshal(decCertStructBytes, &certInfo)
+	_, _, exists, err = userdata.lookupFile(ctx, filename)
 	if err != nil {
 		return err
 	}
+	if exists {
+		return wrapErr(ErrExists, "file %q", filename)
+	}
 
-	// update sender's recipient list and update signature
-	ParentFilename := certInfo.ParentFilename
-	senderInfo, err := usernameToUserStruct(senderUsername)
+	// a bad invitation pointer is the caller's mistake rather than tampering
+	invitationKeyUUID, err := getCertStructKeyUUID(senderUsername, userdata.Username, invitationPtr)
 	if err != nil {
 		return err
 	}
-	senderParent, exists := senderInfo.Invites[ParentFilename]
-	if !exists {
-		return errors.New("Sender's Parent not in Invites Map")
-	}
-	senderCertUUID, exists := senderInfo.Certificates[ParentFilename]
-	if !exists {
-		return errors.New("Sender's Parent not in Certificate Map")
-	}
-	decParentStructBytes, err := senderInfo.certificateDecryption(senderParent, senderUsername, "", senderCertUUID)
+	_, invitationExists, err := datastoreGet(ctx, invitationPtr)
 	if err != nil {
 		return err
 	}
-	var senderCert Certificates
-	err = json.Unmarshal(decParentStructBytes, &senderCert)
+	_, keyExists, err := datastoreGet(ctx, invitationKeyUUID)
 	if err != nil {
 		return err
 	}
+	if !invitationExists || !keyExists {
+		return wrapErr(ErrNotFound, "invitation %s from user %q", invitationPtr, senderUsername)
+	}
 
-	senderCert.Recipients[userdata.Username] = invitationPtr
-
-	// update sender's certificate struct in DataStore
-	_, err = senderInfo.certificateReencryption(senderParent, senderUsername, ParentFilename, senderCertUUID, senderCert)
+	// it has to open and be signed by the sender, they listed us in their own certificate
+	// when they invited us so that's all there is to check
+	_, err = userdata.certificateDecryption(ctx, senderUsername, userdata.Username, filename, invitationPtr)
 	if err != nil {
 		return err
 	}
 
+	ctx, err = commit(ctx)
+	if err != nil {
+		return err
+	}
 	// change name of the file to the given file and store in certificates
-	userdata.Certificates[filename] = invitationPtr
-	userdata.Invites[filename] = senderUsername
-
-	err = userdata.reencryptUser()
+	err = userdata.addFile(ctx, filename, invitationPtr, senderUsername)
 	if err != nil {
 		return err
 	}
@@ -1318,15 +1520,36 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 	return nil
 }
 
-func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+// RevokeAccess takes filename away from recipientUsername and everyone they shared it
+// with. Only the file's owner can revoke, anyone else gets ErrInvalid.
+func (userdata *User) RevokeAccess(filename string, recipientUsername string) (err error) {
+	return userdata.RevokeAccessContext(context.Background(), filename, recipientUsername)
+}
+
+// RevokeAccessContext is like RevokeAccess but gives up once ctx is done, see context.go.
+func (userdata *User) RevokeAccessContext(ctx context.Context, filename string, recipientUsername string) (err error) {
+	defer observe(userdata.observer, OpRevokeAccess, userdata.Username)(&err)
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return err
+	}
 	// get the owners certificate struct for the given filename
-	ownersCertUUID, exist := userdata.Certificates[filename]
+	ownersCertUUID, sender, exist, err := userdata.lookupFile(ctx, filename)
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return errors.New("File does not exist in users namespace")
+		return wrapErr(ErrNotFound, "file %q", filename)
+	}
+	// only the owner holds the key tree a revocation rotates
+	if sender != userdata.Username {
+		return wrapErr(ErrInvalid, "file %q was shared with us, only its owner can revoke access to it", filename)
 	}
 
 	// proper cert decryption
-	ownersDecCertStruct, err := userdata.certificateDecryption("", userdata.Username, filename, ownersCertUUID)
+	ownersDecCertStruct, err := userdata.certificateDecryption(ctx, "", userdata.Username, filename, ownersCertUUID)
 	if err != nil {
 		return err
 	}
@@ -1340,10 +1563,10 @@ func (userdata *User) RevokeAccess(filename string, recipientUsername string) er
 	// verify signature on CertStruct
 	// access the recipient map within it
 	recipientMap := ownersCertStruct.Recipients
-	_, exists := recipientMap[recipientUsername]
+	revokedCertUUID, exists := recipientMap[recipientUsername]
 	if !exists {
 		// check that filename is shared with recipientUsername before deleting
-		return errors.New("Person being revoked does not currently have access to the file.")
+		return wrapErr(ErrNotFound, "user %q does not have access to file %q", recipientUsername, filename)
 	}
 
 	// recursively go through recipient's recipients
@@ -1351,53 +1574,38 @@ func (userdata *User) RevokeAccess(filename string, recipientUsername string) er
 	// delete the datastore entry for the certificate struct
 	// delete recipientUsername from recipient
 	delete(recipientMap, recipientUsername)
-
-	// create a new access token
-	newAccessToken := userlib.RandomBytes(16)
-	// update Access Token in users still with access
-	for username, certificateStructUUID := range recipientMap {
-		// grab the userstruct and call it on UpdateToken
-		var recipientUser User
-		err = recipientUser.updateToken(username, userdata.Username, certificateStructUUID, newAccessToken)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Change way FileInfo is encrypted --> using new access token
-	fileUUID := ownersCertStruct.FileInfo
-	encFileInfo, exists := userlib.DatastoreGet(fileUUID)
-	if !exists {
-		return errors.New("Error finding FileInfo Struct in Datastore")
+	// leave a signed notice in place of the certificate so the recipient (and anyone they shared with) sees ErrRevoked
+	ctx, err = commit(ctx)
+	if err != nil {
+		return err
 	}
-	decFile := userlib.SymDec(ownersCertStruct.AccessToken, encFileInfo)
-
-	var newFile FileInfo
-	err = json.Unmarshal(decFile, &newFile)
+	err = userdata.writeRevocationNotice(ctx, revokedCertUUID)
 	if err != nil {
 		return err
 	}
 
-	newFile.MAC, err = FileMAC(newFile, newFile.Salt, newAccessToken)
+	// their leaf goes, and everything above it gets a new key the rest can still reach
+	if ownersCertStruct.KeyTree != nil {
+		err = userdata.keyTree(&ownersCertStruct).revoke(ctx, revokedCertUUID)
+	} else {
+		err = userdata.plantKeyTree(ctx, &ownersCertStruct, recipientMap)
+	}
 	if err != nil {
 		return err
 	}
 
-	marshalledFile, err := json.Marshal(newFile)
+	// and what's written from now on is under a BlockKey they never had
+	token, err := userdata.keyTree(&ownersCertStruct).token(ctx)
 	if err != nil {
 		return err
 	}
-	newEncFile := userlib.SymEnc(newAccessToken, newFile.Salt, marshalledFile)
-
-	userlib.DatastoreSet(fileUUID, newEncFile)
-
-	// update the owners AccessToken
-	ownersCertStruct.AccessToken = newAccessToken
-	_, err = userdata.certificateReencryption(userdata.Username, userdata.Username, filename, ownersCertUUID, ownersCertStruct)
+	err = rotateFileKey(ctx, ownersCertStruct.FileInfo, token, ownersCertStruct.Reencrypt, userdata.Migrated)
 	if err != nil {
 		return err
 	}
-	err = userdata.reencryptUser()
+
+	// and the recipient goes from the owner's certificate
+	_, err = userdata.certificateReencryption(ctx, userdata.Username, userdata.Username, filename, ownersCertUUID, ownersCertStruct)
 	if err != nil {
 		return err
 	}
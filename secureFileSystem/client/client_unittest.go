@@ -18,23 +18,27 @@ package client
 // integration tests (client_test.go). In other words, the "client." in front is no longer needed.
 
 import (
+	"context"
 	"testing"
 
 	userlib "github.com/cs161-staff/project2-userlib"
 	"github.com/google/uuid"
 
+	"crypto/sha256"
 	_ "encoding/hex"
 	"encoding/json"
 
-	_ "errors"
+	"errors"
+	"fmt"
+	"sort"
 
 	. "github.com/onsi/ginkgo/v2"
 
 	. "github.com/onsi/gomega"
 
-	_ "strconv"
+	"strconv"
 
-	_ "strings"
+	"strings"
 )
 
 func TestSetupAndExecution(t *testing.T) {
@@ -46,6 +50,13 @@ const defaultPassword = "LeButlerJordanJR"
 const contentOne = "Bitcoin is Nick's favorite "
 const contentTwo = "digital "
 
+// UUID of the user's certificate for filename
+func certOf(user *User, filename string) uuid.UUID {
+	certUUID, _, _, err := user.lookupFile(context.Background(), filename)
+	Expect(err).To(BeNil())
+	return certUUID
+}
+
 var _ = Describe("Client Unit Tests", func() {
 
 	aliceFile := "aliceFile.txt"
@@ -70,6 +81,34 @@ var _ = Describe("Client Unit Tests", func() {
 			// struct fields because not all implementations will have a username field.
 			Expect(alice.Username).To(Equal("alice"))
 		})
+
+		Specify("Chunk Test: Chunk sizes stay in bounds and cuts resync after an edit", func() {
+			content := userlib.RandomBytes(512 << 10)
+			chunks := splitChunks(content)
+			total := 0
+			for i, chunk := range chunks {
+				total += len(chunk)
+				Expect(len(chunk)).To(BeNumerically("<=", MaxChunkSize))
+				if i < len(chunks)-1 {
+					Expect(len(chunk)).To(BeNumerically(">=", MinChunkSize))
+				}
+			}
+			Expect(total).To(Equal(len(content)))
+
+			// inserting a byte near the start only changes the first few chunks
+			edited := append([]byte{42}, content...)
+			same := make(map[string]bool)
+			for _, chunk := range chunks {
+				same[string(chunk)] = true
+			}
+			shared := 0
+			for _, chunk := range splitChunks(edited) {
+				if same[string(chunk)] {
+					shared++
+				}
+			}
+			Expect(shared).To(BeNumerically(">=", len(chunks)-3))
+		})
 	})
 
 	Describe("Malicious Activity Tests - User and File Functions", func() {
@@ -91,11 +130,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// init real user
 			_, _ = InitUser("alice", defaultPassword)
 			// get alice Pass UUID
-			aliceHash := userlib.Hash([]byte("alice"))
-			aliceUUID, _ := uuid.FromBytes(aliceHash[:16])
-			aliceHashedEncPass, _ := userlib.DatastoreGet(aliceUUID)
-			passHKDF, _ := userlib.HashKDF(aliceHashedEncPass, []byte("UUID"))
-			passUUID, _ := uuid.FromBytes(passHKDF[:16])
+			_, _, passUUID, _ := passwordKeys("alice", defaultPassword)
 
 			userlib.DebugMsg("Maliciously Changing Alice's User Struct.")
 			// store garbage at alices User Struct.
@@ -110,7 +145,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			_, aliceCertStruct, _ := alice.nameToFileInfo(aliceFile)
+			_, aliceCertStruct, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceFileUUID := aliceCertStruct.FileInfo
 
 			userlib.DebugMsg("Maliciously Changing Alice's FileInfo Struct - Trying to Store File")
@@ -127,7 +162,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			_, aliceCertStruct, _ := alice.nameToFileInfo(aliceFile)
+			_, aliceCertStruct, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceFileUUID := aliceCertStruct.FileInfo
 
 			userlib.DebugMsg("Maliciously Changing Alice's FileInfo Struct - Trying to Load File")
@@ -144,7 +179,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			_, aliceCertStruct, _ := alice.nameToFileInfo(aliceFile)
+			_, aliceCertStruct, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceFileUUID := aliceCertStruct.FileInfo
 
 			userlib.DebugMsg("Maliciously Changing Alice's FileInfo Struct - Trying to Append To File")
@@ -180,12 +215,8 @@ var _ = Describe("Client Unit Tests", func() {
 			alice, _ := InitUser("alice", defaultPassword)
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
-			// get alice file UUID
-			aliceHash := userlib.Hash([]byte("alice"))
-			aliceUUID, _ := uuid.FromBytes(aliceHash[:16])
-			aliceHashedEncPass, _ := userlib.DatastoreGet(aliceUUID)
-			passHKDF, _ := userlib.HashKDF(aliceHashedEncPass, []byte("UUID"))
-			passUUID, _ := uuid.FromBytes(passHKDF[:16])
+			// get alice User struct UUID
+			_, _, passUUID, _ := passwordKeys("alice", defaultPassword)
 
 			userlib.DebugMsg("Maliciously Changing a User Struct.")
 			// store garbage at aliceFile UUID.
@@ -201,7 +232,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			aliceCertUUID := alice.Certificates[aliceFile]
+			aliceCertUUID := certOf(alice, aliceFile)
 
 			userlib.DebugMsg("Maliciously Changing a Certificate Struct.")
 			// store garbage at aliceFile UUID.
@@ -217,7 +248,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			_, aliceCertStruct, _ := alice.nameToFileInfo(aliceFile)
+			_, aliceCertStruct, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceFileUUID := aliceCertStruct.FileInfo
 
 			userlib.DebugMsg("Maliciously Changing an FileInfo Struct.")
@@ -234,7 +265,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			aliceFileInfoStruct, _, _ := alice.nameToFileInfo(aliceFile)
+			aliceFileInfoStruct, _, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceAppendUUID := aliceFileInfoStruct.StartAppend
 
 			userlib.DebugMsg("Maliciously Changing an AppendBlock Struct.")
@@ -251,19 +282,17 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			aliceFileInfoStruct, _, _ := alice.nameToFileInfo(aliceFile)
+			aliceFileInfoStruct, aliceCert, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceAppendUUID := aliceFileInfoStruct.StartAppend
-			encAppendBlock, _ := userlib.DatastoreGet(aliceAppendUUID)
-
-			var appendBlock AppendBlock
-			_ = json.Unmarshal(userlib.SymDec(aliceFileInfoStruct.BlockKey, encAppendBlock), &appendBlock)
+			appendBlock, err := loadAppendBlock(context.Background(), aliceCert.FileInfo, aliceAppendUUID, aliceFileInfoStruct)
+			Expect(err).To(BeNil())
 			aliceAppendDataUUID := appendBlock.FileData
 
 			userlib.DebugMsg("Maliciously Changing an AppendData Struct.")
 			// store garbage at aliceFile UUID.
 			userlib.DatastoreSet(aliceAppendDataUUID, []byte("very bad things were done here..."))
 			// try to store again after things have been corrupted
-			err := alice.StoreFile(aliceFile, []byte(contentTwo))
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
 			Expect(err).ToNot(BeNil())
 		})
 
@@ -273,7 +302,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			aliceCertUUID := alice.Certificates[aliceFile]
+			aliceCertUUID := certOf(alice, aliceFile)
 			aliceKeyUUID, _ := getCertStructKeyUUID("alice", "alice", aliceCertUUID)
 
 			userlib.DebugMsg("Maliciously Changing a Certificate Symmetrict Key.")
@@ -285,6 +314,908 @@ var _ = Describe("Client Unit Tests", func() {
 		})
 	})
 
+	Describe("Key Hierarchy Unit Tests", func() {
+		Specify("Structs from the first client, with the MAC inside, open until they're changed", func() {
+			// the first client's User struct, field for field, and how it sealed it
+			type baselineUser struct {
+				Username     string
+				Password     string
+				Certificates map[string]uuid.UUID
+				Invites      map[string]string
+				MAC          []byte
+				Salt         []byte
+			}
+			key := userlib.RandomBytes(16)
+			user := baselineUser{
+				Username: "alice",
+				Password: defaultPassword,
+				// a file called MAC mustn't be taken for the struct's own
+				Certificates: map[string]uuid.UUID{"MAC": uuid.New()},
+				Invites:      map[string]string{"MAC": "alice"},
+				Salt:         userlib.RandomBytes(16),
+			}
+			unsigned, err := json.Marshal(user)
+			Expect(err).To(BeNil())
+			user.MAC, err = userlib.HMACEval(key, userlib.SymEnc(key, user.Salt, unsigned))
+			Expect(err).To(BeNil())
+			marshalled, err := json.Marshal(user)
+			Expect(err).To(BeNil())
+			stored := userlib.SymEnc(key, user.Salt, marshalled)
+
+			object := sealContext{Kind: KindUser, UUID: uuid.New()}
+			plaintext, _, legacy, err := openSealed(object, key, stored)
+			Expect(err).To(BeNil())
+			Expect(legacy).To(BeTrue())
+			plaintext, err = upgradeVersioned(KindUser, object.UUID, plaintext)
+			Expect(err).To(BeNil())
+			Expect(string(plaintext)).ToNot(ContainSubstring("Salt"))
+			Expect(string(plaintext)).ToNot(ContainSubstring("Password"))
+			var opened User
+			Expect(json.Unmarshal(plaintext, &opened)).To(Succeed())
+			Expect(opened.Username).To(Equal("alice"))
+			Expect(opened.Certificates).To(Equal(user.Certificates))
+
+			_, _, _, err = openSealed(object, userlib.RandomBytes(16), stored)
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+			// nor once what it belongs to was migrated
+			migrated := object
+			migrated.Migrated = true
+			_, _, _, err = openSealed(migrated, key, stored)
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+			user.Username = "mallory"
+			marshalled, err = json.Marshal(user)
+			Expect(err).To(BeNil())
+			_, _, _, err = openSealed(object, key, userlib.SymEnc(key, user.Salt, marshalled))
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Encryption and MAC keys differ per purpose", func() {
+			rootKey := userlib.RandomBytes(16)
+			seen := make(map[string]bool)
+			for _, kind := range []ObjectKind{KindUser, KindCertificate, KindFileInfo, KindAppendBlock, KindAppendData} {
+				encKey, macKey, err := sealKeys(rootKey, kind)
+				Expect(err).To(BeNil())
+				for _, key := range [][]byte{encKey, macKey} {
+					Expect(key).To(HaveLen(16))
+					Expect(key).ToNot(Equal(rootKey))
+					Expect(seen[string(key)]).To(BeFalse())
+					seen[string(key)] = true
+				}
+			}
+		})
+
+		Specify("The login entry tells GetUser the password is right and opens nothing", func() {
+			ctx := context.Background()
+			alice, _ := InitUser("alice", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			entry, legacy, _, err := readLoginEntry(ctx, "alice")
+			Expect(err).To(BeNil())
+			Expect(legacy).To(BeFalse())
+			rootKey, passUUID, err := alice.login()
+			Expect(err).To(BeNil())
+			Expect(entry).ToNot(Equal(rootKey))
+			// it doesn't lead to the User struct or the journal, and doesn't open them
+			entryUUID, _ := userStructUUID(entry)
+			_, exists := userlib.DatastoreGet(entryUUID)
+			Expect(exists).To(BeFalse())
+			sealed, _ := userlib.DatastoreGet(passUUID)
+			_, _, _, err = openSealed(sealContext{Kind: KindUser, UUID: passUUID}, entry, sealed)
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+			journalAt, _ := journalObject(rootKey)
+			entryJournalAt, _ := journalObject(entry)
+			Expect(entryJournalAt.UUID).ToNot(Equal(journalAt.UUID))
+
+			userlib.DebugMsg("One of the first client's accounts, whose login entry is the password hash, moves over at its next GetUser.")
+			var user User
+			Expect(loadSealed(ctx, sealContext{Kind: KindUser, UUID: passUUID}, rootKey, &user)).To(Succeed())
+			passHash := legacyPassHash("alice", defaultPassword)
+			oldUUID, _ := userStructUUID(passHash)
+			Expect(storeSealed(ctx, sealContext{Kind: KindUser, UUID: oldUUID}, passHash, &user)).To(Succeed())
+			userlib.DatastoreDelete(passUUID)
+			userlib.DatastoreSet(loginUUID("alice"), passHash)
+
+			_, err = GetUser("alice", "not the password")
+			Expect(errors.Is(err, ErrAuth)).To(BeTrue())
+			alice, err = GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			content, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne)))
+			upgraded, legacy, _, err := readLoginEntry(ctx, "alice")
+			Expect(err).To(BeNil())
+			Expect(legacy).To(BeFalse())
+			Expect(upgraded).To(Equal(entry))
+			_, exists = userlib.DatastoreGet(oldUUID)
+			Expect(exists).To(BeFalse())
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+		})
+
+		Specify("A session credential logs in like the password and holds neither it nor the login entry alone", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			credential, err := alice.SessionCredential()
+			Expect(err).To(BeNil())
+			Expect(string(credential)).ToNot(ContainSubstring(defaultPassword))
+
+			resumed, err := ResumeSession("alice", credential)
+			Expect(err).To(BeNil())
+			content, err := resumed.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("What the login entry holds isn't enough, nor is a wrong root key.")
+			entry, _, _, _ := readLoginEntry(context.Background(), "alice")
+			_, err = ResumeSession("alice", append(append([]byte{}, entry...), entry...))
+			Expect(err).ToNot(BeNil())
+			wrongRoot := append([]byte{}, credential...)
+			wrongRoot[0] ^= 1
+			_, err = ResumeSession("alice", wrongRoot)
+			Expect(err).ToNot(BeNil())
+			_, err = ResumeSession("alice", credential[:16])
+			Expect(errors.Is(err, ErrAuth)).To(BeTrue())
+			_, err = ResumeSession("bob", credential)
+			Expect(errors.Is(err, ErrNotFound)).To(BeTrue())
+		})
+	})
+
+	Describe("Envelope Unit Tests", func() {
+		Specify("Everything written says what it is and readers check it", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			_ = alice.AppendToFile(aliceFile, make([]byte, 3*MinChunkSize))
+			invite, _ := alice.CreateInvitation(aliceFile, "bob")
+			_ = bob.AcceptInvitation("alice", invite, bobFile)
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			kinds := make(map[ObjectKind]bool)
+			for _, object := range report.Objects {
+				value, _ := userlib.DatastoreGet(object.UUID)
+				header, _ := parseEnvelope(value)
+				Expect(header.Version).To(BeEquivalentTo(envelopeBinary))
+				Expect(header.Kind).To(Equal(object.Kind))
+				kinds[object.Kind] = true
+			}
+			for _, kind := range []ObjectKind{KindLogin, KindUser, KindCertificate, KindCertKey, KindSignature, KindFileInfo, KindAppendBlock, KindAppendData, KindChunk} {
+				Expect(kinds[kind]).To(BeTrue(), string(kind))
+			}
+
+			userlib.DebugMsg("A version we don't know, or another kind or suite, is rejected before anything else.")
+			_, cert, _ := alice.nameToFileInfo(context.Background(), aliceFile)
+			original, _ := userlib.DatastoreGet(cert.FileInfo)
+			for _, header := range []envelopeHeader{
+				{Version: envelopeBinary + 1, Suite: SuiteAESCTRHMAC, Kind: KindFileInfo},
+				{Version: envelopeBinary, Suite: SuiteAESCTRHMAC, Kind: KindAppendBlock},
+				{Version: envelopeBinary, Suite: SuiteRSAOAEP, Kind: KindFileInfo},
+				{Version: envelopeBinary, Suite: SuiteAESCTRHMAC, Kind: KindFileInfo, KeyID: 1},
+			} {
+				_, body := parseEnvelope(original)
+				userlib.DatastoreSet(cert.FileInfo, append(header.marshal(), body...))
+				_, err = alice.LoadFile(aliceFile)
+				var integrityError *IntegrityError
+				Expect(errors.As(err, &integrityError)).To(BeTrue())
+				Expect(integrityError.Kind).To(Equal(KindFileInfo))
+			}
+			userlib.DatastoreSet(cert.FileInfo, original)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Kinds the first client stored are read as version 0 without a header.")
+			stripHeader := func(id uuid.UUID) {
+				value, _ := userlib.DatastoreGet(id)
+				_, body := parseEnvelope(value)
+				userlib.DatastoreSet(id, body)
+			}
+			// a login entry without one is a password hash, see the Key Hierarchy tests
+			stripHeader(alice.Invitations[invite].Signature)
+			keyUUID, _ := getCertStructKeyUUID("alice", "bob", invite)
+			stripHeader(keyUUID)
+			alice, err = GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			report, err = alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+
+			userlib.DebugMsg("Anything else without one is refused.")
+			for _, object := range report.Objects {
+				if object.Kind == KindChunk {
+					stripHeader(object.UUID)
+					break
+				}
+			}
+			_, err = alice.LoadFile(aliceFile)
+			var integrityError *IntegrityError
+			Expect(errors.As(err, &integrityError)).To(BeTrue())
+			Expect(integrityError.Kind).To(Equal(KindChunk))
+		})
+
+		Specify("A revocation notice is its own kind of object", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			invite, _ := alice.CreateInvitation(aliceFile, "bob")
+			_ = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(BeNil())
+
+			value, _ := userlib.DatastoreGet(invite)
+			header, body := parseEnvelope(value)
+			Expect(header.Kind).To(Equal(KindRevocation))
+			Expect(isRevocationNotice(context.Background(), invite, value)).To(BeTrue())
+			// but not as some other kind of object
+			relabelled := append(envelopeHeader{Version: envelopeBinary, Suite: SuiteRSASign, Kind: KindSignature}.marshal(), body...)
+			Expect(isRevocationNotice(context.Background(), invite, relabelled)).To(BeFalse())
+		})
+	})
+
+	Describe("Schema Unit Tests", func() {
+		Specify("Older objects are migrated on read and written back at the current schema", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			_, cert, _ := alice.nameToFileInfo(context.Background(), aliceFile)
+			ctx := sealContext{Kind: KindFileInfo, UUID: cert.FileInfo, File: cert.FileInfo}
+			sealed, _ := userlib.DatastoreGet(cert.FileInfo)
+			plaintext, version, _, err := openSealed(ctx, cert.token, sealed)
+			Expect(err).To(BeNil())
+			plaintext, _, err = structJSON(KindFileInfo, cert.FileInfo, version, plaintext)
+			Expect(err).To(BeNil())
+
+			// pretend the next schema renamed EndAppend from LastAppend
+			original := schemaMigrations[KindFileInfo]
+			DeferCleanup(func() { schemaMigrations[KindFileInfo] = original })
+			schemaMigrations[KindFileInfo] = append(append([]schemaMigration{}, original...), func(fields map[string]json.RawMessage) error {
+				fields["EndAppend"] = fields["LastAppend"]
+				delete(fields, "LastAppend")
+				return nil
+			})
+			var fields map[string]json.RawMessage
+			_ = json.Unmarshal(plaintext, &fields)
+			Expect(string(fields["Schema"])).To(Equal(strconv.Itoa(len(original))))
+			fields["LastAppend"] = fields["EndAppend"]
+			delete(fields, "EndAppend")
+			old, _ := json.Marshal(fields)
+			sealed, _ = sealBytes(ctx, cert.token, envelopeJSON, old)
+			userlib.DatastoreSet(cert.FileInfo, sealed)
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			content, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne + contentTwo)))
+			sealed, _ = userlib.DatastoreGet(cert.FileInfo)
+			plaintext, version, _, _ = openSealed(ctx, cert.token, sealed)
+			plaintext, _, _ = structJSON(KindFileInfo, cert.FileInfo, version, plaintext)
+			fields = nil
+			_ = json.Unmarshal(plaintext, &fields)
+			Expect(string(fields["Schema"])).To(Equal(strconv.Itoa(len(original) + 1)))
+			Expect(fields).To(HaveKey("EndAppend"))
+			Expect(fields).ToNot(HaveKey("LastAppend"))
+
+			userlib.DebugMsg("Something from a newer client isn't read, or rewritten without what we don't know.")
+			fields["Schema"] = json.RawMessage(strconv.Itoa(len(original) + 2))
+			newer, _ := json.Marshal(fields)
+			sealed, _ = sealBytes(ctx, cert.token, envelopeJSON, newer)
+			userlib.DatastoreSet(cert.FileInfo, sealed)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			var integrityError *IntegrityError
+			Expect(errors.As(err, &integrityError)).To(BeTrue())
+			Expect(integrityError.Kind).To(Equal(KindFileInfo))
+			after, _ := userlib.DatastoreGet(cert.FileInfo)
+			Expect(after).To(Equal(sealed))
+		})
+
+		Specify("Migrations fill in what each schema added and refuse what they can't build on", func() {
+			upgrade := func(kind ObjectKind, v interface{}) (fields map[string]json.RawMessage, err error) {
+				marshalled, _ := json.Marshal(v)
+				upgraded, err := upgradeVersioned(kind, uuid.New(), marshalled)
+				if err != nil {
+					return nil, err
+				}
+				Expect(json.Unmarshal(upgraded, &fields)).To(Succeed())
+				return fields, nil
+			}
+			blockKey := userlib.RandomBytes(16)
+			fields, err := upgrade(KindFileInfo, map[string]interface{}{"StartAppend": uuid.New(), "EndAppend": uuid.New(), "BlockKey": blockKey, "MAC": blockKey, "Salt": blockKey})
+			Expect(err).To(BeNil())
+			for _, gone := range []string{"MAC", "Salt"} {
+				Expect(fields).ToNot(HaveKey(gone))
+			}
+			Expect(string(fields["RunSeed"])).To(Equal("null"))
+			Expect(string(fields["RunLength"])).To(Equal(strconv.Itoa(blocksPerRun)))
+			Expect(string(fields["KeyEpoch"])).To(Equal("0"))
+			Expect(string(fields["Ledger"])).To(Equal("null"))
+			Expect(string(fields["Size"])).To(Equal("0"))
+			// a chain from before runs starts a run of its own with the next append
+			var fileInfo FileInfo
+			marshalled, _ := json.Marshal(fields)
+			Expect(json.Unmarshal(marshalled, &fileInfo)).To(Succeed())
+			_, _, indexSeed, err := fileInfo.nextSlot()
+			Expect(err).To(BeNil())
+			Expect(indexSeed).ToNot(BeNil())
+			_, err = upgrade(KindFileInfo, map[string]interface{}{"StartAppend": uuid.New(), "EndAppend": uuid.New()})
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+
+			fields, err = upgrade(KindAppendBlock, map[string]interface{}{"FileData": uuid.New(), "NextAppend": uuid.Nil})
+			Expect(err).To(BeNil())
+			Expect(string(fields["RunSeed"])).To(Equal("null"))
+
+			fields, err = upgrade(KindCertificate, map[string]interface{}{"FileInfo": uuid.New(), "AccessToken": blockKey})
+			Expect(err).To(BeNil())
+			Expect(string(fields["KeyTree"])).To(Equal("null"))
+			Expect(string(fields["Leaf"])).To(Equal("null"))
+			Expect(string(fields["Reencrypt"])).To(Equal(`""`))
+			_, err = upgrade(KindCertificate, map[string]interface{}{"FileInfo": uuid.New()})
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+
+			certUUID := uuid.New()
+			fields, err = upgrade(KindUser, map[string]interface{}{
+				"Username":     "alice",
+				"Password":     defaultPassword,
+				"Certificates": map[string]uuid.UUID{"notes.txt": certUUID},
+				"Invites":      map[string]string{"notes.txt": "bob", "never accepted": "bob"},
+			})
+			Expect(err).To(BeNil())
+			Expect(string(fields["Namespace"])).To(Equal("null"))
+			Expect(string(fields["Ledger"])).To(Equal("null"))
+			Expect(string(fields["Invites"])).To(Equal(`{"notes.txt":"bob"}`))
+			Expect(fields).ToNot(HaveKey("Password"))
+			_, err = upgrade(KindUser, map[string]interface{}{"Username": "alice", "Certificates": map[string]uuid.UUID{"notes.txt": certUUID}})
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Every sealed struct records its schema", func() {
+			for kind, v := range map[ObjectKind]interface{}{KindUser: User{}, KindCertificate: Certificates{}, KindFileInfo: FileInfo{}, KindAppendBlock: AppendBlock{}, KindAppendData: AppendData{}, KindIndexPage: IndexPage{}, KindKeyTree: KeyTree{}, KindKeyNode: KeyNode{}, KindKeyMember: KeyMember{}, KindKeyWrap: KeyWrap{}, KindJournal: Journal{}, KindLedger: Ledger{}, KindQuota: QuotaRecord{}} {
+				marshalled, err := marshalVersioned(kind, v)
+				Expect(err).To(BeNil())
+				var version struct{ Schema int }
+				Expect(json.Unmarshal(marshalled, &version)).To(Succeed())
+				Expect(version.Schema).To(Equal(currentSchema(kind)))
+			}
+			marshalled, err := marshalVersioned(KindAppendBlock, struct{}{})
+			Expect(err).To(BeNil())
+			Expect(string(marshalled)).To(Equal(fmt.Sprintf(`{"Schema":%d}`, currentSchema(KindAppendBlock))))
+		})
+	})
+
+	Describe("Index Unit Tests", func() {
+		Specify("Index pages split, and a left half a crash didn't cut down isn't listed twice", func() {
+			ctx := context.Background()
+			tree := indexTree{root: uuid.New(), key: userlib.RandomBytes(16)}
+			Expect(tree.create(ctx)).To(Succeed())
+			var keys []string
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%04d", i*389%1000)
+				keys = append(keys, key)
+				Expect(tree.put(ctx, key, IndexEntry{Filename: key})).To(Succeed())
+			}
+			walked := func() (walked []string) {
+				err := tree.walk(ctx, nil, func(key string, entry IndexEntry) error {
+					Expect(entry.Filename).To(Equal(key))
+					walked = append(walked, key)
+					return nil
+				})
+				Expect(err).To(BeNil())
+				return walked
+			}
+			for _, key := range keys {
+				entry, found, err := tree.get(ctx, key)
+				Expect(err).To(BeNil())
+				Expect(found).To(BeTrue())
+				Expect(entry.Filename).To(Equal(key))
+			}
+			sort.Strings(keys)
+			Expect(walked()).To(Equal(keys))
+			path, err := tree.descend(ctx, "0000")
+			Expect(err).To(BeNil())
+			Expect(len(path)).To(BeNumerically("<=", 3))
+
+			userlib.DebugMsg("Filling the leaf with 0000 until it splits, then putting it back.")
+			leafUUID := path[len(path)-1].id
+			for i := 0; ; i++ {
+				key := fmt.Sprintf("0000-%03d", i)
+				before, _ := userlib.DatastoreGet(leafUUID)
+				Expect(tree.put(ctx, key, IndexEntry{Filename: key})).To(Succeed())
+				keys = append(keys, key)
+				path, err = tree.descend(ctx, key)
+				Expect(err).To(BeNil())
+				// key went to the new right half, the old leaf holds everything else
+				if path[len(path)-1].id != leafUUID {
+					userlib.DatastoreSet(leafUUID, before)
+					break
+				}
+			}
+			sort.Strings(keys)
+			Expect(walked()).To(Equal(keys))
+
+			found, err := tree.remove(ctx, "0500")
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			_, found, err = tree.get(ctx, "0500")
+			Expect(err).To(BeNil())
+			Expect(found).To(BeFalse())
+			Expect(walked()).To(HaveLen(len(keys) - 1))
+		})
+	})
+
+	Describe("Key Tree Unit Tests", func() {
+		Specify("Every leaf leads to the root, a revoked one doesn't, and revoking costs a few writes a level", func() {
+			ctx := context.Background()
+			fileInfoUUID := uuid.New()
+			tree, state, err := createKeyTree(ctx, nil, fileInfoUUID, 2)
+			Expect(err).To(BeNil())
+			Expect(storeFileInfo(ctx, fileInfoUUID, &FileInfo{}, state.Root)).To(Succeed())
+			leaves := make(map[uuid.UUID]*KeyLeaf)
+			for i := 0; i < 37; i++ {
+				leaf, err := tree.join(ctx)
+				Expect(err).To(BeNil())
+				certUUID := uuid.New()
+				Expect(tree.assign(ctx, certUUID, leaf)).To(Succeed())
+				leaves[certUUID] = leaf
+			}
+			state, err = tree.loadState(ctx)
+			Expect(err).To(BeNil())
+			Expect(state.Height).To(Equal(6))
+			opensFile := func(leaf *KeyLeaf) error {
+				token, _, err := leafToken(ctx, nil, fileInfoUUID, leaf)
+				if err != nil {
+					return err
+				}
+				_, err = loadFileInfo(ctx, fileInfoUUID, token, true)
+				return err
+			}
+			for _, leaf := range leaves {
+				Expect(opensFile(leaf)).To(Succeed())
+			}
+
+			var revoked []*KeyLeaf
+			for certUUID, leaf := range leaves {
+				var stats OpStats
+				done := observe(ObserverFunc(func(s OpStats) { stats = s }), OpRevokeAccess, "alice")
+				err = tree.revoke(ctx, certUUID)
+				done(&err)
+				Expect(err).To(BeNil())
+				Expect(stats.DatastoreSets).To(BeNumerically("<=", 3*state.Height+2))
+				Expect(stats.CryptoOps[CryptoPKE]).To(Equal(0))
+				delete(leaves, certUUID)
+				revoked = append(revoked, leaf)
+				if len(revoked) == 5 {
+					break
+				}
+			}
+			for _, leaf := range leaves {
+				Expect(opensFile(leaf)).To(Succeed())
+			}
+			for _, leaf := range revoked {
+				Expect(errors.Is(opensFile(leaf), ErrIntegrity)).To(BeTrue())
+			}
+
+			userlib.DebugMsg("Freed leaves are handed out again before the tree grows.")
+			for i := 0; i < 5+64-37; i++ {
+				leaf, err := tree.join(ctx)
+				Expect(err).To(BeNil())
+				certUUID := uuid.New()
+				Expect(tree.assign(ctx, certUUID, leaf)).To(Succeed())
+				leaves[certUUID] = leaf
+			}
+			state, err = tree.loadState(ctx)
+			Expect(err).To(BeNil())
+			Expect(state.Height).To(Equal(6))
+			Expect(state.Free).To(BeEmpty())
+			for _, leaf := range leaves {
+				Expect(opensFile(leaf)).To(Succeed())
+			}
+			for _, leaf := range revoked {
+				Expect(errors.Is(opensFile(leaf), ErrIntegrity)).To(BeTrue())
+			}
+			checked := 0
+			tree.walk(ctx, func(kind ObjectKind, id uuid.UUID, err error) bool {
+				Expect(err).To(BeNil())
+				checked++
+				return true
+			})
+			// the tree, 64 leaves with their wraps and members, 62 nodes between them and the root with theirs
+			Expect(checked).To(Equal(1 + 3*64 + 2*62))
+		})
+	})
+
+	Describe("Re-keying Unit Tests", func() {
+		for _, mode := range []ReencryptMode{ReencryptNone, ReencryptLazy, ReencryptEager} {
+			mode := mode
+			Specify("The BlockKey a revoked user kept doesn't open later appends, mode "+string(mode), func() {
+				ctx := context.Background()
+				alice, _ := InitUser("alice", defaultPassword)
+				bob, _ := InitUser("bob", defaultPassword)
+				charles, _ := InitUser("charles", defaultPassword)
+				_ = alice.StoreFile(aliceFile, []byte(contentOne))
+				for i := 0; i < 20; i++ {
+					_ = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				}
+				Expect(alice.SetFileReencryption(aliceFile, mode)).To(Succeed())
+				for _, user := range []*User{bob, charles} {
+					invite, err := alice.CreateInvitation(aliceFile, user.Username)
+					Expect(err).To(BeNil())
+					Expect(user.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+				}
+
+				// everything Charles can keep before he's revoked
+				kept, cert, err := charles.nameToFileInfo(ctx, bobFile)
+				Expect(err).To(BeNil())
+				var chain []uuid.UUID
+				for currUUID := kept.StartAppend; currUUID != uuid.Nil; {
+					block, err := loadAppendBlock(ctx, cert.FileInfo, currUUID, kept)
+					Expect(err).To(BeNil())
+					chain = append(chain, currUUID, block.FileData)
+					currUUID = block.NextAppend
+				}
+				Expect(chain).To(HaveLen(2 * 21))
+				opensWithKept := func(kind ObjectKind, id uuid.UUID) bool {
+					sealed, _ := userlib.DatastoreGet(id)
+					header, _ := parseEnvelope(sealed)
+					_, _, _, err := openSealed(sealContext{Kind: kind, UUID: id, File: cert.FileInfo, KeyID: header.KeyID}, kept.BlockKey, sealed)
+					return err == nil
+				}
+				stillOpen := func() (n int) {
+					for i, id := range chain {
+						kind := KindAppendBlock
+						if i%2 == 1 {
+							kind = KindAppendData
+						}
+						if opensWithKept(kind, id) {
+							n++
+						}
+					}
+					return n
+				}
+
+				Expect(alice.RevokeAccess(aliceFile, "charles")).To(Succeed())
+				Expect(bob.AppendToFile(bobFile, []byte(contentOne))).To(Succeed())
+				fileInfo, _, err := alice.nameToFileInfo(ctx, aliceFile)
+				Expect(err).To(BeNil())
+				Expect(fileInfo.KeyEpoch).To(Equal(uint32(1)))
+				Expect(fileInfo.BlockKey).ToNot(Equal(kept.BlockKey))
+				userlib.DebugMsg("The end block Charles knew and what it links to now are out of his reach.")
+				Expect(opensWithKept(KindAppendBlock, kept.EndAppend)).To(BeFalse())
+				newBlock, err := loadAppendBlock(ctx, cert.FileInfo, fileInfo.EndAppend, fileInfo)
+				Expect(err).To(BeNil())
+				Expect(opensWithKept(KindAppendBlock, fileInfo.EndAppend)).To(BeFalse())
+				Expect(opensWithKept(KindAppendData, newBlock.FileData)).To(BeFalse())
+
+				switch mode {
+				case ReencryptNone:
+					// all but the end block
+					Expect(stillOpen()).To(Equal(2*21 - 1))
+					Expect(fileInfo.OldBlockKeys).To(HaveKey(uint32(0)))
+				case ReencryptLazy:
+					// Bob's append got through the first rekeyPerAppend blocks, the end block went when Alice revoked
+					Expect(stillOpen()).To(Equal(2*(21-rekeyPerAppend) - 1))
+					Expect(alice.AppendToFile(aliceFile, []byte(contentOne))).To(Succeed())
+					Expect(stillOpen()).To(Equal(0))
+					fileInfo, _, err = alice.nameToFileInfo(ctx, aliceFile)
+					Expect(err).To(BeNil())
+					Expect(fileInfo.OldBlockKeys).To(BeEmpty())
+					Expect(fileInfo.Rekey).To(Equal(uuid.Nil))
+				case ReencryptEager:
+					Expect(stillOpen()).To(Equal(0))
+					Expect(fileInfo.OldBlockKeys).To(BeEmpty())
+				}
+
+				expected := contentOne + strings.Repeat(contentTwo, 20) + contentOne
+				if mode == ReencryptLazy {
+					expected += contentOne
+				}
+				for _, load := range []func() ([]byte, error){
+					func() ([]byte, error) { return alice.LoadFile(aliceFile) },
+					func() ([]byte, error) { return bob.LoadFile(bobFile) },
+				} {
+					content, err := load()
+					Expect(err).To(BeNil())
+					Expect(string(content)).To(Equal(expected))
+				}
+				report, err := alice.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.OK()).To(BeTrue())
+			})
+		}
+
+		Specify("Eager re-keying moves chunks to keys the revoked user never had", func() {
+			ctx := context.Background()
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			content := userlib.RandomBytes(3 * AvgChunkSize)
+			Expect(alice.StoreFile(aliceFile, content)).To(Succeed())
+			Expect(alice.SetFileReencryption(aliceFile, ReencryptEager)).To(Succeed())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+
+			// the chunk keys Bob can keep before he's revoked
+			kept, cert, err := bob.nameToFileInfo(ctx, bobFile)
+			Expect(err).To(BeNil())
+			block, err := loadAppendBlock(ctx, cert.FileInfo, kept.StartAppend, kept)
+			Expect(err).To(BeNil())
+			appendData, err := loadAppendData(ctx, cert.FileInfo, block.FileData, kept)
+			Expect(err).To(BeNil())
+			keptChunks := appendData.Chunks
+			Expect(keptChunks).ToNot(BeEmpty())
+
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(Succeed())
+			fileInfo, _, err := alice.nameToFileInfo(ctx, aliceFile)
+			Expect(err).To(BeNil())
+			Expect(fileInfo.OldBlockKeys).To(BeEmpty())
+			appendData, err = loadAppendData(ctx, cert.FileInfo, block.FileData, fileInfo)
+			Expect(err).To(BeNil())
+			Expect(appendData.Chunks).To(HaveLen(len(keptChunks)))
+			for i, ref := range appendData.Chunks {
+				Expect(ref.UUID).ToNot(Equal(keptChunks[i].UUID))
+				Expect(ref.Key).ToNot(Equal(keptChunks[i].Key))
+				_, err = loadChunk(ctx, ChunkRef{UUID: ref.UUID, Key: keptChunks[i].Key, Size: ref.Size, Compression: ref.Compression})
+				Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+			}
+			loaded, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(loaded).To(Equal(content))
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+		})
+	})
+
+	Describe("Journal Unit Tests", func() {
+		Specify("Rolling forward only makes the writes that are still what the call found", func() {
+			ctx := context.Background()
+			alice, _ := InitUser("alice", defaultPassword)
+			rootKey, _, err := alice.login()
+			Expect(err).To(BeNil())
+			object, err := journalObject(rootKey)
+			Expect(err).To(BeNil())
+			digest := func(value string) []byte {
+				sum := sha256.Sum256([]byte(value))
+				return sum[:]
+			}
+			done, pending, changed, created, deleted := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+			userlib.DatastoreSet(done, []byte("done new"))
+			userlib.DatastoreSet(pending, []byte("pending old"))
+			userlib.DatastoreSet(changed, []byte("another session's"))
+			userlib.DatastoreSet(deleted, []byte("deleted old"))
+			entry := Journal{Writes: []JournalWrite{
+				{UUID: done, Value: []byte("done new"), Before: digest("done old")},
+				{UUID: pending, Value: []byte("pending new"), Before: digest("pending old")},
+				{UUID: changed, Value: []byte("changed new"), Before: digest("changed old")},
+				{UUID: created, Value: []byte("created new")},
+				{UUID: deleted, Delete: true, Before: digest("deleted old")},
+			}}
+			Expect(storeSealed(ctx, object, rootKey, &entry)).To(Succeed())
+			_, err = GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			for id, want := range map[uuid.UUID]string{done: "done new", pending: "pending new", changed: "another session's", created: "created new"} {
+				value, _ := userlib.DatastoreGet(id)
+				Expect(string(value)).To(Equal(want))
+			}
+			_, exists := userlib.DatastoreGet(deleted)
+			Expect(exists).To(BeFalse())
+			_, exists = userlib.DatastoreGet(object.UUID)
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Describe("Quota Unit Tests", func() {
+		Specify("Usage puts a Ledger that lost count right from the files", func() {
+			ctx := context.Background()
+			alice, _ := InitUser("alice", defaultPassword)
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(Succeed())
+			Expect(alice.AppendToFile(aliceFile, []byte(contentTwo))).To(Succeed())
+			ledger, err := alice.loadLedger(ctx, alice.Ledger)
+			Expect(err).To(BeNil())
+			Expect(ledger.Used).To(Equal(int64(len(contentOne + contentTwo))))
+
+			// as if two sessions raced, or someone revoked rewrote it
+			ledger.Used = 12345
+			Expect(alice.storeLedger(ctx, ledger)).To(Succeed())
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Used).To(Equal(int64(len(contentOne + contentTwo))))
+			ledger, err = alice.loadLedger(ctx, alice.Ledger)
+			Expect(err).To(BeNil())
+			Expect(ledger.Used).To(Equal(int64(len(contentOne + contentTwo))))
+		})
+
+		Specify("Someone revoked can't lift the quota, and what they do to Used is put right", func() {
+			ctx := context.Background()
+			alice, _ := InitUser("alice", defaultPassword)
+			charles, _ := InitUser("charles", defaultPassword)
+			Expect(alice.SetQuota(100)).To(Succeed())
+			Expect(alice.StoreFile(aliceFile, []byte(strings.Repeat("a", 40)))).To(Succeed())
+			invite, _ := alice.CreateInvitation(aliceFile, "charles")
+			Expect(charles.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+			fileInfo, _, err := charles.nameToFileInfo(ctx, bobFile)
+			Expect(err).To(BeNil())
+			ref := fileInfo.Ledger
+			Expect(ref.Owner).To(Equal("alice"))
+			Expect(alice.RevokeAccess(aliceFile, "charles")).To(Succeed())
+
+			userlib.DebugMsg("Charles fills the Ledger up, Alice's write counts the files instead.")
+			ledger, err := charles.loadLedger(ctx, ref)
+			Expect(err).To(BeNil())
+			ledger.Used = 1000
+			Expect(charles.storeLedger(ctx, ledger)).To(Succeed())
+			Expect(alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 10)))).To(Succeed())
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Quota).To(Equal(int64(100)))
+			Expect(usage.Used).To(Equal(int64(50)))
+
+			userlib.DebugMsg("Charles empties it, Usage puts it back.")
+			ledger.Used = 0
+			Expect(charles.storeLedger(ctx, ledger)).To(Succeed())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Used).To(Equal(int64(50)))
+			err = alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 60)))
+			Expect(errors.Is(err, ErrQuota)).To(BeTrue())
+
+			userlib.DebugMsg("A quota Charles signs himself doesn't count.")
+			Expect(charles.storeQuota(ctx, ref, 0)).To(Succeed())
+			err = alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 60)))
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.Problems()).To(HaveLen(1))
+			Expect(report.Problems()[0].Kind).To(Equal(KindQuota))
+			_, err = GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, ErrIntegrity)).To(BeTrue())
+			Expect(alice.SetQuota(100)).To(Succeed())
+			err = alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 60)))
+			Expect(errors.Is(err, ErrQuota)).To(BeTrue())
+			Expect(alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 50)))).To(Succeed())
+		})
+
+		Specify("StatFile reports the size and a tag that follows the content without reading it", func() {
+			ctx := context.Background()
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(Succeed())
+			stored, err := alice.StatFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(stored.Size).To(Equal(int64(len(contentOne))))
+			invite, _ := alice.CreateInvitation(aliceFile, "bob")
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+
+			userlib.DebugMsg("An append that linked its block in but never wrote FileInfo counts too.")
+			fileInfo, certificate, err := alice.nameToFileInfo(ctx, aliceFile)
+			Expect(err).To(BeNil())
+			before, _ := userlib.DatastoreGet(certificate.FileInfo)
+			Expect(bob.AppendToFile(bobFile, []byte(contentTwo))).To(Succeed())
+			userlib.DatastoreSet(certificate.FileInfo, before)
+			appended, err := alice.StatFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(appended.Size).To(Equal(int64(len(contentOne + contentTwo))))
+			Expect(appended.ETag).ToNot(Equal(stored.ETag))
+			shared, err := bob.StatFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(shared).To(Equal(appended))
+
+			userlib.DebugMsg("None of the content is read.")
+			first, err := loadAppendBlock(ctx, certificate.FileInfo, fileInfo.StartAppend, fileInfo)
+			Expect(err).To(BeNil())
+			data, _ := userlib.DatastoreGet(first.FileData)
+			userlib.DatastoreSet(first.FileData, []byte("garbage"))
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			Expect(alice.StatFile(aliceFile)).To(Equal(appended))
+			userlib.DatastoreSet(first.FileData, data)
+
+			userlib.DebugMsg("Storing the same content again still changes the tag.")
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(Succeed())
+			restored, err := alice.StatFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(restored.Size).To(Equal(stored.Size))
+			Expect(restored.ETag).ToNot(Equal(stored.ETag))
+			_, err = alice.StatFile("nope")
+			Expect(errors.Is(err, ErrNotFound)).To(BeTrue())
+		})
+	})
+
+	Describe("Encoding Unit Tests", func() {
+		Specify("The binary encoding turns back into the same JSON", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			_ = alice.SetFilePadding(aliceFile, &PaddingPolicy{Mode: PadBlock, BlockSize: 64})
+			_ = alice.SetFileCompression(aliceFile, &CompressionPolicy{Algorithm: CompressDeflate})
+			_ = alice.AppendToFile(aliceFile, make([]byte, 3*MinChunkSize))
+			invite, _ := alice.CreateInvitation(aliceFile, "bob")
+			_ = bob.AcceptInvitation("alice", invite, bobFile)
+			fileInfo, cert, err := alice.nameToFileInfo(context.Background(), aliceFile)
+			Expect(err).To(BeNil())
+			block, err := loadAppendBlock(context.Background(), cert.FileInfo, fileInfo.EndAppend, fileInfo)
+			Expect(err).To(BeNil())
+			appendData, err := loadAppendData(context.Background(), cert.FileInfo, block.FileData, fileInfo)
+			Expect(err).To(BeNil())
+			Expect(appendData.Chunks).ToNot(BeEmpty())
+
+			for kind, v := range map[ObjectKind]interface{}{
+				KindUser:        alice,
+				KindCertificate: cert,
+				KindFileInfo:    fileInfo,
+				KindAppendBlock: block,
+				KindAppendData:  appendData,
+			} {
+				marshalled, err := marshalVersioned(kind, v)
+				Expect(err).To(BeNil())
+				encoded, err := marshalBinary(kind, v)
+				Expect(err).To(BeNil())
+				Expect(len(encoded)).To(BeNumerically("<", len(marshalled)), string(kind))
+				again, _ := marshalBinary(kind, v)
+				Expect(again).To(Equal(encoded))
+				decoded, n, err := binaryToJSON(append(encoded, "   "...))
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(len(encoded)))
+				Expect(string(decoded)).To(Equal(string(marshalled)), string(kind))
+			}
+
+			encoded, _ := marshalBinary(KindAppendBlock, struct{}{})
+			decoded, _, err := binaryToJSON(encoded)
+			Expect(err).To(BeNil())
+			Expect(string(decoded)).To(Equal(fmt.Sprintf(`{"Schema":%d}`, currentSchema(KindAppendBlock))))
+
+			userlib.DebugMsg("Cut short or corrupted it's an error, not a panic.")
+			encoded, _ = marshalBinary(KindUser, alice)
+			for i := 0; i < len(encoded); i += 7 {
+				_, _, err = binaryToJSON(encoded[:i])
+				Expect(err).ToNot(BeNil())
+				corrupted := append([]byte{}, encoded...)
+				corrupted[i] ^= 0xff
+				_, _, _ = binaryToJSON(corrupted)
+			}
+		})
+
+		Specify("Either encoding can be read whichever one is being written", func() {
+			DeferCleanup(func() { _ = SetEncoding(EncodingBinary) })
+			Expect(SetEncoding(EncodingJSON)).To(Succeed())
+			alice, _ := InitUser("alice", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			_, cert, _ := alice.nameToFileInfo(context.Background(), aliceFile)
+			value, _ := userlib.DatastoreGet(cert.FileInfo)
+			header, _ := parseEnvelope(value)
+			Expect(header.Version).To(BeEquivalentTo(envelopeJSON))
+
+			Expect(SetEncoding(EncodingBinary)).To(Succeed())
+			Expect(alice.AppendToFile(aliceFile, []byte(contentTwo))).To(Succeed())
+			value, _ = userlib.DatastoreGet(cert.FileInfo)
+			header, _ = parseEnvelope(value)
+			Expect(header.Version).To(BeEquivalentTo(envelopeBinary))
+			content, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne + contentTwo)))
+			Expect(errors.Is(SetEncoding(Encoding(7)), ErrInvalid)).To(BeTrue())
+		})
+	})
+
+	Describe("Verify Unit Tests", func() {
+		Specify("Verify reports a revoked certificate without flagging it", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			invitation, _ := alice.CreateInvitation(aliceFile, "bob")
+			_ = bob.AcceptInvitation("alice", invitation, bobFile)
+			_ = alice.RevokeAccess(aliceFile, "bob")
+
+			report, err := bob.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+			Expect(report.Count(StatusRevoked)).To(Equal(1))
+			for _, object := range report.Objects {
+				if object.Status == StatusRevoked {
+					Expect(object.UUID).To(Equal(certOf(bob, bobFile)))
+				}
+			}
+		})
+	})
+
 	Describe("Malicious Activity Tests - Invitation Functions", func() {
 		Specify("File Maliciously Changed - CreateInvitation", func() {
 			// init real user
@@ -292,7 +1223,7 @@ var _ = Describe("Client Unit Tests", func() {
 			// store real file
 			_ = alice.StoreFile(aliceFile, []byte(contentOne))
 			// get alice file UUID
-			_, aliceCertStruct, _ := alice.nameToFileInfo(aliceFile)
+			_, aliceCertStruct, _ := alice.nameToFileInfo(context.Background(), aliceFile)
 			aliceFileUUID := aliceCertStruct.FileInfo
 
 			userlib.DebugMsg("Maliciously Changing File Info - Trying To Create Invite")
@@ -303,6 +1234,33 @@ var _ = Describe("Client Unit Tests", func() {
 			Expect(err).ToNot(BeNil())
 		})
 
+		Specify("Sharing never opens someone else's User struct", func() {
+			alice, _ := InitUser("alice", defaultPassword)
+			bob, _ := InitUser("bob", defaultPassword)
+			charles, _ := InitUser("charles", "another password")
+			_ = alice.StoreFile(aliceFile, []byte(contentOne))
+			invitation, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob accepts while Alice's User struct is garbage, then Charles gets it from Bob.")
+			aliceUser, _ := userlib.DatastoreGet(alice.cache.passUUID)
+			userlib.DatastoreSet(alice.cache.passUUID, []byte("garbage"))
+			Expect(bob.AcceptInvitation("alice", invitation, bobFile)).To(Succeed())
+			invitation, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invitation, "charlesFile.txt")).To(Succeed())
+			userlib.DatastoreSet(alice.cache.passUUID, aliceUser)
+
+			userlib.DebugMsg("Alice revokes Bob while Bob's and Charles' are garbage.")
+			for _, user := range []*User{bob, charles} {
+				userlib.DatastoreSet(user.cache.passUUID, []byte("garbage"))
+			}
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(Succeed())
+			cert, _, err := alice.openCertificate(context.Background(), "alice", "alice", certOf(alice, aliceFile))
+			Expect(err).To(BeNil())
+			Expect(cert.Recipients).To(BeEmpty())
+		})
+
 		Specify("Revoked User Trying to Gain Access", func() {
 			// init real user
 			alice, _ := InitUser("alice", defaultPassword)
@@ -317,7 +1275,7 @@ var _ = Describe("Client Unit Tests", func() {
 			bob.LoadFile(bobFile)
 			bob.StoreFile(bobFile, []byte("Lakers in 4"))
 			// bob is revoked Access from aliceFile
-			alice.RevokeAccess("bob", aliceFile)
+			alice.RevokeAccess(aliceFile, "bob")
 
 			userlib.DebugMsg("Revoked User Tries to Load File")
 			// bob tries to load file that he no longer has access to.
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// CompressionAlgorithm names how content was compressed before it was encrypted. It's
+// kept in the AppendData (and the ChunkRef for chunks) so it's covered by the MAC.
+type CompressionAlgorithm string
+
+const (
+	CompressNone    CompressionAlgorithm = ""
+	CompressDeflate CompressionAlgorithm = "deflate"
+)
+
+// CompressionPolicy turns on compression for one file, it's off unless set with
+// SetFileCompression.
+//
+// Compressing leaks: how well something compresses says something about what's in it,
+// and anyone who can put their own bytes next to a secret in the same write can learn
+// the secret from the lengths. So it's only worth it for things like logs, and once a
+// file is shared (it has recipients or pending invitations, or we're not its owner)
+// writes aren't compressed anymore unless Shared is set.
+type CompressionPolicy struct {
+	Algorithm CompressionAlgorithm
+	Shared    bool // keep compressing once the file is shared
+}
+
+func (policy CompressionPolicy) validate() error {
+	switch policy.Algorithm {
+	case CompressNone, CompressDeflate:
+		return nil
+	default:
+		return wrapErr(ErrInvalid, "compression algorithm %q", policy.Algorithm)
+	}
+}
+
+func compress(algorithm CompressionAlgorithm, data []byte) (compressed []byte, err error) {
+	if algorithm != CompressDeflate {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Undoes compress. Anything after the end of the compressed stream (padding) is ignored,
+// and it gives up past limit bytes so a bad MAC key can't be used to blow up memory.
+func decompress(kind ObjectKind, id uuid.UUID, algorithm CompressionAlgorithm, data []byte, limit int) (decompressed []byte, err error) {
+	switch algorithm {
+	case CompressNone:
+		return data, nil
+	case CompressDeflate:
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		decompressed, err = io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+		if err != nil {
+			return nil, integrityErr(kind, id, "malformed compressed data")
+		}
+		if len(decompressed) > limit {
+			return nil, integrityErr(kind, id, "decompresses to more than it should")
+		}
+		return decompressed, nil
+	default:
+		return nil, integrityErr(kind, id, "unknown compression algorithm "+string(algorithm))
+	}
+}
+
+// SetFileCompression sets how content written to filename from now on is compressed,
+// nil turns it off. Anyone the file is shared with can change it.
+func (userdata *User) SetFileCompression(filename string, policy *CompressionPolicy) error {
+	return userdata.SetFileCompressionContext(context.Background(), filename, policy)
+}
+
+// SetFileCompressionContext is like SetFileCompression but gives up once ctx is done, see context.go.
+func (userdata *User) SetFileCompressionContext(ctx context.Context, filename string, policy *CompressionPolicy) error {
+	if policy != nil {
+		err := policy.validate()
+		if err != nil {
+			return err
+		}
+	}
+	fileInfo, certificate, err := userdata.nameToFileInfo(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if fileInfo == nil {
+		return wrapErr(ErrNotFound, "file %q", filename)
+	}
+	fileInfo.Compression = policy
+	return storeFileInfo(ctx, certificate.FileInfo, fileInfo, certificate.token)
+}
+
+// the algorithm for writing to filename, nothing for a new file
+func (userdata *User) compressionFor(filename string, fileInfo *FileInfo, certificate *Certificates) CompressionAlgorithm {
+	if fileInfo == nil || fileInfo.Compression == nil {
+		return CompressNone
+	}
+	if !fileInfo.Compression.Shared {
+		shared := len(certificate.Lineage) > 0 || len(certificate.Recipients) > 0
+		for _, invitation := range userdata.Invitations {
+			shared = shared || invitation.Filename == filename
+		}
+		if shared {
+			return CompressNone
+		}
+	}
+	return fileInfo.Compression.Algorithm
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Every exported call that talks to the Datastore or Keystore has a Context variant,
+// e.g. LoadFileContext. ctx is checked before each request and handed to backends that
+// take one (ContextDatastore, ContextKeystore), and once it's done the call returns
+// ctx.Err() unwrapped, so errors.Is(err, context.Canceled) works.
+//
+// Calls that change more than one object first write the new objects nothing refers to
+// yet (AppendData, AppendBlocks, certificates, ...) and only then the ones other sessions
+// read. The last check of ctx is right before the first of those writes, after that the
+// call is committed and runs to the end even if ctx is cancelled or its deadline passes.
+// What it writes from then on goes through the account's journal, so that if the client
+// dies halfway the next GetUser finishes the call, see journal.go. What was written
+// before a cancellation isn't reachable from anywhere and CollectGarbage removes it.
+//
+// Calls that only make one visible write (SetPadding, SetFileCompression, ...) don't need
+// this, and neither do MigrateKeys and CollectGarbage, each of their writes stands on its
+// own.
+
+// Checks ctx one last time and returns a context for the rest of a committed call. It
+// keeps ctx's values but is never done, and the call's journal keeps what it writes.
+func commit(ctx context.Context) (committed context.Context, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return ctx, err
+	}
+	if j := journalOf(ctx); j != nil {
+		j.commit()
+	}
+	return uncancelable{ctx}, nil
+}
+
+type uncancelable struct {
+	context.Context
+}
+
+func (uncancelable) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (uncancelable) Done() <-chan struct{} {
+	return nil
+}
+
+func (uncancelable) Err() error {
+	return nil
+}
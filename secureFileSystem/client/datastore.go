@@ -0,0 +1,257 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Datastore is the untrusted key-value store every object lives in. Nothing read
+// from it is trusted until it has been MAC or signature checked.
+type Datastore interface {
+	Get(key uuid.UUID) (value []byte, ok bool, err error)
+	Set(key uuid.UUID, value []byte) error
+	Delete(key uuid.UUID) error
+}
+
+// EnumerableDatastore can also list its keys, which CollectGarbage needs to find
+// entries nothing refers to anymore.
+type EnumerableDatastore interface {
+	Datastore
+	Keys() ([]uuid.UUID, error)
+}
+
+// HasDatastore can tell whether a key exists without sending its value back. Chunk
+// deduplication uses it to skip uploading chunks that are already stored, backends
+// without it fall back to Get.
+type HasDatastore interface {
+	Datastore
+	Has(key uuid.UUID) (bool, error)
+}
+
+// ContextDatastore takes the caller's context with each request, so a cancelled call
+// doesn't wait for a slow backend. Backends without it are only checked between requests.
+type ContextDatastore interface {
+	Datastore
+	GetContext(ctx context.Context, key uuid.UUID) (value []byte, ok bool, err error)
+	SetContext(ctx context.Context, key uuid.UUID, value []byte) error
+	DeleteContext(ctx context.Context, key uuid.UUID) error
+}
+
+// ContextHasDatastore is a HasDatastore that takes a context, see ContextDatastore.
+type ContextHasDatastore interface {
+	HasDatastore
+	HasContext(ctx context.Context, key uuid.UUID) (bool, error)
+}
+
+// BatchDatastore can fetch many keys in one request. LoadFile uses it to read ahead
+// along append chains, see prefetch.go, backends without it are read one key at a time.
+// values only has the keys that exist. GetMany is called from several goroutines at
+// once, so it has to be safe for concurrent use.
+type BatchDatastore interface {
+	Datastore
+	GetMany(ctx context.Context, keys []uuid.UUID) (values map[uuid.UUID][]byte, err error)
+}
+
+// DigestDatastore can return the SHA-256 of a value instead of the value itself. The
+// session cache uses it to check that what it decrypted before is still what's stored,
+// see cache.go. A backend that lies about a digest gets nothing it couldn't get by
+// serving the old value.
+type DigestDatastore interface {
+	Datastore
+	Digest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, ok bool, err error)
+}
+
+// userlibDatastore is the default backend, userlib's in-memory map.
+type userlibDatastore struct{}
+
+func (userlibDatastore) Get(key uuid.UUID) ([]byte, bool, error) {
+	value, ok := userlib.DatastoreGet(key)
+	return value, ok, nil
+}
+
+func (userlibDatastore) Set(key uuid.UUID, value []byte) error {
+	userlib.DatastoreSet(key, value)
+	return nil
+}
+
+func (userlibDatastore) Delete(key uuid.UUID) error {
+	userlib.DatastoreDelete(key)
+	return nil
+}
+
+func (userlibDatastore) Keys() ([]uuid.UUID, error) {
+	datastoreMap := userlib.DatastoreGetMap()
+	keys := make([]uuid.UUID, 0, len(datastoreMap))
+	for key := range datastoreMap {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+var datastore Datastore = userlibDatastore{}
+
+// SetDatastore replaces the backend used by every client call. It isn't safe to
+// call while other calls are in flight.
+func SetDatastore(ds Datastore) {
+	if ds == nil {
+		ds = userlibDatastore{}
+	}
+	datastore = ds
+}
+
+func datastoreGet(ctx context.Context, key uuid.UUID) (value []byte, ok bool, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return nil, false, err
+	}
+	reads, _ := ctx.Value(readSetKey{}).(*readSet)
+	// what the call wrote itself, if it did
+	if j := journalOf(ctx); j != nil {
+		value, ok, found := j.get(key)
+		if found {
+			if reads != nil && ok {
+				reads.add(key, value)
+			}
+			return value, ok, nil
+		}
+	}
+	value, ok, err = datastoreGetFrom(ctx, key)
+	if j := journalOf(ctx); j != nil && err == nil {
+		j.found(key, sha256.Sum256(value), ok)
+	}
+	if ok && err == nil {
+		if reads != nil {
+			reads.add(key, value)
+		}
+		if tx := txReadsOf(ctx); tx != nil {
+			tx.addFirst(key, sha256.Sum256(value))
+		}
+	}
+	return value, ok, err
+}
+
+// prefetched if it was, otherwise from the backend
+func datastoreGetFrom(ctx context.Context, key uuid.UUID) (value []byte, ok bool, err error) {
+	if prefetched, _ := ctx.Value(prefetcherKey{}).(*prefetcher); prefetched != nil {
+		value, ok, err = prefetched.take(ctx, key)
+		if ok || err != nil {
+			return value, ok, err
+		}
+	}
+	if contextDatastore, supported := datastore.(ContextDatastore); supported {
+		value, ok, err = contextDatastore.GetContext(ctx, key)
+	} else {
+		value, ok, err = datastore.Get(key)
+	}
+	record(func(stats *OpStats) {
+		stats.DatastoreGets++
+		stats.BytesRead += len(value)
+	})
+	return value, ok, err
+}
+
+// one request for all of keys, only for backends that are a BatchDatastore
+func datastoreGetMany(ctx context.Context, keys []uuid.UUID) (values map[uuid.UUID][]byte, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	values, err = datastore.(BatchDatastore).GetMany(ctx, keys)
+	record(func(stats *OpStats) {
+		stats.DatastoreGets++
+		for _, value := range values {
+			stats.BytesRead += len(value)
+		}
+	})
+	return values, err
+}
+
+func datastoreSet(ctx context.Context, key uuid.UUID, value []byte) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if j := journalOf(ctx); j != nil {
+		if j.set(key, value, false) {
+			return nil
+		}
+		j.wroteThrough(key, value)
+	}
+	record(func(stats *OpStats) {
+		stats.DatastoreSets++
+		stats.BytesWritten += len(value)
+	})
+	if contextDatastore, supported := datastore.(ContextDatastore); supported {
+		return contextDatastore.SetContext(ctx, key, value)
+	}
+	return datastore.Set(key, value)
+}
+
+func datastoreDelete(ctx context.Context, key uuid.UUID) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if j := journalOf(ctx); j != nil {
+		if j.set(key, nil, true) {
+			return nil
+		}
+		j.wroteThrough(key, nil)
+	}
+	record(func(stats *OpStats) { stats.DatastoreDeletes++ })
+	if contextDatastore, supported := datastore.(ContextDatastore); supported {
+		return contextDatastore.DeleteContext(ctx, key)
+	}
+	return datastore.Delete(key)
+}
+
+func datastoreHas(ctx context.Context, key uuid.UUID) (ok bool, err error) {
+	if j := journalOf(ctx); j != nil {
+		_, ok, found := j.get(key)
+		if found {
+			return ok, nil
+		}
+	}
+	if _, supported := datastore.(HasDatastore); !supported {
+		_, ok, err = datastoreGet(ctx, key)
+		return ok, err
+	}
+	err = ctx.Err()
+	if err != nil {
+		return false, err
+	}
+	record(func(stats *OpStats) { stats.DatastoreGets++ })
+	if hasDatastore, supported := datastore.(ContextHasDatastore); supported {
+		return hasDatastore.HasContext(ctx, key)
+	}
+	return datastore.(HasDatastore).Has(key)
+}
+
+// only for backends that are a DigestDatastore
+func datastoreDigest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, ok bool, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return digest, false, err
+	}
+	j := journalOf(ctx)
+	if j != nil {
+		value, ok, found := j.get(key)
+		if found {
+			return sha256.Sum256(value), ok, nil
+		}
+	}
+	digest, ok, err = datastore.(DigestDatastore).Digest(ctx, key)
+	if j != nil && err == nil {
+		j.found(key, digest, ok)
+	}
+	record(func(stats *OpStats) {
+		stats.DatastoreGets++
+		if ok {
+			stats.BytesRead += sha256.Size
+		}
+	})
+	return digest, ok, err
+}
@@ -0,0 +1,421 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Encoding picks how sealed structs are serialized before they're encrypted. It's
+// recorded as the envelope version, so objects in either encoding can be read no
+// matter which one is being written.
+type Encoding int
+
+const (
+	// EncodingBinary is compact: byte slices and UUIDs are stored raw instead of as
+	// base64 and text, and RSA private keys as PKCS #1 instead of decimal JSON.
+	EncodingBinary Encoding = iota
+	EncodingJSON
+)
+
+// envelope version each encoding is written with
+var encodingVersions = map[Encoding]byte{
+	EncodingJSON:   envelopeJSON,
+	EncodingBinary: envelopeBinary,
+}
+
+// version newEnvelope writes
+var writeVersion byte = envelopeBinary
+
+// SetEncoding sets the encoding everything is written with from now on, EncodingBinary
+// unless this is called. It isn't safe to call while other calls are in flight.
+func SetEncoding(encoding Encoding) error {
+	version, ok := encodingVersions[encoding]
+	if !ok {
+		return wrapErr(ErrInvalid, "encoding %d", encoding)
+	}
+	writeVersion = version
+	return nil
+}
+
+// The binary encoding is self-describing like JSON: every value starts with a tag. It
+// turns back into exactly the JSON encoding/json produces for the same value, and
+// reading (schema migrations included) goes through that, so the binary encoding only
+// changes what's stored. It's deterministic: struct fields come in declaration order
+// and map entries sorted by key. Struct tags aren't looked at, none of the stored structs
+// have any.
+const (
+	tagNull          = 0
+	tagFalse         = 1
+	tagTrue          = 2
+	tagInt           = 3  // zigzag varint
+	tagUint          = 4  // uvarint
+	tagString        = 5  // uvarint length, then the bytes
+	tagBytes         = 6  // same, base64 in JSON
+	tagUUID          = 7  // 16 bytes
+	tagList          = 8  // uvarint count, then the items
+	tagObject        = 9  // uvarint count, then key string and value for each
+	tagJSON          = 10 // uvarint length, then JSON for anything without its own tag
+	tagRSAPrivateKey = 11 // uvarint length, then PKCS #1 DER
+)
+
+// objects nest a few levels at most, anything deeper is garbage
+const maxBinaryDepth = 32
+
+var (
+	uuidType          = reflect.TypeOf(uuid.UUID{})
+	rsaPrivateKeyType = reflect.TypeOf(rsa.PrivateKey{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// plaintext for the struct v in the encoding of envelope version
+func encodeStruct(version byte, kind ObjectKind, v interface{}) (encoded []byte, err error) {
+	if version == envelopeBinary {
+		return marshalBinary(kind, v)
+	}
+	return marshalVersioned(kind, v)
+}
+
+// JSON for a struct that was stored with envelope version, and how much of plaintext it
+// took up. Anything after that is padding.
+func structJSON(kind ObjectKind, id uuid.UUID, version byte, plaintext []byte) (marshalled []byte, n int, err error) {
+	if version != envelopeBinary {
+		return plaintext, len(bytes.TrimRight(plaintext, " ")), nil
+	}
+	marshalled, n, err = binaryToJSON(plaintext)
+	if err != nil {
+		return nil, 0, integrityErr(kind, id, err.Error())
+	}
+	return marshalled, n, nil
+}
+
+// The struct v in binary, with the current schema of kind as its first field
+func marshalBinary(kind ObjectKind, v interface{}) (marshalled []byte, err error) {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("can't version %T, it isn't a struct", v)
+	}
+	marshalled = append([]byte{tagObject}, 0)
+	marshalled = appendBinaryString(marshalled, tagString, "Schema")
+	marshalled = binary.AppendVarint(append(marshalled, tagInt), int64(currentSchema(kind)))
+	marshalled, fields, err := appendBinaryFields(marshalled, value)
+	if err != nil {
+		return nil, err
+	}
+	if fields+1 > 127 {
+		return nil, fmt.Errorf("%T has too many fields", v)
+	}
+	marshalled[1] = byte(fields + 1)
+	return marshalled, nil
+}
+
+func appendBinaryString(b []byte, tag byte, s string) []byte {
+	b = binary.AppendUvarint(append(b, tag), uint64(len(s)))
+	return append(b, s...)
+}
+
+// appends each exported field as a key and value, returns how many
+func appendBinaryFields(b []byte, value reflect.Value) ([]byte, int, error) {
+	fields := 0
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		b = appendBinaryString(b, tagString, field.Name)
+		var err error
+		b, err = appendBinary(b, value.Field(i))
+		if err != nil {
+			return nil, 0, err
+		}
+		fields++
+	}
+	return b, fields, nil
+}
+
+func appendBinary(b []byte, value reflect.Value) ([]byte, error) {
+	switch value.Type() {
+	case uuidType:
+		id := value.Interface().(uuid.UUID)
+		return append(append(b, tagUUID), id[:]...), nil
+	case rsaPrivateKeyType:
+		key := value.Interface().(rsa.PrivateKey)
+		if key.N == nil {
+			break // zero key, let JSON deal with it
+		}
+		der := x509.MarshalPKCS1PrivateKey(&key)
+		return appendBinaryString(b, tagRSAPrivateKey, string(der)), nil
+	}
+	if value.Type().Implements(jsonMarshalerType) || value.Type().Implements(textMarshalerType) || value.Kind() == reflect.Interface || value.Kind() == reflect.Float32 || value.Kind() == reflect.Float64 {
+		return appendBinaryJSON(b, value)
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return append(b, tagTrue), nil
+		}
+		return append(b, tagFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(append(b, tagInt), value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(append(b, tagUint), value.Uint()), nil
+	case reflect.String:
+		return appendBinaryString(b, tagString, value.String()), nil
+	case reflect.Pointer:
+		if value.IsNil() {
+			return append(b, tagNull), nil
+		}
+		return appendBinary(b, value.Elem())
+	case reflect.Slice:
+		if value.IsNil() {
+			return append(b, tagNull), nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBinaryString(b, tagBytes, string(value.Bytes())), nil
+		}
+		fallthrough
+	case reflect.Array:
+		b = binary.AppendUvarint(append(b, tagList), uint64(value.Len()))
+		for i := 0; i < value.Len(); i++ {
+			var err error
+			b, err = appendBinary(b, value.Index(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if value.IsNil() {
+			return append(b, tagNull), nil
+		}
+		return appendBinaryMap(b, value)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).Anonymous {
+				// encoding/json flattens embedded structs, leave that to it
+				return appendBinaryJSON(b, value)
+			}
+		}
+		start := len(b)
+		b = append(b, tagObject, 0)
+		b, fields, err := appendBinaryFields(b, value)
+		if err != nil {
+			return nil, err
+		}
+		if fields > 127 {
+			return appendBinaryJSON(b[:start], value)
+		}
+		b[start+1] = byte(fields)
+		return b, nil
+	}
+	return appendBinaryJSON(b, value)
+}
+
+func appendBinaryJSON(b []byte, value reflect.Value) ([]byte, error) {
+	marshalled, err := json.Marshal(value.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return appendBinaryString(b, tagJSON, string(marshalled)), nil
+}
+
+// map keys the way encoding/json writes them, sorted
+func appendBinaryMap(b []byte, value reflect.Value) ([]byte, error) {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	entries := make([]entry, 0, value.Len())
+	iter := value.MapRange()
+	for iter.Next() {
+		key := iter.Key()
+		var name string
+		switch {
+		case key.Kind() == reflect.String:
+			name = key.String()
+		case key.Type().Implements(textMarshalerType):
+			text, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			name = string(text)
+		case key.CanInt():
+			name = strconv.FormatInt(key.Int(), 10)
+		case key.CanUint():
+			name = strconv.FormatUint(key.Uint(), 10)
+		default:
+			return nil, fmt.Errorf("can't encode map key of type %s", key.Type())
+		}
+		entries = append(entries, entry{name, iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	b = binary.AppendUvarint(append(b, tagObject), uint64(len(entries)))
+	for _, entry := range entries {
+		b = appendBinaryString(b, tagString, entry.key)
+		var err error
+		b, err = appendBinary(b, entry.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+var errMalformedBinary = errors.New("malformed binary encoding")
+
+// Turns one binary value at the start of b back into JSON, n is how many bytes it took
+func binaryToJSON(b []byte) (marshalled []byte, n int, err error) {
+	marshalled, rest, err := appendBinaryAsJSON(nil, b, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return marshalled, len(b) - len(rest), nil
+}
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errMalformedBinary
+	}
+	return x, b[n:], nil
+}
+
+// length-prefixed bytes
+func readBinaryBytes(b []byte) ([]byte, []byte, error) {
+	length, b, err := readUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > uint64(len(b)) {
+		return nil, nil, errMalformedBinary
+	}
+	return b[:length], b[length:], nil
+}
+
+func appendBinaryAsJSON(out []byte, b []byte, depth int) ([]byte, []byte, error) {
+	if len(b) == 0 || depth > maxBinaryDepth {
+		return nil, nil, errMalformedBinary
+	}
+	tag, b := b[0], b[1:]
+	switch tag {
+	case tagNull:
+		return append(out, "null"...), b, nil
+	case tagFalse:
+		return append(out, "false"...), b, nil
+	case tagTrue:
+		return append(out, "true"...), b, nil
+	case tagInt:
+		x, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, nil, errMalformedBinary
+		}
+		return strconv.AppendInt(out, x, 10), b[n:], nil
+	case tagUint:
+		x, b, err := readUvarint(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return strconv.AppendUint(out, x, 10), b, nil
+	case tagString:
+		s, b, err := readBinaryBytes(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		quoted, err := json.Marshal(string(s))
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(out, quoted...), b, nil
+	case tagBytes:
+		s, b, err := readBinaryBytes(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, '"')
+		out = append(out, base64.StdEncoding.EncodeToString(s)...)
+		return append(out, '"'), b, nil
+	case tagUUID:
+		if len(b) < 16 {
+			return nil, nil, errMalformedBinary
+		}
+		id, _ := uuid.FromBytes(b[:16])
+		return append(append(append(out, '"'), id.String()...), '"'), b[16:], nil
+	case tagJSON:
+		s, b, err := readBinaryBytes(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !json.Valid(s) {
+			return nil, nil, errMalformedBinary
+		}
+		return append(out, s...), b, nil
+	case tagRSAPrivateKey:
+		der, b, err := readBinaryBytes(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, nil, errMalformedBinary
+		}
+		marshalled, err := json.Marshal(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(out, marshalled...), b, nil
+	case tagList, tagObject:
+		count, b, err := readUvarint(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		// every item takes at least a byte, don't believe a count that can't fit
+		if count > uint64(len(b)) || count > math.MaxInt32 {
+			return nil, nil, errMalformedBinary
+		}
+		open, close := byte('['), byte(']')
+		if tag == tagObject {
+			open, close = '{', '}'
+		}
+		out = append(out, open)
+		for i := uint64(0); i < count; i++ {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			if tag == tagObject {
+				if len(b) == 0 || b[0] != tagString {
+					return nil, nil, errMalformedBinary
+				}
+				out, b, err = appendBinaryAsJSON(out, b, depth+1)
+				if err != nil {
+					return nil, nil, err
+				}
+				out = append(out, ':')
+			}
+			out, b, err = appendBinaryAsJSON(out, b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return append(out, close), b, nil
+	default:
+		return nil, nil, errMalformedBinary
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Everything we write to the Datastore starts with a small header that says what it is
+// and how to read it:
+//
+//	"SFSE" || version (1) || cipher suite (1) || len(kind) (1) || kind || key ID (4, big endian)
+//
+// Readers look at the header before anything else and pick the format and algorithms
+// from it, so either can change without rewriting every account at once. The first client
+// wrote values without a header, they're read as version 0, and only for the kinds it
+// stored.
+//
+// The header isn't secret. For sealed objects and chunks it's covered by the MAC along
+// with everything else, for the rest (login entries, wrapped keys, signatures) readers
+// only accept exactly the kind and suite they expect.
+const envelopeMagic = "SFSE"
+
+// Versions 1 and 2 only differ in how sealed structs are serialized, see Encoding.
+const (
+	envelopeJSON   = 1
+	envelopeBinary = 2
+)
+
+// the kinds of values the first client stored, nothing else comes without a header
+var baselineKinds = map[ObjectKind]bool{
+	KindLogin:       true,
+	KindUser:        true,
+	KindCertificate: true,
+	KindCertKey:     true,
+	KindSignature:   true,
+	KindFileInfo:    true,
+	KindAppendBlock: true,
+	KindAppendData:  true,
+}
+
+// CipherSuite names the algorithms the body of an envelope was produced with.
+type CipherSuite byte
+
+const (
+	SuiteAESCTRHMAC    CipherSuite = 1 // AES-128-CTR, then HMAC-SHA-512 over the header and ciphertext
+	SuiteRSAOAEP       CipherSuite = 2 // RSA-OAEP with SHA-512, for wrapped certificate keys
+	SuiteRSASign       CipherSuite = 3 // RSA PKCS #1 v1.5 signatures with SHA-512
+	SuiteLoginVerifier CipherSuite = 5 // HKDF of the Argon2 key, for login entries, see passwordKeys
+)
+
+type envelopeHeader struct {
+	Version byte
+	Suite   CipherSuite
+	Kind    ObjectKind
+	KeyID   uint32 // which generation of the key the body was made with, 0 until keys get rotated
+}
+
+func (header envelopeHeader) marshal() []byte {
+	b := append([]byte(envelopeMagic), header.Version, byte(header.Suite), byte(len(header.Kind)))
+	b = append(b, header.Kind...)
+	return binary.BigEndian.AppendUint32(b, header.KeyID)
+}
+
+// Splits off the header, anything that doesn't start with one is version 0
+func parseEnvelope(value []byte) (header envelopeHeader, body []byte) {
+	if len(value) < len(envelopeMagic)+3 || string(value[:len(envelopeMagic)]) != envelopeMagic {
+		return envelopeHeader{}, value
+	}
+	rest := value[len(envelopeMagic):]
+	kindLen := int(rest[2])
+	if len(rest) < 3+kindLen+4 {
+		return envelopeHeader{}, value
+	}
+	header.Version = rest[0]
+	header.Suite = CipherSuite(rest[1])
+	header.Kind = ObjectKind(rest[3 : 3+kindLen])
+	header.KeyID = binary.BigEndian.Uint32(rest[3+kindLen:])
+	return header, rest[3+kindLen+4:]
+}
+
+// Parses value read from id and checks it's the kind and suite we expect. headerBytes is
+// the raw header, empty for version 0, for callers that MAC it.
+func openEnvelope(kind ObjectKind, suite CipherSuite, id uuid.UUID, value []byte) (header envelopeHeader, headerBytes []byte, body []byte, err error) {
+	header, body = parseEnvelope(value)
+	headerBytes = value[:len(value)-len(body)]
+	switch header.Version {
+	case 0:
+		if !baselineKinds[kind] {
+			return header, nil, nil, integrityErr(kind, id, "no envelope header")
+		}
+		return header, headerBytes, body, nil
+	case envelopeJSON, envelopeBinary:
+		if header.Kind != kind {
+			return header, nil, nil, integrityErr(kind, id, fmt.Sprintf("envelope holds a %s", header.Kind))
+		}
+		if header.Suite != suite {
+			return header, nil, nil, integrityErr(kind, id, fmt.Sprintf("unexpected cipher suite %d", header.Suite))
+		}
+		return header, headerBytes, body, nil
+	default:
+		return header, nil, nil, integrityErr(kind, id, fmt.Sprintf("unsupported format version %d", header.Version))
+	}
+}
+
+func newEnvelope(kind ObjectKind, suite CipherSuite, keyID uint32) []byte {
+	return envelopeHeader{Version: writeVersion, Suite: suite, Kind: kind, KeyID: keyID}.marshal()
+}
+
+// Wraps body in a header and writes it at id
+func datastoreSetEnvelope(ctx context.Context, kind ObjectKind, suite CipherSuite, id uuid.UUID, body []byte) error {
+	return datastoreSet(ctx, id, append(newEnvelope(kind, suite, 0), body...))
+}
+
+// Like datastoreGet, but checks the header and returns the body
+func datastoreGetEnvelope(ctx context.Context, kind ObjectKind, suite CipherSuite, id uuid.UUID) (body []byte, exists bool, err error) {
+	value, exists, err := datastoreGet(ctx, id)
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+	_, _, body, err = openEnvelope(kind, suite, id, value)
+	if err != nil {
+		return nil, true, err
+	}
+	return body, true, nil
+}
+
+// Like datastoreFetch, but checks the header and returns the body
+func datastoreFetchEnvelope(ctx context.Context, kind ObjectKind, suite CipherSuite, id uuid.UUID) (body []byte, err error) {
+	value, err := datastoreFetch(ctx, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	_, _, body, err = openEnvelope(kind, suite, id, value)
+	return body, err
+}
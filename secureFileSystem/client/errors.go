@@ -0,0 +1,94 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Every error returned by the client API wraps one of these sentinels, so
+// callers should match with errors.Is instead of comparing strings.
+// ErrIntegrity is the only one that means the Datastore was tampered with
+// (or corrupted) - everything else is a normal condition or a user mistake.
+// Errors from the Datastore backend itself are passed through unwrapped.
+var (
+	ErrNotFound  = errors.New("not found")              // unknown user, file or recipient
+	ErrIntegrity = errors.New("integrity check failed") // MAC/signature failure, malformed or missing object
+	ErrRevoked   = errors.New("access revoked")         // the caller's access to a file was revoked
+	ErrExists    = errors.New("already exists")         // username or filename is already taken
+	ErrAuth      = errors.New("authentication failed")  // bad username/password
+	ErrConflict  = errors.New("conflict")               // a concurrent session changed the object first
+	ErrInvalid   = errors.New("invalid argument")       // e.g. a malformed option
+	ErrQuota     = errors.New("quota exceeded")         // the write would take the file's owner over their quota
+)
+
+// ObjectKind names the type of a Datastore entry in IntegrityErrors.
+type ObjectKind string
+
+const (
+	KindLogin       ObjectKind = "Login"          // hashed password entry at Hash(username)
+	KindUser        ObjectKind = "User"           // encrypted User struct
+	KindCertificate ObjectKind = "Certificate"    // encrypted Certificates struct
+	KindCertKey     ObjectKind = "CertificateKey" // certificate symKey wrapped with the recipient's public key
+	KindSignature   ObjectKind = "Signature"      // signature over a wrapped certificate key
+	KindFileInfo    ObjectKind = "FileInfo"
+	KindAppendBlock ObjectKind = "AppendBlock"
+	KindAppendData  ObjectKind = "AppendData"
+	KindChunk       ObjectKind = "Chunk"            // deduplicated piece of file content, shared between AppendDatas
+	KindRevocation  ObjectKind = "RevocationNotice" // signed notice the owner leaves in place of a revoked certificate
+	KindIndexPage   ObjectKind = "IndexPage"        // one page of a namespace index, see index.go
+	KindKeyTree     ObjectKind = "KeyTree"          // the owner's view of a file's key tree, see keytree.go
+	KindKeyNode     ObjectKind = "KeyNode"          // the owner's copy of one key of a key tree
+	KindKeyMember   ObjectKind = "KeyMember"        // which leaf of a key tree an invitation got
+	KindKeyWrap     ObjectKind = "KeyWrap"          // a key tree node's parent key, sealed under its own
+	KindLeafGrant   ObjectKind = "LeafGrant"        // a leaf for a certificate from before key trees
+	KindJournal     ObjectKind = "Journal"          // writes of a call that isn't finished yet, see journal.go
+	KindLedger      ObjectKind = "Ledger"           // what an account's files take up, see quota.go
+	KindQuota       ObjectKind = "QuotaRecord"      // an account's quota, signed by the account
+)
+
+// IntegrityError reports an object that failed verification. It matches
+// ErrIntegrity with errors.Is and can be unpacked with errors.As to find out
+// which object was hit.
+type IntegrityError struct {
+	Kind   ObjectKind
+	UUID   uuid.UUID
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%v: %s %s: %s", ErrIntegrity, e.Kind, e.UUID, e.Reason)
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrIntegrity
+}
+
+// QuotaError is what a write returns if it would take the owner of the file over their
+// quota. It matches ErrQuota with errors.Is.
+type QuotaError struct {
+	Quota     int64 // the owner's, in bytes
+	Used      int64 // before the write
+	Requested int64 // how much the write would add
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: %d of %d bytes used, the write needs %d more", ErrQuota, e.Used, e.Quota, e.Requested)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuota
+}
+
+// Reason of IntegrityErrors for objects that were deleted rather than modified
+const reasonMissing = "missing from Datastore"
+
+func integrityErr(kind ObjectKind, id uuid.UUID, reason string) error {
+	return &IntegrityError{Kind: kind, UUID: id, Reason: reason}
+}
+
+// wraps a sentinel with some context, e.g. wrapErr(ErrNotFound, "file %q", name)
+func wrapErr(sentinel error, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", sentinel, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultInvitationTTL is how long an invitation nobody accepted is kept before
+// the garbage collector considers it abandoned.
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+type Invitation struct {
+	Recipient string
+	Filename  string    // our name for the shared file
+	Signature uuid.UUID // our signature over the wrapped certificate key
+	Created   int64     // unix seconds
+}
+
+func (invitation Invitation) expired(ttl time.Duration) bool {
+	return time.Since(time.Unix(invitation.Created, 0)) > ttl
+}
+
+// Adds an invitation to the User struct and writes it back, dropping ones that expired long ago
+func (userdata *User) recordInvitation(ctx context.Context, invitationPtr uuid.UUID, recipient string, filename string, signatureUUID uuid.UUID) (err error) {
+	if userdata.Invitations == nil {
+		userdata.Invitations = make(map[uuid.UUID]Invitation)
+	}
+	for id, invitation := range userdata.Invitations {
+		if invitation.expired(2 * DefaultInvitationTTL) {
+			delete(userdata.Invitations, id)
+		}
+	}
+	userdata.Invitations[invitationPtr] = Invitation{
+		Recipient: recipient,
+		Filename:  filename,
+		Signature: signatureUUID,
+		Created:   time.Now().Unix(),
+	}
+	return userdata.reencryptUser(ctx)
+}
+
+type GCOptions struct {
+	DryRun        bool          // only count the garbage, don't delete anything
+	InvitationTTL time.Duration // unaccepted invitations older than this are garbage, DefaultInvitationTTL if zero
+	Force         bool          // sweep even if some account has corrupted or missing objects
+}
+
+type GCStats struct {
+	Accounts     int // accounts walked
+	Scanned      int // entries in the Datastore
+	Live         int // entries reachable from some account
+	Garbage      int // entries nothing refers to
+	GarbageBytes int
+	Deleted      int // 0 on a dry run
+}
+
+// CollectGarbage deletes every Datastore entry that isn't reachable from any account:
+// chains replaced by StoreFile, certificates of revoked users nobody refers to anymore,
+// abandoned invitations and so on. Only the account owners can decrypt their roots, so
+// it needs a logged-in session for every account in the Keystore and refuses to run
+// otherwise. It also refuses to sweep if any account has corrupted or missing objects
+// (anything behind them would look unreachable) unless opts.Force is set.
+// The Datastore and Keystore backends have to implement EnumerableDatastore and EnumerableKeystore.
+//
+// Other sessions may keep writing while it runs, with limits. It lists the Datastore
+// before walking any account and only deletes from that list, so whatever is stored
+// after it started is left alone, linked in or not; the next run deletes what never was.
+// Calls that were already running when it started are the exception: what they stored
+// before then and link in after the walk passed their account is deleted, so don't start
+// it while a long StoreFile or AppendToFile is under way. The same goes for InitUser: a
+// new account that reaches the Keystore before the walk ends makes it give up with
+// ErrAuth, one that gets there later can lose its User struct. An invitation
+// accepted just as it passes InvitationTTL may find its certificate gone, as it would
+// after the run.
+func CollectGarbage(sessions []*User, opts GCOptions) (stats *GCStats, err error) {
+	return CollectGarbageContext(context.Background(), sessions, opts)
+}
+
+// CollectGarbageContext is like CollectGarbage but gives up once ctx is done, see context.go.
+func CollectGarbageContext(ctx context.Context, sessions []*User, opts GCOptions) (stats *GCStats, err error) {
+	enumerable, ok := datastore.(EnumerableDatastore)
+	if !ok {
+		return nil, errors.New("client: Datastore backend can't enumerate its keys")
+	}
+	enumerableKeys, ok := keystore.(EnumerableKeystore)
+	if !ok {
+		return nil, errors.New("client: Keystore backend can't enumerate its entries")
+	}
+
+	// only what exists before the walk is swept, later writes may not be linked in yet.
+	// Listed before the accounts, so an account that isn't walked has nothing in it
+	keys, err := enumerable.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	// mark everything reachable from every account
+	bySession := make(map[string]*User)
+	for _, session := range sessions {
+		bySession[session.Username] = session
+	}
+	err = checkSessions(enumerableKeys, bySession)
+	if err != nil {
+		return nil, err
+	}
+	stats = &GCStats{}
+	live := make(map[uuid.UUID]bool)
+	for _, session := range sessions {
+		w := newWalker(session.Username, opts.InvitationTTL)
+		w.live = live
+		err = w.walkAccount(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		problems := w.report.Problems()
+		if len(problems) > 0 && !opts.Force {
+			problem := problems[0]
+			return nil, integrityErr(problem.Kind, problem.UUID, "account "+session.Username+" failed to verify, not sweeping: "+problem.Reason)
+		}
+		stats.Accounts++
+	}
+
+	// an account that showed up while we walked stored its User struct before it did
+	err = checkSessions(enumerableKeys, bySession)
+	if err != nil {
+		return nil, err
+	}
+
+	// sweep everything else
+	for _, key := range keys {
+		stats.Scanned++
+		if live[key] {
+			stats.Live++
+			continue
+		}
+		value, exists, err := datastoreGet(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		stats.Garbage++
+		stats.GarbageBytes += len(value)
+		if opts.DryRun {
+			continue
+		}
+		err = datastoreDelete(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		stats.Deleted++
+	}
+	return stats, nil
+}
+
+// Makes sure there's a session for every account in the Keystore
+func checkSessions(enumerableKeys EnumerableKeystore, bySession map[string]*User) error {
+	names, err := enumerableKeys.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		username, isEncKey := strings.CutSuffix(name, " encKey")
+		if isEncKey && bySession[username] == nil {
+			return wrapErr(ErrAuth, "no session for account %q", username)
+		}
+	}
+	return nil
+}
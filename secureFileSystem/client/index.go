@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// A namespace is kept in B-trees of index pages rather than in the User struct, so adding,
+// renaming or looking up one file reads and writes a few pages no matter how many files
+// the account has. Each page is its own sealed object under the Namespace key, at a random
+// UUID except for the root, which stays where the Namespace says. A leaf holds up to
+// indexPageSize sorted keys and their entries, an internal page the separator keys and
+// one more child than it has keys: Children[i] holds the keys from Keys[i-1] up to but
+// not including Keys[i].
+//
+// A full page splits in two and the separator goes to its parent, a full root moves both
+// halves into new pages so it never moves itself. The new right half is written first,
+// then the parent pointing to it, and only then is the left half cut down, so a crash in
+// between leaves keys in two places rather than in none. Readers follow the separators,
+// and walk skips whatever a page holds outside its parent's bounds. Pages aren't merged
+// when they empty out, a namespace that shrank is as deep as it was at its largest.
+//
+// Two sessions changing the same page at once still lose one of the changes like they
+// did with the User struct, changes to different pages no longer collide.
+const (
+	indexPageSize = 64
+	maxIndexDepth = 16 // 64^16 keys is more than anyone has, deeper is garbage
+)
+
+type IndexPage struct {
+	Keys     []string
+	Entries  []IndexEntry // in a leaf, one per key
+	Children []uuid.UUID  // in an internal page, one more than there are keys
+}
+
+// IndexEntry is what a namespace index keeps for one key. The names tree only uses
+// Certificate and Sender, the certificates tree only Filename.
+type IndexEntry struct {
+	Certificate uuid.UUID // our certificate for the file
+	Sender      string    // who shared it with us, ourselves if we own it
+	Filename    string    // our name for the file behind the certificate
+}
+
+func (page *IndexPage) leaf() bool {
+	return len(page.Children) == 0
+}
+
+// where key is or would go among the keys of a leaf
+func (page *IndexPage) position(key string) (i int, found bool) {
+	i = sort.SearchStrings(page.Keys, key)
+	return i, i < len(page.Keys) && page.Keys[i] == key
+}
+
+// which child of an internal page key belongs under
+func (page *IndexPage) child(key string) int {
+	return sort.Search(len(page.Keys), func(i int) bool { return page.Keys[i] > key })
+}
+
+// Splits an oversized page in two, separator is the first key of right
+func (page *IndexPage) split() (left *IndexPage, right *IndexPage, separator string) {
+	mid := len(page.Keys) / 2
+	if page.leaf() {
+		left = &IndexPage{Keys: append([]string{}, page.Keys[:mid]...), Entries: append([]IndexEntry{}, page.Entries[:mid]...)}
+		right = &IndexPage{Keys: append([]string{}, page.Keys[mid:]...), Entries: append([]IndexEntry{}, page.Entries[mid:]...)}
+		return left, right, page.Keys[mid]
+	}
+	// the middle separator moves up, it doesn't stay in either half
+	left = &IndexPage{Keys: append([]string{}, page.Keys[:mid]...), Children: append([]uuid.UUID{}, page.Children[:mid+1]...)}
+	right = &IndexPage{Keys: append([]string{}, page.Keys[mid+1:]...), Children: append([]uuid.UUID{}, page.Children[mid+1:]...)}
+	return left, right, page.Keys[mid]
+}
+
+// indexTree is one B-tree of a namespace
+type indexTree struct {
+	root  uuid.UUID
+	key   []byte
+	cache *sessionCache // may be nil
+}
+
+func (tree indexTree) object(id uuid.UUID) sealContext {
+	return sealContext{Kind: KindIndexPage, UUID: id}
+}
+
+// Decrypts and MAC-checks one page, from the session cache if it hasn't changed
+func (tree indexTree) loadPage(ctx context.Context, id uuid.UUID) (page *IndexPage, err error) {
+	marshalled, err := tree.cache.open(ctx, KindIndexPage, id, tree.key, func(ctx context.Context, sealed []byte) ([]byte, error) {
+		return openStructJSON(tree.object(id), tree.key, sealed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	page = &IndexPage{}
+	err = json.Unmarshal(marshalled, page)
+	if err != nil {
+		return nil, integrityErr(KindIndexPage, id, "malformed struct")
+	}
+	if page.leaf() && len(page.Entries) != len(page.Keys) || !page.leaf() && len(page.Children) != len(page.Keys)+1 {
+		return nil, integrityErr(KindIndexPage, id, "malformed page")
+	}
+	if !sort.StringsAreSorted(page.Keys) {
+		return nil, integrityErr(KindIndexPage, id, "keys out of order")
+	}
+	return page, nil
+}
+
+// Seals and writes one page, the session cache keeps it as if it had just been read
+func (tree indexTree) storePage(ctx context.Context, id uuid.UUID, page *IndexPage) (err error) {
+	sealed, err := sealStruct(tree.object(id), tree.key, page)
+	if err != nil {
+		return err
+	}
+	err = datastoreSet(ctx, id, sealed)
+	if err != nil {
+		return err
+	}
+	tree.cache.wrote(KindIndexPage, id, tree.key, sealed, page)
+	return nil
+}
+
+// Writes an empty root, what a new tree starts as
+func (tree indexTree) create(ctx context.Context) (err error) {
+	return tree.storePage(ctx, tree.root, &IndexPage{})
+}
+
+type indexStep struct {
+	id    uuid.UUID
+	page  *IndexPage
+	child int // which child we went down to, in internal pages
+}
+
+// The pages from the root down to the leaf key belongs in
+func (tree indexTree) descend(ctx context.Context, key string) (path []indexStep, err error) {
+	id := tree.root
+	for {
+		if len(path) == maxIndexDepth {
+			return nil, integrityErr(KindIndexPage, id, "index too deep")
+		}
+		page, err := tree.loadPage(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		step := indexStep{id: id, page: page}
+		if page.leaf() {
+			return append(path, step), nil
+		}
+		step.child = page.child(key)
+		path = append(path, step)
+		id = page.Children[step.child]
+	}
+}
+
+func (tree indexTree) get(ctx context.Context, key string) (entry IndexEntry, found bool, err error) {
+	path, err := tree.descend(ctx, key)
+	if err != nil {
+		return IndexEntry{}, false, err
+	}
+	leaf := path[len(path)-1].page
+	i, found := leaf.position(key)
+	if !found {
+		return IndexEntry{}, false, nil
+	}
+	return leaf.Entries[i], true, nil
+}
+
+// Adds key or replaces its entry
+func (tree indexTree) put(ctx context.Context, key string, entry IndexEntry) (err error) {
+	path, err := tree.descend(ctx, key)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1].page
+	i, found := leaf.position(key)
+	if found {
+		leaf.Entries[i] = entry
+	} else {
+		leaf.Keys = append(leaf.Keys[:i], append([]string{key}, leaf.Keys[i:]...)...)
+		leaf.Entries = append(leaf.Entries[:i], append([]IndexEntry{entry}, leaf.Entries[i:]...)...)
+	}
+
+	// split on the way up as far as pages overflow, the left halves are cut down last
+	var shrunk []indexStep
+	for level := len(path) - 1; ; level-- {
+		id, page := path[level].id, path[level].page
+		if len(page.Keys) <= indexPageSize {
+			err = tree.storePage(ctx, id, page)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		left, right, separator := page.split()
+		rightUUID := uuid.New()
+		if level == 0 {
+			leftUUID := uuid.New()
+			err = tree.storePage(ctx, leftUUID, left)
+			if err != nil {
+				return err
+			}
+			err = tree.storePage(ctx, rightUUID, right)
+			if err != nil {
+				return err
+			}
+			err = tree.storePage(ctx, id, &IndexPage{Keys: []string{separator}, Children: []uuid.UUID{leftUUID, rightUUID}})
+			if err != nil {
+				return err
+			}
+			break
+		}
+		err = tree.storePage(ctx, rightUUID, right)
+		if err != nil {
+			return err
+		}
+		shrunk = append(shrunk, indexStep{id: id, page: left})
+		parent, at := path[level-1].page, path[level-1].child
+		parent.Keys = append(parent.Keys[:at], append([]string{separator}, parent.Keys[at:]...)...)
+		parent.Children = append(parent.Children[:at+1], append([]uuid.UUID{rightUUID}, parent.Children[at+1:]...)...)
+	}
+	for _, step := range shrunk {
+		err = tree.storePage(ctx, step.id, step.page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes key, found is false if it wasn't there
+func (tree indexTree) remove(ctx context.Context, key string) (found bool, err error) {
+	path, err := tree.descend(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	step := path[len(path)-1]
+	i, found := step.page.position(key)
+	if !found {
+		return false, nil
+	}
+	step.page.Keys = append(step.page.Keys[:i], step.page.Keys[i+1:]...)
+	step.page.Entries = append(step.page.Entries[:i], step.page.Entries[i+1:]...)
+	return true, tree.storePage(ctx, step.id, step.page)
+}
+
+// Calls visit with every key and entry in order. visitPage, if set, is called with every
+// page first, and when it returns false neither the page nor anything under it is read.
+func (tree indexTree) walk(ctx context.Context, visitPage func(id uuid.UUID, err error) bool, visit func(key string, entry IndexEntry) error) (err error) {
+	return tree.walkPage(ctx, tree.root, 0, nil, nil, visitPage, visit)
+}
+
+// low and high bound the keys the parent sent here, nil if there's no bound
+func (tree indexTree) walkPage(ctx context.Context, id uuid.UUID, depth int, low *string, high *string, visitPage func(id uuid.UUID, err error) bool, visit func(key string, entry IndexEntry) error) (err error) {
+	var page *IndexPage
+	if depth == maxIndexDepth {
+		err = integrityErr(KindIndexPage, id, "index too deep")
+	} else {
+		page, err = tree.loadPage(ctx, id)
+	}
+	if visitPage != nil {
+		if !visitPage(id, err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	inBounds := func(key string) bool {
+		return (low == nil || key >= *low) && (high == nil || key < *high)
+	}
+	if page.leaf() {
+		for i, key := range page.Keys {
+			// what a split left behind until the left half was cut down
+			if !inBounds(key) {
+				continue
+			}
+			err = visit(key, page.Entries[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, child := range page.Children {
+		childLow, childHigh := low, high
+		if i > 0 && (low == nil || page.Keys[i-1] > *low) {
+			childLow = &page.Keys[i-1]
+		}
+		if i < len(page.Keys) && (high == nil || page.Keys[i] < *high) {
+			childHigh = &page.Keys[i]
+		}
+		err = tree.walkPage(ctx, child, depth+1, childLow, childHigh, visitPage, visit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// A call that changes more than one object other sessions read (see context.go) doesn't
+// write them as it goes once it's committed. The writes and deletes are kept in the
+// call's journal, where the rest of the call reads them back from, and when the call
+// returns without an error they go to the Datastore together:
+//
+//  1. the whole lot is sealed into one Journal under the account's root key, at a
+//     UUID derived from it, and written there,
+//  2. each write and delete is made, in the order the call made them,
+//  3. the Journal is deleted.
+//
+// A client that dies before 1 has left nothing but objects nobody refers to, the call
+// is rolled back and CollectGarbage removes them. One that dies after it left a Journal,
+// and the next GetUser for the account makes the writes in it that weren't made yet
+// before anything else, so the call is rolled forward. A call with only one visible
+// write makes it straight away, on its own it can't be half done. A call that fails after
+// it's committed writes none of it.
+//
+// Each write in the Journal carries the digest of what the call found at its UUID, the
+// first time it read it or wrote it straight away. Rolling forward only makes a write if
+// that's still what's stored, and leaves objects that already hold what the call wrote
+// alone. An object another session changed since the crash keeps that session's change
+// and the write is dropped, that's as much as can be done without compare-and-swap in the
+// Datastore. All sessions of an account share the one Journal, so if two of them commit
+// at the same moment only the last one's can be rolled forward.
+type Journal struct {
+	Writes []JournalWrite
+}
+
+type JournalWrite struct {
+	UUID   uuid.UUID
+	Value  []byte
+	Delete bool   // Value is nil then
+	Before []byte // SHA-256 of what was stored at UUID before the call, nil if nothing was
+}
+
+// journal collects the writes of one call, it travels in the call's context
+type journal struct {
+	userdata *User
+
+	mu        sync.Mutex
+	committed bool
+	writes    map[uuid.UUID]*JournalWrite
+	order     []uuid.UUID                      // in the order the call first wrote them
+	before    map[uuid.UUID]*[sha256.Size]byte // what the call found stored, nil for nothing
+}
+
+type journalKey struct{}
+
+func newJournal(userdata *User) *journal {
+	return &journal{userdata: userdata, writes: make(map[uuid.UUID]*JournalWrite), before: make(map[uuid.UUID]*[sha256.Size]byte)}
+}
+
+// Where the account whose root key is key keeps its Journal, sealed under key
+func journalObject(key []byte) (object sealContext, err error) {
+	derived, err := hashKDF(key, []byte("journal UUID"))
+	if err != nil {
+		return sealContext{}, err
+	}
+	id, err := uuid.FromBytes(derived[:16])
+	if err != nil {
+		return sealContext{}, err
+	}
+	return sealContext{Kind: KindJournal, UUID: id}, nil
+}
+
+// Gives the call a journal, done has to be deferred right after so what the call wrote
+// gets to the Datastore:
+//
+//	ctx, done := userdata.startJournal(ctx)
+//	defer done(&err)
+//
+// A call made from inside another one, or as part of a transaction (see tx.go), shares
+// the journal that's already there.
+func (userdata *User) startJournal(ctx context.Context) (withJournal context.Context, done func(errp *error)) {
+	if journalOf(ctx) != nil {
+		return ctx, func(*error) {}
+	}
+	j := newJournal(userdata)
+	return context.WithValue(ctx, journalKey{}, j), func(errp *error) {
+		if *errp != nil {
+			return
+		}
+		*errp = j.flush(ctx)
+	}
+}
+
+// The call's journal, nil if it has none
+func journalOf(ctx context.Context) *journal {
+	j, _ := ctx.Value(journalKey{}).(*journal)
+	return j
+}
+
+// From here on writes go in the journal
+func (j *journal) commit() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.committed = true
+}
+
+// Keeps a write, or a delete if value is nil. handled is false if the call isn't committed
+// yet and the write should go straight to the Datastore.
+func (j *journal) set(key uuid.UUID, value []byte, deleted bool) (handled bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.committed {
+		return false
+	}
+	if _, seen := j.writes[key]; !seen {
+		j.order = append(j.order, key)
+	}
+	j.writes[key] = &JournalWrite{UUID: key, Value: value, Delete: deleted}
+	return true
+}
+
+// Notes what the Datastore holds at key, if the call doesn't know yet. exists is false
+// if it holds nothing.
+func (j *journal) found(key uuid.UUID, digest [sha256.Size]byte, exists bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, known := j.before[key]; known {
+		return
+	}
+	j.before[key] = nil
+	if exists {
+		j.before[key] = &digest
+	}
+}
+
+// Notes what the call wrote to the Datastore itself at key before it was committed, nil
+// for a delete
+func (j *journal) wroteThrough(key uuid.UUID, value []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.before[key] = nil
+	if value != nil {
+		digest := sha256.Sum256(value)
+		j.before[key] = &digest
+	}
+}
+
+// What the call wrote at key. found is false if it didn't write there.
+func (j *journal) get(key uuid.UUID) (value []byte, ok bool, found bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	write, found := j.writes[key]
+	if !found {
+		return nil, false, false
+	}
+	return write.Value, !write.Delete, true
+}
+
+// What the journal holds at one point, to go back to with restore
+type journalSavepoint struct {
+	committed bool
+	writes    map[uuid.UUID]*JournalWrite
+	order     []uuid.UUID
+}
+
+func (j *journal) save() journalSavepoint {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	writes := make(map[uuid.UUID]*JournalWrite, len(j.writes))
+	for key, write := range j.writes {
+		writes[key] = write
+	}
+	return journalSavepoint{committed: j.committed, writes: writes, order: j.order[:len(j.order):len(j.order)]}
+}
+
+// Forgets whatever was kept since save
+func (j *journal) restore(savepoint journalSavepoint) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.committed = savepoint.committed
+	j.writes = savepoint.writes
+	j.order = savepoint.order
+}
+
+// Writes out what the call wrote, through the Journal if there's more than one write
+func (j *journal) flush(ctx context.Context) (err error) {
+	j.mu.Lock()
+	entry := Journal{Writes: make([]JournalWrite, 0, len(j.order))}
+	var unknown []int // writes to what the call never read
+	for _, key := range j.order {
+		write := *j.writes[key]
+		before, known := j.before[key]
+		if !known {
+			unknown = append(unknown, len(entry.Writes))
+		} else if before != nil {
+			write.Before = before[:]
+		}
+		entry.Writes = append(entry.Writes, write)
+	}
+	j.committed = false
+	j.writes = make(map[uuid.UUID]*JournalWrite)
+	j.order = nil
+	j.before = make(map[uuid.UUID]*[sha256.Size]byte)
+	j.mu.Unlock()
+
+	// nothing of this goes through the journal, and it's finished whatever ctx says
+	ctx = uncancelable{context.WithValue(ctx, journalKey{}, (*journal)(nil))}
+	if len(entry.Writes) < 2 {
+		return applyJournal(ctx, &entry)
+	}
+	for _, i := range unknown {
+		digest, exists, err := storedDigest(ctx, entry.Writes[i].UUID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			entry.Writes[i].Before = digest[:]
+		}
+	}
+	rootKey, _, err := j.userdata.login()
+	if err != nil {
+		return err
+	}
+	object, err := journalObject(rootKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealStruct(object, rootKey, &entry)
+	if err != nil {
+		return err
+	}
+	err = datastoreSet(ctx, object.UUID, sealed)
+	if err != nil {
+		return err
+	}
+	err = applyJournal(ctx, &entry)
+	if err != nil {
+		return err
+	}
+	// another session of the account may have put its own there since
+	ours, err := stillStored(ctx, object.UUID, sealed)
+	if err != nil || !ours {
+		return err
+	}
+	return datastoreDelete(ctx, object.UUID)
+}
+
+func applyJournal(ctx context.Context, entry *Journal) (err error) {
+	for _, write := range entry.Writes {
+		if write.Delete {
+			err = datastoreDelete(ctx, write.UUID)
+		} else {
+			err = datastoreSet(ctx, write.UUID, write.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the Datastore still holds exactly value at key
+func stillStored(ctx context.Context, key uuid.UUID, value []byte) (stored bool, err error) {
+	digest, exists, err := storedDigest(ctx, key)
+	return exists && digest == sha256.Sum256(value), err
+}
+
+// The SHA-256 of what the Datastore holds at key, from the digest if it can send one
+func storedDigest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, exists bool, err error) {
+	if _, digests := datastore.(DigestDatastore); digests {
+		return datastoreDigest(ctx, key)
+	}
+	current, exists, err := datastoreGet(ctx, key)
+	if err != nil || !exists {
+		return digest, false, err
+	}
+	return sha256.Sum256(current), true, nil
+}
+
+// Whether a write from a Journal still has to be made, and may be: it's not there yet and
+// what it was written over hasn't changed
+func stillPending(ctx context.Context, write *JournalWrite) (pending bool, err error) {
+	digest, exists, err := storedDigest(ctx, write.UUID)
+	if err != nil {
+		return false, err
+	}
+	if write.Delete && !exists || !write.Delete && exists && digest == sha256.Sum256(write.Value) {
+		return false, nil
+	}
+	if write.Before == nil {
+		return !exists, nil
+	}
+	return exists && bytes.Equal(digest[:], write.Before), nil
+}
+
+// Rolls forward what a session of the account didn't get to finish, if anything. Called
+// by GetUser before it reads anything else, key is the root key or, for an account from
+// before it, the password hash.
+func recoverJournal(ctx context.Context, key []byte) (err error) {
+	object, err := journalObject(key)
+	if err != nil {
+		return err
+	}
+	sealed, exists, err := datastoreGet(ctx, object.UUID)
+	if err != nil || !exists {
+		return err
+	}
+	var entry Journal
+	err = openStruct(object, key, sealed, &entry)
+	if err != nil {
+		return err
+	}
+	// once we've started it has to be finished
+	ctx, err = commit(ctx)
+	if err != nil {
+		return err
+	}
+	pending := Journal{}
+	for i := range entry.Writes {
+		ok, err := stillPending(ctx, &entry.Writes[i])
+		if err != nil {
+			return err
+		}
+		if ok {
+			pending.Writes = append(pending.Writes, entry.Writes[i])
+		}
+	}
+	err = applyJournal(ctx, &pending)
+	if err != nil {
+		return err
+	}
+	return datastoreDelete(ctx, object.UUID)
+}
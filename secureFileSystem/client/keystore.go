@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Keystore is the trusted public key directory. Entries can't be changed once set,
+// so a second Set of the same name has to fail.
+type Keystore interface {
+	Get(name string) (value userlib.PublicKeyType, ok bool, err error)
+	Set(name string, value userlib.PublicKeyType) error
+}
+
+// EnumerableKeystore can also list its entries, which CollectGarbage needs to make
+// sure it was given a session for every account.
+type EnumerableKeystore interface {
+	Keystore
+	Names() ([]string, error)
+}
+
+// ContextKeystore takes the caller's context with each request, see ContextDatastore.
+type ContextKeystore interface {
+	Keystore
+	GetContext(ctx context.Context, name string) (value userlib.PublicKeyType, ok bool, err error)
+	SetContext(ctx context.Context, name string, value userlib.PublicKeyType) error
+}
+
+// userlibKeystore is the default backend, userlib's in-memory map.
+type userlibKeystore struct{}
+
+func (userlibKeystore) Get(name string) (userlib.PublicKeyType, bool, error) {
+	value, ok := userlib.KeystoreGet(name)
+	return value, ok, nil
+}
+
+func (userlibKeystore) Set(name string, value userlib.PublicKeyType) error {
+	return userlib.KeystoreSet(name, value)
+}
+
+func (userlibKeystore) Names() ([]string, error) {
+	keystoreMap := userlib.KeystoreGetMap()
+	names := make([]string, 0, len(keystoreMap))
+	for name := range keystoreMap {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+var keystore Keystore = userlibKeystore{}
+
+// SetKeystore replaces the public key directory used by every client call. It isn't
+// safe to call while other calls are in flight.
+func SetKeystore(ks Keystore) {
+	if ks == nil {
+		ks = userlibKeystore{}
+	}
+	keystore = ks
+}
+
+func keystoreGet(ctx context.Context, name string) (value userlib.PublicKeyType, ok bool, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return value, false, err
+	}
+	record(func(stats *OpStats) { stats.KeystoreGets++ })
+	if contextKeystore, supported := keystore.(ContextKeystore); supported {
+		return contextKeystore.GetContext(ctx, name)
+	}
+	return keystore.Get(name)
+}
+
+func keystoreSet(ctx context.Context, name string, value userlib.PublicKeyType) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	record(func(stats *OpStats) { stats.KeystoreSets++ })
+	if contextKeystore, supported := keystore.(ContextKeystore); supported {
+		return contextKeystore.SetContext(ctx, name, value)
+	}
+	return keystore.Set(name, value)
+}
+
+// Sets name to value, which is fine if it already is, like when an earlier attempt got
+// that far
+func keystoreSetOnce(ctx context.Context, name string, value userlib.PublicKeyType) error {
+	err := keystoreSet(ctx, name, value)
+	if err == nil {
+		return nil
+	}
+	current, exists, getErr := keystoreGet(ctx, name)
+	if getErr != nil || !exists {
+		return err
+	}
+	if current.KeyType == value.KeyType && current.PubKey.Equal(&value.PubKey) {
+		return nil
+	}
+	return wrapErr(ErrExists, "keystore entry %q", name)
+}
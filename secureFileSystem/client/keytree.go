@@ -0,0 +1,647 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A file's FileInfo is sealed under its AccessToken. Certificates used to carry the token
+// itself, so revoking one recipient meant a new token in the certificate of everyone
+// left, a public-key unwrap and a write per recipient. Now the token is the root of a
+// binary key tree: every invitation the owner hands out gets a leaf, and whoever the
+// recipient shares with gets the same leaf. Every node below the root has a KeyWrap, its
+// parent's key sealed under its own, at a UUID derived from the FileInfo UUID and where
+// the node is, so a leaf's holder reads its way up to the token in Height steps. Only
+// the owner's certificate has the tree's key, which seals the KeyTree, the KeyNode with
+// every node's key and the KeyMember saying which leaf an invitation got.
+//
+// Revoking someone gives every node above their leaf a new key and wraps each one for
+// both its children, so it writes about three objects a level and needs no public-key
+// operation, then FileInfo is resealed under the new root. Leaves are handed out in
+// order and the ones revocations give back are reused. A full tree grows a level on top,
+// which changes the token too.
+//
+// Files from before there were key trees keep the token in every certificate until their
+// owner first revokes someone. That revocation plants a tree and leaves each recipient
+// left a LeafGrant, their leaf wrapped to their public key and signed like a certificate.
+// Nobody else's private key is needed for it, so it can't rewrite their certificates:
+// a recipient moves theirs onto the tree the next time they open the file, and grants
+// the leaf on to whoever they shared with. Until then those further down can't open it.
+const maxKeyTreeHeight = 32 // that many levels is more leaves than anyone shares with, taller is garbage
+
+// KeyTree is the owner's view of a file's key tree
+type KeyTree struct {
+	Height int    // leaves are level 0, the root is level Height
+	Leaves int    // leaves handed out so far, at most 1<<Height
+	Free   []int  // leaves revocations gave back, handed out again first
+	Root   []byte // the root's key, the file's AccessToken
+}
+
+// KeyNode is the owner's copy of the key of a node below the root
+type KeyNode struct {
+	Key         []byte
+	Certificate uuid.UUID // for a leaf, the invitation it was given to
+}
+
+// KeyMember is which leaf the owner gave an invitation
+type KeyMember struct {
+	Leaf int
+}
+
+// KeyWrap is the key of a node's parent, sealed under the node's own key
+type KeyWrap struct {
+	Key  []byte
+	Root bool // the parent is the root, so Key is the AccessToken
+}
+
+// KeyLeaf is a certificate's place in the key tree of its file
+type KeyLeaf struct {
+	Index int
+	Key   []byte
+}
+
+// LeafGrant is the leaf of a file from before key trees that someone's certificate moves onto
+type LeafGrant struct {
+	Leaf *KeyLeaf
+}
+
+// keyTree is the owner's handle on the key tree of one file
+type keyTree struct {
+	file  uuid.UUID // FileInfo UUID
+	key   []byte
+	cache *sessionCache // may be nil
+}
+
+func (userdata *User) keyTree(cert *Certificates) keyTree {
+	return keyTree{file: cert.FileInfo, key: cert.KeyTree, cache: userdata.cache}
+}
+
+func keyWrapObject(fileInfoUUID uuid.UUID, level int, position int) sealContext {
+	hash := userlib.Hash([]byte(fmt.Sprintf("key wrap %s %d %d", fileInfoUUID, level, position)))
+	id, _ := uuid.FromBytes(hash[:16])
+	return sealContext{Kind: KindKeyWrap, UUID: id, File: fileInfoUUID}
+}
+
+// where the owner keeps the object of kind called name under the tree's key
+func (tree keyTree) object(kind ObjectKind, name string) (object sealContext, err error) {
+	derived, err := hashKDF(tree.key, []byte(name))
+	if err != nil {
+		return sealContext{}, err
+	}
+	id, err := uuid.FromBytes(derived[:16])
+	if err != nil {
+		return sealContext{}, err
+	}
+	return sealContext{Kind: kind, UUID: id, File: tree.file}, nil
+}
+
+func (tree keyTree) stateObject() (sealContext, error) {
+	return tree.object(KindKeyTree, "key tree")
+}
+
+func (tree keyTree) nodeObject(level int, position int) (sealContext, error) {
+	return tree.object(KindKeyNode, fmt.Sprintf("key node %d %d", level, position))
+}
+
+func (tree keyTree) memberObject(certUUID uuid.UUID) (sealContext, error) {
+	return tree.object(KindKeyMember, "key member "+certUUID.String())
+}
+
+// Writes a tree with room for capacity leaves and none handed out, FileInfo has to be
+// sealed under its root for it to count
+func createKeyTree(ctx context.Context, cache *sessionCache, fileInfoUUID uuid.UUID, capacity int) (tree keyTree, state *KeyTree, err error) {
+	tree = keyTree{file: fileInfoUUID, key: userlib.RandomBytes(16), cache: cache}
+	state = &KeyTree{Height: 1, Root: userlib.RandomBytes(16)}
+	for 1<<state.Height < capacity {
+		state.Height++
+	}
+	err = tree.storeState(ctx, state)
+	if err != nil {
+		return keyTree{}, nil, err
+	}
+	return tree, state, nil
+}
+
+func (tree keyTree) loadState(ctx context.Context) (state *KeyTree, err error) {
+	object, err := tree.stateObject()
+	if err != nil {
+		return nil, err
+	}
+	state = &KeyTree{}
+	err = tree.cache.load(ctx, object, tree.key, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Height < 1 || state.Height > maxKeyTreeHeight || state.Leaves < 0 || state.Leaves > 1<<state.Height || len(state.Root) != 16 {
+		return nil, integrityErr(KindKeyTree, object.UUID, "malformed tree")
+	}
+	for _, index := range state.Free {
+		if index < 0 || index >= state.Leaves {
+			return nil, integrityErr(KindKeyTree, object.UUID, "malformed tree")
+		}
+	}
+	return state, nil
+}
+
+func (tree keyTree) storeState(ctx context.Context, state *KeyTree) (err error) {
+	object, err := tree.stateObject()
+	if err != nil {
+		return err
+	}
+	return tree.cache.store(ctx, object, tree.key, state)
+}
+
+// The AccessToken, what FileInfo is sealed under now
+func (tree keyTree) token(ctx context.Context) (token []byte, err error) {
+	state, err := tree.loadState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return state.Root, nil
+}
+
+// whether the node has a key, the root always does
+func (state *KeyTree) holds(level int, position int) bool {
+	if level > 0 {
+		return position<<level < state.Leaves
+	}
+	if position >= state.Leaves {
+		return false
+	}
+	for _, free := range state.Free {
+		if free == position {
+			return false
+		}
+	}
+	return true
+}
+
+func (tree keyTree) loadNode(ctx context.Context, level int, position int) (node *KeyNode, err error) {
+	object, err := tree.nodeObject(level, position)
+	if err != nil {
+		return nil, err
+	}
+	node = &KeyNode{}
+	err = tree.cache.load(ctx, object, tree.key, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(node.Key) != 16 {
+		return nil, integrityErr(KindKeyNode, object.UUID, "malformed key")
+	}
+	return node, nil
+}
+
+func (tree keyTree) storeNode(ctx context.Context, level int, position int, node *KeyNode) (err error) {
+	object, err := tree.nodeObject(level, position)
+	if err != nil {
+		return err
+	}
+	return tree.cache.store(ctx, object, tree.key, node)
+}
+
+// Wraps parentKey for the node at level, position, whose key is key
+func (tree keyTree) storeWrap(ctx context.Context, level int, position int, key []byte, parentKey []byte, root bool) (err error) {
+	return tree.cache.store(ctx, keyWrapObject(tree.file, level, position), key, &KeyWrap{Key: parentKey, Root: root})
+}
+
+// Opens the wrap of the node at level, position of the file's tree with the node's key
+func loadKeyWrap(ctx context.Context, cache *sessionCache, fileInfoUUID uuid.UUID, level int, position int, key []byte) (wrap *KeyWrap, err error) {
+	object := keyWrapObject(fileInfoUUID, level, position)
+	wrap = &KeyWrap{}
+	err = cache.load(ctx, object, key, wrap)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrap.Key) != 16 {
+		return nil, integrityErr(KindKeyWrap, object.UUID, "malformed key")
+	}
+	return wrap, nil
+}
+
+// Reads from leaf up to the AccessToken. wraps are the KeyWraps it read, the one that
+// failed included.
+func leafToken(ctx context.Context, cache *sessionCache, fileInfoUUID uuid.UUID, leaf *KeyLeaf) (token []byte, wraps []uuid.UUID, err error) {
+	key, position := leaf.Key, leaf.Index
+	if len(key) != 16 || position < 0 {
+		return nil, nil, integrityErr(KindCertificate, uuid.Nil, "malformed key tree leaf")
+	}
+	for level := 0; level < maxKeyTreeHeight; level++ {
+		wraps = append(wraps, keyWrapObject(fileInfoUUID, level, position).UUID)
+		wrap, err := loadKeyWrap(ctx, cache, fileInfoUUID, level, position, key)
+		if err != nil {
+			return nil, wraps, err
+		}
+		if wrap.Root {
+			return wrap.Key, wraps, nil
+		}
+		key, position = wrap.Key, position/2
+	}
+	return nil, wraps, integrityErr(KindKeyWrap, wraps[len(wraps)-1], "key tree too tall")
+}
+
+// The AccessToken of the file cert is for, from the key tree if the file has one
+func (cert *Certificates) fileToken(ctx context.Context, cache *sessionCache) (token []byte, err error) {
+	switch {
+	case cert.KeyTree != nil:
+		return keyTree{file: cert.FileInfo, key: cert.KeyTree, cache: cache}.token(ctx)
+	case cert.Leaf != nil:
+		token, _, err = leafToken(ctx, cache, cert.FileInfo, cert.Leaf)
+		return token, err
+	}
+	return cert.AccessToken, nil
+}
+
+// Moves FileInfo from the old AccessToken to the new one
+func (tree keyTree) reseal(ctx context.Context, oldToken []byte, newToken []byte) (err error) {
+	// planting a tree on a file of the first client's that nobody migrated yet is fine
+	fileInfo, err := loadFileInfo(ctx, tree.file, oldToken, false)
+	if err != nil {
+		return err
+	}
+	return storeFileInfo(ctx, tree.file, fileInfo, newToken)
+}
+
+// Hands out a leaf, the invitation that gets it is recorded with assign
+func (tree keyTree) join(ctx context.Context) (leaf *KeyLeaf, err error) {
+	state, err := tree.loadState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var index int
+	if n := len(state.Free); n > 0 {
+		index = state.Free[n-1]
+		state.Free = state.Free[:n-1]
+	} else {
+		if state.Leaves == 1<<state.Height {
+			err = tree.grow(ctx, state)
+			if err != nil {
+				return nil, err
+			}
+		}
+		index = state.Leaves
+	}
+	leaf = &KeyLeaf{Index: index, Key: userlib.RandomBytes(16)}
+	err = tree.storeNode(ctx, 0, index, &KeyNode{Key: leaf.Key})
+	if err != nil {
+		return nil, err
+	}
+	// wrap it, and the nodes above it that this is the first leaf under
+	key := leaf.Key
+	for level := 1; level <= state.Height; level++ {
+		position := index >> level
+		parentKey, existed := state.Root, true
+		if level < state.Height {
+			if state.holds(level, position) {
+				node, err := tree.loadNode(ctx, level, position)
+				if err != nil {
+					return nil, err
+				}
+				parentKey = node.Key
+			} else {
+				parentKey, existed = userlib.RandomBytes(16), false
+				err = tree.storeNode(ctx, level, position, &KeyNode{Key: parentKey})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		err = tree.storeWrap(ctx, level-1, index>>(level-1), key, parentKey, level == state.Height)
+		if err != nil {
+			return nil, err
+		}
+		if existed {
+			break
+		}
+		key = parentKey
+	}
+	if index == state.Leaves {
+		state.Leaves++
+	}
+	err = tree.storeState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// Puts a new root on top of a full tree, state is written back by the caller
+func (tree keyTree) grow(ctx context.Context, state *KeyTree) (err error) {
+	if state.Height == maxKeyTreeHeight {
+		return wrapErr(ErrInvalid, "file shared with too many users")
+	}
+	oldRoot, newRoot := state.Root, userlib.RandomBytes(16)
+	err = tree.storeNode(ctx, state.Height, 0, &KeyNode{Key: oldRoot})
+	if err != nil {
+		return err
+	}
+	err = tree.storeWrap(ctx, state.Height, 0, oldRoot, newRoot, true)
+	if err != nil {
+		return err
+	}
+	// the old root's children have to keep going up now
+	for position := 0; position < 2; position++ {
+		if !state.holds(state.Height-1, position) {
+			continue
+		}
+		child, err := tree.loadNode(ctx, state.Height-1, position)
+		if err != nil {
+			return err
+		}
+		err = tree.storeWrap(ctx, state.Height-1, position, child.Key, oldRoot, false)
+		if err != nil {
+			return err
+		}
+	}
+	err = tree.reseal(ctx, oldRoot, newRoot)
+	if err != nil {
+		return err
+	}
+	state.Height++
+	state.Root = newRoot
+	return nil
+}
+
+// Records that leaf went to the invitation at certUUID, so it can be revoked
+func (tree keyTree) assign(ctx context.Context, certUUID uuid.UUID, leaf *KeyLeaf) (err error) {
+	object, err := tree.memberObject(certUUID)
+	if err != nil {
+		return err
+	}
+	err = tree.cache.store(ctx, object, tree.key, &KeyMember{Leaf: leaf.Index})
+	if err != nil {
+		return err
+	}
+	return tree.storeNode(ctx, 0, leaf.Index, &KeyNode{Key: leaf.Key, Certificate: certUUID})
+}
+
+// Takes the leaf of the invitation at certUUID out of the tree
+func (tree keyTree) revoke(ctx context.Context, certUUID uuid.UUID) (err error) {
+	object, err := tree.memberObject(certUUID)
+	if err != nil {
+		return err
+	}
+	var member KeyMember
+	err = tree.cache.load(ctx, object, tree.key, &member)
+	if err != nil {
+		return err
+	}
+	err = tree.leave(ctx, member.Leaf)
+	if err != nil {
+		return err
+	}
+	return datastoreDelete(ctx, object.UUID)
+}
+
+// Gives everything above the leaf at index a new key, the new root becomes the AccessToken
+func (tree keyTree) leave(ctx context.Context, index int) (err error) {
+	state, err := tree.loadState(ctx)
+	if err != nil {
+		return err
+	}
+	if !state.holds(0, index) {
+		object, _ := tree.stateObject()
+		return integrityErr(KindKeyTree, object.UUID, fmt.Sprintf("leaf %d isn't handed out", index))
+	}
+	keys := make([][]byte, state.Height+1)
+	for level := 1; level <= state.Height; level++ {
+		keys[level] = userlib.RandomBytes(16)
+	}
+	// our copies first, then the wraps from the top down, so nobody finds a new key
+	// before there's a way up from it
+	for level := 1; level < state.Height; level++ {
+		err = tree.storeNode(ctx, level, index>>level, &KeyNode{Key: keys[level]})
+		if err != nil {
+			return err
+		}
+	}
+	for level := state.Height; level >= 1; level-- {
+		for child := 2 * (index >> level); child <= 2*(index>>level)+1; child++ {
+			var childKey []byte
+			switch {
+			case child == index>>(level-1) && level == 1:
+				continue // the leaf that's leaving
+			case child == index>>(level-1):
+				childKey = keys[level-1]
+			case !state.holds(level-1, child):
+				continue
+			default:
+				node, err := tree.loadNode(ctx, level-1, child)
+				if err != nil {
+					return err
+				}
+				childKey = node.Key
+			}
+			err = tree.storeWrap(ctx, level-1, child, childKey, keys[level], level == state.Height)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	leafObject, err := tree.nodeObject(0, index)
+	if err != nil {
+		return err
+	}
+	for _, id := range []uuid.UUID{keyWrapObject(tree.file, 0, index).UUID, leafObject.UUID} {
+		err = datastoreDelete(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	err = tree.reseal(ctx, state.Root, keys[state.Height])
+	if err != nil {
+		return err
+	}
+	state.Free = append(state.Free, index)
+	state.Root = keys[state.Height]
+	return tree.storeState(ctx, state)
+}
+
+// Moves a file from before key trees onto one, with a leaf for each of recipients. cert
+// is the owner's certificate, it has to be written back for the tree to count.
+func (userdata *User) plantKeyTree(ctx context.Context, cert *Certificates, recipients map[string]uuid.UUID) (err error) {
+	tree, keys, err := createKeyTree(ctx, userdata.cache, cert.FileInfo, len(recipients))
+	if err != nil {
+		return err
+	}
+	usernames := make([]string, 0, len(recipients))
+	for username := range recipients {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		leaf, err := tree.join(ctx)
+		if err != nil {
+			return err
+		}
+		err = tree.assign(ctx, recipients[username], leaf)
+		if err != nil {
+			return err
+		}
+		err = userdata.grantLeaf(ctx, username, recipients[username], cert.FileInfo, leaf)
+		if err != nil {
+			return err
+		}
+	}
+	err = tree.reseal(ctx, cert.AccessToken, keys.Root)
+	if err != nil {
+		return err
+	}
+	cert.AccessToken = nil
+	cert.KeyTree = tree.key
+	return nil
+}
+
+// Where the LeafGrant sender leaves for recipient's certificate at certUUID is, with the
+// UUIDs of its wrapped key and signature
+func leafGrantObject(sender string, recipient string, certUUID uuid.UUID, fileInfoUUID uuid.UUID) (object sealContext, keyUUID uuid.UUID, signatureUUID uuid.UUID, err error) {
+	grantHash := userlib.Hash([]byte("leaf grant " + certUUID.String()))
+	grantUUID, _ := uuid.FromBytes(grantHash[:16])
+	signatureHash := userlib.Hash([]byte("leaf grant signature " + certUUID.String()))
+	signatureUUID, _ = uuid.FromBytes(signatureHash[:16])
+	keyUUID, err = getCertStructKeyUUID(sender, recipient, grantUUID)
+	if err != nil {
+		return sealContext{}, uuid.Nil, uuid.Nil, err
+	}
+	return sealContext{Kind: KindLeafGrant, UUID: grantUUID, File: fileInfoUUID}, keyUUID, signatureUUID, nil
+}
+
+// Leaves recipient leaf for their certificate at certUUID, sealed under a key only they
+// can unwrap and signed by us
+func (userdata *User) grantLeaf(ctx context.Context, recipient string, certUUID uuid.UUID, fileInfoUUID uuid.UUID, leaf *KeyLeaf) (err error) {
+	object, keyUUID, signatureUUID, err := leafGrantObject(userdata.Username, recipient, certUUID, fileInfoUUID)
+	if err != nil {
+		return err
+	}
+	symKey := userlib.RandomBytes(16)
+	encSymKey, keySig, err := userdata.wrapKey(ctx, recipient, symKey)
+	if err != nil {
+		return err
+	}
+	err = datastoreSetEnvelope(ctx, KindCertKey, SuiteRSAOAEP, keyUUID, encSymKey)
+	if err != nil {
+		return err
+	}
+	err = datastoreSetEnvelope(ctx, KindSignature, SuiteRSASign, signatureUUID, keySig)
+	if err != nil {
+		return err
+	}
+	return storeSealed(ctx, object, symKey, &LeafGrant{Leaf: leaf})
+}
+
+// The leaf sender granted us for our certificate at certPtr, nil if they haven't
+func (userdata *User) loadLeafGrant(ctx context.Context, sender string, certPtr uuid.UUID, fileInfoUUID uuid.UUID) (leaf *KeyLeaf, err error) {
+	object, _, signatureUUID, err := leafGrantObject(sender, userdata.Username, certPtr, fileInfoUUID)
+	if err != nil {
+		return nil, err
+	}
+	sealed, exists, err := datastoreGet(ctx, object.UUID)
+	if err != nil || !exists {
+		return nil, err
+	}
+	encSymKey, symKey, err := loadCertKey(ctx, sender, userdata.Username, object.UUID, userdata.DecryptKey)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyKeySignature(ctx, sender, encSymKey, signatureUUID)
+	if err != nil {
+		return nil, err
+	}
+	var grant LeafGrant
+	err = openStruct(object, symKey, sealed, &grant)
+	if err != nil {
+		return nil, err
+	}
+	if grant.Leaf == nil {
+		return nil, integrityErr(KindLeafGrant, object.UUID, "no leaf")
+	}
+	return grant.Leaf, nil
+}
+
+// Moves our certificate at certPtr, sealed under symKey, onto the leaf sender granted us,
+// after granting it on to everyone we shared the file with
+func (userdata *User) takeLeafGrant(ctx context.Context, sender string, certPtr uuid.UUID, symKey []byte, cert *Certificates, leaf *KeyLeaf) (err error) {
+	usernames := make([]string, 0, len(cert.Recipients))
+	for username := range cert.Recipients {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		err = userdata.grantLeaf(ctx, username, cert.Recipients[username], cert.FileInfo, leaf)
+		if err != nil {
+			return err
+		}
+	}
+	cert.AccessToken = nil
+	cert.Leaf = leaf
+	err = storeSealed(ctx, sealContext{Kind: KindCertificate, UUID: certPtr}, symKey, cert)
+	if err != nil {
+		return err
+	}
+	object, keyUUID, signatureUUID, err := leafGrantObject(sender, userdata.Username, certPtr, cert.FileInfo)
+	if err != nil {
+		return err
+	}
+	for _, id := range []uuid.UUID{object.UUID, keyUUID, signatureUUID} {
+		err = datastoreDelete(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls visit with every object of the tree as it's checked, top down. The KeyWraps are
+// checked to hold their parent's key. visit returning false skips what's under the object.
+func (tree keyTree) walk(ctx context.Context, visit func(kind ObjectKind, id uuid.UUID, err error) bool) {
+	object, err := tree.stateObject()
+	if err != nil {
+		return
+	}
+	state, err := tree.loadState(ctx)
+	if !visit(KindKeyTree, object.UUID, err) {
+		return
+	}
+	parents := map[int][]byte{0: state.Root}
+	for level := state.Height - 1; level >= 0; level-- {
+		keys := make(map[int][]byte)
+		for position := 0; position<<level < state.Leaves; position++ {
+			if !state.holds(level, position) {
+				continue
+			}
+			object, err := tree.nodeObject(level, position)
+			if err != nil {
+				return
+			}
+			node, err := tree.loadNode(ctx, level, position)
+			if !visit(KindKeyNode, object.UUID, err) {
+				continue
+			}
+			keys[position] = node.Key
+			wrapObject := keyWrapObject(tree.file, level, position)
+			wrap, err := loadKeyWrap(ctx, tree.cache, tree.file, level, position, node.Key)
+			parentKey, checked := parents[position/2]
+			if err == nil && (checked && !userlib.HMACEqual(wrap.Key, parentKey) || wrap.Root != (level == state.Height-1)) {
+				err = integrityErr(KindKeyWrap, wrapObject.UUID, "doesn't lead to the root")
+			}
+			visit(KindKeyWrap, wrapObject.UUID, err)
+			if level == 0 && node.Certificate != uuid.Nil {
+				memberObject, err := tree.memberObject(node.Certificate)
+				if err != nil {
+					return
+				}
+				var member KeyMember
+				err = tree.cache.load(ctx, memberObject, tree.key, &member)
+				if err == nil && member.Leaf != position {
+					err = integrityErr(KindKeyMember, memberObject.UUID, "wrong leaf")
+				}
+				visit(KindKeyMember, memberObject.UUID, err)
+			}
+		}
+		parents = keys
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Revoking one recipient of a file shared with n, what it writes should grow with the
+// tree's height and not with n:
+//
+//	go test ./client -bench KeyTree -run xxx
+func BenchmarkKeyTreeRevoke(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("recipients=%d", n), func(b *testing.B) {
+			ctx := context.Background()
+			fileInfoUUID := uuid.New()
+			tree, state, err := createKeyTree(ctx, nil, fileInfoUUID, 2)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = storeFileInfo(ctx, fileInfoUUID, &FileInfo{}, state.Root)
+			if err != nil {
+				b.Fatal(err)
+			}
+			join := func() uuid.UUID {
+				leaf, err := tree.join(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				certUUID := uuid.New()
+				err = tree.assign(ctx, certUUID, leaf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				return certUUID
+			}
+			members := make([]uuid.UUID, n)
+			for i := range members {
+				members[i] = join()
+			}
+
+			var writes, pke int
+			observer := ObserverFunc(func(stats OpStats) {
+				writes += stats.DatastoreSets
+				pke += stats.CryptoOps[CryptoPKE]
+			})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a different member every time, and someone takes their place
+				at := i % n
+				done := observe(observer, OpRevokeAccess, "owner")
+				err = tree.revoke(ctx, members[at])
+				done(&err)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				members[at] = join()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+			b.ReportMetric(float64(pke)/float64(b.N), "pke/op")
+		})
+	}
+}
+
+// RevokeAccess from start to end, with the revocation notice, the key rotation and the
+// owner's certificate on top of the tree. Its writes should grow with the tree's height
+// and not with n either:
+//
+//	go test ./client -bench RevokeAccess -run xxx
+func BenchmarkRevokeAccess(b *testing.B) {
+	for _, n := range []int{4, 16, 64, 256} {
+		b.Run(fmt.Sprintf("recipients=%d", n), func(b *testing.B) {
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			owner, err := InitUser("owner", "owner password")
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = owner.StoreFile("shared.txt", []byte("shared with everyone"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			share := func(recipient *User, filename string) {
+				invitation, err := owner.CreateInvitation("shared.txt", recipient.Username)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = recipient.AcceptInvitation("owner", invitation, filename)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			recipients := make([]*User, n)
+			for i := range recipients {
+				recipients[i], err = InitUser(fmt.Sprintf("recipient%d", i), "recipient password")
+				if err != nil {
+					b.Fatal(err)
+				}
+				share(recipients[i], "shared.txt")
+			}
+
+			var writes, written int
+			owner.SetObserver(ObserverFunc(func(stats OpStats) {
+				if stats.Op == OpRevokeAccess {
+					writes += stats.DatastoreSets
+					written += stats.BytesWritten
+				}
+			}))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a different recipient every time, and they're invited back
+				recipient := recipients[i%n]
+				err = owner.RevokeAccess("shared.txt", recipient.Username)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				share(recipient, fmt.Sprintf("shared-%d.txt", i))
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+			b.ReportMetric(float64(written)/float64(b.N), "bytes-written/op")
+		})
+	}
+}
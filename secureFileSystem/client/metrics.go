@@ -0,0 +1,187 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Op names a public client call in OpStats.
+type Op string
+
+const (
+	OpInitUser         Op = "InitUser"
+	OpGetUser          Op = "GetUser"
+	OpStoreFile        Op = "StoreFile"
+	OpAppendToFile     Op = "AppendToFile"
+	OpLoadFile         Op = "LoadFile"
+	OpCreateInvitation Op = "CreateInvitation"
+	OpAcceptInvitation Op = "AcceptInvitation"
+	OpRevokeAccess     Op = "RevokeAccess"
+	OpCommit           Op = "Commit" // of a transaction, see tx.go
+)
+
+// CryptoPrimitive groups the userlib calls OpStats counts.
+type CryptoPrimitive string
+
+const (
+	CryptoKeyGen       CryptoPrimitive = "keygen"        // PKEKeyGen, DSKeyGen
+	CryptoPKE          CryptoPrimitive = "pke"           // PKEEnc, PKEDec
+	CryptoSignature    CryptoPrimitive = "signature"     // DSSign, DSVerify
+	CryptoSymmetric    CryptoPrimitive = "symmetric"     // SymEnc, SymDec
+	CryptoMAC          CryptoPrimitive = "mac"           // HMACEval
+	CryptoKDF          CryptoPrimitive = "kdf"           // HashKDF
+	CryptoPasswordHash CryptoPrimitive = "password-hash" // Argon2Key
+)
+
+// OpStats is what one public call cost. Has counts as a Datastore get that moved no bytes,
+// it's a round trip all the same, Digest as one that read the digest, and a GetMany as one
+// get however many keys it asked for. Values that were prefetched count when they arrive, not when they're used.
+type OpStats struct {
+	Op       Op
+	Username string
+	Err      error // what the call returned
+	Duration time.Duration
+
+	DatastoreGets    int
+	DatastoreSets    int
+	DatastoreDeletes int
+	KeystoreGets     int
+	KeystoreSets     int
+	BytesRead        int // Datastore values returned by gets
+	BytesWritten     int // Datastore values sent by sets
+	CryptoOps        map[CryptoPrimitive]int
+}
+
+// RoundTrips returns how many requests the call sent to the Datastore and Keystore.
+func (stats *OpStats) RoundTrips() int {
+	return stats.DatastoreGets + stats.DatastoreSets + stats.DatastoreDeletes + stats.KeystoreGets + stats.KeystoreSets
+}
+
+// Observer is told about every public call once it returns. Observe is called on
+// the goroutine that made the call, so it should be quick.
+type Observer interface {
+	Observe(stats OpStats)
+}
+
+// ObserverFunc lets a plain function be an Observer.
+type ObserverFunc func(stats OpStats)
+
+func (f ObserverFunc) Observe(stats OpStats) {
+	f(stats)
+}
+
+var defaultObserver Observer
+
+// SetObserver sets the Observer InitUser and GetUser report to, and that the handles
+// they return start out with. nil turns it off. It isn't safe to call while other calls
+// are in flight.
+func SetObserver(observer Observer) {
+	defaultObserver = observer
+}
+
+// SetObserver replaces the Observer for calls made on this handle, nil turns it off.
+func (userdata *User) SetObserver(observer Observer) {
+	userdata.observer = observer
+}
+
+// The call being observed right now. Calls aren't told apart by goroutine, so if
+// observed calls overlap each one also counts what the others did in the meantime.
+var (
+	recordingMu sync.Mutex
+	recording   *OpStats
+)
+
+// Starts recording op for observer, the returned function reports it with whatever
+// *errp holds by then. Meant to be deferred:
+//
+//	defer observe(userdata.observer, OpLoadFile, userdata.Username)(&err)
+func observe(observer Observer, op Op, username string) func(errp *error) {
+	if observer == nil {
+		return func(*error) {}
+	}
+	stats := &OpStats{Op: op, Username: username, CryptoOps: make(map[CryptoPrimitive]int)}
+	recordingMu.Lock()
+	previous := recording
+	recording = stats
+	recordingMu.Unlock()
+	start := time.Now()
+	return func(errp *error) {
+		recordingMu.Lock()
+		recording = previous
+		recordingMu.Unlock()
+		stats.Duration = time.Since(start)
+		stats.Err = *errp
+		observer.Observe(*stats)
+	}
+}
+
+func record(update func(stats *OpStats)) {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	if recording != nil {
+		update(recording)
+	}
+}
+
+func countCrypto(primitive CryptoPrimitive) {
+	record(func(stats *OpStats) { stats.CryptoOps[primitive]++ })
+}
+
+// The userlib primitives, counted
+
+func pkeKeyGen() (userlib.PKEEncKey, userlib.PKEDecKey, error) {
+	countCrypto(CryptoKeyGen)
+	return userlib.PKEKeyGen()
+}
+
+func dsKeyGen() (userlib.DSSignKey, userlib.DSVerifyKey, error) {
+	countCrypto(CryptoKeyGen)
+	return userlib.DSKeyGen()
+}
+
+func pkeEnc(key userlib.PKEEncKey, plaintext []byte) ([]byte, error) {
+	countCrypto(CryptoPKE)
+	return userlib.PKEEnc(key, plaintext)
+}
+
+func pkeDec(key userlib.PKEDecKey, ciphertext []byte) ([]byte, error) {
+	countCrypto(CryptoPKE)
+	return userlib.PKEDec(key, ciphertext)
+}
+
+func dsSign(key userlib.DSSignKey, msg []byte) ([]byte, error) {
+	countCrypto(CryptoSignature)
+	return userlib.DSSign(key, msg)
+}
+
+func dsVerify(key userlib.DSVerifyKey, msg []byte, sig []byte) error {
+	countCrypto(CryptoSignature)
+	return userlib.DSVerify(key, msg, sig)
+}
+
+func symEnc(key []byte, iv []byte, plaintext []byte) []byte {
+	countCrypto(CryptoSymmetric)
+	return userlib.SymEnc(key, iv, plaintext)
+}
+
+func symDec(key []byte, ciphertext []byte) []byte {
+	countCrypto(CryptoSymmetric)
+	return userlib.SymDec(key, ciphertext)
+}
+
+func hmacEval(key []byte, msg []byte) ([]byte, error) {
+	countCrypto(CryptoMAC)
+	return userlib.HMACEval(key, msg)
+}
+
+func hashKDF(key []byte, purpose []byte) ([]byte, error) {
+	countCrypto(CryptoKDF)
+	return userlib.HashKDF(key, purpose)
+}
+
+func argon2Key(password []byte, salt []byte, keyLen uint32) []byte {
+	countCrypto(CryptoPasswordHash)
+	return userlib.Argon2Key(password, salt, keyLen)
+}
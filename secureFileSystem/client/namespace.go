@@ -0,0 +1,380 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Namespace says where an account keeps its files: a B-tree from filename to our
+// certificate and who it's from, and one from certificate UUID back to the filename, see
+// index.go. Accounts from before it keep them in User.Certificates and User.Invites until
+// the first change to the namespace moves them over.
+type Namespace struct {
+	Key   []byte    // seals the index pages
+	Names uuid.UUID // root page of the names tree
+	Certs uuid.UUID // root page of the certificates tree
+}
+
+func (userdata *User) namesTree() indexTree {
+	return indexTree{root: userdata.Namespace.Names, key: userdata.Namespace.Key, cache: userdata.cache}
+}
+
+func (userdata *User) certsTree() indexTree {
+	return indexTree{root: userdata.Namespace.Certs, key: userdata.Namespace.Key, cache: userdata.cache}
+}
+
+// Sets up an empty namespace, the User struct has to be written for it to count
+func (userdata *User) createNamespace(ctx context.Context) (err error) {
+	namespace := &Namespace{Key: userlib.RandomBytes(16), Names: uuid.New(), Certs: uuid.New()}
+	userdata.Namespace = namespace
+	err = userdata.namesTree().create(ctx)
+	if err != nil {
+		return err
+	}
+	return userdata.certsTree().create(ctx)
+}
+
+// Moves an account from before Namespace over to index pages and writes the User struct.
+// userdata should be fresh.
+func (userdata *User) indexNamespace(ctx context.Context) (err error) {
+	if userdata.Namespace != nil {
+		return nil
+	}
+	var filenames []string
+	for filename := range userdata.Certificates {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	err = userdata.createNamespace(ctx)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		sender, exists := userdata.Invites[filename]
+		if !exists {
+			return integrityErr(KindUser, loginUUID(userdata.Username), "certificate without sender")
+		}
+		err = userdata.addFile(ctx, filename, userdata.Certificates[filename], sender)
+		if err != nil {
+			return err
+		}
+	}
+	userdata.Certificates = nil
+	userdata.Invites = nil
+	return userdata.reencryptUser(ctx)
+}
+
+// MAC-checks the root pages of the namespace
+func (userdata *User) checkNamespace(ctx context.Context) (err error) {
+	if userdata.Namespace == nil {
+		return nil
+	}
+	_, err = userdata.namesTree().loadPage(ctx, userdata.Namespace.Names)
+	if err != nil {
+		return err
+	}
+	_, err = userdata.certsTree().loadPage(ctx, userdata.Namespace.Certs)
+	return err
+}
+
+// Our certificate for filename and who it's from
+func (userdata *User) lookupFile(ctx context.Context, filename string) (certUUID uuid.UUID, sender string, found bool, err error) {
+	if userdata.Namespace == nil {
+		certUUID, found = userdata.Certificates[filename]
+		if !found {
+			return uuid.Nil, "", false, nil
+		}
+		sender, exists := userdata.Invites[filename]
+		if !exists {
+			return uuid.Nil, "", false, integrityErr(KindUser, loginUUID(userdata.Username), "certificate without sender")
+		}
+		return certUUID, sender, true, nil
+	}
+	entry, found, err := userdata.namesTree().get(ctx, filename)
+	if err != nil || !found {
+		return uuid.Nil, "", false, err
+	}
+	return entry.Certificate, entry.Sender, true, nil
+}
+
+// Adds filename to the namespace, or points it to another certificate. The certificates
+// tree goes first, an entry there whose name doesn't lead back to it is ignored.
+func (userdata *User) addFile(ctx context.Context, filename string, certUUID uuid.UUID, sender string) (err error) {
+	err = userdata.indexNamespace(ctx)
+	if err != nil {
+		return err
+	}
+	err = userdata.certsTree().put(ctx, certUUID.String(), IndexEntry{Filename: filename})
+	if err != nil {
+		return err
+	}
+	return userdata.namesTree().put(ctx, filename, IndexEntry{Certificate: certUUID, Sender: sender})
+}
+
+// Takes filename out of the namespace
+func (userdata *User) removeFile(ctx context.Context, filename string, certUUID uuid.UUID) (err error) {
+	err = userdata.indexNamespace(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = userdata.namesTree().remove(ctx, filename)
+	if err != nil {
+		return err
+	}
+	_, err = userdata.certsTree().remove(ctx, certUUID.String())
+	return err
+}
+
+// Calls visit with every file in the namespace, sorted by name. visitPage is as for
+// indexTree.walk, and isn't called for accounts from before Namespace.
+func (userdata *User) walkFiles(ctx context.Context, visitPage func(id uuid.UUID, err error) bool, visit func(filename string, certUUID uuid.UUID, sender string) error) (err error) {
+	if userdata.Namespace == nil {
+		filenames := make([]string, 0, len(userdata.Certificates))
+		for filename := range userdata.Certificates {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		for _, filename := range filenames {
+			certUUID, sender, _, err := userdata.lookupFile(ctx, filename)
+			if err != nil {
+				return err
+			}
+			err = visit(filename, certUUID, sender)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return userdata.namesTree().walk(ctx, visitPage, func(filename string, entry IndexEntry) error {
+		return visit(filename, entry.Certificate, entry.Sender)
+	})
+}
+
+// ListFiles returns the names in the user's namespace, sorted.
+func (userdata *User) ListFiles() (filenames []string, err error) {
+	return userdata.ListFilesContext(context.Background())
+}
+
+// ListFilesContext is like ListFiles but gives up once ctx is done, see context.go.
+func (userdata *User) ListFilesContext(ctx context.Context) (filenames []string, err error) {
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filenames = []string{}
+	err = userdata.walkFiles(ctx, nil, func(filename string, certUUID uuid.UUID, sender string) error {
+		filenames = append(filenames, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filenames, nil
+}
+
+// DeleteFile removes filename from the user's namespace. If the user owns the file
+// everyone it was shared with is revoked and the content is deleted from the Datastore,
+// otherwise only this user's name for it goes away and the owner's copy is untouched.
+func (userdata *User) DeleteFile(filename string) error {
+	return userdata.DeleteFileContext(context.Background(), filename)
+}
+
+// DeleteFileContext is like DeleteFile but gives up once ctx is done, see context.go.
+func (userdata *User) DeleteFileContext(ctx context.Context, filename string) (err error) {
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	certUUID, sender, exists, err := userdata.lookupFile(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return wrapErr(ErrNotFound, "file %q", filename)
+	}
+
+	ownInvitations := false
+	if sender == userdata.Username {
+		decCert, err := userdata.certificateDecryption(ctx, "", userdata.Username, filename, certUUID)
+		if err != nil {
+			return err
+		}
+		var cert Certificates
+		err = json.Unmarshal(decCert, &cert)
+		if err != nil {
+			return err
+		}
+		token, err := cert.fileToken(ctx, userdata.cache)
+		if err != nil {
+			return err
+		}
+		fileInfo, err := loadFileInfo(ctx, cert.FileInfo, token, userdata.Migrated)
+		if err != nil {
+			return err
+		}
+
+		// recipients (and everyone they shared with) see ErrRevoked rather than tampering,
+		// and so does anyone trying to accept an invitation we haven't withdrawn
+		ctx, err = commit(ctx)
+		if err != nil {
+			return err
+		}
+		for _, recipientCertUUID := range cert.Recipients {
+			err = userdata.writeRevocationNotice(ctx, recipientCertUUID)
+			if err != nil {
+				return err
+			}
+		}
+		for invitationUUID, invitation := range userdata.Invitations {
+			if invitation.Filename != filename {
+				continue
+			}
+			err = userdata.writeRevocationNotice(ctx, invitationUUID)
+			if err != nil {
+				return err
+			}
+			delete(userdata.Invitations, invitationUUID)
+			ownInvitations = true
+		}
+
+		// the chain, then the FileInfo and our own certificate
+		var doomed []uuid.UUID
+		currUUID := fileInfo.StartAppend
+		for currUUID != uuid.Nil {
+			block, err := loadAppendBlock(ctx, cert.FileInfo, currUUID, fileInfo)
+			if err != nil {
+				return err
+			}
+			doomed = append(doomed, currUUID, block.FileData)
+			currUUID = block.NextAppend
+		}
+		keyUUID, err := getCertStructKeyUUID(userdata.Username, userdata.Username, certUUID)
+		if err != nil {
+			return err
+		}
+		if cert.KeyTree != nil {
+			userdata.keyTree(&cert).walk(ctx, func(kind ObjectKind, id uuid.UUID, err error) bool {
+				doomed = append(doomed, id)
+				return err == nil
+			})
+		}
+		doomed = append(doomed, cert.FileInfo, certUUID, keyUUID, cert.SignatureUUID)
+		for _, id := range doomed {
+			err = datastoreDelete(ctx, id)
+			if err != nil {
+				return err
+			}
+		}
+		// and its content doesn't count against our quota anymore
+		if fileInfo.Ledger != nil {
+			ledger, err := userdata.loadLedger(ctx, fileInfo.Ledger)
+			if err != nil {
+				return err
+			}
+			ledger.Used -= fileInfo.Size
+			err = userdata.storeLedger(ctx, ledger)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ctx, err = commit(ctx)
+	if err != nil {
+		return err
+	}
+	err = userdata.removeFile(ctx, filename, certUUID)
+	if err != nil {
+		return err
+	}
+	if ownInvitations {
+		return userdata.reencryptUser(ctx)
+	}
+	return nil
+}
+
+// RenameFile moves a file to a new name in the user's namespace. Nobody else's name
+// for the file changes, and invitations to it can still be accepted.
+func (userdata *User) RenameFile(oldname string, newname string) error {
+	return userdata.RenameFileContext(context.Background(), oldname, newname)
+}
+
+// RenameFileContext is like RenameFile but gives up once ctx is done, see context.go.
+func (userdata *User) RenameFileContext(ctx context.Context, oldname string, newname string) (err error) {
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	certUUID, sender, exists, err := userdata.lookupFile(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return wrapErr(ErrNotFound, "file %q", oldname)
+	}
+	if oldname == newname {
+		return nil
+	}
+	_, _, exists, err = userdata.lookupFile(ctx, newname)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return wrapErr(ErrExists, "file %q", newname)
+	}
+	ctx, err = commit(ctx)
+	if err != nil {
+		return err
+	}
+	err = userdata.addFile(ctx, newname, certUUID, sender)
+	if err != nil {
+		return err
+	}
+	_, err = userdata.namesTree().remove(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	renamed := false
+	for invitationUUID, invitation := range userdata.Invitations {
+		if invitation.Filename == oldname {
+			invitation.Filename = newname
+			userdata.Invitations[invitationUUID] = invitation
+			renamed = true
+		}
+	}
+	if renamed {
+		return userdata.reencryptUser(ctx)
+	}
+	return nil
+}
+
+// name the user gave the file behind certUUID
+func (userdata *User) filenameOf(ctx context.Context, certUUID uuid.UUID) (filename string, found bool, err error) {
+	if userdata.Namespace == nil {
+		for filename, id := range userdata.Certificates {
+			if id == certUUID {
+				return filename, true, nil
+			}
+		}
+		return "", false, nil
+	}
+	entry, found, err := userdata.certsTree().get(ctx, certUUID.String())
+	if err != nil || !found {
+		return "", false, err
+	}
+	// left over from a name we didn't get to finish adding, or removing
+	id, _, found, err := userdata.lookupFile(ctx, entry.Filename)
+	if err != nil || !found || id != certUUID {
+		return "", false, err
+	}
+	return entry.Filename, true, nil
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"math/bits"
+
+	"github.com/google/uuid"
+)
+
+// PaddingMode says how stored content is rounded up before it's encrypted, so whoever
+// runs the Datastore only learns a bucket instead of the exact size of every write.
+type PaddingMode int
+
+const (
+	PadNone       PaddingMode = iota // exact sizes, the default
+	PadPowerOfTwo                    // round up to the next power of two
+	PadBlock                         // round up to a multiple of BlockSize
+)
+
+// MaxPaddingBlockSize is the largest BlockSize PadBlock accepts.
+const MaxPaddingBlockSize = 1 << 20
+
+// PaddingPolicy is set per account with SetPadding and per file with SetFilePadding,
+// a file's policy wins over the account default of whoever writes to it. It only
+// applies to content written after it's set. It's stored inside the AppendData it was
+// applied to, so it's covered by the MAC and the padded length is checked on load.
+//
+// Chunks get padded too, but one this account already stored keeps the length it was
+// first stored with since it's reused as is.
+type PaddingPolicy struct {
+	Mode      PaddingMode
+	BlockSize int // only for PadBlock
+}
+
+func (policy PaddingPolicy) validate() error {
+	switch policy.Mode {
+	case PadNone, PadPowerOfTwo:
+		return nil
+	case PadBlock:
+		if policy.BlockSize <= 0 || policy.BlockSize > MaxPaddingBlockSize {
+			return wrapErr(ErrInvalid, "padding block size %d", policy.BlockSize)
+		}
+		return nil
+	default:
+		return wrapErr(ErrInvalid, "padding mode %d", policy.Mode)
+	}
+}
+
+// length n is padded to
+func (policy PaddingPolicy) paddedLen(n int) int {
+	switch policy.Mode {
+	case PadPowerOfTwo:
+		if n <= 1 {
+			return n
+		}
+		return 1 << bits.Len(uint(n-1))
+	case PadBlock:
+		if policy.BlockSize <= 0 {
+			return n
+		}
+		return (n + policy.BlockSize - 1) / policy.BlockSize * policy.BlockSize
+	default:
+		return n
+	}
+}
+
+// pads b with filler bytes up to the policy's length
+func (policy PaddingPolicy) pad(b []byte, filler byte) []byte {
+	padded := make([]byte, policy.paddedLen(len(b)))
+	copy(padded, b)
+	for i := len(b); i < len(padded); i++ {
+		padded[i] = filler
+	}
+	return padded
+}
+
+// SetPadding sets the account's default padding policy. Other sessions that are already
+// logged in keep using the old one until they log in again.
+func (userdata *User) SetPadding(policy PaddingPolicy) error {
+	return userdata.SetPaddingContext(context.Background(), policy)
+}
+
+// SetPaddingContext is like SetPadding but gives up once ctx is done, see context.go.
+func (userdata *User) SetPaddingContext(ctx context.Context, policy PaddingPolicy) error {
+	err := policy.validate()
+	if err != nil {
+		return err
+	}
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	userdata.Padding = policy
+	return userdata.reencryptUser(ctx)
+}
+
+// SetFilePadding sets the padding policy for everyone writing to filename, nil goes back
+// to each writer's account default. Anyone the file is shared with can change it.
+func (userdata *User) SetFilePadding(filename string, policy *PaddingPolicy) error {
+	return userdata.SetFilePaddingContext(context.Background(), filename, policy)
+}
+
+// SetFilePaddingContext is like SetFilePadding but gives up once ctx is done, see context.go.
+func (userdata *User) SetFilePaddingContext(ctx context.Context, filename string, policy *PaddingPolicy) error {
+	if policy != nil {
+		err := policy.validate()
+		if err != nil {
+			return err
+		}
+	}
+	fileInfo, certificate, err := userdata.nameToFileInfo(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if fileInfo == nil {
+		return wrapErr(ErrNotFound, "file %q", filename)
+	}
+	fileInfo.Padding = policy
+	return storeFileInfo(ctx, certificate.FileInfo, fileInfo, certificate.token)
+}
+
+// the policy for writing to fileInfo, nil for a file that doesn't exist yet
+func (userdata *User) paddingFor(fileInfo *FileInfo) PaddingPolicy {
+	if fileInfo != nil && fileInfo.Padding != nil {
+		return *fileInfo.Padding
+	}
+	return userdata.Padding
+}
+
+// An AppendData is padded with spaces after the struct, which is still valid JSON. The
+// policy is inside the MAC, so the length has to be exactly what it says. The struct is
+// measured as it was stored, re-marshalling it would give another length once it was
+// migrated from an older schema or if it was stored in the other encoding.
+func checkAppendDataPadding(dataUUID uuid.UUID, appendData *AppendData, marshalledLen int, plaintextLen int) error {
+	if plaintextLen != appendData.Padding.paddedLen(marshalledLen) {
+		return integrityErr(KindAppendData, dataUUID, "padding doesn't match policy")
+	}
+	return nil
+}
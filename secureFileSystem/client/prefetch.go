@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Following an append chain one AppendBlock and AppendData at a time takes two round
+// trips per append. So chains are laid out in runs of blocksPerRun blocks: the first
+// block of a run, its index block, carries a random RunSeed, and the UUIDs of every
+// block of the run and of their AppendData are derived from it (runSlot). Blocks still
+// point to the next one and that's what readers follow, the seed only tells them what
+// they're about to need. Chains from before there were runs read the same way, just
+// without the read-ahead, and their next append starts a run.
+//
+// When readChain reaches an index block it asks for the rest of the run, and for the
+// chunks of each AppendData once that's open, with GetMany in batches of prefetchBatch
+// keys, at most prefetchInFlight batches outstanding. Prefetched values are MAC checked
+// when they're used like anything else, a value that isn't there or doesn't check out is
+// no different from one read directly.
+const (
+	blocksPerRun     = 16
+	prefetchBatch    = 64
+	prefetchInFlight = 4
+)
+
+// UUIDs of the n-th block of the run with seed and of its AppendData
+func runSlot(seed []byte, n int) (blockUUID uuid.UUID, dataUUID uuid.UUID, err error) {
+	derived, err := hashKDF(seed, []byte(fmt.Sprintf("run slot %d", n)))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	blockUUID, err = uuid.FromBytes(derived[:16])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	dataUUID, err = uuid.FromBytes(derived[16:32])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	return blockUUID, dataUUID, nil
+}
+
+// Picks the UUIDs for the next block of the file and its AppendData, starting a new
+// run if the current one is full or there is none. indexSeed is what goes in the block
+// if it's the first of its run. fileInfo has to be written back for the slot to count.
+//
+// Two appends that both get past the conflict check end up in the same slot and the
+// last one wins, the same append is lost as when blocks went to random UUIDs.
+func (fileInfo *FileInfo) nextSlot() (blockUUID uuid.UUID, dataUUID uuid.UUID, indexSeed []byte, err error) {
+	if len(fileInfo.RunSeed) != 16 || fileInfo.RunLength < 0 || fileInfo.RunLength >= blocksPerRun {
+		fileInfo.RunSeed = userlib.RandomBytes(16)
+		fileInfo.RunLength = 0
+	}
+	if fileInfo.RunLength == 0 {
+		indexSeed = fileInfo.RunSeed
+	}
+	blockUUID, dataUUID, err = runSlot(fileInfo.RunSeed, fileInfo.RunLength)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, nil, err
+	}
+	fileInfo.RunLength++
+	return blockUUID, dataUUID, indexSeed, nil
+}
+
+// Appends link their block in first and write FileInfo after, so blocks past EndAppend
+// are appends that died in between or haven't got there yet. catchUp moves EndAppend,
+// the run and Size past them, the Ledger stays as it is until Usage counts it again.
+// Returns the block that really is the end.
+func (fileInfo *FileInfo) catchUp(ctx context.Context, fileInfoUUID uuid.UUID, endUUID uuid.UUID, end *AppendBlock) (realEndUUID uuid.UUID, realEnd *AppendBlock, err error) {
+	seen := map[uuid.UUID]bool{endUUID: true}
+	for end.NextAppend != uuid.Nil {
+		nextUUID := end.NextAppend
+		if seen[nextUUID] {
+			return uuid.Nil, nil, integrityErr(KindAppendBlock, nextUUID, "append chain loops")
+		}
+		seen[nextUUID] = true
+		next, err := loadAppendBlock(ctx, fileInfoUUID, nextUUID, fileInfo)
+		if err != nil {
+			return uuid.Nil, nil, err
+		}
+		inRun := false
+		if len(next.RunSeed) == 16 {
+			fileInfo.RunSeed = next.RunSeed
+			fileInfo.RunLength = 0
+			inRun = true
+		} else if len(fileInfo.RunSeed) == 16 && fileInfo.RunLength > 0 && fileInfo.RunLength < blocksPerRun {
+			slot, _, err := runSlot(fileInfo.RunSeed, fileInfo.RunLength)
+			if err != nil {
+				return uuid.Nil, nil, err
+			}
+			inRun = slot == nextUUID
+		}
+		if inRun {
+			fileInfo.RunLength++
+		} else {
+			// not where the run goes on, the next append starts a new one
+			fileInfo.RunLength = blocksPerRun
+		}
+		if fileInfo.Ledger != nil {
+			data, err := loadAppendData(ctx, fileInfoUUID, next.FileData, fileInfo)
+			if err != nil {
+				return uuid.Nil, nil, err
+			}
+			size, err := dataSize(next, data)
+			if err != nil {
+				return uuid.Nil, nil, err
+			}
+			fileInfo.Size += size
+		}
+		fileInfo.EndAppend = nextUUID
+		endUUID, end = nextUUID, next
+	}
+	return endUUID, end, nil
+}
+
+// Calls visit with every AppendBlock of the file and its AppendData, in order, each
+// one MAC checked. Reads ahead if the backend is a BatchDatastore.
+func readChain(ctx context.Context, fileInfoUUID uuid.UUID, fileInfo *FileInfo, visit func(ctx context.Context, block *AppendBlock, data *AppendData) error) (err error) {
+	prefetch, ctx := newPrefetcher(ctx)
+	defer prefetch.close()
+	for currUUID := fileInfo.StartAppend; currUUID != uuid.Nil; {
+		block, err := loadAppendBlock(ctx, fileInfoUUID, currUUID, fileInfo)
+		if err != nil {
+			return err
+		}
+		if prefetch != nil && len(block.RunSeed) == 16 {
+			// the last run is only as long as FileInfo says
+			length := blocksPerRun
+			if bytes.Equal(block.RunSeed, fileInfo.RunSeed) && fileInfo.RunLength < length {
+				length = fileInfo.RunLength
+			}
+			var keys []uuid.UUID
+			for n := 0; n < length; n++ {
+				blockUUID, dataUUID, err := runSlot(block.RunSeed, n)
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					keys = append(keys, blockUUID)
+				}
+				keys = append(keys, dataUUID)
+			}
+			prefetch.start(keys)
+		}
+		data, err := loadAppendData(ctx, fileInfoUUID, block.FileData, fileInfo)
+		if err != nil {
+			return err
+		}
+		if prefetch != nil && len(data.Chunks) > 0 {
+			keys := make([]uuid.UUID, len(data.Chunks))
+			for i, ref := range data.Chunks {
+				keys[i] = ref.UUID
+			}
+			prefetch.start(keys)
+		}
+		err = visit(ctx, block, data)
+		if err != nil {
+			return err
+		}
+		currUUID = block.NextAppend
+	}
+	return nil
+}
+
+// prefetcher holds the batches started for one call. It travels in the call's context,
+// where datastoreGet looks for it.
+type prefetcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{} // one per batch in flight
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	fetches map[uuid.UUID]*prefetch
+}
+
+type prefetch struct {
+	done  chan struct{}
+	value []byte
+	ok    bool
+}
+
+type prefetcherKey struct{}
+
+// A prefetcher and a context carrying it, or nil and ctx if the backend can't batch.
+// close has to be called before the call returns, so nothing it started outlives it.
+func newPrefetcher(ctx context.Context) (p *prefetcher, withPrefetch context.Context) {
+	if _, supported := datastore.(BatchDatastore); !supported {
+		return nil, ctx
+	}
+	p = &prefetcher{slots: make(chan struct{}, prefetchInFlight), fetches: make(map[uuid.UUID]*prefetch)}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	return p, context.WithValue(ctx, prefetcherKey{}, p)
+}
+
+// Starts fetching whichever of keys haven't been asked for yet
+func (p *prefetcher) start(keys []uuid.UUID) {
+	var batch []uuid.UUID
+	p.mu.Lock()
+	for _, key := range keys {
+		if _, started := p.fetches[key]; started || key == uuid.Nil {
+			continue
+		}
+		p.fetches[key] = &prefetch{done: make(chan struct{})}
+		batch = append(batch, key)
+	}
+	p.mu.Unlock()
+	for len(batch) > 0 {
+		n := prefetchBatch
+		if len(batch) < n {
+			n = len(batch)
+		}
+		p.wg.Add(1)
+		go p.fetch(batch[:n])
+		batch = batch[n:]
+	}
+}
+
+func (p *prefetcher) fetch(keys []uuid.UUID) {
+	defer p.wg.Done()
+	var values map[uuid.UUID][]byte
+	select {
+	case p.slots <- struct{}{}:
+		// a failed batch is just nothing prefetched, reading the keys directly reports it
+		values, _ = datastoreGetMany(p.ctx, keys)
+		<-p.slots
+	case <-p.ctx.Done():
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		fetch := p.fetches[key]
+		fetch.value, fetch.ok = values[key]
+		close(fetch.done)
+	}
+}
+
+// The prefetched value of key, waiting for it if it's on its way. ok is false if key
+// wasn't prefetched or didn't come back, the caller reads it itself then.
+func (p *prefetcher) take(ctx context.Context, key uuid.UUID) (value []byte, ok bool, err error) {
+	p.mu.Lock()
+	fetch := p.fetches[key]
+	p.mu.Unlock()
+	if fetch == nil {
+		return nil, false, nil
+	}
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	return fetch.value, fetch.ok, nil
+}
+
+func (p *prefetcher) close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
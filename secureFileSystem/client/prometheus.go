@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// PrometheusExporter is an Observer that adds up every call it's told about and writes
+// the totals in the Prometheus text exposition format. It's an http.Handler, so a
+// service can mount it at /metrics:
+//
+//	exporter := client.NewPrometheusExporter()
+//	client.SetObserver(exporter)
+//	http.Handle("/metrics", exporter)
+type PrometheusExporter struct {
+	mu      sync.Mutex
+	results map[opResult]int
+	totals  map[Op]*opTotals
+}
+
+type opResult struct {
+	op     Op
+	result string
+}
+
+type opTotals struct {
+	datastoreGets    int
+	datastoreSets    int
+	datastoreDeletes int
+	keystoreGets     int
+	keystoreSets     int
+	bytesRead        int
+	bytesWritten     int
+	cryptoOps        map[CryptoPrimitive]int
+	durationBuckets  []int // how many calls took at most latencyBuckets[i]
+	durationSum      float64
+	calls            int
+}
+
+// upper bounds of the latency histogram, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{
+		results: make(map[opResult]int),
+		totals:  make(map[Op]*opTotals),
+	}
+}
+
+// the result label, the same names sfs uses for error kinds
+func resultLabel(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	for _, sentinel := range []struct {
+		err  error
+		name string
+	}{
+		{ErrNotFound, "not_found"},
+		{ErrIntegrity, "integrity"},
+		{ErrRevoked, "revoked"},
+		{ErrExists, "exists"},
+		{ErrAuth, "auth"},
+		{ErrConflict, "conflict"},
+		{ErrInvalid, "invalid"},
+	} {
+		if errors.Is(err, sentinel.err) {
+			return sentinel.name
+		}
+	}
+	return "error"
+}
+
+func (e *PrometheusExporter) Observe(stats OpStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.results[opResult{stats.Op, resultLabel(stats.Err)}]++
+	totals := e.totals[stats.Op]
+	if totals == nil {
+		totals = &opTotals{cryptoOps: make(map[CryptoPrimitive]int), durationBuckets: make([]int, len(latencyBuckets))}
+		e.totals[stats.Op] = totals
+	}
+	totals.datastoreGets += stats.DatastoreGets
+	totals.datastoreSets += stats.DatastoreSets
+	totals.datastoreDeletes += stats.DatastoreDeletes
+	totals.keystoreGets += stats.KeystoreGets
+	totals.keystoreSets += stats.KeystoreSets
+	totals.bytesRead += stats.BytesRead
+	totals.bytesWritten += stats.BytesWritten
+	for primitive, count := range stats.CryptoOps {
+		totals.cryptoOps[primitive] += count
+	}
+	seconds := stats.Duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			totals.durationBuckets[i]++
+		}
+	}
+	totals.durationSum += seconds
+	totals.calls++
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (e *PrometheusExporter) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	e.mu.Lock()
+	e.write(&buf)
+	e.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = e.WriteTo(w)
+}
+
+func (e *PrometheusExporter) write(buf *bytes.Buffer) {
+	header := func(name string, kind string, help string) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	ops := make([]Op, 0, len(e.totals))
+	for op := range e.totals {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	results := make([]opResult, 0, len(e.results))
+	for result := range e.results {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].op != results[j].op {
+			return results[i].op < results[j].op
+		}
+		return results[i].result < results[j].result
+	})
+	header("sfs_client_operations_total", "counter", "Client calls by operation and result.")
+	for _, result := range results {
+		fmt.Fprintf(buf, "sfs_client_operations_total{op=%q,result=%q} %d\n", result.op, result.result, e.results[result])
+	}
+
+	header("sfs_client_datastore_requests_total", "counter", "Datastore requests made by client calls.")
+	for _, op := range ops {
+		totals := e.totals[op]
+		fmt.Fprintf(buf, "sfs_client_datastore_requests_total{op=%q,method=\"get\"} %d\n", op, totals.datastoreGets)
+		fmt.Fprintf(buf, "sfs_client_datastore_requests_total{op=%q,method=\"set\"} %d\n", op, totals.datastoreSets)
+		fmt.Fprintf(buf, "sfs_client_datastore_requests_total{op=%q,method=\"delete\"} %d\n", op, totals.datastoreDeletes)
+	}
+	header("sfs_client_datastore_bytes_total", "counter", "Bytes of Datastore values moved by client calls.")
+	for _, op := range ops {
+		totals := e.totals[op]
+		fmt.Fprintf(buf, "sfs_client_datastore_bytes_total{op=%q,direction=\"read\"} %d\n", op, totals.bytesRead)
+		fmt.Fprintf(buf, "sfs_client_datastore_bytes_total{op=%q,direction=\"written\"} %d\n", op, totals.bytesWritten)
+	}
+	header("sfs_client_keystore_requests_total", "counter", "Keystore requests made by client calls.")
+	for _, op := range ops {
+		totals := e.totals[op]
+		fmt.Fprintf(buf, "sfs_client_keystore_requests_total{op=%q,method=\"get\"} %d\n", op, totals.keystoreGets)
+		fmt.Fprintf(buf, "sfs_client_keystore_requests_total{op=%q,method=\"set\"} %d\n", op, totals.keystoreSets)
+	}
+	header("sfs_client_crypto_operations_total", "counter", "Cryptographic primitives run by client calls.")
+	for _, op := range ops {
+		totals := e.totals[op]
+		primitives := make([]CryptoPrimitive, 0, len(totals.cryptoOps))
+		for primitive := range totals.cryptoOps {
+			primitives = append(primitives, primitive)
+		}
+		sort.Slice(primitives, func(i, j int) bool { return primitives[i] < primitives[j] })
+		for _, primitive := range primitives {
+			fmt.Fprintf(buf, "sfs_client_crypto_operations_total{op=%q,primitive=%q} %d\n", op, primitive, totals.cryptoOps[primitive])
+		}
+	}
+
+	header("sfs_client_operation_duration_seconds", "histogram", "Latency of client calls.")
+	for _, op := range ops {
+		totals := e.totals[op]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(buf, "sfs_client_operation_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, totals.durationBuckets[i])
+		}
+		fmt.Fprintf(buf, "sfs_client_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, totals.calls)
+		fmt.Fprintf(buf, "sfs_client_operation_duration_seconds_sum{op=%q} %g\n", op, totals.durationSum)
+		fmt.Fprintf(buf, "sfs_client_operation_duration_seconds_count{op=%q} %d\n", op, totals.calls)
+	}
+}
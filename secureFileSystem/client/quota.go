@@ -0,0 +1,357 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every account has a Ledger, sealed under a key of its own, with how many bytes of
+// content the files it owns have between them, before compression, padding and
+// encryption. A file's FileInfo points to its owner's Ledger and keeps its own Size, so
+// whoever writes to the file, the owner or anyone it's shared with, adds what the file
+// grew by to the Ledger, in the same journal as the write itself. Only the owner takes
+// anything off: a file someone else shrinks stays counted at its old size until the owner
+// writes to it or asks for Usage, which adds the files' own Sizes up again.
+//
+// The quota itself isn't in the Ledger. Everyone a file was ever shared with has the
+// Ledger key, revoked or not, so it's in a QuotaRecord next to the Ledger that the owner
+// signs and everyone checks against the owner's verify key. What a revoked user does to
+// Used the owner puts right from the files: Usage does, and so does a write of the
+// owner's that the Ledger says would go over. They're as safe as the files are.
+type LedgerRef struct {
+	UUID  uuid.UUID
+	Key   []byte
+	Owner string // who signs the QuotaRecord
+}
+
+type Ledger struct {
+	Used int64 // bytes of content in the files counted against it
+
+	ref *LedgerRef // not stored, where it was loaded from
+}
+
+// QuotaRecord is the owner's quota, sealed under the Ledger key next to the Ledger.
+type QuotaRecord struct {
+	Quota     int64  // bytes, 0 is no limit
+	Signature []byte // the owner's, over signedQuota
+}
+
+// UsageReport is what Usage returns.
+type UsageReport struct {
+	Quota int64 // 0 is no limit
+	Used  int64 // what counts against Quota
+	Files []FileUsage
+}
+
+// FileUsage is one file the user owns, and what it takes up.
+type FileUsage struct {
+	Filename string
+	Bytes    int64
+	Counted  bool // false for files from before quotas the owner hasn't written to since
+}
+
+// Sets up an empty ledger with no quota, the User struct has to be written for it to count
+func (userdata *User) createLedger(ctx context.Context) (err error) {
+	ref := &LedgerRef{UUID: uuid.New(), Key: userlib.RandomBytes(16), Owner: userdata.Username}
+	err = userdata.cache.store(ctx, sealContext{Kind: KindLedger, UUID: ref.UUID}, ref.Key, &Ledger{})
+	if err != nil {
+		return err
+	}
+	err = userdata.storeQuota(ctx, ref, 0)
+	if err != nil {
+		return err
+	}
+	userdata.Ledger = ref
+	return nil
+}
+
+// Returns the account's Ledger, making one for accounts created before quotas
+func (userdata *User) ledger(ctx context.Context) (ref *LedgerRef, err error) {
+	if userdata.Ledger != nil {
+		return userdata.Ledger, nil
+	}
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if userdata.Ledger != nil {
+		return userdata.Ledger, nil
+	}
+	err = userdata.createLedger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.reencryptUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return userdata.Ledger, nil
+}
+
+// Whether ref is the account's own Ledger
+func (userdata *User) ownsLedger(ref *LedgerRef) bool {
+	return userdata.Ledger != nil && userdata.Ledger.UUID == ref.UUID
+}
+
+func (userdata *User) loadLedger(ctx context.Context, ref *LedgerRef) (ledger *Ledger, err error) {
+	ledger = &Ledger{}
+	err = userdata.cache.load(ctx, sealContext{Kind: KindLedger, UUID: ref.UUID}, ref.Key, ledger)
+	if err != nil {
+		return nil, err
+	}
+	ledger.ref = ref
+	return ledger, nil
+}
+
+// Writes the ledger back, if there is one
+func (userdata *User) storeLedger(ctx context.Context, ledger *Ledger) (err error) {
+	if ledger == nil {
+		return nil
+	}
+	return userdata.cache.store(ctx, sealContext{Kind: KindLedger, UUID: ledger.ref.UUID}, ledger.ref.Key, ledger)
+}
+
+// Where the QuotaRecord of the Ledger at ref goes
+func quotaObject(ref *LedgerRef) (object sealContext, err error) {
+	derived, err := hashKDF(ref.Key, []byte("quota record UUID"))
+	if err != nil {
+		return sealContext{}, err
+	}
+	id, err := uuid.FromBytes(derived[:16])
+	if err != nil {
+		return sealContext{}, err
+	}
+	return sealContext{Kind: KindQuota, UUID: id}, nil
+}
+
+// What the owner signs, tied to the Ledger so a record can't be moved to another one
+func signedQuota(ref *LedgerRef, quota int64) []byte {
+	return []byte("quota of ledger " + ref.UUID.String() + ": " + strconv.FormatInt(quota, 10))
+}
+
+// Signs quota as the owner of the Ledger at ref and writes it next to it
+func (userdata *User) storeQuota(ctx context.Context, ref *LedgerRef, quota int64) (err error) {
+	object, err := quotaObject(ref)
+	if err != nil {
+		return err
+	}
+	signature, err := dsSign(userdata.SignKey, signedQuota(ref, quota))
+	if err != nil {
+		return err
+	}
+	return storeSealed(ctx, object, ref.Key, &QuotaRecord{Quota: quota, Signature: signature})
+}
+
+// The quota of the Ledger at ref, once the owner's signature checks out
+func (userdata *User) loadQuota(ctx context.Context, ref *LedgerRef) (quota int64, err error) {
+	object, err := quotaObject(ref)
+	if err != nil {
+		return 0, err
+	}
+	// the owner is part of what the cached record was checked against
+	cacheKey := append([]byte(ref.Owner+" "), ref.Key...)
+	marshalled, err := userdata.cache.open(ctx, KindQuota, object.UUID, cacheKey, func(ctx context.Context, sealed []byte) ([]byte, error) {
+		marshalled, err := openStructJSON(object, ref.Key, sealed)
+		if err != nil {
+			return nil, err
+		}
+		var record QuotaRecord
+		err = json.Unmarshal(marshalled, &record)
+		if err != nil {
+			return nil, integrityErr(KindQuota, object.UUID, "malformed struct")
+		}
+		verifyKey, exists, err := keystoreGet(ctx, ref.Owner+" verifyKey")
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, wrapErr(ErrNotFound, "verify key of user %q", ref.Owner)
+		}
+		if dsVerify(verifyKey, signedQuota(ref, record.Quota), record.Signature) != nil {
+			return nil, integrityErr(KindQuota, object.UUID, "not signed by the owner")
+		}
+		return marshalled, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var record QuotaRecord
+	err = json.Unmarshal(marshalled, &record)
+	if err != nil {
+		return 0, integrityErr(KindQuota, object.UUID, "malformed struct")
+	}
+	return record.Quota, nil
+}
+
+// Has a file from before quotas count against its owner's from now on, if we're the
+// owner. None of its content is counted yet.
+func (userdata *User) meterFile(ctx context.Context, filename string, fileInfo *FileInfo) (metered bool, err error) {
+	_, sender, _, err := userdata.lookupFile(ctx, filename)
+	if err != nil || sender != userdata.Username {
+		return false, err
+	}
+	fileInfo.Ledger, err = userdata.ledger(ctx)
+	if err != nil {
+		return false, err
+	}
+	fileInfo.Size = 0
+	return true, nil
+}
+
+// How many bytes of content the file's chain has
+func chainSize(ctx context.Context, fileInfoUUID uuid.UUID, fileInfo *FileInfo) (size int64, err error) {
+	err = readChain(ctx, fileInfoUUID, fileInfo, func(ctx context.Context, block *AppendBlock, data *AppendData) error {
+		blockSize, err := dataSize(block, data)
+		size += blockSize
+		return err
+	})
+	return size, err
+}
+
+// How many bytes of content one block has
+func dataSize(block *AppendBlock, data *AppendData) (size int64, err error) {
+	inline, err := decompress(KindAppendData, block.FileData, data.Compression, data.AppendData, MinChunkSize-1)
+	if err != nil {
+		return 0, err
+	}
+	size = int64(len(inline))
+	for _, ref := range data.Chunks {
+		size += int64(ref.Size)
+	}
+	return size, nil
+}
+
+// Makes the file size bytes long as far as its owner's quota goes. A QuotaError if it
+// grows and that takes the owner over, otherwise the Ledger as it is then, nil if the
+// file doesn't count against anyone's. fileInfo and the Ledger have to be written for it
+// to count.
+func (userdata *User) resizeFile(ctx context.Context, fileInfo *FileInfo, size int64) (ledger *Ledger, err error) {
+	if fileInfo.Ledger == nil {
+		return nil, nil
+	}
+	owner := userdata.ownsLedger(fileInfo.Ledger)
+	ledger, err = userdata.loadLedger(ctx, fileInfo.Ledger)
+	if err != nil {
+		return nil, err
+	}
+	grows := size - fileInfo.Size
+	fileInfo.Size = size
+	if grows <= 0 {
+		// only the owner takes anything off
+		if owner {
+			ledger.Used += grows
+		}
+		return ledger, nil
+	}
+	quota, err := userdata.loadQuota(ctx, fileInfo.Ledger)
+	if err != nil {
+		return nil, err
+	}
+	if quota > 0 && ledger.Used+grows > quota && owner {
+		// don't take the Ledger's word for it
+		_, ledger.Used, err = userdata.countUsage(ctx, ledger.ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if quota > 0 && ledger.Used+grows > quota {
+		return nil, &QuotaError{Quota: quota, Used: ledger.Used, Requested: grows}
+	}
+	ledger.Used += grows
+	return ledger, nil
+}
+
+// SetQuota limits how many bytes of content the files the user owns can have between
+// them, 0 for no limit. Writes that would go over it, by the user or by anyone they
+// shared a file with, return a QuotaError. A quota below what's used already only stops
+// files from growing.
+func (userdata *User) SetQuota(bytes int64) error {
+	return userdata.SetQuotaContext(context.Background(), bytes)
+}
+
+// SetQuotaContext is like SetQuota but gives up once ctx is done, see context.go.
+func (userdata *User) SetQuotaContext(ctx context.Context, bytes int64) error {
+	if bytes < 0 {
+		return wrapErr(ErrInvalid, "quota %d", bytes)
+	}
+	ref, err := userdata.ledger(ctx)
+	if err != nil {
+		return err
+	}
+	return userdata.storeQuota(ctx, ref, bytes)
+}
+
+// Usage reports the user's quota, how much of it is used, and what each file the user
+// owns takes up. If the Ledger doesn't add up to the files, after writers raced, someone
+// shrank a file that was shared with them or someone revoked rewrote it, it's put right
+// from the files.
+func (userdata *User) Usage() (report *UsageReport, err error) {
+	return userdata.UsageContext(context.Background())
+}
+
+// UsageContext is like Usage but gives up once ctx is done, see context.go.
+func (userdata *User) UsageContext(ctx context.Context) (report *UsageReport, err error) {
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := userdata.ledger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := userdata.loadLedger(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	report, used, err := userdata.countUsage(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	report.Quota, err = userdata.loadQuota(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if ledger.Used != used {
+		ledger.Used = used
+		err = userdata.storeLedger(ctx, ledger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.Used = used
+	return report, nil
+}
+
+// Adds up the Sizes of the files the user owns that count against the Ledger at ref
+func (userdata *User) countUsage(ctx context.Context, ref *LedgerRef) (report *UsageReport, used int64, err error) {
+	report = &UsageReport{Files: []FileUsage{}}
+	err = userdata.walkFiles(ctx, nil, func(filename string, certUUID uuid.UUID, sender string) error {
+		if sender != userdata.Username {
+			return nil
+		}
+		certificate, fileInfo, err := userdata.openCertificate(ctx, sender, userdata.Username, certUUID)
+		if err != nil {
+			return err
+		}
+		usage := FileUsage{Filename: filename, Bytes: fileInfo.Size}
+		usage.Counted = fileInfo.Ledger != nil && fileInfo.Ledger.UUID == ref.UUID
+		if usage.Counted {
+			used += fileInfo.Size
+		} else {
+			usage.Bytes, err = chainSize(ctx, certificate.FileInfo, fileInfo)
+			if err != nil {
+				return err
+			}
+		}
+		report.Files = append(report.Files, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return report, used, nil
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A revoked user loses the AccessToken, but they may well still have the BlockKey the
+// chain is sealed under and the UUIDs of its blocks. So a revocation rotates the BlockKey
+// too: what's appended afterwards is sealed under a new key, in a run at UUIDs derived
+// from a new seed, and the end block, which the next append links from, is resealed
+// under the new key straight away.
+//
+// Keys are numbered by epoch. Every AppendBlock and AppendData says in its envelope
+// header (the KeyID) which epoch it was sealed in, and readers take that epoch's key
+// from FileInfo, which keeps the keys of earlier epochs as long as there are blocks under
+// them. The header is covered by the MAC, so changing it only picks a key the MAC won't
+// check out with. What happens to the older blocks is up to the file's ReencryptMode,
+// which is kept in the owner's certificate: anyone the file is shared with can reseal
+// FileInfo, and whoever is about to be revoked would rather their old blocks stayed
+// readable.
+//
+// Resealing keeps the plaintext as it was, padding and all, at the same UUID. Chunks are
+// shared with every file the writer stored the same bytes in, and their keys are only in
+// AppendData, so whoever was revoked may have kept those too. ReencryptEager copies the
+// chunks of what it reseals under new random keys, see rekeyChunks; ReencryptLazy leaves
+// them where they are, so content that was chunked, at least MinChunkSize per store or
+// append, stays readable to them until it's overwritten.
+const rekeyPerAppend = blocksPerRun
+
+// ReencryptMode says what revoking someone from a file does with the blocks already in
+// it. Whatever the mode, what's written after the revocation is under a key the revoked
+// user never had.
+type ReencryptMode string
+
+const (
+	// ReencryptNone leaves older blocks under their keys. Whoever was revoked can still
+	// read, and rewrite, what was in the file when they lost access.
+	ReencryptNone ReencryptMode = ""
+	// ReencryptLazy has every append reseal up to rekeyPerAppend older blocks, from the
+	// start of the file, and the old keys go once it gets to the end. Revoking stays as
+	// cheap as with ReencryptNone, old content is safe once enough has been appended,
+	// except for chunked content, whose chunks keep their keys.
+	ReencryptLazy ReencryptMode = "lazy"
+	// ReencryptEager reseals the whole chain, and copies its chunks under new keys, before
+	// RevokeAccess returns.
+	ReencryptEager ReencryptMode = "eager"
+)
+
+func (mode ReencryptMode) validate() error {
+	switch mode {
+	case ReencryptNone, ReencryptLazy, ReencryptEager:
+		return nil
+	default:
+		return wrapErr(ErrInvalid, "re-encryption mode %q", mode)
+	}
+}
+
+// The key blocks sealed in epoch are under, nil if the file doesn't have it anymore
+func (fileInfo *FileInfo) blockKey(epoch uint32) []byte {
+	if epoch == fileInfo.KeyEpoch {
+		return fileInfo.BlockKey
+	}
+	return fileInfo.OldBlockKeys[epoch]
+}
+
+// What a sealed block or AppendData of the file opens as, with the key of the epoch its
+// header names. The first client's values have no header and are from the first epoch.
+func (fileInfo *FileInfo) blockObject(kind ObjectKind, fileInfoUUID uuid.UUID, id uuid.UUID, sealed []byte) (object sealContext, key []byte, err error) {
+	header, _ := parseEnvelope(sealed)
+	object = sealContext{Kind: kind, UUID: id, File: fileInfoUUID, KeyID: header.KeyID, Migrated: fileInfo.Migrated}
+	key = fileInfo.blockKey(header.KeyID)
+	if key == nil {
+		return object, nil, integrityErr(kind, id, fmt.Sprintf("sealed with key %d, which the file doesn't have", header.KeyID))
+	}
+	return object, key, nil
+}
+
+// How blocks and AppendData of the file are sealed now, under BlockKey
+func (fileInfo *FileInfo) currentObject(kind ObjectKind, fileInfoUUID uuid.UUID, id uuid.UUID) sealContext {
+	return sealContext{Kind: kind, UUID: id, File: fileInfoUUID, KeyID: fileInfo.KeyEpoch}
+}
+
+// Starts the next epoch with a new BlockKey, the old one stays for the blocks under it
+func (fileInfo *FileInfo) rotateBlockKey() {
+	if fileInfo.OldBlockKeys == nil {
+		fileInfo.OldBlockKeys = make(map[uint32][]byte)
+	}
+	fileInfo.OldBlockKeys[fileInfo.KeyEpoch] = fileInfo.BlockKey
+	fileInfo.KeyEpoch++
+	fileInfo.BlockKey = userlib.RandomBytes(16)
+	// whoever had the old key knows the old seed, the next append starts a run of its own
+	fileInfo.RunSeed = nil
+}
+
+// Starts the next epoch for a chain that replaces the old one, none of the old keys are
+// needed anymore and the old blocks can't be spliced back in
+func (fileInfo *FileInfo) newChain() {
+	fileInfo.rotateBlockKey()
+	fileInfo.OldBlockKeys = nil
+	fileInfo.Rekey = uuid.Nil
+	fileInfo.Migrated = true
+}
+
+// Reseals the block or AppendData at id under BlockKey if it's from an earlier epoch.
+// Returns what's stored there now.
+func (fileInfo *FileInfo) rekeyObject(ctx context.Context, kind ObjectKind, fileInfoUUID uuid.UUID, id uuid.UUID) (sealed []byte, err error) {
+	sealed, err = datastoreFetch(ctx, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	object, key, err := fileInfo.blockObject(kind, fileInfoUUID, id, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if object.KeyID == fileInfo.KeyEpoch {
+		return sealed, nil
+	}
+	plaintext, version, legacy, err := openSealed(object, key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		// structs from back then are JSON
+		version = envelopeJSON
+	}
+	sealed, err = sealBytes(fileInfo.currentObject(kind, fileInfoUUID, id), fileInfo.BlockKey, version, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return sealed, datastoreSet(ctx, id, sealed)
+}
+
+// Like rekeyObject for an AppendData, except that a chunked one from an earlier epoch
+// gets its chunks copied under new keys too
+func (fileInfo *FileInfo) rekeyAppendData(ctx context.Context, fileInfoUUID uuid.UUID, id uuid.UUID) (err error) {
+	sealed, err := datastoreFetch(ctx, KindAppendData, id)
+	if err != nil {
+		return err
+	}
+	header, _ := parseEnvelope(sealed)
+	if header.KeyID == fileInfo.KeyEpoch {
+		return nil
+	}
+	appendData, err := loadAppendData(ctx, fileInfoUUID, id, fileInfo)
+	if err != nil {
+		return err
+	}
+	if len(appendData.Chunks) == 0 {
+		_, err = fileInfo.rekeyObject(ctx, KindAppendData, fileInfoUUID, id)
+		return err
+	}
+	appendData.Chunks, err = rekeyChunks(ctx, appendData.Chunks, appendData.Padding)
+	if err != nil {
+		return err
+	}
+	return sealAppendData(ctx, fileInfoUUID, id, appendData, fileInfo)
+}
+
+// Reseals the blocks from earlier epochs and their AppendData, from the block at from
+// on, limit blocks at most or all of them if it's negative. With chunks their chunks get
+// new keys too, see rekeyAppendData. next is where it stopped, Nil once it got to the
+// end, and then the old keys go. from has to be StartAppend, or where an earlier call
+// stopped, for that to be right.
+func (fileInfo *FileInfo) rekeyChain(ctx context.Context, fileInfoUUID uuid.UUID, from uuid.UUID, limit int, chunks bool) (next uuid.UUID, err error) {
+	next = from
+	for n := 0; next != uuid.Nil && n != limit; n++ {
+		sealed, err := fileInfo.rekeyObject(ctx, KindAppendBlock, fileInfoUUID, next)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		var block AppendBlock
+		err = openStruct(fileInfo.currentObject(KindAppendBlock, fileInfoUUID, next), fileInfo.BlockKey, sealed, &block)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if chunks {
+			err = fileInfo.rekeyAppendData(ctx, fileInfoUUID, block.FileData)
+		} else {
+			_, err = fileInfo.rekeyObject(ctx, KindAppendData, fileInfoUUID, block.FileData)
+		}
+		if err != nil {
+			return uuid.Nil, err
+		}
+		next = block.NextAppend
+	}
+	if next == uuid.Nil {
+		fileInfo.OldBlockKeys = nil
+	}
+	return next, nil
+}
+
+// Moves the file's content onto a new BlockKey after a revocation. token is the new
+// AccessToken, the one the revoked user doesn't have, and mode is the owner's.
+func rotateFileKey(ctx context.Context, fileInfoUUID uuid.UUID, token []byte, mode ReencryptMode, migrated bool) (err error) {
+	fileInfo, err := loadFileInfo(ctx, fileInfoUUID, token, migrated)
+	if err != nil {
+		return err
+	}
+	fileInfo.rotateBlockKey()
+	fileInfo.Rekey = uuid.Nil
+	switch mode {
+	case ReencryptEager:
+		_, err = fileInfo.rekeyChain(ctx, fileInfoUUID, fileInfo.StartAppend, -1, true)
+	case ReencryptLazy:
+		fileInfo.Rekey = fileInfo.StartAppend
+		fallthrough
+	default:
+		_, err = fileInfo.rekeyObject(ctx, KindAppendBlock, fileInfoUUID, fileInfo.EndAppend)
+	}
+	if err != nil {
+		return err
+	}
+	return storeFileInfo(ctx, fileInfoUUID, fileInfo, token)
+}
+
+// SetFileReencryption sets what revoking someone from filename does with what's already in
+// it. If there are blocks under old keys already, ReencryptEager reseals them now and
+// ReencryptLazy starts on them with the next append. Only the file's owner can change
+// it, for anyone else it's ErrInvalid.
+func (userdata *User) SetFileReencryption(filename string, mode ReencryptMode) error {
+	return userdata.SetFileReencryptionContext(context.Background(), filename, mode)
+}
+
+// SetFileReencryptionContext is like SetFileReencryption but gives up once ctx is done, see context.go.
+func (userdata *User) SetFileReencryptionContext(ctx context.Context, filename string, mode ReencryptMode) (err error) {
+	err = mode.validate()
+	if err != nil {
+		return err
+	}
+	ctx, done := userdata.startJournal(ctx)
+	defer done(&err)
+	userdata, err = userdata.current(ctx)
+	if err != nil {
+		return err
+	}
+	certUUID, sender, exists, err := userdata.lookupFile(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return wrapErr(ErrNotFound, "file %q", filename)
+	}
+	if sender != userdata.Username {
+		return wrapErr(ErrInvalid, "file %q was shared with us, only its owner can set how it's re-encrypted", filename)
+	}
+	certificate, fileInfo, err := userdata.openCertificate(ctx, sender, userdata.Username, certUUID)
+	if err != nil {
+		return err
+	}
+	ctx, err = commit(ctx)
+	if err != nil {
+		return err
+	}
+	certificate.Reencrypt = mode
+	_, err = userdata.certificateReencryption(ctx, userdata.Username, userdata.Username, filename, certUUID, *certificate)
+	if err != nil {
+		return err
+	}
+	fileInfo.Rekey = uuid.Nil
+	if len(fileInfo.OldBlockKeys) > 0 {
+		switch mode {
+		case ReencryptEager:
+			_, err = fileInfo.rekeyChain(ctx, certificate.FileInfo, fileInfo.StartAppend, -1, true)
+			if err != nil {
+				return err
+			}
+		case ReencryptLazy:
+			fileInfo.Rekey = fileInfo.StartAppend
+		}
+	}
+	return storeFileInfo(ctx, certificate.FileInfo, fileInfo, certificate.token)
+}
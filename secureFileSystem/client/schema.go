@@ -0,0 +1,244 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Sealed structs carry the version of their layout next to their fields:
+//
+//	{"Schema":1,"StartAppend":...}
+//
+// Objects written before there was one are schema 0. To change a struct, add a migration
+// for its kind that turns the previous schema's fields into the new ones, the current
+// schema is how many migrations a kind has. Readers run whatever migrations an object is
+// missing before unmarshalling it, so old objects keep loading, and the next time one
+// is written it's sealed at the current schema. An object from a newer client is refused
+// instead, rewriting it would drop the fields we don't know about.
+type schemaMigration func(fields map[string]json.RawMessage) error
+
+// schemaMigrations[kind][n] upgrades a kind from schema n to n+1. Kinds that the first
+// client didn't store have been at schema 0 since they were added.
+var schemaMigrations = map[ObjectKind][]schemaMigration{
+	KindUser:        {baselineUser},
+	KindCertificate: {baselineCertificate},
+	KindFileInfo:    {baselineFileInfo},
+	KindAppendBlock: {baselineAppendBlock},
+	KindAppendData:  {baselineFields},
+}
+
+// Migrations fill in what a schema added with what objects from before it meant, so the
+// rest of the client only ever sees the current layout. They check the fields they build
+// on while they're at it, an object that doesn't have them is refused rather than read
+// as if it had zero values.
+//
+// Schema 0 is the first client's layout, see openBaseline. It kept the MAC and IV it
+// checked a struct with in the struct itself, the seal does that now.
+func baselineFields(fields map[string]json.RawMessage) error {
+	delete(fields, "MAC")
+	delete(fields, "Salt")
+	return nil
+}
+
+// The first client kept the namespace in Certificates and Invites, those stay until the
+// first change to the namespace moves them to index pages, so every certificate needs the
+// name of whoever it's from. An Invites entry without a certificate is from a file that
+// was never accepted, it's dropped. The account gets a Ledger the first time it needs one.
+// The first client kept the password in the struct too, it's dropped. Nothing the account
+// reaches has been migrated yet, see MigrateKeys.
+func baselineUser(fields map[string]json.RawMessage) error {
+	err := baselineFields(fields)
+	if err != nil {
+		return err
+	}
+	delete(fields, "Password")
+	var certificates map[string]uuid.UUID
+	var invites map[string]string
+	err = unmarshalField(fields, "Certificates", &certificates)
+	if err != nil {
+		return err
+	}
+	err = unmarshalField(fields, "Invites", &invites)
+	if err != nil {
+		return err
+	}
+	for filename := range certificates {
+		if _, exists := invites[filename]; !exists {
+			return fmt.Errorf("certificate for %q without sender", filename)
+		}
+	}
+	for filename := range invites {
+		if _, exists := certificates[filename]; !exists {
+			delete(invites, filename)
+		}
+	}
+	err = marshalField(fields, "Invites", invites)
+	if err != nil {
+		return err
+	}
+	for name, value := range map[string]interface{}{"Namespace": nil, "Ledger": nil, "Migrated": false} {
+		err = marshalField(fields, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first client's certificates have no key tree, the file's AccessToken is in the
+// certificate and has to be there. Their files are at ReencryptNone.
+func baselineCertificate(fields map[string]json.RawMessage) error {
+	err := baselineFields(fields)
+	if err != nil {
+		return err
+	}
+	var token []byte
+	err = unmarshalField(fields, "AccessToken", &token)
+	if err != nil {
+		return err
+	}
+	if len(token) != 16 {
+		return fmt.Errorf("AccessToken is %d bytes", len(token))
+	}
+	for name, value := range map[string]interface{}{"KeyTree": nil, "Leaf": nil, "Reencrypt": ReencryptNone} {
+		err = marshalField(fields, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first client's chains aren't laid out in runs, so FileInfo says the run it's in is
+// full and the next append starts one. Everything is in the first epoch and nothing is
+// being re-encrypted. The file counts against no quota, and against its owner's from the
+// owner's next write on. The chain hasn't been migrated yet.
+func baselineFileInfo(fields map[string]json.RawMessage) error {
+	err := baselineFields(fields)
+	if err != nil {
+		return err
+	}
+	var chain struct {
+		StartAppend, EndAppend uuid.UUID
+		BlockKey               []byte
+	}
+	err = unmarshalFields(fields, &chain)
+	if err != nil {
+		return err
+	}
+	if chain.StartAppend == uuid.Nil || chain.EndAppend == uuid.Nil || len(chain.BlockKey) != 16 {
+		return errors.New("no chain")
+	}
+	for name, value := range map[string]interface{}{"RunSeed": nil, "RunLength": blocksPerRun, "KeyEpoch": 0, "OldBlockKeys": nil, "Rekey": uuid.Nil, "Ledger": nil, "Size": 0, "Migrated": false} {
+		err = marshalField(fields, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first client's blocks don't start runs
+func baselineAppendBlock(fields map[string]json.RawMessage) error {
+	err := baselineFields(fields)
+	if err != nil {
+		return err
+	}
+	return marshalField(fields, "RunSeed", nil)
+}
+
+// Unmarshals fields[name] into v, a field that isn't there leaves v as it is
+func unmarshalField(fields map[string]json.RawMessage, name string, v interface{}) error {
+	value, exists := fields[name]
+	if !exists {
+		return nil
+	}
+	err := json.Unmarshal(value, v)
+	if err != nil {
+		return fmt.Errorf("malformed %s", name)
+	}
+	return nil
+}
+
+// Unmarshals all of fields into struct v
+func unmarshalFields(fields map[string]json.RawMessage, v interface{}) error {
+	marshalled, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(marshalled, v)
+	if err != nil {
+		return errors.New("malformed struct")
+	}
+	return nil
+}
+
+func marshalField(fields map[string]json.RawMessage, name string, v interface{}) (err error) {
+	fields[name], err = json.Marshal(v)
+	return err
+}
+
+func currentSchema(kind ObjectKind) int {
+	return len(schemaMigrations[kind])
+}
+
+// json.Marshal of struct v with the current schema of kind added in front
+func marshalVersioned(kind ObjectKind, v interface{}) (marshalled []byte, err error) {
+	fields, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 || fields[0] != '{' {
+		return nil, fmt.Errorf("can't version %T, it isn't a struct", v)
+	}
+	marshalled = []byte(fmt.Sprintf(`{"Schema":%d`, currentSchema(kind)))
+	if len(fields) > 2 {
+		marshalled = append(marshalled, ',')
+	}
+	return append(marshalled, fields[1:]...), nil
+}
+
+// Unmarshals what marshalVersioned wrote into v, migrating it first if it's older
+func unmarshalVersioned(kind ObjectKind, id uuid.UUID, plaintext []byte, v interface{}) (err error) {
+	plaintext, err = upgradeVersioned(kind, id, plaintext)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(plaintext, v)
+	if err != nil {
+		return integrityErr(kind, id, "malformed struct")
+	}
+	return nil
+}
+
+// What marshalVersioned wrote, with whatever migrations it's missing applied
+func upgradeVersioned(kind ObjectKind, id uuid.UUID, plaintext []byte) (upgraded []byte, err error) {
+	var version struct{ Schema int }
+	err = json.Unmarshal(plaintext, &version)
+	if err != nil {
+		return nil, integrityErr(kind, id, "malformed struct")
+	}
+	current := currentSchema(kind)
+	if version.Schema < 0 || version.Schema > current {
+		return nil, integrityErr(kind, id, fmt.Sprintf("schema %d, this client only knows up to %d", version.Schema, current))
+	}
+	if version.Schema == current {
+		return plaintext, nil
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(plaintext, &fields)
+	if err != nil {
+		return nil, integrityErr(kind, id, "malformed struct")
+	}
+	for _, migrate := range schemaMigrations[kind][version.Schema:] {
+		err = migrate(fields)
+		if err != nil {
+			return nil, integrityErr(kind, id, fmt.Sprintf("migrating from schema %d: %v", version.Schema, err))
+		}
+	}
+	delete(fields, "Schema")
+	return json.Marshal(fields)
+}
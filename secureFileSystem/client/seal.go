@@ -0,0 +1,366 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every User, Certificates, FileInfo, AppendBlock, AppendData and IndexPage is stored sealed:
+//
+//	header || IV || SymEnc ciphertext || HMAC(key, header || associated data || IV || ciphertext)
+//
+// with the envelope header from envelope.go. The associated data is the object's kind,
+// the UUID it's stored at and the FileInfo of the file it belongs to, so a ciphertext
+// moved to another UUID, read as another kind of object or spliced into another file
+// under the same key fails the MAC even though it was made with the right key.
+//
+// The root key an object is sealed under (the account's, a certificate symKey, an AccessToken
+// or a BlockKey) is never used directly, sealKeys derives a separate encryption and MAC
+// key from it for each kind of object. The first client's objects have no header and
+// keep their MAC in the struct, see openBaseline. They open until MigrateKeys has rewritten
+// them and recorded that it did, in the User struct for the account's certificates and
+// the FileInfo of the files it reaches, and in FileInfo for the file's chain. After that
+// nothing without a header opens there, so an old value put back doesn't either.
+type sealContext struct {
+	Kind     ObjectKind
+	UUID     uuid.UUID
+	File     uuid.UUID // FileInfo UUID, Nil for Users and Certificates which don't belong to one file
+	KeyID    uint32    // goes in the header, opening fails if the object says it was sealed with another
+	Migrated bool      // the account or file was migrated, opening fails if the first client stored it
+}
+
+func (ctx sealContext) associatedData() []byte {
+	ad := append([]byte(ctx.Kind), 0)
+	ad = append(ad, ctx.UUID[:]...)
+	return append(ad, ctx.File[:]...)
+}
+
+// encryption and MAC keys for sealing one kind of object under rootKey
+func sealKeys(rootKey []byte, kind ObjectKind) (encKey []byte, macKey []byte, err error) {
+	encKey, err = hashKDF(rootKey, []byte("seal encryption "+kind))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err = hashKDF(rootKey, []byte("seal MAC "+kind))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// Encrypts plaintext under key with a fresh IV and MACs it together with ctx. version
+// says how plaintext is encoded if it's a struct.
+func sealBytes(ctx sealContext, key []byte, version byte, plaintext []byte) (sealed []byte, err error) {
+	encKey, macKey, err := sealKeys(key, ctx.Kind)
+	if err != nil {
+		return nil, err
+	}
+	header := envelopeHeader{Version: version, Suite: SuiteAESCTRHMAC, Kind: ctx.Kind, KeyID: ctx.KeyID}.marshal()
+	ciphertext := symEnc(encKey, userlib.RandomBytes(userlib.AESBlockSizeBytes), plaintext)
+	mac, err := hmacEval(macKey, append(append(header, ctx.associatedData()...), ciphertext...))
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, ciphertext...), mac...), nil
+}
+
+// Checks the MAC against ctx and decrypts, anything wrong is an IntegrityError for ctx
+func openBytes(ctx sealContext, key []byte, sealed []byte) (plaintext []byte, err error) {
+	plaintext, _, _, err = openSealed(ctx, key, sealed)
+	return plaintext, err
+}
+
+// Like openBytes, also returns the envelope version, legacy is true if the first client
+// stored it
+func openSealed(ctx sealContext, key []byte, sealed []byte) (plaintext []byte, version byte, legacy bool, err error) {
+	header, headerBytes, body, err := openEnvelope(ctx.Kind, SuiteAESCTRHMAC, ctx.UUID, sealed)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if header.KeyID != ctx.KeyID {
+		return nil, 0, false, integrityErr(ctx.Kind, ctx.UUID, fmt.Sprintf("sealed with key %d, expected %d", header.KeyID, ctx.KeyID))
+	}
+	if header.Version == 0 {
+		if ctx.Migrated {
+			return nil, 0, false, integrityErr(ctx.Kind, ctx.UUID, "stored by the first client after it was migrated")
+		}
+		plaintext, err = openBaseline(ctx, key, body)
+		if err != nil {
+			return nil, 0, false, integrityErr(ctx.Kind, ctx.UUID, "MAC mismatch")
+		}
+		return plaintext, 0, true, nil
+	}
+	if len(body) < userlib.AESBlockSizeBytes+userlib.HashSizeBytes {
+		return nil, 0, false, integrityErr(ctx.Kind, ctx.UUID, "too short")
+	}
+	ciphertext, mac := body[:len(body)-userlib.HashSizeBytes], body[len(body)-userlib.HashSizeBytes:]
+	encKey, macKey, err := sealKeys(key, ctx.Kind)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	authenticated := append(append([]byte{}, headerBytes...), ctx.associatedData()...)
+	expectedMAC, err := hmacEval(macKey, append(authenticated, ciphertext...))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if !userlib.HMACEqual(mac, expectedMAC) {
+		return nil, 0, false, integrityErr(ctx.Kind, ctx.UUID, "MAC mismatch")
+	}
+	return symDec(encKey, ciphertext), header.Version, false, nil
+}
+
+// Opens a struct the way the first client stored them, before there was any sealing:
+//
+//	SymEnc(key, Salt, JSON of the struct)
+//
+// with the MAC inside the struct, HMAC(key, SymEnc(key, Salt, JSON of the struct with MAC
+// null)). The key is the root key itself and nothing binds the value to where it's stored,
+// so these are only read to be rewritten, see MigrateKeys. Returns the struct's JSON, at
+// schema 0 like everything from before schemas, which drops MAC and Salt.
+func openBaseline(ctx sealContext, key []byte, body []byte) (plaintext []byte, err error) {
+	if len(body) <= userlib.AESBlockSizeBytes {
+		return nil, errors.New("too short")
+	}
+	marshalled := symDec(key, body)
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(marshalled, &fields)
+	if err != nil {
+		return nil, err
+	}
+	var mac, salt []byte
+	err = json.Unmarshal(fields["MAC"], &mac)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(fields["Salt"], &salt)
+	if err != nil || len(salt) != userlib.AESBlockSizeBytes {
+		return nil, errors.New("no salt")
+	}
+	// json.Marshal of the same struct with MAC nil, that's what was MACed
+	start, end, found := topLevelField(marshalled, "MAC")
+	if !found {
+		return nil, errors.New("no MAC")
+	}
+	unsigned := append(append(append([]byte{}, marshalled[:start]...), `"MAC":null`...), marshalled[end:]...)
+	expectedMAC, err := hmacEval(key, symEnc(key, salt, unsigned))
+	if err != nil {
+		return nil, err
+	}
+	if !userlib.HMACEqual(mac, expectedMAC) {
+		return nil, errors.New("MAC mismatch")
+	}
+	return marshalled, nil
+}
+
+// Where name and its value are in a JSON object as json.Marshal writes it, end is past the
+// value
+func topLevelField(marshalled []byte, name string) (start int, end int, found bool) {
+	decoder := json.NewDecoder(bytes.NewReader(marshalled))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return 0, 0, false
+	}
+	for decoder.More() {
+		start = int(decoder.InputOffset())
+		if marshalled[start] == ',' {
+			start++
+		}
+		key, err := decoder.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return 0, 0, false
+		}
+		if key == name {
+			return start, int(decoder.InputOffset()), true
+		}
+	}
+	return 0, 0, false
+}
+
+func sealStruct(ctx sealContext, key []byte, v interface{}) (sealed []byte, err error) {
+	version := writeVersion
+	encoded, err := encodeStruct(version, ctx.Kind, v)
+	if err != nil {
+		return nil, err
+	}
+	return sealBytes(ctx, key, version, encoded)
+}
+
+func openStruct(ctx sealContext, key []byte, sealed []byte, v interface{}) (err error) {
+	marshalled, err := openStructJSON(ctx, key, sealed)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(marshalled, v)
+	if err != nil {
+		return integrityErr(ctx.Kind, ctx.UUID, "malformed struct")
+	}
+	return nil
+}
+
+// Like openStruct, but returns the struct as JSON of its current schema
+func openStructJSON(ctx sealContext, key []byte, sealed []byte) (marshalled []byte, err error) {
+	plaintext, version, _, err := openSealed(ctx, key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	marshalled, n, err := structJSON(ctx.Kind, ctx.UUID, version, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(plaintext) {
+		return nil, integrityErr(ctx.Kind, ctx.UUID, "trailing data after struct")
+	}
+	return upgradeVersioned(ctx.Kind, ctx.UUID, marshalled)
+}
+
+// Seals v and writes it at object.UUID
+func storeSealed(ctx context.Context, object sealContext, key []byte, v interface{}) (err error) {
+	sealed, err := sealStruct(object, key, v)
+	if err != nil {
+		return err
+	}
+	return datastoreSet(ctx, object.UUID, sealed)
+}
+
+// Fetches object.UUID and opens it into v
+func loadSealed(ctx context.Context, object sealContext, key []byte, v interface{}) (err error) {
+	sealed, err := datastoreFetch(ctx, object.Kind, object.UUID)
+	if err != nil {
+		return err
+	}
+	return openStruct(object, key, sealed, v)
+}
+
+// Rewrites the object at object.UUID the current way if the first client stored it.
+// Revocation notices and objects that don't open are left alone.
+func resealLegacy(ctx context.Context, object sealContext, key []byte) (resealed bool, err error) {
+	sealed, exists, err := datastoreGet(ctx, object.UUID)
+	if err != nil || !exists {
+		return false, err
+	}
+	plaintext, _, legacy, err := openSealed(object, key, sealed)
+	if err != nil || !legacy {
+		return false, nil
+	}
+	// migrated, so nothing the current schema dropped is left behind
+	upgraded, err := upgradeVersioned(object.Kind, object.UUID, plaintext)
+	if err != nil {
+		return false, err
+	}
+	// written as JSON, the binary encoding needs the struct
+	marshalled, err := marshalVersioned(object.Kind, json.RawMessage(upgraded))
+	if err != nil {
+		return false, err
+	}
+	sealed, err = sealBytes(object, key, envelopeJSON, marshalled)
+	if err != nil {
+		return false, err
+	}
+	return true, datastoreSet(ctx, object.UUID, sealed)
+}
+
+// MigrateKeys seals everything the account can reach that the first client stored, with
+// its MAC in the struct and no envelope header: the User struct, certificates, and the
+// FileInfo and AppendBlock/AppendData chain of every file, owned or shared. It returns
+// how many objects it rewrote. Once a file's chain is done its FileInfo records that, and
+// once everything is the User struct does, from then on values without a header aren't
+// read there anymore. It shouldn't run while other sessions are writing to the same
+// files, since it writes back what it read.
+func (userdata *User) MigrateKeys() (migrated int, err error) {
+	return userdata.MigrateKeysContext(context.Background())
+}
+
+// MigrateKeysContext is like MigrateKeys but gives up once ctx is done, see context.go.
+func (userdata *User) MigrateKeysContext(ctx context.Context) (migrated int, err error) {
+	reseal := func(object sealContext, key []byte) error {
+		resealed, err := resealLegacy(ctx, object, key)
+		if resealed {
+			migrated++
+		}
+		return err
+	}
+
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rootKey, passUUID, err := userdata.login()
+	if err != nil {
+		return 0, err
+	}
+	err = reseal(sealContext{Kind: KindUser, UUID: passUUID}, rootKey)
+	if err != nil {
+		return migrated, err
+	}
+
+	err = userdata.walkFiles(ctx, nil, func(filename string, certUUID uuid.UUID, sender string) error {
+		_, symKey, err := loadCertKey(ctx, sender, userdata.Username, certUUID, userdata.DecryptKey)
+		if err != nil {
+			return err
+		}
+		err = reseal(sealContext{Kind: KindCertificate, UUID: certUUID}, symKey)
+		if err != nil {
+			return err
+		}
+		cert, err := loadCertificate(ctx, certUUID, symKey, false)
+		if err != nil {
+			return err
+		}
+		token, err := cert.fileToken(ctx, userdata.cache)
+		if err != nil {
+			return checkLineage(ctx, cert.Lineage, err)
+		}
+		err = reseal(sealContext{Kind: KindFileInfo, UUID: cert.FileInfo, File: cert.FileInfo}, token)
+		if err != nil {
+			return err
+		}
+		fileInfo, err := loadFileInfo(ctx, cert.FileInfo, token, false)
+		if err != nil {
+			return checkLineage(ctx, cert.Lineage, err)
+		}
+		// the first client's blocks are from the first epoch, if the file still has its key
+		legacyKey := fileInfo.blockKey(0)
+		for currUUID := fileInfo.StartAppend; currUUID != uuid.Nil; {
+			block, err := loadAppendBlock(ctx, cert.FileInfo, currUUID, fileInfo)
+			if err != nil {
+				return err
+			}
+			if legacyKey != nil {
+				err = reseal(sealContext{Kind: KindAppendBlock, UUID: currUUID, File: cert.FileInfo}, legacyKey)
+				if err != nil {
+					return err
+				}
+				err = reseal(sealContext{Kind: KindAppendData, UUID: block.FileData, File: cert.FileInfo}, legacyKey)
+				if err != nil {
+					return err
+				}
+			}
+			currUUID = block.NextAppend
+		}
+		if fileInfo.Migrated {
+			return nil
+		}
+		// from now on the chain only opens sealed
+		fileInfo.Migrated = true
+		return storeFileInfo(ctx, cert.FileInfo, fileInfo, token)
+	})
+	if err != nil || userdata.Migrated {
+		return migrated, err
+	}
+	err = userdata.refresh(ctx)
+	if err != nil {
+		return migrated, err
+	}
+	userdata.Migrated = true
+	return migrated, userdata.reencryptUser(ctx)
+}
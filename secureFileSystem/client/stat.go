@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// FileStat is what StatFile returns.
+type FileStat struct {
+	Size int64  // bytes of content
+	ETag string // changes whenever the content does
+}
+
+// StatFile tells how big filename is and gives a tag that changes with its content,
+// from its FileInfo and the last blocks of its chain without reading the content.
+// Files from before quotas that their owner hasn't written to since don't keep a Size,
+// for them it's counted from the chain.
+func (userdata *User) StatFile(filename string) (stat *FileStat, err error) {
+	return userdata.StatFileContext(context.Background(), filename)
+}
+
+// StatFileContext is like StatFile but gives up once ctx is done, see context.go.
+func (userdata *User) StatFileContext(ctx context.Context, filename string) (stat *FileStat, err error) {
+	fileInfo, certificate, err := userdata.nameToFileInfo(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo == nil {
+		return nil, wrapErr(ErrNotFound, "file %q", filename)
+	}
+	// appends that linked their block in but haven't got to FileInfo count too
+	end, err := loadAppendBlock(ctx, certificate.FileInfo, fileInfo.EndAppend, fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = fileInfo.catchUp(ctx, certificate.FileInfo, fileInfo.EndAppend, end)
+	if err != nil {
+		return nil, err
+	}
+	stat = &FileStat{Size: fileInfo.Size}
+	if fileInfo.Ledger == nil {
+		stat.Size, err = chainSize(ctx, certificate.FileInfo, fileInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// StoreFile starts a new chain and every append ends it with a new block, both
+	// somewhere nobody has used before
+	tag := userlib.Hash(append(fileInfo.StartAppend[:], fileInfo.EndAppend[:]...))
+	stat.ETag = hex.EncodeToString(tag[:16])
+	return stat, nil
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// A Tx groups StoreFile and AppendToFile calls on any number of files so they take
+// effect together. Each call runs like it would on its own, on the same FileInfos,
+// AppendBlocks and index pages, except that what it makes visible to other sessions stays
+// in the transaction's journal (see journal.go), where its later calls read it back.
+// Commit writes the lot out the way a single call's journal is, so a client that dies
+// halfway has it rolled forward by the next GetUser.
+//
+// Everything the transaction read from the Datastore is remembered by digest, the first
+// time it was read. Commit checks all of it is still stored unchanged first, and if
+// another session changed any of it in the meantime, appended to one of the files,
+// renamed one, revoked someone, committed a transaction of its own, it returns
+// ErrConflict and writes nothing. Readers that come along while Commit is writing can
+// still see some files changed and others not yet, and a session that changes something
+// between the check and the writes isn't noticed, the Datastore has nothing like
+// compare-and-swap to close that gap with.
+type Tx struct {
+	userdata *User
+	ctx      context.Context
+	journal  *journal
+	reads    *readSet
+
+	mu       sync.Mutex
+	finished bool
+}
+
+type txReadsKey struct{}
+
+// The read set of the transaction the call is part of, nil if it isn't part of one
+func txReadsOf(ctx context.Context) *readSet {
+	reads, _ := ctx.Value(txReadsKey{}).(*readSet)
+	return reads
+}
+
+// Begin starts a transaction. Nothing its calls change is visible to anyone else until
+// Commit returns.
+func (userdata *User) Begin() *Tx {
+	return userdata.BeginContext(context.Background())
+}
+
+// BeginContext is like Begin, the transaction's calls and its Commit give up once ctx
+// is done, see context.go.
+func (userdata *User) BeginContext(ctx context.Context) *Tx {
+	tx := &Tx{
+		userdata: userdata,
+		journal:  newJournal(userdata),
+		reads:    &readSet{digests: make(map[uuid.UUID][sha256.Size]byte)},
+	}
+	ctx = context.WithValue(ctx, journalKey{}, tx.journal)
+	tx.ctx = context.WithValue(ctx, txReadsKey{}, tx.reads)
+	return tx
+}
+
+// Runs one call of the transaction. A call that fails leaves nothing in the journal, the
+// transaction goes on as if it hadn't been made.
+func (tx *Tx) do(call func(ctx context.Context) error) (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.finished {
+		return wrapErr(ErrInvalid, "transaction already finished")
+	}
+	savepoint := tx.journal.save()
+	err = call(tx.ctx)
+	if err != nil {
+		tx.journal.restore(savepoint)
+	}
+	return err
+}
+
+// StoreFile is User.StoreFile as part of the transaction.
+func (tx *Tx) StoreFile(filename string, content []byte) error {
+	return tx.do(func(ctx context.Context) error {
+		return tx.userdata.StoreFileContext(ctx, filename, content)
+	})
+}
+
+// AppendToFile is User.AppendToFile as part of the transaction.
+func (tx *Tx) AppendToFile(filename string, content []byte) error {
+	return tx.do(func(ctx context.Context) error {
+		return tx.userdata.AppendToFileContext(ctx, filename, content)
+	})
+}
+
+// LoadFile is User.LoadFile as part of the transaction, it sees what the transaction
+// wrote so far.
+func (tx *Tx) LoadFile(filename string) (content []byte, err error) {
+	err = tx.do(func(ctx context.Context) error {
+		content, err = tx.userdata.LoadFileContext(ctx, filename)
+		return err
+	})
+	return content, err
+}
+
+// Commit makes everything the transaction did visible, or, if another session changed
+// something it read since, returns ErrConflict and nothing. Either way the transaction
+// is finished.
+func (tx *Tx) Commit() (err error) {
+	defer observe(tx.userdata.observer, OpCommit, tx.userdata.Username)(&err)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.finished {
+		return wrapErr(ErrInvalid, "transaction already finished")
+	}
+	tx.finished = true
+
+	// what's stored now, not what we wrote
+	ctx := context.WithValue(tx.ctx, journalKey{}, (*journal)(nil))
+	ctx = context.WithValue(ctx, txReadsKey{}, (*readSet)(nil))
+	tx.reads.mu.Lock()
+	read := cachedObject{reads: tx.reads.digests}
+	tx.reads.mu.Unlock()
+	unchanged, err := read.fresh(ctx)
+	if err != nil {
+		return err
+	}
+	if !unchanged {
+		return wrapErr(ErrConflict, "another session changed what the transaction read")
+	}
+	_, err = commit(ctx)
+	if err != nil {
+		return err
+	}
+	return tx.journal.flush(ctx)
+}
+
+// Abort finishes the transaction without making any of it visible. What its calls wrote
+// that nothing refers to is left for CollectGarbage.
+func (tx *Tx) Abort() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.finished = true
+}
@@ -0,0 +1,381 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// ObjectStatus is the outcome of checking one Datastore entry in Verify.
+type ObjectStatus string
+
+const (
+	StatusHealthy   ObjectStatus = "healthy"
+	StatusCorrupted ObjectStatus = "corrupted" // failed to decrypt, parse, MAC or signature check
+	StatusMissing   ObjectStatus = "missing"   // referenced but not in the Datastore
+	StatusRevoked   ObjectStatus = "revoked"   // replaced by a valid revocation notice, not a problem
+)
+
+type ObjectReport struct {
+	Kind     ObjectKind
+	UUID     uuid.UUID
+	Filename string // file the object belongs to, empty for the account itself
+	Status   ObjectStatus
+	Reason   string
+}
+
+// VerifyReport lists every object Verify reached, in the order they were checked.
+type VerifyReport struct {
+	Username string
+	Objects  []ObjectReport
+}
+
+// Count returns how many objects have the given status.
+func (report *VerifyReport) Count(status ObjectStatus) int {
+	count := 0
+	for _, object := range report.Objects {
+		if object.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Problems returns the corrupted and missing objects.
+func (report *VerifyReport) Problems() []ObjectReport {
+	var problems []ObjectReport
+	for _, object := range report.Objects {
+		if object.Status == StatusCorrupted || object.Status == StatusMissing {
+			problems = append(problems, object)
+		}
+	}
+	return problems
+}
+
+// OK reports whether nothing reachable was corrupted or missing.
+func (report *VerifyReport) OK() bool {
+	return len(report.Problems()) == 0
+}
+
+// walker does the traversal for both Verify and CollectGarbage. Every object it reaches
+// is checked into report, and everything that has to survive garbage collection is marked live.
+type walker struct {
+	report        *VerifyReport
+	live          map[uuid.UUID]bool
+	chunks        map[uuid.UUID]bool // chunks already checked, files and versions share them
+	invitationTTL time.Duration
+}
+
+func newWalker(username string, invitationTTL time.Duration) *walker {
+	if invitationTTL <= 0 {
+		invitationTTL = DefaultInvitationTTL
+	}
+	return &walker{
+		report:        &VerifyReport{Username: username},
+		live:          make(map[uuid.UUID]bool),
+		chunks:        make(map[uuid.UUID]bool),
+		invitationTTL: invitationTTL,
+	}
+}
+
+// records the result of loading one object, returns true if it's safe to follow what it points to
+func (w *walker) check(kind ObjectKind, id uuid.UUID, filename string, err error) bool {
+	object := ObjectReport{Kind: kind, UUID: id, Filename: filename, Status: StatusHealthy}
+	var integrityErr *IntegrityError
+	switch {
+	case err == nil:
+	case errors.As(err, &integrityErr):
+		object.Kind = integrityErr.Kind
+		object.UUID = integrityErr.UUID
+		object.Status = StatusCorrupted
+		if integrityErr.Reason == reasonMissing {
+			object.Status = StatusMissing
+		}
+		object.Reason = integrityErr.Reason
+	case errors.Is(err, ErrRevoked):
+		object.Status = StatusRevoked
+		object.Reason = err.Error()
+	default:
+		object.Status = StatusCorrupted
+		object.Reason = err.Error()
+	}
+	w.report.Objects = append(w.report.Objects, object)
+	if object.Status != StatusMissing {
+		w.live[object.UUID] = true
+	}
+	return err == nil
+}
+
+// keeps entries we can't check ourselves but someone else still needs
+func (w *walker) keep(ids ...uuid.UUID) {
+	for _, id := range ids {
+		w.live[id] = true
+	}
+}
+
+// Verify re-checks every MAC and signature reachable from the user: the login entry,
+// the User struct, the index pages of its namespace, each certificate (with its wrapped key and signature), each FileInfo
+// and its whole AppendBlock/AppendData/chunk chain, plus the invitations the user sent that
+// nobody has accepted yet. Unlike the file operations it keeps going
+// after a failure and reports every healthy, corrupted and missing object it reaches.
+// The returned error is only non-nil if the account itself can't be found.
+func (userdata *User) Verify() (report *VerifyReport, err error) {
+	return userdata.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify but gives up once ctx is done, see context.go.
+func (userdata *User) VerifyContext(ctx context.Context) (report *VerifyReport, err error) {
+	w := newWalker(userdata.Username, DefaultInvitationTTL)
+	err = w.walkAccount(ctx, userdata)
+	if err != nil {
+		return nil, err
+	}
+	return w.report, nil
+}
+
+func (w *walker) walkAccount(ctx context.Context, userdata *User) (err error) {
+	// the login entry has to match the password this session logged in with
+	userUUID := loginUUID(userdata.Username)
+	entry, legacy, exists, err := readLoginEntry(ctx, userdata.Username)
+	if errors.Is(err, ErrIntegrity) {
+		w.check(KindLogin, userUUID, "", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return wrapErr(ErrNotFound, "user %q", userdata.Username)
+	}
+	rootKey, passUUID, err := userdata.login()
+	if err != nil {
+		return err
+	}
+	if legacy || !userlib.HMACEqual(entry, userdata.cache.verifier) {
+		w.check(KindLogin, userUUID, "", integrityErr(KindLogin, userUUID, "login entry doesn't match the password"))
+		return nil
+	}
+	w.check(KindLogin, userUUID, "", nil)
+
+	user := &User{}
+	err = loadSealed(ctx, sealContext{Kind: KindUser, UUID: passUUID, Migrated: true}, rootKey, user)
+	if !w.check(KindUser, passUUID, "", err) {
+		return nil
+	}
+	// a session of the account may be in the middle of writing out its journal
+	journalAt, err := journalObject(rootKey)
+	if err != nil {
+		return err
+	}
+	w.keep(journalAt.UUID)
+	if user.Ledger != nil {
+		_, err = user.loadLedger(ctx, user.Ledger)
+		w.check(KindLedger, user.Ledger.UUID, "", err)
+		if user.Ledger.Owner != "" {
+			var object sealContext
+			object, err = quotaObject(user.Ledger)
+			if err != nil {
+				return err
+			}
+			_, err = user.loadQuota(ctx, user.Ledger)
+			w.check(KindQuota, object.UUID, "", err)
+		}
+	}
+
+	// the index pages first, a page that doesn't check out only loses the files under it
+	checkPage := func(id uuid.UUID, err error) bool {
+		return w.check(KindIndexPage, id, "", err)
+	}
+	err = user.walkFiles(ctx, checkPage, func(filename string, certUUID uuid.UUID, sender string) error {
+		w.walkFile(ctx, user, filename, certUUID, sender)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrIntegrity) {
+		return err
+	}
+	if err != nil {
+		w.check(KindUser, passUUID, "", err)
+	}
+	if user.Namespace != nil {
+		err = user.certsTree().walk(ctx, checkPage, func(string, IndexEntry) error { return nil })
+		if err != nil && !errors.Is(err, ErrIntegrity) {
+			return err
+		}
+	}
+	w.walkInvitations(ctx, user)
+	return nil
+}
+
+func (w *walker) walkFile(ctx context.Context, userdata *User, filename string, certUUID uuid.UUID, sender string) {
+	// without the key's UUID the certificate can't be opened, that's as bad as a corrupted one
+	keyUUID, err := getCertStructKeyUUID(sender, userdata.Username, certUUID)
+	if err != nil {
+		w.check(KindCertKey, certUUID, filename, err)
+		return
+	}
+	encSymKey, symKey, err := loadCertKey(ctx, sender, userdata.Username, certUUID, userdata.DecryptKey)
+	if !w.check(KindCertKey, keyUUID, filename, err) {
+		return
+	}
+	cert, err := loadCertificate(ctx, certUUID, symKey, userdata.Migrated)
+	if !w.check(KindCertificate, certUUID, filename, err) {
+		return
+	}
+	err = verifyCertSignature(ctx, cert, sender, encSymKey)
+	w.check(KindSignature, cert.SignatureUUID, filename, err)
+
+	// the certificates we were shared through hold the revocation notices we'd need
+	w.keep(cert.Lineage...)
+	// a file that moved onto a key tree since we last opened it left us a leaf
+	if cert.Leaf == nil && cert.KeyTree == nil {
+		grant, keyUUID, signatureUUID, err := leafGrantObject(sender, userdata.Username, certUUID, cert.FileInfo)
+		if err != nil {
+			return
+		}
+		leaf, err := userdata.loadLeafGrant(ctx, sender, certUUID, cert.FileInfo)
+		if err != nil || leaf != nil {
+			w.check(KindLeafGrant, grant.UUID, filename, err)
+			w.keep(keyUUID, signatureUUID)
+		}
+		if err != nil {
+			return
+		}
+		if leaf != nil {
+			cert.AccessToken = nil
+			cert.Leaf = leaf
+		}
+	}
+
+	// the owner checks the whole key tree, everyone else the way up from their leaf
+	token := cert.AccessToken
+	switch {
+	case cert.KeyTree != nil:
+		userdata.keyTree(cert).walk(ctx, func(kind ObjectKind, id uuid.UUID, err error) bool {
+			return w.check(kind, id, filename, err)
+		})
+		token, err = userdata.keyTree(cert).token(ctx)
+	case cert.Leaf != nil:
+		var wraps []uuid.UUID
+		token, wraps, err = leafToken(ctx, nil, cert.FileInfo, cert.Leaf)
+		if err != nil {
+			err = checkLineage(ctx, cert.Lineage, err)
+		}
+		for i, id := range wraps {
+			if i < len(wraps)-1 || err == nil {
+				w.check(KindKeyWrap, id, filename, nil)
+			} else {
+				w.check(KindKeyWrap, id, filename, err)
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	fileInfo, err := loadFileInfo(ctx, cert.FileInfo, token, userdata.Migrated)
+	if err != nil {
+		err = checkLineage(ctx, cert.Lineage, err)
+	}
+	if !w.check(KindFileInfo, cert.FileInfo, filename, err) {
+		return
+	}
+
+	// walk the chain, a bad AppendData doesn't stop us but a bad AppendBlock cuts the chain
+	seen := make(map[uuid.UUID]bool)
+	currUUID := fileInfo.StartAppend
+	for currUUID != uuid.Nil {
+		if seen[currUUID] {
+			w.check(KindAppendBlock, currUUID, filename, integrityErr(KindAppendBlock, currUUID, "append chain loops"))
+			return
+		}
+		seen[currUUID] = true
+		block, err := loadAppendBlock(ctx, cert.FileInfo, currUUID, fileInfo)
+		if !w.check(KindAppendBlock, currUUID, filename, err) {
+			return
+		}
+		appendData, err := loadAppendData(ctx, cert.FileInfo, block.FileData, fileInfo)
+		if w.check(KindAppendData, block.FileData, filename, err) {
+			for _, ref := range appendData.Chunks {
+				if w.chunks[ref.UUID] {
+					continue
+				}
+				w.chunks[ref.UUID] = true
+				_, err = loadChunk(ctx, ref)
+				w.check(KindChunk, ref.UUID, filename, err)
+			}
+		}
+		currUUID = block.NextAppend
+	}
+	// blocks past it are appends that haven't been recorded in FileInfo yet, see catchUp
+	if !seen[fileInfo.EndAppend] {
+		w.check(KindFileInfo, cert.FileInfo, filename, integrityErr(KindFileInfo, cert.FileInfo, "EndAppend is not on the chain"))
+	}
+}
+
+// Invitations are kept until they expire, the ones that were accepted by the recipient
+// after that. Whether they were isn't something we can see, and we can't decrypt the
+// certificate either, but we can check the wrapped key and our signature over it, and keep
+// a LeafGrant the recipient will need when they next open the file.
+func (w *walker) walkInvitations(ctx context.Context, userdata *User) {
+	invitationUUIDs := make([]uuid.UUID, 0, len(userdata.Invitations))
+	for invitationUUID := range userdata.Invitations {
+		invitationUUIDs = append(invitationUUIDs, invitationUUID)
+	}
+	sort.Slice(invitationUUIDs, func(i, j int) bool {
+		return invitationUUIDs[i].String() < invitationUUIDs[j].String()
+	})
+	for _, invitationUUID := range invitationUUIDs {
+		invitation := userdata.Invitations[invitationUUID]
+		if invitation.expired(w.invitationTTL) {
+			continue
+		}
+		_, err := datastoreFetch(ctx, KindCertificate, invitationUUID)
+		if err != nil {
+			w.check(KindCertificate, invitationUUID, invitation.Filename, err)
+		} else {
+			w.keep(invitationUUID)
+		}
+		keyUUID, err := getCertStructKeyUUID(userdata.Username, invitation.Recipient, invitationUUID)
+		if err != nil {
+			w.check(KindCertKey, invitationUUID, invitation.Filename, err)
+			continue
+		}
+		encSymKey, err := datastoreFetchEnvelope(ctx, KindCertKey, SuiteRSAOAEP, keyUUID)
+		if err == nil {
+			// a bad wrapped key would only show as a bad signature otherwise
+			encKey, exists, keyErr := keystoreGet(ctx, invitation.Recipient+" encKey")
+			switch {
+			case keyErr != nil:
+				err = keyErr
+			case !exists:
+				err = wrapErr(ErrNotFound, "encryption key of user %q", invitation.Recipient)
+			case len(encSymKey) != encKey.PubKey.Size():
+				err = integrityErr(KindCertKey, keyUUID, "malformed wrapped key")
+			}
+		}
+		if !w.check(KindCertKey, keyUUID, invitation.Filename, err) {
+			continue
+		}
+		signature, err := datastoreFetchEnvelope(ctx, KindSignature, SuiteRSASign, invitation.Signature)
+		if err == nil {
+			verifyKey, exists, keyErr := keystoreGet(ctx, userdata.Username+" verifyKey")
+			switch {
+			case keyErr != nil:
+				err = keyErr
+			case !exists:
+				err = wrapErr(ErrNotFound, "verify key of user %q", userdata.Username)
+			case dsVerify(verifyKey, encSymKey, signature) != nil:
+				err = integrityErr(KindSignature, invitation.Signature, "bad signature")
+			}
+		}
+		w.check(KindSignature, invitation.Signature, invitation.Filename, err)
+		grant, grantKeyUUID, grantSignatureUUID, err := leafGrantObject(userdata.Username, invitation.Recipient, invitationUUID, uuid.Nil)
+		if err == nil {
+			w.keep(grant.UUID, grantKeyUUID, grantSignatureUUID)
+		}
+	}
+}
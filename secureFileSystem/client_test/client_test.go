@@ -6,10 +6,15 @@ package client_test
 import (
 	// Some imports use an underscore to prevent the compiler from complaining
 	// about unused imports.
+	"context"
+	"crypto/sha256"
 	_ "encoding/hex"
-	_ "errors"
+	"errors"
+	"fmt"
+	"sort"
 	_ "strconv"
-	_ "strings"
+	"strings"
+	"sync"
 	"testing"
 
 	// A "dot" import is used here so that the functions in the ginko and gomega
@@ -352,6 +357,28 @@ var _ = Describe("Client Tests", func() {
 			Expect(err).ToNot(BeNil())
 		})
 
+		Specify("Custom Test: Only the owner can revoke", func() {
+			alice, _ = client.InitUser("alice", defaultPassword)
+			bob, _ = client.InitUser("bob", defaultPassword)
+			charles, _ = client.InitUser("charles", defaultPassword)
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(Succeed())
+			invite, _ := alice.CreateInvitation(aliceFile, "bob")
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+			invite, _ = bob.CreateInvitation(bobFile, "charles")
+			Expect(charles.AcceptInvitation("bob", invite, charlesFile)).To(Succeed())
+
+			userlib.DebugMsg("Bob tries to revoke Charles, who he shared the file with.")
+			err := bob.RevokeAccess(bobFile, "charles")
+			Expect(errors.Is(err, client.ErrInvalid)).To(BeTrue())
+			content, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne)))
+			Expect(alice.AppendToFile(aliceFile, []byte(contentTwo))).To(Succeed())
+			content, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
 		Specify("Custom Test: Testing Datastore Entry Deletion", func() {
 			userlib.DebugMsg("Initializing users Alice, Bob, and Charlie.")
 			alice, err = client.InitUser("alice", defaultPassword)
@@ -362,95 +389,1690 @@ var _ = Describe("Client Tests", func() {
 
 			charles, err = client.InitUser("charles", defaultPassword)
 			Expect(err).To(BeNil())
-			userlib.DatastoreClear()
+			userlib.DatastoreClear()
+
+			userlib.DebugMsg("Trying to access users Alice, should error.")
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+
+		})
+
+		Specify("Custom Test: Testing Keystore Entry Deletion", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charlie.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			userlib.KeystoreClear()
+
+			userlib.DebugMsg("Trying to access key, should error while looking for key.")
+			err = alice.StoreFile(aliceFile, []byte("content"))
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Bandwidth Tests", func() {
+			measureBandwidth := func(probe func()) (bandwidth int) {
+				before := userlib.DatastoreGetBandwidth()
+				probe()
+				after := userlib.DatastoreGetBandwidth()
+				return after - before
+			}
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			size10 := make([]byte, 10)
+			err = alice.StoreFile("alice10.txt", size10)
+			bw1 := measureBandwidth(func() {
+				alice.AppendToFile("alice10.txt", []byte("append"))
+			})
+			userlib.DebugMsg("Appending to a File of Size %d.", len(size10))
+
+			size50 := make([]byte, 50)
+			err = alice.StoreFile("alice50.txt", size50)
+			bw2 := measureBandwidth(func() {
+				alice.AppendToFile("alice50.txt", []byte("append"))
+			})
+			userlib.DebugMsg("Appending to a File of Size %d.", len(size50))
+
+			size200 := make([]byte, 200)
+			err = alice.StoreFile("alice200.txt", size200)
+			bw3 := measureBandwidth(func() {
+				alice.AppendToFile("alice200.txt", []byte("append"))
+			})
+			userlib.DebugMsg("Appending to a File of Size %d.", len(size200))
+
+			size1000 := make([]byte, 1000)
+			err = alice.StoreFile("alice1000.txt", size1000)
+			bw4 := measureBandwidth(func() {
+				alice.AppendToFile("alice1000.txt", []byte("append"))
+			})
+			userlib.DebugMsg("Appending to a File of Size %d.", len(size1000))
+
+			size2000 := make([]byte, 2000)
+			err = alice.StoreFile("alice2000.txt", size2000)
+			bw5 := measureBandwidth(func() {
+				alice.AppendToFile("alice2000.txt", []byte("append"))
+			})
+			userlib.DebugMsg("Appending to a File of Size %d.", len(size2000))
+
+			size10000 := make([]byte, 10000)
+			err = alice.StoreFile("alice10000.txt", size10000)
+			bw6 := measureBandwidth(func() {
+				alice.AppendToFile("alice10000.txt", []byte("append"))
+			})
+			userlib.DebugMsg("Appending to a File of Size %d.", len(size10000))
+
+			maxDiff := bw2 - bw1
+			diff2 := bw4 - bw3
+			diff3 := bw6 - bw5
+
+			if diff2 > maxDiff {
+				maxDiff = diff2
+			}
+			if diff3 > maxDiff {
+				maxDiff = diff3
+			}
+			userlib.DebugMsg("Max Difference in Bandwidth between Appends is %d.", maxDiff)
+			isGreaterThan500 := maxDiff > 500
+			Expect(isGreaterThan500).To(BeFalse())
+		})
+	})
+
+	Describe("Error Tests", func() {
+		Specify("Error Test: User mistakes are not reported as tampering.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			_, err = client.InitUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrExists)).To(BeTrue())
+			_, err = client.GetUser("alex", defaultPassword)
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			_, err = client.GetUser("alice", wrongPassword)
+			Expect(errors.Is(err, client.ErrAuth)).To(BeTrue())
+			_, err = alice.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			_, err = alice.CreateInvitation(aliceFile, "legoat")
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			err = bob.AcceptInvitation("alice", uuid.New(), bobFile)
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeFalse())
+		})
+
+		Specify("Error Test: Tampering reports the object kind and UUID.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			beforeStore := userlib.DatastoreGetMap()
+			before := make(map[uuid.UUID]bool)
+			for id := range beforeStore {
+				before[id] = true
+			}
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			for id := range userlib.DatastoreGetMap() {
+				if before[id] {
+					continue
+				}
+				original, _ := userlib.DatastoreGet(id)
+				userlib.DatastoreSet(id, []byte(maliciousContent))
+				_, err = alice.LoadFile(aliceFile)
+				Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+				var integrityErr *client.IntegrityError
+				Expect(errors.As(err, &integrityErr)).To(BeTrue())
+				Expect(integrityErr.Kind).ToNot(BeEmpty())
+				userlib.DatastoreSet(id, original)
+			}
+		})
+
+		Specify("Error Test: Ciphertexts can't be replayed at another UUID of the same file.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			var appendData []uuid.UUID
+			for _, object := range report.Objects {
+				if object.Kind == client.KindAppendData {
+					appendData = append(appendData, object.UUID)
+				}
+			}
+			Expect(appendData).To(HaveLen(2))
+
+			userlib.DebugMsg("Replaying the second AppendData over the first.")
+			second, _ := userlib.DatastoreGet(appendData[1])
+			userlib.DatastoreSet(appendData[0], second)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			var integrityErr *client.IntegrityError
+			Expect(errors.As(err, &integrityErr)).To(BeTrue())
+			Expect(integrityErr.Kind).To(Equal(client.KindAppendData))
+			Expect(integrityErr.UUID).To(Equal(appendData[0]))
+		})
+
+		Specify("Error Test: Revoked users and their recipients get ErrRevoked.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+		})
+	})
+
+	Describe("Verify Tests", func() {
+		Specify("Verify Test: A clean account verifies and every corrupted object is reported.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+			healthy := report.Count(client.StatusHealthy)
+			Expect(healthy).To(Equal(len(report.Objects)))
+
+			report, err = bob.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+
+			userlib.DebugMsg("Corrupting every object reachable from Alice, one at a time.")
+			report, _ = alice.Verify()
+			for _, object := range report.Objects[1:] {
+				original, _ := userlib.DatastoreGet(object.UUID)
+				userlib.DatastoreSet(object.UUID, []byte(maliciousContent))
+				corrupted, err := alice.Verify()
+				Expect(err).To(BeNil())
+				Expect(corrupted.OK()).To(BeFalse())
+				Expect(corrupted.Problems()[0].UUID).To(Equal(object.UUID))
+				userlib.DatastoreSet(object.UUID, original)
+			}
+		})
+
+		Specify("Verify Test: Verify keeps going after the first problem.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			var dataUUIDs []uuid.UUID
+			for _, object := range report.Objects {
+				if object.Kind == client.KindAppendData && object.Filename == aliceFile {
+					dataUUIDs = append(dataUUIDs, object.UUID)
+				}
+			}
+			Expect(dataUUIDs).To(HaveLen(3))
+
+			userlib.DatastoreSet(dataUUIDs[0], []byte(maliciousContent))
+			userlib.DatastoreDelete(dataUUIDs[2])
+			after, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(after.Objects).To(HaveLen(len(report.Objects)))
+			Expect(after.Count(client.StatusCorrupted)).To(Equal(1))
+			Expect(after.Count(client.StatusMissing)).To(Equal(1))
+			for _, object := range after.Objects {
+				if object.Filename == bobFile {
+					Expect(object.Status).To(Equal(client.StatusHealthy))
+				}
+			}
+		})
+	})
+
+	Describe("Namespace Tests", func() {
+		Specify("Namespace Test: ListFiles and DeleteFile.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{aliceFile, bobFile}))
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			pending, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob deleting his copy leaves Alice's alone.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			files, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(BeEmpty())
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Alice deleting the file she owns revokes the pending invitation too.")
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			before := len(userlib.DatastoreGetMap())
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", before))
+			files, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{bobFile}))
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			err = charles.AcceptInvitation("alice", pending, charlesFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			err = alice.DeleteFile(aliceFile)
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+		})
+
+		Specify("Namespace Test: RenameFile keeps shares and invitations working.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			pending, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			err = alice.RenameFile(aliceFile, charlesFile)
+			Expect(errors.Is(err, client.ErrExists)).To(BeTrue())
+			err = alice.RenameFile("missing.txt", "other.txt")
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+
+			userlib.DebugMsg("Alice renames the shared file, Bob's name for it stays.")
+			err = alice.RenameFile(aliceFile, "renamed.txt")
+			Expect(err).To(BeNil())
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{charlesFile, "renamed.txt"}))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile("renamed.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Charles can still accept the invitation Alice sent before renaming.")
+			err = charles.AcceptInvitation("alice", pending, aliceFile)
+			Expect(err).To(BeNil())
+			data, err = charles.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Namespace Test: Adding a file costs about the same with 100 files or 700.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			name := func(i int) string { return fmt.Sprintf("file %04d", i) }
+			added := make(map[int]int)
+			for i := 0; i < 700; i++ {
+				before := userlib.DatastoreGetBandwidth()
+				err = alice.StoreFile(name(i), []byte(contentOne))
+				Expect(err).To(BeNil())
+				added[i] = userlib.DatastoreGetBandwidth() - before
+			}
+			userlib.DebugMsg("Adding file 100 moved %d bytes, file 699 %d.", added[100], added[699])
+			Expect(added[699]).To(BeNumerically("<", added[100]*3/2))
+
+			userlib.DebugMsg("A new session only reads the pages on the way to the file.")
+			alicePhone, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			before := userlib.DatastoreGetBandwidth()
+			data, err := alicePhone.LoadFile(name(350))
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			Expect(userlib.DatastoreGetBandwidth() - before).To(BeNumerically("<", 700*30))
+
+			files, err := alicePhone.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(HaveLen(700))
+			Expect(sort.StringsAreSorted(files)).To(BeTrue())
+
+			userlib.DebugMsg("Renames, deletes and shares work at that size too.")
+			err = alicePhone.RenameFile(name(10), "renamed.txt")
+			Expect(err).To(BeNil())
+			err = alicePhone.DeleteFile(name(20))
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(name(10))
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			_, err = alice.LoadFile(name(20))
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			invite, err := alice.CreateInvitation("renamed.txt", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			files, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(HaveLen(699))
+			Expect(files).To(ContainElement("renamed.txt"))
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+			stats, err := client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{DryRun: true})
+			Expect(err).To(BeNil())
+			Expect(stats.Garbage).To(Equal(0))
+		})
+	})
+
+	Describe("Garbage Collection Tests", func() {
+		Specify("GC Test: Overwritten chains are collected and files still load.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Nothing is garbage yet.")
+			stats, err := client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{DryRun: true})
+			Expect(err).To(BeNil())
+			Expect(stats.Accounts).To(Equal(2))
+			Expect(stats.Garbage).To(Equal(0))
+
+			userlib.DebugMsg("Overwriting the file leaves the old chain behind.")
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			before := len(userlib.DatastoreGetMap())
+			stats, err = client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{DryRun: true})
+			Expect(err).To(BeNil())
+			Expect(stats.Garbage).To(Equal(4))
+			Expect(stats.GarbageBytes).To(BeNumerically(">", 0))
+			Expect(stats.Deleted).To(Equal(0))
+			Expect(userlib.DatastoreGetMap()).To(HaveLen(before))
+
+			stats, err = client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{})
+			Expect(err).To(BeNil())
+			Expect(stats.Deleted).To(Equal(4))
+			Expect(userlib.DatastoreGetMap()).To(HaveLen(before - 4))
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+		})
+
+		Specify("GC Test: Abandoned invitations expire, accepted ones don't.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			sessions := []*client.User{alice, bob, charles}
+			stats, err := client.CollectGarbage(sessions, client.GCOptions{DryRun: true})
+			Expect(err).To(BeNil())
+			Expect(stats.Garbage).To(Equal(0))
+
+			userlib.DebugMsg("Charles' invitation (certificate, wrapped key, signature) is garbage once it expires.")
+			stats, err = client.CollectGarbage(sessions, client.GCOptions{InvitationTTL: 1})
+			Expect(err).To(BeNil())
+			Expect(stats.Deleted).To(Equal(3))
+
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("GC Test: GC refuses to run without every session or on a corrupted account.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			_, err = client.CollectGarbage([]*client.User{alice}, client.GCOptions{})
+			Expect(errors.Is(err, client.ErrAuth)).To(BeTrue())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			var fileInfoUUID uuid.UUID
+			for _, object := range report.Objects {
+				if object.Kind == client.KindFileInfo {
+					fileInfoUUID = object.UUID
+				}
+			}
+			userlib.DatastoreSet(fileInfoUUID, []byte(maliciousContent))
+			before := len(userlib.DatastoreGetMap())
+			_, err = client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{})
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			Expect(userlib.DatastoreGetMap()).To(HaveLen(before))
+
+			userlib.DebugMsg("Forcing it sweeps the chain behind the corrupted FileInfo.")
+			stats, err := client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{Force: true})
+			Expect(err).To(BeNil())
+			Expect(stats.Deleted).To(Equal(2))
+		})
+
+		Specify("GC Test: Writes made while it walks are kept.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			// another session stores a file, and a call in flight a value it hasn't linked in yet
+			unlinked := uuid.New()
+			writing := &writingDatastore{during: func() {
+				err := alice.StoreFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				userlib.DatastoreSet(unlinked, []byte(contentThree))
+			}}
+			client.SetDatastore(writing)
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			stats, err := client.CollectGarbage([]*client.User{alice}, client.GCOptions{})
+			Expect(err).To(BeNil())
+			Expect(writing.during).To(BeNil())
+			Expect(stats.Deleted).To(Equal(0))
+			_, ok := userlib.DatastoreGet(unlinked)
+			Expect(ok).To(BeTrue())
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("The next run deletes what nothing linked in.")
+			stats, err = client.CollectGarbage([]*client.User{alice}, client.GCOptions{})
+			Expect(err).To(BeNil())
+			Expect(stats.Deleted).To(Equal(1))
+			_, ok = userlib.DatastoreGet(unlinked)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Chunking Tests", func() {
+		Specify("Chunking Test: Big files are deduplicated per account and chunks are checked.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(256 << 10)
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			chunks := func() map[uuid.UUID]bool {
+				report, err := alice.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.OK()).To(BeTrue())
+				found := make(map[uuid.UUID]bool)
+				for _, object := range report.Objects {
+					if object.Kind == client.KindChunk {
+						found[object.UUID] = true
+					}
+				}
+				return found
+			}
+			firstChunks := chunks()
+			Expect(len(firstChunks)).To(BeNumerically(">", 4))
+
+			userlib.DebugMsg("Changing a few bytes only uploads the chunks around them.")
+			edited := append([]byte{}, content...)
+			copy(edited[100<<10:], "a small edit")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, edited)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap()) - before).To(BeNumerically("<", 6))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+
+			userlib.DebugMsg("A second copy only adds metadata.")
+			before = len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(bobFile, content)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap()) - before).To(BeNumerically("<", len(firstChunks)))
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+
+			userlib.DebugMsg("Sharing works, recipients don't need alice's DedupKey.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+
+			userlib.DebugMsg("GC keeps chunks another file still uses.")
+			err = alice.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			stats, err := client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{})
+			Expect(err).To(BeNil())
+			Expect(stats.Deleted).To(BeNumerically(">", 0))
+			Expect(stats.Deleted).To(BeNumerically("<", len(firstChunks)))
+			data, err = bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+
+			userlib.DebugMsg("Tampering with a chunk is caught.")
+			for id := range chunks() {
+				userlib.DatastoreSet(id, []byte("not a chunk"))
+				break
+			}
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			var integrityErr *client.IntegrityError
+			Expect(errors.As(err, &integrityErr)).To(BeTrue())
+			Expect(integrityErr.Kind).To(Equal(client.KindChunk))
+		})
+	})
+
+	Describe("Padding Tests", func() {
+		Specify("Padding Test: Padded AppendData only shows the bucket and can't be trimmed.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			// ciphertext length of every AppendData in filename, in chain order, without the
+			// envelope header ("SFSE", version, suite, kind length, kind, key ID)
+			headerLen := len("SFSE") + 3 + len(client.KindAppendData) + 4
+			appendDataSizes := func(user *client.User, filename string) (sizes []int, ids []uuid.UUID) {
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.OK()).To(BeTrue())
+				for _, object := range report.Objects {
+					if object.Kind == client.KindAppendData && object.Filename == filename {
+						value, ok := userlib.DatastoreGet(object.UUID)
+						Expect(ok).To(BeTrue())
+						sizes = append(sizes, len(value)-headerLen-userlib.AESBlockSizeBytes-userlib.HashSizeBytes)
+						ids = append(ids, object.UUID)
+					}
+				}
+				return sizes, ids
+			}
+
+			err = alice.SetPadding(client.PaddingPolicy{Mode: client.PadBlock})
+			Expect(errors.Is(err, client.ErrInvalid)).To(BeTrue())
+			err = alice.SetPadding(client.PaddingPolicy{Mode: client.PadPowerOfTwo})
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte("a"))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			sizes, _ := appendDataSizes(alice, aliceFile)
+			Expect(sizes).To(HaveLen(2))
+			Expect(sizes[0]).To(Equal(sizes[1]))
+			Expect(sizes[0] & (sizes[0] - 1)).To(Equal(0))
+
+			userlib.DebugMsg("A file policy applies to everyone writing to the file.")
+			err = alice.SetFilePadding(aliceFile, &client.PaddingPolicy{Mode: client.PadBlock, BlockSize: 1000})
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			sizes, ids := appendDataSizes(alice, aliceFile)
+			Expect(sizes).To(HaveLen(3))
+			Expect(sizes[2]).To(Equal(1000))
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte("a" + contentTwo + contentTwo)))
+
+			userlib.DebugMsg("Trimming or extending the padding is caught.")
+			original, _ := userlib.DatastoreGet(ids[2])
+			for _, tampered := range [][]byte{original[:len(original)-1], append(append([]byte{}, original...), ' ')} {
+				userlib.DatastoreSet(ids[2], tampered)
+				_, err = alice.LoadFile(aliceFile)
+				Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+				var integrityErr *client.IntegrityError
+				Expect(errors.As(err, &integrityErr)).To(BeTrue())
+				Expect(integrityErr.Kind).To(Equal(client.KindAppendData))
+			}
+			userlib.DatastoreSet(ids[2], original)
+
+			userlib.DebugMsg("Going back to the account default.")
+			err = alice.SetFilePadding(aliceFile, nil)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			sizes, _ = appendDataSizes(alice, aliceFile)
+			Expect(sizes).To(HaveLen(1))
+			Expect(sizes[0] & (sizes[0] - 1)).To(Equal(0))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Compression Tests", func() {
+		Specify("Compression Test: Opted-in files compress until they're shared.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			storedBytes := func() (total int) {
+				for _, value := range userlib.DatastoreGetMap() {
+					total += len(value)
+				}
+				return total
+			}
+			logLines := ""
+			for len(logLines) < 1500 {
+				logLines += "GET /index.html 200 OK\n"
+			}
+			bigLog := ""
+			for len(bigLog) < 100<<10 {
+				bigLog += logLines
+			}
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetFileCompression(aliceFile, &client.CompressionPolicy{Algorithm: "lz77"})
+			Expect(errors.Is(err, client.ErrInvalid)).To(BeTrue())
+			err = alice.SetFileCompression(aliceFile, &client.CompressionPolicy{Algorithm: client.CompressDeflate})
+			Expect(err).To(BeNil())
+
+			before := storedBytes()
+			err = alice.AppendToFile(aliceFile, []byte(logLines))
+			Expect(err).To(BeNil())
+			Expect(storedBytes() - before).To(BeNumerically("<", len(logLines)/2))
+			before = storedBytes()
+			err = alice.AppendToFile(aliceFile, []byte(bigLog))
+			Expect(err).To(BeNil())
+			Expect(storedBytes() - before).To(BeNumerically("<", len(bigLog)/10))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + logLines + bigLog)))
+
+			userlib.DebugMsg("Sharing turns it off unless the policy says otherwise.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			for _, user := range []*client.User{alice, bob} {
+				filename := aliceFile
+				if user == bob {
+					filename = bobFile
+				}
+				before = storedBytes()
+				err = user.AppendToFile(filename, []byte(logLines))
+				Expect(err).To(BeNil())
+				Expect(storedBytes() - before).To(BeNumerically(">", len(logLines)))
+			}
+			err = alice.SetFileCompression(aliceFile, &client.CompressionPolicy{Algorithm: client.CompressDeflate, Shared: true})
+			Expect(err).To(BeNil())
+			before = storedBytes()
+			err = bob.AppendToFile(bobFile, []byte(logLines))
+			Expect(err).To(BeNil())
+			Expect(storedBytes() - before).To(BeNumerically("<", len(logLines)/2))
+
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + logLines + bigLog + logLines + logLines + logLines)))
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+		})
+	})
+
+	Describe("Encoding Tests", func() {
+		Specify("Encoding Test: The binary encoding moves fewer bytes per append and stays small.", func() {
+			DeferCleanup(func() { _ = client.SetEncoding(client.EncodingBinary) })
+			// with a backend that can tell the session cache what's unchanged, the bytes it
+			// sends for that are in the observer's count, userlib doesn't see them
+			client.SetDatastore(digestingDatastore{})
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			var moved int
+			client.SetObserver(client.ObserverFunc(func(stats client.OpStats) {
+				moved += stats.BytesRead + stats.BytesWritten
+			}))
+			DeferCleanup(func() { client.SetObserver(nil) })
+			appendBandwidth := make(map[client.Encoding]int)
+			stored := make(map[client.Encoding]int)
+			for _, encoding := range []client.Encoding{client.EncodingJSON, client.EncodingBinary} {
+				userlib.DatastoreClear()
+				userlib.KeystoreClear()
+				Expect(client.SetEncoding(encoding)).To(Succeed())
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+
+				before := moved
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				appendBandwidth[encoding] = moved - before
+				for _, value := range userlib.DatastoreGetMap() {
+					stored[encoding] += len(value)
+				}
+				content, err := alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(content).To(Equal([]byte(contentOne + contentTwo)))
+			}
+			userlib.DebugMsg("Append bandwidth: JSON %d, binary %d. Stored: JSON %d, binary %d.",
+				appendBandwidth[client.EncodingJSON], appendBandwidth[client.EncodingBinary], stored[client.EncodingJSON], stored[client.EncodingBinary])
+			// an append doesn't read the User struct anymore, most of what's left is IVs,
+			// MACs and wrapped keys, which are the same size either way
+			Expect(appendBandwidth[client.EncodingBinary]).To(BeNumerically("<", appendBandwidth[client.EncodingJSON]*9/10))
+			Expect(stored[client.EncodingBinary]).To(BeNumerically("<", stored[client.EncodingJSON]*3/4))
+
+			// regression bounds, a bit over what it takes today. The ledger and the owner's
+			// signed quota are stored for every account.
+			Expect(appendBandwidth[client.EncodingBinary]).To(BeNumerically("<", 2500))
+			Expect(stored[client.EncodingBinary]).To(BeNumerically("<", 6200))
+		})
+	})
+
+	Describe("Metrics Tests", func() {
+		Specify("Metrics Test: Observers see what each call cost and the exporter adds it up.", func() {
+			var observed []client.OpStats
+			exporter := client.NewPrometheusExporter()
+			client.SetObserver(client.ObserverFunc(func(stats client.OpStats) {
+				observed = append(observed, stats)
+				exporter.Observe(stats)
+			}))
+			DeferCleanup(func() { client.SetObserver(nil) })
+
+			// bytes moved have to match what userlib measured for the same call
+			measured := func(probe func()) (bandwidth int, stats client.OpStats) {
+				before := userlib.DatastoreGetBandwidth()
+				count := len(observed)
+				probe()
+				Expect(observed).To(HaveLen(count + 1))
+				return userlib.DatastoreGetBandwidth() - before, observed[count]
+			}
+
+			bandwidth, stats := measured(func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+			})
+			Expect(stats.Op).To(Equal(client.OpInitUser))
+			Expect(stats.KeystoreSets).To(Equal(2))
+			Expect(stats.CryptoOps[client.CryptoKeyGen]).To(Equal(2))
+			Expect(stats.CryptoOps[client.CryptoPasswordHash]).To(Equal(1))
+			Expect(stats.BytesRead + stats.BytesWritten).To(Equal(bandwidth))
+
+			bandwidth, stats = measured(func() {
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+			})
+			Expect(stats.Op).To(Equal(client.OpStoreFile))
+			Expect(stats.Username).To(Equal("alice"))
+			Expect(stats.DatastoreSets).To(BeNumerically(">", 0))
+			Expect(stats.BytesRead + stats.BytesWritten).To(Equal(bandwidth))
+			Expect(stats.CryptoOps[client.CryptoPKE]).To(BeNumerically(">", 0))
+
+			bandwidth, stats = measured(func() {
+				_, err = alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+			})
+			Expect(stats.Op).To(Equal(client.OpLoadFile))
+			Expect(stats.DatastoreSets).To(Equal(0))
+			Expect(stats.BytesRead).To(Equal(bandwidth))
+			Expect(stats.RoundTrips()).To(Equal(stats.DatastoreGets + stats.KeystoreGets))
+			Expect(stats.Duration).To(BeNumerically(">", 0))
+
+			_, stats = measured(func() {
+				_, err = alice.LoadFile(bobFile)
+				Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			})
+			Expect(errors.Is(stats.Err, client.ErrNotFound)).To(BeTrue())
+
+			// a handle can have its own observer, or none
+			alice.SetObserver(nil)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			Expect(observed).To(HaveLen(4))
+
+			var metrics strings.Builder
+			_, err = exporter.WriteTo(&metrics)
+			Expect(err).To(BeNil())
+			Expect(metrics.String()).To(ContainSubstring("# TYPE sfs_client_operations_total counter\n"))
+			Expect(metrics.String()).To(ContainSubstring(`sfs_client_operations_total{op="LoadFile",result="ok"} 1` + "\n"))
+			Expect(metrics.String()).To(ContainSubstring(`sfs_client_operations_total{op="LoadFile",result="not_found"} 1` + "\n"))
+			Expect(metrics.String()).To(ContainSubstring(`sfs_client_keystore_requests_total{op="InitUser",method="set"} 2` + "\n"))
+			Expect(metrics.String()).To(ContainSubstring(`sfs_client_operation_duration_seconds_count{op="StoreFile"} 1` + "\n"))
+			Expect(metrics.String()).ToNot(ContainSubstring("AppendToFile"))
+		})
+	})
+
+	Describe("Context Tests", func() {
+		Specify("Context Test: Cancelling partway leaves other sessions seeing all or nothing.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = alice.LoadFileContext(ctx, aliceFile)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+
+			// cancel after every possible number of writes, until the call gets to commit
+			cancelling := &cancellingDatastore{}
+			client.SetDatastore(cancelling)
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			for _, op := range []struct {
+				name   string
+				call   func(ctx context.Context) error
+				before string
+				after  string
+			}{
+				{"append", func(ctx context.Context) error {
+					return bob.AppendToFileContext(ctx, bobFile, []byte(contentTwo))
+				}, contentOne, contentOne + contentTwo},
+				{"overwrite", func(ctx context.Context) error {
+					return alice.StoreFileContext(ctx, aliceFile, []byte(contentThree))
+				}, contentOne + contentTwo, contentThree},
+			} {
+				for writes := 0; ; writes++ {
+					ctx, cancel := context.WithCancel(context.Background())
+					cancelling.cancelAfter(writes, cancel)
+					err = op.call(ctx)
+					cancel()
+					cancelling.cancelAfter(-1, nil)
+					content, loadErr := bob.LoadFile(bobFile)
+					Expect(loadErr).To(BeNil())
+					if err == nil {
+						userlib.DebugMsg("%s committed after %d writes", op.name, writes)
+						Expect(string(content)).To(Equal(op.after))
+						break
+					}
+					Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+					Expect(string(content)).To(Equal(op.before))
+				}
+			}
+
+			// what the cancelled attempts left behind is unreachable
+			stats, err := client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{DryRun: true})
+			Expect(err).To(BeNil())
+			Expect(stats.Garbage).To(BeNumerically(">", 0))
+		})
+	})
+
+	Describe("Cache Tests", func() {
+		Specify("Cache Test: A session reuses what it opened and still sees other sessions' changes.", func() {
+			// the cache needs a backend that can send digests
+			client.SetDatastore(digestingDatastore{})
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			var observed []client.OpStats
+			client.SetObserver(client.ObserverFunc(func(stats client.OpStats) {
+				observed = append(observed, stats)
+			}))
+			DeferCleanup(func() { client.SetObserver(nil) })
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			bob, err = client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			load := func(user *client.User, filename string) (content string, stats client.OpStats, err error) {
+				observed = nil
+				bytes, err := user.LoadFile(filename)
+				Expect(observed).To(HaveLen(1))
+				return string(bytes), observed[0], err
+			}
+			content, cold, err := load(bob, bobFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(contentOne))
+			Expect(cold.CryptoOps[client.CryptoPKE]).To(BeNumerically(">", 0))
+			content, warm, err := load(bob, bobFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(contentOne))
+			Expect(warm.CryptoOps[client.CryptoPKE]).To(Equal(0))
+			Expect(warm.CryptoOps[client.CryptoSignature]).To(Equal(0))
+			Expect(warm.KeystoreGets).To(Equal(0))
+			Expect(warm.BytesRead).To(BeNumerically("<", cold.BytesRead))
+
+			userlib.DebugMsg("An append from another session shows up.")
+			alicePhone, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alicePhone.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			content, stats, err := load(bob, bobFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(contentOne + contentTwo))
+			Expect(stats.CryptoOps[client.CryptoPKE]).To(Equal(0))
+
+			userlib.DebugMsg("So does a file another session of ours accepted.")
+			err = alice.StoreFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bobLaptop.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			content, _, err = load(bob, charlesFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(contentThree))
+
+			userlib.DebugMsg("And a revocation.")
+			err = alicePhone.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, _, err = load(bob, bobFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			content, _, err = load(alice, aliceFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(contentOne + contentTwo))
+
+			userlib.DebugMsg("Without digests nothing is cached, every load costs what the first one did.")
+			client.SetDatastore(nil)
+			_, cold, err = load(alice, aliceFile)
+			Expect(err).To(BeNil())
+			_, warm, err = load(alice, aliceFile)
+			Expect(err).To(BeNil())
+			Expect(warm.CryptoOps[client.CryptoPKE]).To(Equal(cold.CryptoOps[client.CryptoPKE]))
+			Expect(warm.BytesRead).To(Equal(cold.BytesRead))
+		})
+	})
+
+	Describe("Prefetch Tests", func() {
+		Specify("Prefetch Test: Long chains load in a few batches and are checked all the same.", func() {
+			batching := &batchingDatastore{}
+			client.SetDatastore(batching)
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			var observed []client.OpStats
+			client.SetObserver(client.ObserverFunc(func(stats client.OpStats) {
+				observed = append(observed, stats)
+			}))
+			DeferCleanup(func() { client.SetObserver(nil) })
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected := contentOne
+			big := make([]byte, 5*client.MinChunkSize)
+			for i := range big {
+				big[i] = byte(i * 7)
+			}
+			for i := 0; i < 40; i++ {
+				appended := []byte(fmt.Sprintf("append %d\n", i))
+				if i == 20 {
+					appended = big
+				}
+				err = alice.AppendToFile(aliceFile, appended)
+				Expect(err).To(BeNil())
+				expected += string(appended)
+			}
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			for _, user := range []*client.User{alice, bob} {
+				filename := aliceFile
+				if user == bob {
+					filename = bobFile
+				}
+				observed = nil
+				content, err := user.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(string(content)).To(Equal(expected))
+				// 41 blocks, their AppendData and the big append's chunks one at a time
+				// would be over 80 gets
+				Expect(observed).To(HaveLen(1))
+				userlib.DebugMsg("LoadFile of 41 appends took %d Datastore gets", observed[0].DatastoreGets)
+				Expect(observed[0].DatastoreGets).To(BeNumerically("<", 20))
+			}
+			Expect(batching.batches).To(BeNumerically(">", 0))
+
+			userlib.DebugMsg("A tampered block is caught whether it came in a batch or not.")
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			for key, value := range userlib.DatastoreGetMap() {
+				if before[key] {
+					continue
+				}
+				value[len(value)-1] ^= 1
+				userlib.DatastoreSet(key, value)
+			}
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+	})
+
+	Describe("Revocation Tests", func() {
+		Specify("Revocation Test: Revoking one of many costs about what revoking one of two does.", func() {
+			var observed []client.OpStats
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			alice.SetObserver(client.ObserverFunc(func(stats client.OpStats) {
+				observed = append(observed, stats)
+			}))
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Trying to access users Alice, should error.")
-			alice, err = client.GetUser("alice", defaultPassword)
-			Expect(err).ToNot(BeNil())
+			userlib.DebugMsg("Alice shares one file with eight users and another with two of them.")
+			var users []*client.User
+			for i := 0; i < 8; i++ {
+				user, err := client.InitUser(fmt.Sprintf("user%d", i), defaultPassword)
+				Expect(err).To(BeNil())
+				users = append(users, user)
+				invite, err := alice.CreateInvitation(aliceFile, user.Username)
+				Expect(err).To(BeNil())
+				err = user.AcceptInvitation("alice", invite, aliceFile)
+				Expect(err).To(BeNil())
+				if i < 2 {
+					invite, err = alice.CreateInvitation(bobFile, user.Username)
+					Expect(err).To(BeNil())
+					err = user.AcceptInvitation("alice", invite, bobFile)
+					Expect(err).To(BeNil())
+				}
+			}
+			invite, err := users[0].CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("user0", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			revoke := func(filename string, recipient string) client.OpStats {
+				observed = nil
+				err = alice.RevokeAccess(filename, recipient)
+				Expect(err).To(BeNil())
+				Expect(observed).To(HaveLen(1))
+				return observed[0]
+			}
+			small := revoke(bobFile, "user1")
+			large := revoke(aliceFile, "user3")
+			userlib.DebugMsg("Revoking one of 2 wrote %d values, one of 8 wrote %d", small.DatastoreSets, large.DatastoreSets)
+			Expect(large.CryptoOps[client.CryptoPKE]).To(Equal(small.CryptoOps[client.CryptoPKE]))
+			// the tree is two levels deeper, three writes a level
+			Expect(large.DatastoreSets).To(BeNumerically("<=", small.DatastoreSets+6))
+
+			userlib.DebugMsg("Everyone else keeps access, the revoked users don't.")
+			_, err = users[1].LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			_, err = users[3].LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			data, err := users[0].LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			for i, user := range users {
+				if i == 3 {
+					continue
+				}
+				data, err = user.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			}
+
+			userlib.DebugMsg("Revoking User0 cuts off Charles too, and freed places are handed out again.")
+			revoke(aliceFile, "user0")
+			_, err = charles.LoadFile(charlesFile)
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).To(BeNil())
+			data, err = charles.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
 
+			for _, user := range []*client.User{alice, charles, users[7]} {
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.OK()).To(BeTrue())
+			}
 		})
+	})
 
-		Specify("Custom Test: Testing Keystore Entry Deletion", func() {
-			userlib.DebugMsg("Initializing users Alice, Bob, and Charlie.")
+	Describe("Re-keying Tests", func() {
+		Specify("Re-keying Test: Files stay whole in every mode, only eager revocations pay for the chain.", func() {
+			var observed []client.OpStats
 			alice, err = client.InitUser("alice", defaultPassword)
 			Expect(err).To(BeNil())
-
+			alice.SetObserver(client.ObserverFunc(func(stats client.OpStats) {
+				observed = append(observed, stats)
+			}))
 			bob, err = client.InitUser("bob", defaultPassword)
 			Expect(err).To(BeNil())
-
 			charles, err = client.InitUser("charles", defaultPassword)
 			Expect(err).To(BeNil())
-			userlib.KeystoreClear()
+			err = alice.SetFileReencryption(aliceFile, client.ReencryptLazy)
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+
+			revokeWrites := make(map[client.ReencryptMode]int)
+			for i, mode := range []client.ReencryptMode{client.ReencryptNone, client.ReencryptLazy, client.ReencryptEager} {
+				filename := fmt.Sprintf("rekey-%d.txt", i)
+				userlib.DebugMsg("Revoking Charles from a file of 31 appends with re-encryption %q.", mode)
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				expected := contentOne
+				for n := 0; n < 30; n++ {
+					err = alice.AppendToFile(filename, []byte(contentTwo))
+					Expect(err).To(BeNil())
+					expected += contentTwo
+				}
+				err = alice.SetFileReencryption(filename, "sometimes")
+				Expect(errors.Is(err, client.ErrInvalid)).To(BeTrue())
+				err = alice.SetFileReencryption(filename, mode)
+				Expect(err).To(BeNil())
+				for _, user := range []*client.User{bob, charles} {
+					invite, err := alice.CreateInvitation(filename, user.Username)
+					Expect(err).To(BeNil())
+					err = user.AcceptInvitation("alice", invite, filename)
+					Expect(err).To(BeNil())
+				}
+				// charles would rather keep his old blocks readable, it isn't up to him
+				err = charles.SetFileReencryption(filename, client.ReencryptNone)
+				Expect(errors.Is(err, client.ErrInvalid)).To(BeTrue())
+
+				observed = nil
+				err = alice.RevokeAccess(filename, "charles")
+				Expect(err).To(BeNil())
+				Expect(observed).To(HaveLen(1))
+				revokeWrites[mode] = observed[0].DatastoreSets
+				_, err = charles.LoadFile(filename)
+				Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+
+				for n := 0; n < 3; n++ {
+					err = bob.AppendToFile(filename, []byte(contentThree))
+					Expect(err).To(BeNil())
+					expected += contentThree
+				}
+				for _, user := range []*client.User{alice, bob} {
+					data, err := user.LoadFile(filename)
+					Expect(err).To(BeNil())
+					Expect(string(data)).To(Equal(expected))
+					report, err := user.Verify()
+					Expect(err).To(BeNil())
+					Expect(report.OK()).To(BeTrue())
+				}
 
-			userlib.DebugMsg("Trying to access key, should error while looking for key.")
-			err = alice.StoreFile(aliceFile, []byte("content"))
-			Expect(err).ToNot(BeNil())
+				// a new chain doesn't need any of the old keys
+				err = bob.StoreFile(filename, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				data, err := alice.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentTwo)))
+			}
+			Expect(revokeWrites[client.ReencryptLazy]).To(Equal(revokeWrites[client.ReencryptNone]))
+			// every block and its AppendData but the end block, which is resealed either way
+			Expect(revokeWrites[client.ReencryptEager]).To(Equal(revokeWrites[client.ReencryptNone] + 2*31 - 1))
 		})
+	})
 
-		Specify("Bandwidth Tests", func() {
-			measureBandwidth := func(probe func()) (bandwidth int) {
-				before := userlib.DatastoreGetBandwidth()
-				probe()
-				after := userlib.DatastoreGetBandwidth()
-				return after - before
+	Describe("Journal Tests", func() {
+		Specify("Journal Test: A client that dies after any write leaves the call wholly done or not at all.", func() {
+			for _, username := range []string{"alice", "bob", "charles"} {
+				_, err = client.InitUser(username, defaultPassword)
+				Expect(err).To(BeNil())
+			}
+			sessions := func() (alice, bob, charles *client.User) {
+				users := make(map[string]*client.User)
+				for _, username := range []string{"alice", "bob", "charles"} {
+					user, err := client.GetUser(username, defaultPassword)
+					Expect(err).To(BeNil())
+					users[username] = user
+				}
+				return users["alice"], users["bob"], users["charles"]
 			}
+			alice, bob, charles = sessions()
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(Succeed())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+			charlesInvite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
 
-			alice, err = client.InitUser("alice", defaultPassword)
-			size10 := make([]byte, 10)
-			err = alice.StoreFile("alice10.txt", size10)
-			bw1 := measureBandwidth(func() {
-				alice.AppendToFile("alice10.txt", []byte("append"))
-			})
-			userlib.DebugMsg("Appending to a File of Size %d.", len(size10))
+			// every attempt starts from here
+			datastoreSnapshot := make(map[uuid.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				datastoreSnapshot[key] = value
+			}
+			keystoreSnapshot := make(map[string]userlib.PublicKeyType)
+			for name, value := range userlib.KeystoreGetMap() {
+				keystoreSnapshot[name] = value
+			}
+			restore := func() {
+				userlib.DatastoreClear()
+				for key, value := range datastoreSnapshot {
+					userlib.DatastoreSet(key, value)
+				}
+				userlib.KeystoreClear()
+				for name, value := range keystoreSnapshot {
+					Expect(userlib.KeystoreSet(name, value)).To(Succeed())
+				}
+			}
 
-			size50 := make([]byte, 50)
-			err = alice.StoreFile("alice50.txt", size50)
-			bw2 := measureBandwidth(func() {
-				alice.AppendToFile("alice50.txt", []byte("append"))
-			})
-			userlib.DebugMsg("Appending to a File of Size %d.", len(size50))
+			// what every user sees of every file, fresh sessions so nothing is cached
+			view := func(user *client.User, filename string) string {
+				content, err := user.LoadFile(filename)
+				switch {
+				case errors.Is(err, client.ErrNotFound):
+					return "not found"
+				case errors.Is(err, client.ErrRevoked):
+					return "revoked"
+				case err != nil:
+					return err.Error()
+				}
+				return string(content)
+			}
+			state := func() string {
+				alice, bob, charles := sessions()
+				report, err := alice.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
+				return strings.Join([]string{
+					view(alice, aliceFile), view(alice, "new.txt"), view(alice, "renamed.txt"),
+					view(bob, bobFile), view(charles, charlesFile),
+				}, " | ")
+			}
 
-			size200 := make([]byte, 200)
-			err = alice.StoreFile("alice200.txt", size200)
-			bw3 := measureBandwidth(func() {
-				alice.AppendToFile("alice200.txt", []byte("append"))
-			})
-			userlib.DebugMsg("Appending to a File of Size %d.", len(size200))
+			crashing := &crashingDatastore{}
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			for _, op := range []struct {
+				name string
+				call func(alice, bob, charles *client.User) error
+			}{
+				{"store", func(alice, bob, charles *client.User) error {
+					return alice.StoreFile("new.txt", []byte(contentTwo))
+				}},
+				{"overwrite", func(alice, bob, charles *client.User) error {
+					return alice.StoreFile(aliceFile, []byte(contentThree))
+				}},
+				{"append", func(alice, bob, charles *client.User) error {
+					return bob.AppendToFile(bobFile, []byte(contentTwo))
+				}},
+				{"invite", func(alice, bob, charles *client.User) error {
+					_, err := bob.CreateInvitation(bobFile, "charles")
+					return err
+				}},
+				{"accept", func(alice, bob, charles *client.User) error {
+					return charles.AcceptInvitation("alice", charlesInvite, charlesFile)
+				}},
+				{"revoke", func(alice, bob, charles *client.User) error {
+					return alice.RevokeAccess(aliceFile, "bob")
+				}},
+				{"delete", func(alice, bob, charles *client.User) error {
+					return alice.DeleteFile(aliceFile)
+				}},
+				{"rename", func(alice, bob, charles *client.User) error {
+					return alice.RenameFile(aliceFile, "renamed.txt")
+				}},
+			} {
+				restore()
+				before := state()
+				var crashed []string
+				for writes := 0; ; writes++ {
+					restore()
+					alice, bob, charles = sessions()
+					crashing.crashAfter(writes)
+					client.SetDatastore(crashing)
+					err = op.call(alice, bob, charles)
+					client.SetDatastore(nil)
+					if err == nil {
+						after := state()
+						rolledForward := 0
+						for _, seen := range crashed {
+							Expect(seen).To(Or(Equal(before), Equal(after)))
+							if seen == after {
+								rolledForward++
+							}
+						}
+						userlib.DebugMsg("%s made %d writes, %d crashes were rolled forward", op.name, writes, rolledForward)
+						break
+					}
+					Expect(errors.Is(err, errCrashed)).To(BeTrue())
+					crashed = append(crashed, state())
+				}
+			}
 
-			size1000 := make([]byte, 1000)
-			err = alice.StoreFile("alice1000.txt", size1000)
-			bw4 := measureBandwidth(func() {
-				alice.AppendToFile("alice1000.txt", []byte("append"))
-			})
-			userlib.DebugMsg("Appending to a File of Size %d.", len(size1000))
+			// an account that doesn't get all the way through InitUser isn't there, and
+			// trying again finishes it, with whatever Keystore entries the last try made
+			restore()
+			writes := 0
+			for ; ; writes++ {
+				crashing.crashAfter(writes)
+				client.SetDatastore(crashing)
+				_, err = client.InitUser("doris", defaultPassword)
+				client.SetDatastore(nil)
+				if err == nil {
+					break
+				}
+				Expect(errors.Is(err, errCrashed)).To(BeTrue())
+				_, err = client.GetUser("doris", defaultPassword)
+				Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			}
+			// dying right before the login entry, the Keystore entries are made, the name is
+			// taken for anyone with another password
+			crashing.crashAfter(writes - 1)
+			client.SetDatastore(crashing)
+			_, err = client.InitUser("edgar", defaultPassword)
+			client.SetDatastore(nil)
+			Expect(errors.Is(err, errCrashed)).To(BeTrue())
+			_, err = client.InitUser("edgar", "another password")
+			Expect(errors.Is(err, client.ErrExists)).To(BeTrue())
+			_, err = client.InitUser("edgar", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err := client.GetUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(doris.StoreFile(aliceFile, []byte(contentOne))).To(Succeed())
+			report, err := doris.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.Problems()).To(BeEmpty())
+		})
+	})
 
-			size2000 := make([]byte, 2000)
-			err = alice.StoreFile("alice2000.txt", size2000)
-			bw5 := measureBandwidth(func() {
-				alice.AppendToFile("alice2000.txt", []byte("append"))
-			})
-			userlib.DebugMsg("Appending to a File of Size %d.", len(size2000))
+	Describe("Transaction Tests", func() {
+		Specify("Transaction Test: Files change together, and a transaction that lost a race changes nothing.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("config", []byte("v1\n"))).To(Succeed())
+			Expect(alice.StoreFile("manifest", []byte("config v1\n"))).To(Succeed())
+			invite, err := alice.CreateInvitation("manifest", "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+			aliceDesktop, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
 
-			size10000 := make([]byte, 10000)
-			err = alice.StoreFile("alice10000.txt", size10000)
-			bw6 := measureBandwidth(func() {
-				alice.AppendToFile("alice10000.txt", []byte("append"))
-			})
-			userlib.DebugMsg("Appending to a File of Size %d.", len(size10000))
+			userlib.DebugMsg("Nobody sees a transaction before it commits, except the transaction itself.")
+			tx := alice.Begin()
+			Expect(tx.StoreFile("config", []byte("v2\n"))).To(Succeed())
+			Expect(tx.AppendToFile("manifest", []byte("config v2\n"))).To(Succeed())
+			Expect(tx.StoreFile("checksum", []byte("1234\n"))).To(Succeed())
+			Expect(tx.AppendToFile("checksum", []byte("5678\n"))).To(Succeed())
+			// a call that fails is just left out
+			err = tx.AppendToFile("missing", []byte(contentOne))
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			content, err := tx.LoadFile("checksum")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("1234\n5678\n"))
+			content, err = aliceDesktop.LoadFile("config")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("v1\n"))
+			_, err = aliceDesktop.LoadFile("checksum")
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			content, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("config v1\n"))
 
-			maxDiff := bw2 - bw1
-			diff2 := bw4 - bw3
-			diff3 := bw6 - bw5
+			Expect(tx.Commit()).To(Succeed())
+			content, err = aliceDesktop.LoadFile("config")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("v2\n"))
+			content, err = aliceDesktop.LoadFile("checksum")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("1234\n5678\n"))
+			content, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("config v1\nconfig v2\n"))
+			err = tx.StoreFile("config", []byte("v3\n"))
+			Expect(errors.Is(err, client.ErrInvalid)).To(BeTrue())
+			Expect(errors.Is(tx.Commit(), client.ErrInvalid)).To(BeTrue())
+
+			userlib.DebugMsg("Of two transactions on the same file only the first to commit does.")
+			first := alice.Begin()
+			second := aliceDesktop.Begin()
+			Expect(first.AppendToFile("manifest", []byte("config v3\n"))).To(Succeed())
+			Expect(second.StoreFile("config", []byte("v3 from the desktop\n"))).To(Succeed())
+			Expect(second.AppendToFile("manifest", []byte("config v3 from the desktop\n"))).To(Succeed())
+			Expect(first.Commit()).To(Succeed())
+			err = second.Commit()
+			Expect(errors.Is(err, client.ErrConflict)).To(BeTrue())
+			content, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("config v1\nconfig v2\nconfig v3\n"))
+			content, err = alice.LoadFile("config")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("v2\n"))
+
+			userlib.DebugMsg("A recipient appending in the meantime is a conflict too, an aborted transaction leaves no trace.")
+			tx = alice.Begin()
+			Expect(tx.AppendToFile("manifest", []byte("config v4\n"))).To(Succeed())
+			Expect(bob.AppendToFile(bobFile, []byte("bob was here\n"))).To(Succeed())
+			Expect(errors.Is(tx.Commit(), client.ErrConflict)).To(BeTrue())
+			tx = alice.Begin()
+			Expect(tx.StoreFile("config", []byte("v4\n"))).To(Succeed())
+			tx.Abort()
+			Expect(errors.Is(tx.Commit(), client.ErrInvalid)).To(BeTrue())
+			content, err = alice.LoadFile("config")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("v2\n"))
+			content, err = alice.LoadFile("manifest")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("config v1\nconfig v2\nconfig v3\nbob was here\n"))
+			for _, user := range []*client.User{alice, bob} {
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
+			}
+		})
 
-			if diff2 > maxDiff {
-				maxDiff = diff2
+		Specify("Transaction Test: A client that dies during Commit leaves all of the transaction or none of it.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("config", []byte("v1\n"))).To(Succeed())
+			Expect(alice.StoreFile("manifest", []byte("config v1\n"))).To(Succeed())
+			datastoreSnapshot := make(map[uuid.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				datastoreSnapshot[key] = value
 			}
-			if diff3 > maxDiff {
-				maxDiff = diff3
+			state := func() string {
+				alice, err := client.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				config, err := alice.LoadFile("config")
+				Expect(err).To(BeNil())
+				manifest, err := alice.LoadFile("manifest")
+				Expect(err).To(BeNil())
+				return string(config) + string(manifest)
+			}
+			before := state()
+			after := "v2\nconfig v1\nconfig v2\n"
+
+			crashing := &crashingDatastore{}
+			DeferCleanup(func() { client.SetDatastore(nil) })
+			for writes := 0; ; writes++ {
+				userlib.DatastoreClear()
+				for key, value := range datastoreSnapshot {
+					userlib.DatastoreSet(key, value)
+				}
+				alice, err = client.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				tx := alice.Begin()
+				Expect(tx.StoreFile("config", []byte("v2\n"))).To(Succeed())
+				Expect(tx.AppendToFile("manifest", []byte("config v2\n"))).To(Succeed())
+				crashing.crashAfter(writes)
+				client.SetDatastore(crashing)
+				err = tx.Commit()
+				client.SetDatastore(nil)
+				if err == nil {
+					Expect(state()).To(Equal(after))
+					break
+				}
+				Expect(errors.Is(err, errCrashed)).To(BeTrue())
+				Expect(state()).To(Or(Equal(before), Equal(after)))
+			}
+		})
+	})
+
+	Describe("Quota Tests", func() {
+		Specify("Quota Test: Writes past the owner's quota are refused, whoever makes them.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(*usage).To(Equal(client.UsageReport{Files: []client.FileUsage{}}))
+			Expect(errors.Is(alice.SetQuota(-1), client.ErrInvalid)).To(BeTrue())
+			Expect(alice.SetQuota(100)).To(Succeed())
+
+			userlib.DebugMsg("Alice fills up her quota, overwriting with less frees some of it.")
+			Expect(alice.StoreFile(aliceFile, []byte(strings.Repeat("a", 40)))).To(Succeed())
+			Expect(alice.StoreFile("config", []byte(strings.Repeat("c", 50)))).To(Succeed())
+			err = alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 20)))
+			Expect(errors.Is(err, client.ErrQuota)).To(BeTrue())
+			var quotaErr *client.QuotaError
+			Expect(errors.As(err, &quotaErr)).To(BeTrue())
+			Expect(*quotaErr).To(Equal(client.QuotaError{Quota: 100, Used: 90, Requested: 20}))
+			err = alice.StoreFile("another", []byte(strings.Repeat("x", 11)))
+			Expect(errors.Is(err, client.ErrQuota)).To(BeTrue())
+			_, err = alice.LoadFile("another")
+			Expect(errors.Is(err, client.ErrNotFound)).To(BeTrue())
+			Expect(alice.StoreFile(aliceFile, []byte(strings.Repeat("a", 10)))).To(Succeed())
+			Expect(alice.AppendToFile(aliceFile, []byte(strings.Repeat("a", 20)))).To(Succeed())
+
+			userlib.DebugMsg("Bob's appends to Alice's file count against Alice, his own files against him.")
+			invite, err := alice.CreateInvitation("config", "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Succeed())
+			Expect(bob.AppendToFile(bobFile, []byte(strings.Repeat("b", 15)))).To(Succeed())
+			err = bob.AppendToFile(bobFile, []byte(strings.Repeat("b", 10)))
+			Expect(errors.As(err, &quotaErr)).To(BeTrue())
+			Expect(*quotaErr).To(Equal(client.QuotaError{Quota: 100, Used: 95, Requested: 10}))
+			err = bob.StoreFile(bobFile, []byte(strings.Repeat("b", 80)))
+			Expect(errors.Is(err, client.ErrQuota)).To(BeTrue())
+			Expect(bob.StoreFile(bobFile, []byte(strings.Repeat("b", 70)))).To(Succeed())
+			Expect(bob.StoreFile(charlesFile, []byte(strings.Repeat("b", 500)))).To(Succeed())
+			content, err := alice.LoadFile("config")
+			Expect(err).To(BeNil())
+			Expect(content).To(HaveLen(70))
+
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(*usage).To(Equal(client.UsageReport{Quota: 100, Used: 100, Files: []client.FileUsage{
+				{Filename: aliceFile, Bytes: 30, Counted: true},
+				{Filename: "config", Bytes: 70, Counted: true},
+			}}))
+			usage, err = bob.Usage()
+			Expect(err).To(BeNil())
+			Expect(*usage).To(Equal(client.UsageReport{Used: 500, Files: []client.FileUsage{
+				{Filename: charlesFile, Bytes: 500, Counted: true},
+			}}))
+
+			userlib.DebugMsg("Deleting a file gives its space back, another session sees the same.")
+			Expect(alice.DeleteFile("config")).To(Succeed())
+			alicePhone, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			usage, err = alicePhone.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Used).To(Equal(int64(30)))
+			Expect(alicePhone.StoreFile("config", []byte(strings.Repeat("c", 70)))).To(Succeed())
+			Expect(errors.Is(alice.AppendToFile(aliceFile, []byte("a")), client.ErrQuota)).To(BeTrue())
+			for _, user := range []*client.User{alice, bob} {
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
 			}
-			userlib.DebugMsg("Max Difference in Bandwidth between Appends is %d.", maxDiff)
-			isGreaterThan500 := maxDiff > 500
-			Expect(isGreaterThan500).To(BeFalse())
 		})
 	})
 
@@ -557,3 +2179,190 @@ var _ = Describe("Client Tests", func() {
 		})
 	})
 })
+
+// cancellingDatastore is userlib's Datastore, except it cancels a context once a set
+// number of writes went through
+type cancellingDatastore struct {
+	writes int
+	cancel context.CancelFunc
+}
+
+func (ds *cancellingDatastore) cancelAfter(writes int, cancel context.CancelFunc) {
+	ds.writes = writes
+	ds.cancel = cancel
+	if writes == 0 && cancel != nil {
+		cancel()
+	}
+}
+
+func (ds *cancellingDatastore) Get(key uuid.UUID) ([]byte, bool, error) {
+	value, ok := userlib.DatastoreGet(key)
+	return value, ok, nil
+}
+
+func (ds *cancellingDatastore) Set(key uuid.UUID, value []byte) error {
+	userlib.DatastoreSet(key, value)
+	ds.writes--
+	if ds.writes == 0 && ds.cancel != nil {
+		ds.cancel()
+	}
+	return nil
+}
+
+func (ds *cancellingDatastore) Delete(key uuid.UUID) error {
+	userlib.DatastoreDelete(key)
+	return nil
+}
+
+func (ds *cancellingDatastore) Keys() ([]uuid.UUID, error) {
+	keys := make([]uuid.UUID, 0)
+	for key := range userlib.DatastoreGetMap() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// writingDatastore is userlib's Datastore, except that the first Get runs during, as if
+// another client wrote right then
+type writingDatastore struct {
+	during func()
+}
+
+func (ds *writingDatastore) Get(key uuid.UUID) ([]byte, bool, error) {
+	if during := ds.during; during != nil {
+		ds.during = nil
+		during()
+	}
+	value, ok := userlib.DatastoreGet(key)
+	return value, ok, nil
+}
+
+func (ds *writingDatastore) Set(key uuid.UUID, value []byte) error {
+	userlib.DatastoreSet(key, value)
+	return nil
+}
+
+func (ds *writingDatastore) Delete(key uuid.UUID) error {
+	userlib.DatastoreDelete(key)
+	return nil
+}
+
+func (ds *writingDatastore) Keys() ([]uuid.UUID, error) {
+	keys := make([]uuid.UUID, 0)
+	for key := range userlib.DatastoreGetMap() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// digestingDatastore is userlib's Datastore with Digest, hashed where the values are like
+// a remote backend would, so only the digest is sent. userlib doesn't see that as
+// bandwidth, OpStats counts it.
+type digestingDatastore struct{}
+
+func (digestingDatastore) Get(key uuid.UUID) ([]byte, bool, error) {
+	value, ok := userlib.DatastoreGet(key)
+	return value, ok, nil
+}
+
+func (digestingDatastore) Digest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, ok bool, err error) {
+	value, ok := userlib.DatastoreGetMap()[key]
+	if !ok {
+		return digest, false, nil
+	}
+	return sha256.Sum256(value), true, nil
+}
+
+func (digestingDatastore) Set(key uuid.UUID, value []byte) error {
+	userlib.DatastoreSet(key, value)
+	return nil
+}
+
+func (digestingDatastore) Delete(key uuid.UUID) error {
+	userlib.DatastoreDelete(key)
+	return nil
+}
+
+var errCrashed = errors.New("client died")
+
+// crashingDatastore is userlib's Datastore, except that once a set number of writes and
+// deletes went through every other one fails, as if the client had died right there
+type crashingDatastore struct {
+	writes int
+}
+
+func (ds *crashingDatastore) crashAfter(writes int) {
+	ds.writes = writes
+}
+
+func (ds *crashingDatastore) Get(key uuid.UUID) ([]byte, bool, error) {
+	value, ok := userlib.DatastoreGet(key)
+	return value, ok, nil
+}
+
+func (ds *crashingDatastore) Set(key uuid.UUID, value []byte) error {
+	if ds.writes == 0 {
+		return errCrashed
+	}
+	ds.writes--
+	userlib.DatastoreSet(key, value)
+	return nil
+}
+
+func (ds *crashingDatastore) Delete(key uuid.UUID) error {
+	if ds.writes == 0 {
+		return errCrashed
+	}
+	ds.writes--
+	userlib.DatastoreDelete(key)
+	return nil
+}
+
+func (ds *crashingDatastore) Keys() ([]uuid.UUID, error) {
+	keys := make([]uuid.UUID, 0)
+	for key := range userlib.DatastoreGetMap() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// batchingDatastore is userlib's Datastore with GetMany. The client calls it from
+// several goroutines and userlib isn't safe for that, so every call takes a lock.
+type batchingDatastore struct {
+	mu      sync.Mutex
+	batches int
+}
+
+func (ds *batchingDatastore) Get(key uuid.UUID) ([]byte, bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	value, ok := userlib.DatastoreGet(key)
+	return value, ok, nil
+}
+
+func (ds *batchingDatastore) GetMany(ctx context.Context, keys []uuid.UUID) (map[uuid.UUID][]byte, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.batches++
+	values := make(map[uuid.UUID][]byte)
+	for _, key := range keys {
+		if value, ok := userlib.DatastoreGet(key); ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func (ds *batchingDatastore) Set(key uuid.UUID, value []byte) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	userlib.DatastoreSet(key, value)
+	return nil
+}
+
+func (ds *batchingDatastore) Delete(key uuid.UUID) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	userlib.DatastoreDelete(key)
+	return nil
+}
@@ -0,0 +1,264 @@
+package client_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// Golden fixtures are dumps of the Datastore and Keystore after fixtureScenario ran on a
+// released client, one per stored format that has shipped:
+//
+//	0-baseline      the first client's, the MAC inside each struct and nothing sealed
+//
+// They must keep loading. Before a release that changes the format, add a fixture of the
+// last released one with SFS_WRITE_FIXTURE=testdata/<n>-<name>.json go test ./client_test/
+// run on that release.
+type fixture struct {
+	Datastore map[uuid.UUID][]byte
+	Keystore  map[string]userlib.PublicKeyType
+}
+
+var fixturePasswords = map[string]string{
+	"alice":   "alice password",
+	"bob":     "bob password",
+	"charlie": "charlie password",
+}
+
+func fixtureBigContent() []byte {
+	big := make([]byte, 12000)
+	for i := range big {
+		big[i] = byte(i*i + i/7)
+	}
+	return big
+}
+
+// alice owns notes.txt and big.bin, shared notes.txt with charlie and revoked him, then
+// shared it with bob who appended to it. bob has a file of his own.
+func fixtureScenario() {
+	users := make(map[string]*client.User)
+	for _, username := range []string{"alice", "bob", "charlie"} {
+		user, err := client.InitUser(username, fixturePasswords[username])
+		Expect(err).To(BeNil())
+		users[username] = user
+	}
+	alice, bob, charlie := users["alice"], users["bob"], users["charlie"]
+
+	Expect(alice.StoreFile("notes.txt", []byte("first line\n"))).To(Succeed())
+	Expect(alice.AppendToFile("notes.txt", []byte("second line\n"))).To(Succeed())
+	Expect(alice.StoreFile("big.bin", fixtureBigContent())).To(Succeed())
+
+	invite, err := alice.CreateInvitation("notes.txt", "charlie")
+	Expect(err).To(BeNil())
+	Expect(charlie.AcceptInvitation("alice", invite, "shared.txt")).To(Succeed())
+	Expect(alice.RevokeAccess("notes.txt", "charlie")).To(Succeed())
+
+	invite, err = alice.CreateInvitation("notes.txt", "bob")
+	Expect(err).To(BeNil())
+	Expect(bob.AcceptInvitation("alice", invite, "from_alice.txt")).To(Succeed())
+	Expect(bob.AppendToFile("from_alice.txt", []byte("bob was here\n"))).To(Succeed())
+	Expect(bob.StoreFile("own.txt", []byte("bob's own file"))).To(Succeed())
+}
+
+// A copy of everything in the Datastore
+func copyDatastore() map[uuid.UUID][]byte {
+	copied := make(map[uuid.UUID][]byte)
+	for id, value := range userlib.DatastoreGetMap() {
+		copied[id] = append([]byte{}, value...)
+	}
+	return copied
+}
+
+var _ = Describe("Golden Fixture Tests", func() {
+	BeforeEach(func() {
+		userlib.DatastoreClear()
+		userlib.KeystoreClear()
+	})
+
+	paths, _ := filepath.Glob(filepath.Join("testdata", "*.json"))
+
+	Specify("There are fixtures to check", func() {
+		Expect(paths).ToNot(BeEmpty())
+	})
+
+	for _, path := range paths {
+		path := path
+		Specify("Fixture "+filepath.Base(path)+" still loads, and keeps working once written to", func() {
+			raw, err := os.ReadFile(path)
+			Expect(err).To(BeNil())
+			var stored fixture
+			Expect(json.Unmarshal(raw, &stored)).To(Succeed())
+			for id, value := range stored.Datastore {
+				userlib.DatastoreSet(id, value)
+			}
+			for name, key := range stored.Keystore {
+				Expect(userlib.KeystoreSet(name, key)).To(Succeed())
+			}
+
+			alice, err := client.GetUser("alice", fixturePasswords["alice"])
+			Expect(err).To(BeNil())
+			bob, err := client.GetUser("bob", fixturePasswords["bob"])
+			Expect(err).To(BeNil())
+			charlie, err := client.GetUser("charlie", fixturePasswords["charlie"])
+			Expect(err).To(BeNil())
+
+			notes := "first line\nsecond line\nbob was here\n"
+			content, err := alice.LoadFile("notes.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(notes))
+			content, err = bob.LoadFile("from_alice.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(notes))
+			content, err = alice.LoadFile("big.bin")
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(fixtureBigContent()))
+			content, err = bob.LoadFile("own.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("bob's own file"))
+			_, err = charlie.LoadFile("shared.txt")
+			if filepath.Base(path) == "0-baseline.json" {
+				// the first client left nothing to say he was revoked, his certificate
+				// just has an AccessToken that doesn't open FileInfo anymore, so Verify
+				// would report it until he drops the file
+				Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+				Expect(charlie.DeleteFile("shared.txt")).To(Succeed())
+			} else {
+				Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			}
+			for _, user := range []*client.User{alice, bob} {
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
+			}
+
+			userlib.DebugMsg("Writing to old objects upgrades them and they still read back.")
+			Expect(bob.AppendToFile("from_alice.txt", []byte("third line\n"))).To(Succeed())
+			Expect(alice.StoreFile("big.bin", []byte("smaller now"))).To(Succeed())
+			Expect(bob.StoreFile("own.txt", fixtureBigContent())).To(Succeed())
+			content, err = alice.LoadFile("notes.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(notes + "third line\n"))
+			content, err = alice.LoadFile("big.bin")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("smaller now"))
+			content, err = bob.LoadFile("own.txt")
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal(fixtureBigContent()))
+			// files from before quotas count from their owner's first write on
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Files).To(HaveLen(2))
+			Expect(usage.Files[0]).To(Equal(client.FileUsage{Filename: "big.bin", Bytes: 11, Counted: true}))
+			Expect(usage.Files[1].Filename).To(Equal("notes.txt"))
+			Expect(usage.Files[1].Bytes).To(Equal(int64(len(notes + "third line\n"))))
+			Expect(usage.Used).To(BeNumerically(">=", 11))
+
+			before := copyDatastore()
+			for _, user := range []*client.User{alice, bob} {
+				_, err = user.MigrateKeys()
+				Expect(err).To(BeNil())
+				migrated, err := user.MigrateKeys()
+				Expect(err).To(BeNil())
+				Expect(migrated).To(Equal(0))
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
+			}
+			content, err = bob.LoadFile("from_alice.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(notes + "third line\n"))
+
+			userlib.DebugMsg("What MigrateKeys rewrote isn't read if the old value is put back.")
+			after := copyDatastore()
+			replayed := 0
+			for id, value := range before {
+				if !bytes.HasPrefix(value, []byte("SFSE")) && !bytes.Equal(after[id], value) {
+					userlib.DatastoreSet(id, value)
+					replayed++
+				}
+			}
+			Expect(replayed).ToNot(BeZero())
+			_, err = alice.LoadFile("notes.txt")
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			_, err = bob.LoadFile("own.txt")
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			for id, value := range after {
+				userlib.DatastoreSet(id, value)
+			}
+
+			userlib.DebugMsg("Changing an old namespace moves it to index pages with every file in it.")
+			Expect(alice.RenameFile("big.bin", "big-renamed.bin")).To(Succeed())
+			Expect(bob.StoreFile("another.txt", []byte("another"))).To(Succeed())
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{"big-renamed.bin", "notes.txt"}))
+			files, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{"another.txt", "from_alice.txt", "own.txt"}))
+			content, err = alice.LoadFile("big-renamed.bin")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal("smaller now"))
+			invite, err := alice.CreateInvitation("notes.txt", "charlie")
+			Expect(err).To(BeNil())
+			Expect(charlie.AcceptInvitation("alice", invite, "again.txt")).To(Succeed())
+			content, err = charlie.LoadFile("again.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(notes + "third line\n"))
+			for _, user := range []*client.User{alice, bob, charlie} {
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
+			}
+
+			dave, err := client.InitUser("dave", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation("from_alice.txt", "dave")
+			Expect(err).To(BeNil())
+			Expect(dave.AcceptInvitation("bob", invite, "via_bob.txt")).To(Succeed())
+
+			userlib.DebugMsg("Revoking from an old file moves whoever is left onto a key tree.")
+			Expect(alice.RevokeAccess("notes.txt", "charlie")).To(Succeed())
+			_, err = charlie.LoadFile("again.txt")
+			Expect(errors.Is(err, client.ErrRevoked)).To(BeTrue())
+			// Dave gets a leaf from Bob, the next time Bob opens the file
+			Expect(bob.AppendToFile("from_alice.txt", []byte("fourth line\n"))).To(Succeed())
+			content, err = dave.LoadFile("via_bob.txt")
+			Expect(err).To(BeNil())
+			Expect(string(content)).To(Equal(notes + "third line\nfourth line\n"))
+			invite, err = alice.CreateInvitation("notes.txt", "charlie")
+			Expect(err).To(BeNil())
+			Expect(charlie.AcceptInvitation("alice", invite, "third.txt")).To(Succeed())
+			for _, user := range []*client.User{alice, bob, charlie, dave} {
+				filename := map[*client.User]string{alice: "notes.txt", bob: "from_alice.txt", charlie: "third.txt", dave: "via_bob.txt"}[user]
+				content, err = user.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(string(content)).To(Equal(notes + "third line\nfourth line\n"))
+				report, err := user.Verify()
+				Expect(err).To(BeNil())
+				Expect(report.Problems()).To(BeEmpty())
+			}
+		})
+	}
+
+	Specify("Writing a fixture of the current format", func() {
+		path := os.Getenv("SFS_WRITE_FIXTURE")
+		if path == "" {
+			Skip("set SFS_WRITE_FIXTURE to write one")
+		}
+		fixtureScenario()
+		stored := fixture{Datastore: userlib.DatastoreGetMap(), Keystore: userlib.KeystoreGetMap()}
+		raw, err := json.MarshalIndent(stored, "", "\t")
+		Expect(err).To(BeNil())
+		Expect(os.WriteFile(path, append(raw, '\n'), 0644)).To(Succeed())
+	})
+})
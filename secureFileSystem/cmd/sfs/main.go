@@ -0,0 +1,520 @@
+// Command sfs runs the client against a Datastore and Keystore kept on local disk.
+//
+//	sfs [-store DIR] [-server URL] [-json] COMMAND [ARGS]
+//
+// The store defaults to $SFS_HOME, or ~/.sfs. With -server (or $SFS_SERVER) the
+// Datastore and Keystore live on an sfsd server instead and only the session is local;
+// the server's token is read from $SFS_TOKEN. Whoever runs that server has to be trusted
+// with the Keystore, see package remote.
+// Passwords are read from $SFS_PASSWORD, or from the first line of stdin. login caches
+// the session in the store so later commands don't need the password; logout removes it.
+// The session file holds a credential derived from the password, not the password, but
+// whoever reads it can open the account as the password would, and it keeps working
+// after logout for anyone who copied it. It's written mode 0600 and sfs won't use one
+// that anyone but its owner can read.
+// File content is read from stdin / written to stdout unless a path is given.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/davserver"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+	"github.com/cs161-staff/project2-starter-code/remote"
+	"github.com/cs161-staff/project2-starter-code/s3gateway"
+)
+
+const usage = `usage: sfs [-store DIR] [-server URL] [-json] COMMAND [ARGS]
+
+commands:
+  init-user USER                  create an account and log in as it
+  login USER                      log in and cache the session
+  logout                          forget the cached session
+  put NAME [PATH]                 store a file, replacing its content
+  get NAME [PATH]                 print a file or save it to PATH
+  append NAME [PATH]              append to a file
+  ls                              list your files
+  share NAME RECIPIENT            invite RECIPIENT, prints the invitation
+  accept SENDER INVITATION NAME   accept an invitation under NAME
+  revoke NAME RECIPIENT           revoke RECIPIENT's access
+  rm NAME                         delete a file (revokes everyone if you own it)
+  migrate-keys                    rewrite objects stored before per-purpose keys
+  fsck                            check every object you can reach, exits non-zero on problems
+  serve-dav [ADDR]                serve WebDAV on ADDR (localhost:8162), logins use basic auth
+  serve-s3 [ADDR]                 serve your files as S3 bucket "sfs" on ADDR (localhost:8163)
+`
+
+const sessionFile = "session.json"
+
+// exit codes, so scripts can tell what went wrong without parsing messages
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitIntegrity
+	exitRevoked
+	exitExists
+	exitAuth
+	exitConflict
+	exitQuota
+)
+
+type session struct {
+	Username   string
+	Credential []byte // from User.SessionCredential
+}
+
+type cli struct {
+	store  string
+	server string
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sfs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	c := &cli{stdin: stdin, stdout: stdout}
+	flags.StringVar(&c.store, "store", defaultStore(), "directory holding the datastore, keystore and session")
+	flags.StringVar(&c.server, "server", os.Getenv("SFS_SERVER"), "URL of an sfsd server to use instead of the local store")
+	flags.BoolVar(&c.json, "json", false, "print results and errors as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	ds, ks, err := localstore.Open(c.store)
+	if err != nil {
+		return c.fail(stderr, err)
+	}
+	if c.server != "" {
+		remoteDatastore, remoteKeystore := remote.Dial(c.server, os.Getenv("SFS_TOKEN"), nil)
+		client.SetDatastore(remoteDatastore)
+		client.SetKeystore(remoteKeystore)
+	} else {
+		client.SetDatastore(ds)
+		client.SetKeystore(ks)
+	}
+
+	err = c.dispatch(flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		var usageErr usageError
+		if errors.As(err, &usageErr) {
+			fmt.Fprintf(stderr, "sfs: %v\n\n%s", err, usage)
+			return exitUsage
+		}
+		return c.fail(stderr, err)
+	}
+	return exitOK
+}
+
+func defaultStore() string {
+	if dir := os.Getenv("SFS_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".sfs"
+	}
+	return filepath.Join(home, ".sfs")
+}
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func wantArgs(command string, args []string, min int, max int) error {
+	if len(args) < min || len(args) > max {
+		return usageError(fmt.Sprintf("wrong number of arguments to %s", command))
+	}
+	return nil
+}
+
+func (c *cli) dispatch(command string, args []string) (err error) {
+	switch command {
+	case "init-user", "login":
+		if err = wantArgs(command, args, 1, 1); err != nil {
+			return err
+		}
+		return c.login(command == "init-user", args[0])
+	case "logout":
+		if err = wantArgs(command, args, 0, 0); err != nil {
+			return err
+		}
+		err = os.Remove(filepath.Join(c.store, sessionFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return c.done("logged out", nil)
+	case "put", "append":
+		if err = wantArgs(command, args, 1, 2); err != nil {
+			return err
+		}
+		return c.write(command == "append", args[0], optional(args, 1))
+	case "get":
+		if err = wantArgs(command, args, 1, 2); err != nil {
+			return err
+		}
+		return c.get(args[0], optional(args, 1))
+	case "ls":
+		if err = wantArgs(command, args, 0, 0); err != nil {
+			return err
+		}
+		return c.ls()
+	case "share":
+		if err = wantArgs(command, args, 2, 2); err != nil {
+			return err
+		}
+		return c.share(args[0], args[1])
+	case "accept":
+		if err = wantArgs(command, args, 3, 3); err != nil {
+			return err
+		}
+		return c.accept(args[0], args[1], args[2])
+	case "revoke":
+		if err = wantArgs(command, args, 2, 2); err != nil {
+			return err
+		}
+		user, err := c.user()
+		if err != nil {
+			return err
+		}
+		err = user.RevokeAccess(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return c.done(fmt.Sprintf("revoked %s's access to %s", args[1], args[0]), map[string]string{"name": args[0], "recipient": args[1]})
+	case "rm":
+		if err = wantArgs(command, args, 1, 1); err != nil {
+			return err
+		}
+		user, err := c.user()
+		if err != nil {
+			return err
+		}
+		err = user.DeleteFile(args[0])
+		if err != nil {
+			return err
+		}
+		return c.done("removed "+args[0], map[string]string{"name": args[0]})
+	case "migrate-keys":
+		if err = wantArgs(command, args, 0, 0); err != nil {
+			return err
+		}
+		user, err := c.user()
+		if err != nil {
+			return err
+		}
+		migrated, err := user.MigrateKeys()
+		if err != nil {
+			return err
+		}
+		return c.done(fmt.Sprintf("rewrote %d objects", migrated), map[string]int{"migrated": migrated})
+	case "fsck":
+		if err = wantArgs(command, args, 0, 0); err != nil {
+			return err
+		}
+		return c.fsck()
+	case "serve-dav":
+		if err = wantArgs(command, args, 0, 1); err != nil {
+			return err
+		}
+		addr := optional(args, 0)
+		if addr == "" {
+			addr = "localhost:8162"
+		}
+		fmt.Fprintf(c.stdout, "serving WebDAV on http://%s\n", addr)
+		return http.ListenAndServe(addr, davserver.NewHandler())
+	case "serve-s3":
+		if err = wantArgs(command, args, 0, 1); err != nil {
+			return err
+		}
+		user, err := c.user()
+		if err != nil {
+			return err
+		}
+		addr := optional(args, 0)
+		if addr == "" {
+			addr = "localhost:8163"
+		}
+		gateway := s3gateway.New()
+		secretKey, err := gateway.AddUser(user)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "serving bucket %q on http://%s, access key %q and secret key %q\n", gateway.Bucket, addr, user.Username, secretKey)
+		return http.ListenAndServe(addr, gateway)
+	}
+	return usageError(fmt.Sprintf("unknown command %q", command))
+}
+
+func optional(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+func (c *cli) password() (string, error) {
+	if password, ok := os.LookupEnv("SFS_PASSWORD"); ok {
+		return password, nil
+	}
+	line, err := bufio.NewReader(c.stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("no password given, set SFS_PASSWORD or pass it on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *cli) login(create bool, username string) error {
+	password, err := c.password()
+	if err != nil {
+		return err
+	}
+	var user *client.User
+	if create {
+		user, err = client.InitUser(username, password)
+	} else {
+		user, err = client.GetUser(username, password)
+	}
+	if err != nil {
+		return err
+	}
+	credential, err := user.SessionCredential()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(session{Username: username, Credential: credential})
+	if err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that's already there
+	path := filepath.Join(c.store, sessionFile)
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return err
+	}
+	return c.done("logged in as "+username, map[string]string{"username": username})
+}
+
+// logs in again with the cached session, the User struct may have changed since
+func (c *cli) user() (*client.User, error) {
+	path := filepath.Join(c.store, sessionFile)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.New("not logged in, run sfs login first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s can be read by others (mode %v), log in again", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("bad session file, log in again: %w", err)
+	}
+	if s.Credential == nil {
+		return nil, errors.New("session file from an older sfs, log in again")
+	}
+	return client.ResumeSession(s.Username, s.Credential)
+}
+
+func (c *cli) write(appending bool, name string, path string) error {
+	user, err := c.user()
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if path == "" || path == "-" {
+		content, err = io.ReadAll(c.stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	verb := "stored"
+	if appending {
+		verb = "appended"
+		err = user.AppendToFile(name, content)
+	} else {
+		err = user.StoreFile(name, content)
+	}
+	if err != nil {
+		return err
+	}
+	return c.done(fmt.Sprintf("%s %d bytes to %s", verb, len(content), name), map[string]interface{}{"name": name, "bytes": len(content)})
+}
+
+func (c *cli) get(name string, path string) error {
+	user, err := c.user()
+	if err != nil {
+		return err
+	}
+	content, err := user.LoadFile(name)
+	if err != nil {
+		return err
+	}
+	if path != "" && path != "-" {
+		err = os.WriteFile(path, content, 0600)
+		if err != nil {
+			return err
+		}
+		return c.done(fmt.Sprintf("wrote %d bytes to %s", len(content), path), map[string]interface{}{"name": name, "bytes": len(content), "path": path})
+	}
+	if c.json {
+		// JSON encodes []byte as base64
+		return c.done("", map[string]interface{}{"name": name, "content": content})
+	}
+	_, err = c.stdout.Write(content)
+	return err
+}
+
+func (c *cli) ls() error {
+	user, err := c.user()
+	if err != nil {
+		return err
+	}
+	filenames, err := user.ListFiles()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.done("", map[string][]string{"files": filenames})
+	}
+	for _, filename := range filenames {
+		fmt.Fprintln(c.stdout, filename)
+	}
+	return nil
+}
+
+// prints what Verify found wrong, and fails with an integrity error if it found anything
+func (c *cli) fsck() error {
+	user, err := c.user()
+	if err != nil {
+		return err
+	}
+	report, err := user.Verify()
+	if err != nil {
+		return err
+	}
+	problems := report.Problems()
+	if c.json {
+		err = c.done("", map[string]interface{}{"checked": len(report.Objects), "problems": problems})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range problems {
+			fmt.Fprintf(c.stdout, "%s %s %s %s: %s\n", problem.Status, problem.Kind, problem.UUID, problem.Filename, problem.Reason)
+		}
+		fmt.Fprintf(c.stdout, "checked %d objects, %d problems\n", len(report.Objects), len(problems))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d of %d objects are corrupted or missing: %w", len(problems), len(report.Objects), client.ErrIntegrity)
+	}
+	return nil
+}
+
+func (c *cli) share(name string, recipient string) error {
+	user, err := c.user()
+	if err != nil {
+		return err
+	}
+	invitation, err := user.CreateInvitation(name, recipient)
+	if err != nil {
+		return err
+	}
+	// just the invitation on its own line, so it can be captured with $(sfs share ...)
+	return c.done(invitation.String(), map[string]string{"name": name, "recipient": recipient, "invitation": invitation.String()})
+}
+
+func (c *cli) accept(sender string, invitation string, name string) error {
+	invitationUUID, err := uuid.Parse(invitation)
+	if err != nil {
+		return usageError(fmt.Sprintf("bad invitation %q", invitation))
+	}
+	user, err := c.user()
+	if err != nil {
+		return err
+	}
+	err = user.AcceptInvitation(sender, invitationUUID, name)
+	if err != nil {
+		return err
+	}
+	return c.done(fmt.Sprintf("accepted %s's invitation as %s", sender, name), map[string]string{"name": name, "sender": sender})
+}
+
+// prints message, or result as JSON with -json
+func (c *cli) done(message string, result interface{}) error {
+	if !c.json {
+		fmt.Fprintln(c.stdout, message)
+		return nil
+	}
+	if result == nil {
+		result = map[string]string{}
+	}
+	return json.NewEncoder(c.stdout).Encode(result)
+}
+
+func (c *cli) fail(stderr io.Writer, err error) int {
+	code, kind := exitError, "error"
+	for _, sentinel := range []struct {
+		err  error
+		code int
+		kind string
+	}{
+		{client.ErrNotFound, exitNotFound, "not_found"},
+		{client.ErrIntegrity, exitIntegrity, "integrity"},
+		{client.ErrRevoked, exitRevoked, "revoked"},
+		{client.ErrExists, exitExists, "exists"},
+		{client.ErrAuth, exitAuth, "auth"},
+		{client.ErrConflict, exitConflict, "conflict"},
+		{client.ErrQuota, exitQuota, "quota"},
+		{client.ErrInvalid, exitUsage, "invalid"},
+	} {
+		if errors.Is(err, sentinel.err) {
+			code, kind = sentinel.code, sentinel.kind
+			break
+		}
+	}
+	if c.json {
+		json.NewEncoder(stderr).Encode(map[string]string{"error": err.Error(), "kind": kind})
+	} else {
+		fmt.Fprintf(stderr, "sfs: %v\n", err)
+	}
+	return code
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// runs sfs against dir and returns what it printed
+func sfs(t *testing.T, dir string, stdin string, wantCode int, args ...string) string {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-store", dir}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	if code != wantCode {
+		t.Fatalf("sfs %s: exit %d, want %d\nstdout: %s\nstderr: %s", strings.Join(args, " "), code, wantCode, stdout.String(), stderr.String())
+	}
+	if wantCode != exitOK {
+		return stderr.String()
+	}
+	return stdout.String()
+}
+
+func TestHandoff(t *testing.T) {
+	// alice and bob take turns logging in to the same store
+	store := t.TempDir()
+	t.Setenv("SFS_PASSWORD", "")
+	os.Unsetenv("SFS_PASSWORD")
+
+	sfs(t, store, "alicepw\n", exitOK, "init-user", "alice")
+	sfs(t, store, "bobpw\n", exitOK, "init-user", "bob")
+	sfs(t, store, "wrong\n", exitAuth, "login", "alice")
+	sfs(t, store, "alicepw\n", exitOK, "login", "alice")
+
+	sfs(t, store, "hello ", exitOK, "put", "report.txt")
+	sfs(t, store, "world", exitOK, "append", "report.txt")
+	if got := sfs(t, store, "", exitOK, "get", "report.txt"); got != "hello world" {
+		t.Fatalf("get = %q", got)
+	}
+	if got := sfs(t, store, "", exitOK, "ls"); got != "report.txt\n" {
+		t.Fatalf("ls = %q", got)
+	}
+	invitation := strings.TrimSpace(sfs(t, store, "", exitOK, "share", "report.txt", "bob"))
+
+	sfs(t, store, "bobpw\n", exitOK, "login", "bob")
+	sfs(t, store, "", exitOK, "accept", "alice", invitation, "from-alice.txt")
+	var loaded struct {
+		Name    string
+		Content []byte
+	}
+	err := json.Unmarshal([]byte(sfs(t, store, "", exitOK, "-json", "get", "from-alice.txt")), &loaded)
+	if err != nil || string(loaded.Content) != "hello world" {
+		t.Fatalf("json get = %+v, %v", loaded, err)
+	}
+
+	sfs(t, store, "alicepw\n", exitOK, "login", "alice")
+	sfs(t, store, "", exitOK, "revoke", "report.txt", "bob")
+	sfs(t, store, "", exitOK, "rm", "report.txt")
+	sfs(t, store, "", exitNotFound, "get", "report.txt")
+
+	sfs(t, store, "bobpw\n", exitOK, "login", "bob")
+	var failure struct{ Error, Kind string }
+	err = json.Unmarshal([]byte(sfs(t, store, "", exitRevoked, "-json", "get", "from-alice.txt")), &failure)
+	if err != nil || failure.Kind != "revoked" {
+		t.Fatalf("json error = %+v, %v", failure, err)
+	}
+
+	sfs(t, store, "", exitOK, "logout")
+	sfs(t, store, "", exitError, "ls")
+	sfs(t, store, "", exitUsage, "frobnicate")
+}
+
+func TestFsck(t *testing.T) {
+	store := t.TempDir()
+	t.Setenv("SFS_PASSWORD", "alicepw")
+
+	sfs(t, store, "", exitOK, "init-user", "alice")
+	sfs(t, store, "hello ", exitOK, "put", "report.txt")
+	if got := sfs(t, store, "", exitOK, "fsck"); !strings.HasSuffix(got, " 0 problems\n") {
+		t.Fatalf("fsck = %q", got)
+	}
+
+	// flip a byte in everything the append writes
+	before := make(map[string]bool)
+	entries, err := os.ReadDir(filepath.Join(store, "datastore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		before[entry.Name()] = true
+	}
+	sfs(t, store, "world", exitOK, "append", "report.txt")
+	entries, err = os.ReadDir(filepath.Join(store, "datastore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if before[entry.Name()] {
+			continue
+		}
+		path := filepath.Join(store, "datastore", entry.Name())
+		value, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value[len(value)/2] ^= 1
+		err = os.WriteFile(path, value, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := sfs(t, store, "", exitIntegrity, "fsck"); !strings.Contains(got, "corrupted or missing") {
+		t.Fatalf("fsck = %q", got)
+	}
+	var report struct {
+		Checked  int
+		Problems []struct{ Status, Kind, Filename string }
+	}
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-store", store, "-json", "fsck"}, strings.NewReader(""), &stdout, &stderr)
+	err = json.Unmarshal(stdout.Bytes(), &report)
+	if code != exitIntegrity || err != nil || len(report.Problems) == 0 || report.Problems[0].Filename != "report.txt" {
+		t.Fatalf("json fsck = exit %d, %+v, %v", code, report, err)
+	}
+}
+
+func TestSessionFile(t *testing.T) {
+	store := t.TempDir()
+	t.Setenv("SFS_PASSWORD", "alicepw")
+	path := filepath.Join(store, sessionFile)
+
+	sfs(t, store, "", exitOK, "init-user", "alice")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("alicepw")) {
+		t.Fatalf("session file holds the password: %s", data)
+	}
+	sfs(t, store, "", exitOK, "ls")
+
+	// one others can read isn't used, and logging in again fixes it
+	err = os.Chmod(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfs(t, store, "", exitError, "ls")
+	sfs(t, store, "", exitOK, "login", "alice")
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("session file after login = %v, %v", info.Mode(), err)
+	}
+	sfs(t, store, "", exitOK, "ls")
+
+	// a tampered credential doesn't get in, nor does a session file that kept the password
+	var s session
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Credential[16] ^= 1
+	for _, tampered := range []struct {
+		file     interface{}
+		wantCode int
+	}{
+		{s, exitAuth},
+		{struct{ Username, Password string }{"alice", "alicepw"}, exitError},
+	} {
+		data, err = json.Marshal(tampered.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sfs(t, store, "", tampered.wantCode, "ls")
+	}
+}
+
+func TestFailCodes(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		wantCode int
+		wantKind string
+	}{
+		{&client.QuotaError{Quota: 10, Used: 8, Requested: 5}, exitQuota, "quota"},
+		{fmt.Errorf("storing: %w", client.ErrConflict), exitConflict, "conflict"},
+		{errors.New("disk on fire"), exitError, "error"},
+	} {
+		var stderr bytes.Buffer
+		c := &cli{json: true}
+		code := c.fail(&stderr, test.err)
+		var printed struct{ Error, Kind string }
+		err := json.Unmarshal(stderr.Bytes(), &printed)
+		if code != test.wantCode || err != nil || printed.Kind != test.wantKind {
+			t.Fatalf("fail(%v) = %d, %s, want %d and kind %q", test.err, code, stderr.String(), test.wantCode, test.wantKind)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Command sfsd serves a Datastore and Keystore kept on local disk over HTTP, for
+// sfs -server and other remote clients.
+//
+//	sfsd [-addr HOST:PORT] [-store DIR] [-token TOKEN]
+//
+// Every request has to carry the token, which defaults to $SFSD_TOKEN; without either a
+// random one is made up and logged at startup. Clients pass it with $SFS_TOKEN. The
+// server keeps the Keystore too, so whoever runs it has to be trusted by everyone who
+// shares files through it, see package remote.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/cs161-staff/project2-starter-code/localstore"
+	"github.com/cs161-staff/project2-starter-code/remote"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8161", "address to listen on")
+	store := flag.String("store", "sfsd-store", "directory holding the datastore and keystore")
+	token := flag.String("token", os.Getenv("SFSD_TOKEN"), "token clients have to send, random if empty")
+	flag.Parse()
+
+	ds, ks, err := localstore.Open(*store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *token == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			log.Fatal(err)
+		}
+		*token = hex.EncodeToString(random)
+		log.Printf("token %s", *token)
+	}
+	server := remote.NewServer(ds, ks)
+	server.Token = *token
+	log.Printf("serving %s on http://%s", *store, *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,195 @@
+package davserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+)
+
+type davClient struct {
+	t        *testing.T
+	server   *httptest.Server
+	username string
+	password string
+}
+
+func (c *davClient) do(method string, path string, body string, header map[string]string) (int, string, http.Header) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.SetBasicAuth(c.username, c.password)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.server.Client().Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp.StatusCode, string(respBody), resp.Header
+}
+
+func (c *davClient) expect(method string, path string, body string, header map[string]string, want int) string {
+	c.t.Helper()
+	status, respBody, _ := c.do(method, path, body, header)
+	if status != want {
+		c.t.Fatalf("%s %s = %d, want %d: %s", method, path, status, want, respBody)
+	}
+	return respBody
+}
+
+// number of AppendBlocks in filename, to tell appends from rewrites
+func chainLength(t *testing.T, user *client.User, filename string) int {
+	t.Helper()
+	report, err := user.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := 0
+	for _, object := range report.Objects {
+		if object.Kind == client.KindAppendBlock && object.Filename == filename {
+			blocks++
+		}
+	}
+	return blocks
+}
+
+func TestWebDAV(t *testing.T) {
+	ds, ks, err := localstore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDatastore(ds)
+	client.SetKeystore(ks)
+	t.Cleanup(func() {
+		client.SetDatastore(nil)
+		client.SetKeystore(nil)
+	})
+	alice, err := client.InitUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewHandler())
+	defer server.Close()
+
+	intruder := &davClient{t: t, server: server, username: "alice", password: "wrong"}
+	intruder.expect("PROPFIND", "/", "", map[string]string{"Depth": "1"}, http.StatusUnauthorized)
+
+	c := &davClient{t: t, server: server, username: "alice", password: "password"}
+	c.expect("PUT", "/notes.txt", "hello", nil, http.StatusCreated)
+	if got := c.expect("GET", "/notes.txt", "", nil, http.StatusOK); got != "hello" {
+		t.Fatalf("GET = %q", got)
+	}
+
+	// a PUT rewrites the file whole, even with more on the end
+	c.expect("PUT", "/notes.txt", "hello world", nil, http.StatusCreated)
+	if n := chainLength(t, alice, "notes.txt"); n != 1 {
+		t.Fatalf("chain has %d blocks after a rewrite, want 1", n)
+	}
+	_, _, put := c.do("PUT", "/notes.txt", "goodbye", nil)
+	_, _, got := c.do("GET", "/notes.txt", "", nil)
+	stat, err := alice.StatFile("notes.txt")
+	if err != nil || put.Get("ETag") != `"`+stat.ETag+`"` || got.Get("ETag") != put.Get("ETag") {
+		t.Fatalf("ETag after PUT %q, GET %q, StatFile %+v, %v", put.Get("ETag"), got.Get("ETag"), stat, err)
+	}
+	c.expect("GET", "/notes.txt", "", map[string]string{"If-None-Match": put.Get("ETag")}, http.StatusNotModified)
+	content, err := alice.LoadFile("notes.txt")
+	if err != nil || string(content) != "goodbye" {
+		t.Fatalf("LoadFile = %q, %v", content, err)
+	}
+
+	c.expect("PUT", "/other.txt", "x", nil, http.StatusCreated)
+	listing := c.expect("PROPFIND", "/", "", map[string]string{"Depth": "1"}, http.StatusMultiStatus)
+	for _, want := range []string{"/notes.txt", "/other.txt", "<D:getcontentlength>7</D:getcontentlength>", put.Get("ETag")} {
+		if !strings.Contains(listing, want) {
+			t.Fatalf("PROPFIND listing is missing %s:\n%s", want, listing)
+		}
+	}
+
+	c.expect("MOVE", "/notes.txt", "", map[string]string{"Destination": server.URL + "/renamed.txt"}, http.StatusCreated)
+	c.expect("GET", "/notes.txt", "", nil, http.StatusNotFound)
+	if got := c.expect("GET", "/renamed.txt", "", nil, http.StatusOK); got != "goodbye" {
+		t.Fatalf("GET after MOVE = %q", got)
+	}
+	c.expect("MOVE", "/renamed.txt", "", map[string]string{"Destination": server.URL + "/other.txt", "Overwrite": "F"}, http.StatusPreconditionFailed)
+
+	c.expect("DELETE", "/renamed.txt", "", nil, http.StatusNoContent)
+	c.expect("GET", "/renamed.txt", "", nil, http.StatusNotFound)
+	c.expect("MKCOL", "/dir", "", nil, http.StatusMethodNotAllowed)
+
+	files, err := alice.ListFiles()
+	if err != nil || len(files) != 1 || files[0] != "other.txt" {
+		t.Fatalf("ListFiles = %v, %v", files, err)
+	}
+}
+
+func TestCloseConflict(t *testing.T) {
+	ds, ks, err := localstore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDatastore(ds)
+	client.SetKeystore(ks)
+	t.Cleanup(func() {
+		client.SetDatastore(nil)
+		client.SetKeystore(nil)
+	})
+	alice, err := client.InitUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.StoreFile("notes.txt", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else appends between the read and the write back
+	fsys := NewFileSystem(alice)
+	f, err := fsys.OpenFile(context.Background(), "/notes.txt", os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.AppendToFile("notes.txt", []byte(" there"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(" world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("Close = %v, want a conflict", err)
+	}
+	content, err := alice.LoadFile("notes.txt")
+	if err != nil || string(content) != "hello there" {
+		t.Fatalf("LoadFile = %q, %v", content, err)
+	}
+
+	f, err = fsys.OpenFile(context.Background(), "/notes.txt", os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(" world"))
+	if err == nil {
+		err = f.Close()
+	}
+	content, _ = alice.LoadFile("notes.txt")
+	if err != nil || string(content) != "hello there world" {
+		t.Fatalf("LoadFile after Close = %q, %v", content, err)
+	}
+}
@@ -0,0 +1,356 @@
+// Package davserver serves a user's files over WebDAV so they can be mounted from
+// ordinary desktop tools. It is only a frontend for the client package: everything is
+// decrypted in this process and the Datastore stays untrusted.
+//
+// The namespace is flat, the same as a user's, so the root collection is the only
+// directory.
+package davserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// FileSystem is a webdav.FileSystem over one user's namespace.
+type FileSystem struct {
+	user *client.User
+}
+
+func NewFileSystem(user *client.User) *FileSystem {
+	return &FileSystem{user: user}
+}
+
+// maps "/name" to the filename, root is ""
+func filename(op string, name string) (string, error) {
+	name = strings.TrimPrefix(name, "/")
+	if strings.Contains(name, "/") {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return name, nil
+}
+
+// turns client errors into the fs errors webdav.Handler knows how to answer
+func pathError(op string, name string, err error) error {
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		err = fs.ErrNotExist
+	case errors.Is(err, client.ErrExists):
+		err = fs.ErrExist
+	case errors.Is(err, client.ErrRevoked):
+		err = fs.ErrPermission
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := filename("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &fs.PathError{Op: "open", Path: "/", Err: fs.ErrPermission}
+		}
+		return &dir{fsys: fsys}, nil
+	}
+
+	f := &file{
+		fsys:     fsys,
+		name:     name,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+	}
+	truncate := f.writable && flag&os.O_TRUNC != 0
+	var content []byte
+	switch {
+	case truncate:
+		// replaced whole whatever's there, only whether it is matters
+		_, err = fsys.user.StatFile(name)
+	case f.writable:
+		// read and written back in one transaction, so a write in between is a conflict
+		// rather than lost
+		f.tx = fsys.user.Begin()
+		content, err = f.tx.LoadFile(name)
+	default:
+		// the tag first, one older than the content only costs a client a download
+		var stat *client.FileStat
+		stat, err = fsys.user.StatFile(name)
+		if err == nil {
+			f.etag = etag(stat)
+			content, err = fsys.user.LoadFile(name)
+		}
+	}
+	exists := err == nil
+	if err != nil && !errors.Is(err, client.ErrNotFound) {
+		f.abort()
+		return nil, pathError("open", name, err)
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		f.abort()
+		return nil, pathError("open", name, err)
+	}
+	if exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		f.abort()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	f.content = content
+	f.dirty = !exists || truncate
+	if flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.content))
+	}
+	return f, nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name, err := filename("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return &fs.PathError{Op: "remove", Path: "/", Err: fs.ErrPermission}
+	}
+	err = fsys.user.DeleteFile(name)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := filename("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newName, err = filename("rename", newName)
+	if err != nil {
+		return err
+	}
+	if oldName == "" || newName == "" {
+		return &fs.PathError{Op: "rename", Path: "/", Err: fs.ErrPermission}
+	}
+	err = fsys.user.RenameFile(oldName, newName)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	return nil
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := filename("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return rootInfo{}, nil
+	}
+	stat, err := fsys.user.StatFile(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return &fileInfo{name: name, size: stat.Size, etag: etag(stat)}, nil
+}
+
+// file buffers the whole content, nothing is written until Close
+type file struct {
+	fsys     *FileSystem
+	name     string
+	writable bool
+	tx       *client.Tx // what a writable file was read in, unless it was truncated
+	etag     string     // of content, if the file was opened to read
+	content  []byte
+	pos      int64
+	dirty    bool
+}
+
+func (f *file) Read(p []byte) (n int, err error) {
+	if f.pos >= int64(len(f.content)) {
+		return 0, io.EOF
+	}
+	n = copy(p, f.content[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.content))
+	default:
+		return 0, fmt.Errorf("davserver: bad whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *file) Write(p []byte) (n int, err error) {
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.content)) {
+		grown := make([]byte, end)
+		copy(grown, f.content)
+		f.content = grown
+	}
+	copy(f.content[f.pos:], p)
+	f.pos = end
+	f.dirty = true
+	return len(p), nil
+}
+
+// Writes the file back whole. One that was read first only is if nobody else wrote to it
+// since, otherwise Close fails with client.ErrConflict and writes nothing.
+func (f *file) Close() (err error) {
+	if !f.dirty {
+		f.abort()
+		return nil
+	}
+	f.dirty = false
+	if f.tx != nil {
+		err = f.tx.StoreFile(f.name, f.content)
+		if err == nil {
+			err = f.tx.Commit()
+		}
+		f.tx.Abort()
+	} else {
+		err = f.fsys.user.StoreFile(f.name, f.content)
+	}
+	if err != nil {
+		return pathError("write", f.name, err)
+	}
+	return nil
+}
+
+func (f *file) abort() {
+	if f.tx != nil {
+		f.tx.Abort()
+	}
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: f.name, size: int64(len(f.content)), etag: f.etag, fsys: f.fsys}, nil
+}
+
+// dir is the root collection
+type dir struct {
+	fsys  *FileSystem
+	names []string // left to return from Readdir
+	read  bool
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: "/", Err: errors.New("is a directory")}
+}
+
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: "/", Err: errors.New("is a directory")}
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: "/", Err: fs.ErrPermission}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		names, err := d.fsys.user.ListFiles()
+		if err != nil {
+			return nil, pathError("readdir", "/", err)
+		}
+		d.names = names
+		d.read = true
+	}
+	if count > 0 && len(d.names) == 0 {
+		return nil, io.EOF
+	}
+	n := len(d.names)
+	if count > 0 && count < n {
+		n = count
+	}
+	infos := make([]os.FileInfo, 0, n)
+	for _, name := range d.names[:n] {
+		stat, err := d.fsys.user.StatFile(name)
+		if err != nil {
+			// a file we lost access to still shows up, just empty
+			stat = &client.FileStat{}
+		}
+		infos = append(infos, &fileInfo{name: name, size: stat.Size, etag: etag(stat)})
+	}
+	d.names = d.names[n:]
+	return infos, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return rootInfo{}, nil
+}
+
+// fileInfo also gives webdav.Handler an ETag and content type so it doesn't have to
+// reopen the file to work them out
+type fileInfo struct {
+	name string
+	size int64
+	etag string
+	fsys *FileSystem // to look the ETag up with, for a file being written
+}
+
+func etag(stat *client.FileStat) string {
+	return `"` + stat.ETag + `"`
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return 0600 }
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} } // not tracked
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// webdav.Handler asks for a file it wrote after Close, when the file has its new tag
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag != "" {
+		return fi.etag, nil
+	}
+	stat, err := fi.fsys.user.StatFileContext(ctx, fi.name)
+	if err != nil {
+		return "", err
+	}
+	return etag(stat), nil
+}
+
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	return "application/octet-stream", nil
+}
+
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "/" }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() os.FileMode  { return os.ModeDir | 0700 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,79 @@
+package davserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// Handler serves WebDAV with HTTP basic auth, logging users in with GetUser. Only
+// put it behind TLS or on localhost, the password is sent on every request.
+//
+// Requests are handled one at a time since the client package shares one backend.
+type Handler struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	passwordHash [sha256.Size]byte
+	dav          *webdav.Handler
+}
+
+func NewHandler() *Handler {
+	return &Handler{sessions: make(map[string]*session)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		unauthorized(w)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, err := h.login(username, password)
+	if errors.Is(err, client.ErrAuth) || errors.Is(err, client.ErrNotFound) {
+		unauthorized(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.dav.ServeHTTP(w, r)
+}
+
+// GetUser is slow on purpose, so keep the session around after the first request
+func (h *Handler) login(username string, password string) (*session, error) {
+	passwordHash := sha256.Sum256([]byte(password))
+	s, exists := h.sessions[username]
+	if exists && subtle.ConstantTimeCompare(s.passwordHash[:], passwordHash[:]) == 1 {
+		return s, nil
+	}
+	user, err := client.GetUser(username, password)
+	if err != nil {
+		return nil, err
+	}
+	s = &session{
+		passwordHash: passwordHash,
+		dav: &webdav.Handler{
+			FileSystem: NewFileSystem(user),
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	h.sessions[username] = s
+	return s, nil
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="sfs"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,214 @@
+// Package localstore keeps the Datastore and Keystore in a directory so they survive
+// between runs of the sfs command. Every Datastore entry is one file named after its UUID
+// and every Keystore entry is one JSON file, so several processes can share a directory.
+package localstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+const (
+	datastoreDir = "datastore"
+	keystoreDir  = "keystore"
+)
+
+// Datastore is a client.EnumerableDatastore, client.BatchDatastore and
+// client.DigestDatastore backed by dir/datastore.
+type Datastore struct {
+	dir string
+}
+
+// Keystore is a client.EnumerableKeystore backed by dir/keystore.
+type Keystore struct {
+	dir string
+}
+
+// Open creates dir if needed and returns the Datastore and Keystore stored in it.
+func Open(dir string) (ds *Datastore, ks *Keystore, err error) {
+	ds = &Datastore{dir: filepath.Join(dir, datastoreDir)}
+	ks = &Keystore{dir: filepath.Join(dir, keystoreDir)}
+	for _, sub := range []string{ds.dir, ks.dir} {
+		err = os.MkdirAll(sub, 0700)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ds, ks, nil
+}
+
+func (ds *Datastore) path(key uuid.UUID) string {
+	return filepath.Join(ds.dir, key.String())
+}
+
+func (ds *Datastore) Get(key uuid.UUID) (value []byte, ok bool, err error) {
+	value, err = os.ReadFile(ds.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// GetMany reads the files one after another, it saves the caller nothing but lets
+// a remote.Server answer batches in one go.
+func (ds *Datastore) GetMany(ctx context.Context, keys []uuid.UUID) (values map[uuid.UUID][]byte, err error) {
+	values = make(map[uuid.UUID][]byte, len(keys))
+	for _, key := range keys {
+		err = ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		value, ok, err := ds.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// Digest still reads the whole file, what it saves the session cache is opening the
+// value again, and a remote.Server sending it.
+func (ds *Datastore) Digest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, ok bool, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return digest, false, err
+	}
+	value, ok, err := ds.Get(key)
+	if err != nil || !ok {
+		return digest, false, err
+	}
+	return sha256.Sum256(value), true, nil
+}
+
+func (ds *Datastore) Has(key uuid.UUID) (ok bool, err error) {
+	_, err = os.Stat(ds.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ds *Datastore) Set(key uuid.UUID, value []byte) error {
+	return writeAtomic(ds.dir, ds.path(key), value)
+}
+
+func (ds *Datastore) Delete(key uuid.UUID) error {
+	err := os.Remove(ds.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (ds *Datastore) Keys() (keys []uuid.UUID, err error) {
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		key, err := uuid.Parse(entry.Name())
+		if err != nil {
+			continue // leftover temp file
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// names can hold anything, so the file name is the hex of the name
+func (ks *Keystore) path(name string) string {
+	return filepath.Join(ks.dir, hex.EncodeToString([]byte(name))+".json")
+}
+
+func (ks *Keystore) Get(name string) (value userlib.PublicKeyType, ok bool, err error) {
+	data, err := os.ReadFile(ks.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return value, false, nil
+	}
+	if err != nil {
+		return value, false, err
+	}
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return value, false, fmt.Errorf("localstore: keystore entry %q: %w", name, err)
+	}
+	return value, true, nil
+}
+
+// Set fails if name is already taken, same as userlib.KeystoreSet.
+func (ks *Keystore) Set(name string, value userlib.PublicKeyType) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ks.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("localstore: keystore entry %q has been taken", name)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (ks *Keystore) Names() (names []string, err error) {
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		encoded, isJSON := strings.CutSuffix(entry.Name(), ".json")
+		if !isJSON {
+			continue
+		}
+		name, err := hex.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+// writes to a temp file first so readers never see half an entry
+func writeAtomic(dir string, path string, value []byte) error {
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(value)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,250 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Datastore is a client.EnumerableDatastore talking to a Server. It's also a
+// client.ContextDatastore, a cancelled call aborts the request in flight, and a
+// client.BatchDatastore and client.DigestDatastore.
+type Datastore struct {
+	base string
+	http *http.Client
+}
+
+// Keystore is a client.EnumerableKeystore and client.ContextKeystore talking to a Server.
+type Keystore struct {
+	base string
+	http *http.Client
+}
+
+// Dial returns the backends for the server at baseURL, e.g. "http://host:8161". token
+// is the server's Token, empty if it has none. httpClient may be nil to use
+// http.DefaultClient.
+func Dial(baseURL string, token string, httpClient *http.Client) (*Datastore, *Keystore) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if token != "" {
+		withToken := *httpClient
+		withToken.Transport = bearer{token: token, next: httpClient.Transport}
+		httpClient = &withToken
+	}
+	base := strings.TrimRight(baseURL, "/")
+	return &Datastore{base: base + datastorePrefix, http: httpClient},
+		&Keystore{base: base + keystorePrefix, http: httpClient}
+}
+
+// bearer sends the server's Token with every request
+type bearer struct {
+	token string
+	next  http.RoundTripper // http.DefaultTransport if nil
+}
+
+func (b bearer) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := b.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return next.RoundTrip(req)
+}
+
+// StatusError is a response the server shouldn't have given.
+type StatusError struct {
+	Method string
+	URL    string
+	Status string
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("remote: %s %s: %s: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// does the request, anything but a 2xx or 404 is an error. found is false on a 404.
+func do(ctx context.Context, httpClient *http.Client, method string, target string, body []byte) (respBody []byte, found bool, err error) {
+	respBody, _, found, err = doWithHeader(ctx, httpClient, method, target, body)
+	return respBody, found, err
+}
+
+// do that also returns the response headers
+func doWithHeader(ctx context.Context, httpClient *http.Client, method string, target string, body []byte) (respBody []byte, header http.Header, found bool, err error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer resp.Body.Close()
+	respBody, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, false, &StatusError{Method: method, URL: target, Status: resp.Status, Body: strings.TrimSpace(string(respBody))}
+	}
+	return respBody, resp.Header, true, nil
+}
+
+func (ds *Datastore) Get(key uuid.UUID) (value []byte, ok bool, err error) {
+	return ds.GetContext(context.Background(), key)
+}
+
+func (ds *Datastore) GetContext(ctx context.Context, key uuid.UUID) (value []byte, ok bool, err error) {
+	return do(ctx, ds.http, http.MethodGet, ds.base+key.String(), nil)
+}
+
+// Has is a HEAD request, so checking for a chunk doesn't download it.
+func (ds *Datastore) Has(key uuid.UUID) (ok bool, err error) {
+	return ds.HasContext(context.Background(), key)
+}
+
+func (ds *Datastore) HasContext(ctx context.Context, key uuid.UUID) (ok bool, err error) {
+	_, ok, err = do(ctx, ds.http, http.MethodHead, ds.base+key.String(), nil)
+	return ok, err
+}
+
+// Digest has the server hash the value, so checking that it's unchanged doesn't
+// download it.
+func (ds *Datastore) Digest(ctx context.Context, key uuid.UUID) (digest [sha256.Size]byte, ok bool, err error) {
+	body, ok, err := do(ctx, ds.http, http.MethodGet, ds.base+key.String()+"?digest=sha256", nil)
+	if err != nil || !ok {
+		return digest, false, err
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil || len(decoded) != sha256.Size {
+		return digest, false, fmt.Errorf("remote: malformed digest of %s", key)
+	}
+	copy(digest[:], decoded)
+	return digest, true, nil
+}
+
+// GetMany sends the keys MaxBatchKeys at a time, and asks again for the ones a response
+// had no room for.
+func (ds *Datastore) GetMany(ctx context.Context, keys []uuid.UUID) (values map[uuid.UUID][]byte, err error) {
+	values = make(map[uuid.UUID][]byte, len(keys))
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > MaxBatchKeys {
+			batch = batch[:MaxBatchKeys]
+		}
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return nil, err
+		}
+		respBody, header, _, err := doWithHeader(ctx, ds.http, http.MethodPost, ds.base, body)
+		if err != nil {
+			return nil, err
+		}
+		unanswered := 0
+		if raw := header.Get(unansweredHeader); raw != "" {
+			unanswered, err = strconv.Atoi(raw)
+			if err != nil || unanswered < 0 || unanswered >= len(batch) {
+				return nil, fmt.Errorf("remote: malformed %s header %q", unansweredHeader, raw)
+			}
+		}
+		keys = keys[len(batch)-unanswered:]
+		var found map[uuid.UUID][]byte
+		err = json.Unmarshal(respBody, &found)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range found {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func (ds *Datastore) Set(key uuid.UUID, value []byte) error {
+	return ds.SetContext(context.Background(), key, value)
+}
+
+func (ds *Datastore) SetContext(ctx context.Context, key uuid.UUID, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, _, err := do(ctx, ds.http, http.MethodPut, ds.base+key.String(), value)
+	return err
+}
+
+func (ds *Datastore) Delete(key uuid.UUID) error {
+	return ds.DeleteContext(context.Background(), key)
+}
+
+func (ds *Datastore) DeleteContext(ctx context.Context, key uuid.UUID) error {
+	_, _, err := do(ctx, ds.http, http.MethodDelete, ds.base+key.String(), nil)
+	return err
+}
+
+func (ds *Datastore) Keys() (keys []uuid.UUID, err error) {
+	body, _, err := do(context.Background(), ds.http, http.MethodGet, ds.base, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &keys)
+	return keys, err
+}
+
+func (ks *Keystore) Get(name string) (value userlib.PublicKeyType, ok bool, err error) {
+	return ks.GetContext(context.Background(), name)
+}
+
+func (ks *Keystore) GetContext(ctx context.Context, name string) (value userlib.PublicKeyType, ok bool, err error) {
+	body, ok, err := do(ctx, ks.http, http.MethodGet, ks.base+url.PathEscape(name), nil)
+	if err != nil || !ok {
+		return value, false, err
+	}
+	err = json.Unmarshal(body, &value)
+	if err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+// Set fails with a *StatusError (409 Conflict) if name is already taken.
+func (ks *Keystore) Set(name string, value userlib.PublicKeyType) error {
+	return ks.SetContext(context.Background(), name, value)
+}
+
+func (ks *Keystore) SetContext(ctx context.Context, name string, value userlib.PublicKeyType) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, _, err = do(ctx, ks.http, http.MethodPut, ks.base+url.PathEscape(name), body)
+	return err
+}
+
+func (ks *Keystore) Names() (names []string, err error) {
+	body, _, err := do(context.Background(), ks.http, http.MethodGet, ks.base, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &names)
+	return names, err
+}
@@ -0,0 +1,317 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+)
+
+func startServer(t *testing.T) (server *httptest.Server, ds *Datastore, ks *Keystore) {
+	t.Helper()
+	localDatastore, localKeystore, err := localstore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewServer(localDatastore, localKeystore)
+	handler.Token = "token"
+	server = httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	ds, ks = Dial(server.URL, "token", server.Client())
+	return server, ds, ks
+}
+
+func TestTokenRequired(t *testing.T) {
+	server, ds, _ := startServer(t)
+	key := uuid.New()
+	if err := ds.Set(key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "wrong"} {
+		other, _ := Dial(server.URL, token, server.Client())
+		var status *StatusError
+		if err := other.Set(key, []byte("forged")); !errors.As(err, &status) || status.Status != "401 Unauthorized" {
+			t.Fatalf("Set with token %q = %v, want 401", token, err)
+		}
+		if _, _, err := other.Get(key); !errors.As(err, &status) || status.Status != "401 Unauthorized" {
+			t.Fatalf("Get with token %q = %v, want 401", token, err)
+		}
+	}
+	value, ok, err := ds.Get(key)
+	if err != nil || !ok || string(value) != "hello" {
+		t.Fatalf("Get = %q, %v, %v", value, ok, err)
+	}
+}
+
+func TestDatastoreRoundTrip(t *testing.T) {
+	_, ds, _ := startServer(t)
+	key := uuid.New()
+	_, ok, err := ds.Get(key)
+	if err != nil || ok {
+		t.Fatalf("Get of a missing key = %v, %v", ok, err)
+	}
+	for _, value := range [][]byte{[]byte("hello"), {}} {
+		err = ds.Set(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok, err := ds.Get(key)
+		if err != nil || !ok || string(got) != string(value) {
+			t.Fatalf("Get = %q, %v, %v, want %q", got, ok, err, value)
+		}
+	}
+	ok, err = ds.Has(key)
+	if err != nil || !ok {
+		t.Fatalf("Has = %v, %v", ok, err)
+	}
+	keys, err := ds.Keys()
+	if err != nil || len(keys) != 1 || keys[0] != key {
+		t.Fatalf("Keys = %v, %v", keys, err)
+	}
+	err = ds.Delete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, _ = ds.Get(key)
+	if ok {
+		t.Fatal("key still there after Delete")
+	}
+	ok, err = ds.Has(key)
+	if err != nil || ok {
+		t.Fatalf("Has after Delete = %v, %v", ok, err)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	_, ds, _ := startServer(t)
+	stored := make(map[uuid.UUID][]byte)
+	var keys []uuid.UUID
+	for i := 0; i < MaxBatchKeys+10; i++ {
+		key := uuid.New()
+		keys = append(keys, key)
+		if i%3 == 0 {
+			continue // missing
+		}
+		stored[key] = []byte(key.String())
+		err := ds.Set(key, stored[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, err := ds.GetMany(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(stored) {
+		t.Fatalf("GetMany returned %d values, want %d", len(values), len(stored))
+	}
+	for key, value := range stored {
+		if string(values[key]) != string(value) {
+			t.Fatalf("GetMany[%s] = %q, want %q", key, values[key], value)
+		}
+	}
+}
+
+func TestGetManyStopsAtMaxBatchBytes(t *testing.T) {
+	server, ds, _ := startServer(t)
+	var keys []uuid.UUID
+	for i := 0; i < 5; i++ {
+		key := uuid.New()
+		keys = append(keys, key)
+		err := ds.Set(key, bytes.Repeat([]byte{byte(i)}, MaxBatchBytes/3))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the server answers as many as fit and says how many are left
+	body, _ := json.Marshal(keys)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+datastorePrefix, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found map[uuid.UUID][]byte
+	err = json.NewDecoder(resp.Body).Decode(&found)
+	resp.Body.Close()
+	if err != nil || len(found) != 3 || resp.Header.Get(unansweredHeader) != "2" {
+		t.Fatalf("POST answered %d keys, %s %q, %v", len(found), unansweredHeader, resp.Header.Get(unansweredHeader), err)
+	}
+
+	// and the client backend asks again for those
+	values, err := ds.GetMany(context.Background(), keys)
+	if err != nil || len(values) != len(keys) {
+		t.Fatalf("GetMany returned %d values, %v", len(values), err)
+	}
+	for i, key := range keys {
+		if len(values[key]) != MaxBatchBytes/3 || values[key][0] != byte(i) {
+			t.Fatalf("GetMany[%d] is wrong", i)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	_, ds, _ := startServer(t)
+	key := uuid.New()
+	_, ok, err := ds.Digest(context.Background(), key)
+	if err != nil || ok {
+		t.Fatalf("Digest of a missing key = %v, %v", ok, err)
+	}
+	value := []byte("hello")
+	err = ds.Set(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, ok, err := ds.Digest(context.Background(), key)
+	if err != nil || !ok || digest != sha256.Sum256(value) {
+		t.Fatalf("Digest = %x, %v, %v, want %x", digest, ok, err, sha256.Sum256(value))
+	}
+}
+
+func TestKeystoreEntriesCantBeReplaced(t *testing.T) {
+	_, _, ks := startServer(t)
+	encKey, _, err := userlib.PKEKeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "alice encKey/with odd?chars"
+	err = ks.Set(name, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := ks.Get(name)
+	if err != nil || !ok || got.PubKey.N.Cmp(encKey.PubKey.N) != 0 {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	err = ks.Set(name, encKey)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != "409 Conflict" {
+		t.Fatalf("second Set = %v, want 409", err)
+	}
+	names, err := ks.Names()
+	if err != nil || len(names) != 1 || names[0] != name {
+		t.Fatalf("Names = %v, %v", names, err)
+	}
+}
+
+func TestServerRejectsBadRequests(t *testing.T) {
+	server, _, _ := startServer(t)
+	for _, test := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/datastore/not-a-uuid", http.StatusBadRequest},
+		{http.MethodPost, "/datastore/" + uuid.NewString(), http.StatusMethodNotAllowed},
+		{http.MethodGet, "/elsewhere", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(test.method, server.URL+test.path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, resp.StatusCode, test.want)
+		}
+	}
+}
+
+// two "machines" with their own sessions sharing one server
+func TestClientOverServer(t *testing.T) {
+	_, ds, ks := startServer(t)
+	client.SetDatastore(ds)
+	client.SetKeystore(ks)
+	t.Cleanup(func() {
+		client.SetDatastore(nil)
+		client.SetKeystore(nil)
+	})
+
+	alice, err := client.InitUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.InitUser("bob", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.StoreFile("notes", []byte("shared "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := alice.CreateInvitation("notes", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := client.GetUser("bob", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.AcceptInvitation("alice", invitation, "from-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.AppendToFile("from-alice", []byte("across machines"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := alice.LoadFile("notes")
+	if err != nil || string(content) != "shared across machines" {
+		t.Fatalf("LoadFile = %q, %v", content, err)
+	}
+
+	stats, err := client.CollectGarbage([]*client.User{alice, bob}, client.GCOptions{DryRun: true})
+	if err != nil || stats.Garbage != 0 {
+		t.Fatalf("CollectGarbage = %+v, %v", stats, err)
+	}
+}
+
+// a deadline aborts the request the server is sitting on instead of waiting it out
+func TestContextAbortsRequests(t *testing.T) {
+	localDatastore, localKeystore, err := localstore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	handler := NewServer(localDatastore, localKeystore)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	ds, ks := Dial(server.URL, "", server.Client())
+	client.SetDatastore(ds)
+	client.SetKeystore(ks)
+	t.Cleanup(func() {
+		client.SetDatastore(nil)
+		client.SetKeystore(nil)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.GetUserContext(ctx, "alice", "password")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetUserContext = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("GetUserContext took %v after its deadline", elapsed)
+	}
+}
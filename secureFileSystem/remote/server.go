@@ -0,0 +1,326 @@
+// Package remote serves a Datastore and Keystore over HTTP and provides the matching
+// client backends, so several processes or machines can share one store.
+//
+// The Datastore side doesn't have to be trusted with what's in it, the client seals
+// everything, though it sees which values are read and written and how big they are, and
+// anyone who reads a login entry can guess passwords against it offline. The Keystore
+// side does have to be trusted: it hands out the public keys that shares are encrypted to
+// and checked against, so whoever runs it can read and forge anything shared from then
+// on. Run it yourself, or keep the Keystore on a server that you do.
+//
+// With Server.Token set, every request has to carry it as "Authorization: Bearer TOKEN",
+// anything else gets 401 Unauthorized. Dial's token does that. The protocol is
+// deliberately dumb otherwise:
+//
+//	GET    /datastore/          JSON list of keys
+//	POST   /datastore/          JSON list of keys in, JSON object of the ones that exist out,
+//	                            the last Sfs-Unanswered keys weren't looked up if set
+//	GET    /datastore/{uuid}    raw value, 404 if missing
+//	GET    /datastore/{uuid}?digest=sha256    hex SHA-256 of the value, 404 if missing
+//	HEAD   /datastore/{uuid}    200 or 404, no body
+//	PUT    /datastore/{uuid}    set the value to the request body
+//	DELETE /datastore/{uuid}
+//	GET    /keystore/           JSON list of names
+//	GET    /keystore/{name}     JSON userlib.PublicKeyType, 404 if missing
+//	PUT    /keystore/{name}     publish a key, 409 if the name is taken
+//
+// Keystore names are path-escaped.
+package remote
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// MaxValueSize is the largest Datastore value or Keystore entry the server accepts.
+const MaxValueSize = 64 << 20
+
+// MaxBatchKeys is the most keys one POST /datastore/ may ask for.
+const MaxBatchKeys = 1024
+
+// MaxBatchBytes is how many bytes of values one POST /datastore/ answers with at most.
+// The server stops once the next value wouldn't fit and says how many keys it didn't
+// get to in the Sfs-Unanswered header, the first key is answered whatever its size.
+const MaxBatchBytes = 16 << 20
+
+const unansweredHeader = "Sfs-Unanswered"
+
+const (
+	datastorePrefix = "/datastore/"
+	keystorePrefix  = "/keystore/"
+)
+
+// Server is an http.Handler exposing ds and ks. Both have to be safe for concurrent use.
+type Server struct {
+	Token string // required of every request if set, see the package doc
+
+	ds client.EnumerableDatastore
+	ks client.EnumerableKeystore
+}
+
+func NewServer(ds client.EnumerableDatastore, ks client.EnumerableKeystore) *Server {
+	return &Server{ds: ds, ks: ks}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sfsd"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, datastorePrefix):
+		s.serveDatastore(w, r, strings.TrimPrefix(r.URL.Path, datastorePrefix))
+	case strings.HasPrefix(r.URL.Path, keystorePrefix):
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), keystorePrefix))
+		if err != nil {
+			http.Error(w, "bad keystore name", http.StatusBadRequest)
+			return
+		}
+		s.serveKeystore(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *Server) serveDatastore(w http.ResponseWriter, r *http.Request, rawKey string) {
+	if rawKey == "" {
+		switch r.Method {
+		case http.MethodGet:
+			keys, err := s.ds.Keys()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, keys)
+		case http.MethodPost:
+			s.serveGetMany(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+	key, err := uuid.Parse(rawKey)
+	if err != nil {
+		http.Error(w, "bad key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("digest") {
+			s.serveDigest(w, r, key)
+			return
+		}
+		value, ok, err := s.ds.Get(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(value)
+	case http.MethodHead:
+		var ok bool
+		if hasDatastore, supported := s.ds.(client.HasDatastore); supported {
+			ok, err = hasDatastore.Has(key)
+		} else {
+			_, ok, err = s.ds.Get(key)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		value, err := readBody(w, r)
+		if err != nil {
+			return
+		}
+		err = s.ds.Set(key, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err = s.ds.Delete(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (s *Server) serveDigest(w http.ResponseWriter, r *http.Request, key uuid.UUID) {
+	if r.URL.Query().Get("digest") != "sha256" {
+		http.Error(w, "unknown digest", http.StatusBadRequest)
+		return
+	}
+	var digest [sha256.Size]byte
+	var ok bool
+	var err error
+	if digestDatastore, supported := s.ds.(client.DigestDatastore); supported {
+		digest, ok, err = digestDatastore.Digest(r.Context(), key)
+	} else {
+		var value []byte
+		value, ok, err = s.ds.Get(key)
+		digest = sha256.Sum256(value)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, hex.EncodeToString(digest[:]))
+}
+
+func (s *Server) serveGetMany(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r)
+	if err != nil {
+		return
+	}
+	var keys []uuid.UUID
+	err = json.Unmarshal(body, &keys)
+	if err != nil {
+		http.Error(w, "bad key list", http.StatusBadRequest)
+		return
+	}
+	if len(keys) > MaxBatchKeys {
+		http.Error(w, "too many keys", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// one key at a time rather than through client.BatchDatastore, so the values in
+	// memory never add up to more than the response can hold
+	values := make(map[uuid.UUID][]byte)
+	total := 0
+	answered := 0
+	for _, key := range keys {
+		value, ok, err := s.ds.Get(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok && answered > 0 && total+len(value) > MaxBatchBytes {
+			break
+		}
+		if ok {
+			values[key] = value
+			total += len(value)
+		}
+		answered++
+	}
+	if answered < len(keys) {
+		w.Header().Set(unansweredHeader, strconv.Itoa(len(keys)-answered))
+	}
+	writeJSON(w, values)
+}
+
+func (s *Server) serveKeystore(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		names, err := s.ks.Names()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, names)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, ok, err := s.ks.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, value)
+	case http.MethodPut:
+		body, err := readBody(w, r)
+		if err != nil {
+			return
+		}
+		var value userlib.PublicKeyType
+		err = json.Unmarshal(body, &value)
+		if err != nil {
+			http.Error(w, "bad public key", http.StatusBadRequest)
+			return
+		}
+		// the backend is the one that knows whether the name is taken, and Set is
+		// required to fail if it is
+		err = s.ks.Set(name, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+// reads the whole body, answering the request itself if that fails
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxValueSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
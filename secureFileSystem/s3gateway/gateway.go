@@ -0,0 +1,479 @@
+// Package s3gateway serves a user's files through the core of the S3 API, for tools
+// that only speak S3. Each user gets one bucket whose object keys are their filenames,
+// so the same files show up in sfs, WebDAV and S3. Only path-style URLs
+// (http://host/bucket/key) and header-signed SigV4 requests are supported.
+//
+// Supported: ListBuckets, ListObjectsV2, PutObject, GetObject, HeadObject, DeleteObject,
+// CreateMultipartUpload, UploadPart, CompleteMultipartUpload, AbortMultipartUpload.
+// Each multipart part is kept as a file of the user's own under ".s3-uploads/" until the
+// upload completes, then the parts are copied into the object in one transaction, each
+// part one AppendBlock, so nobody sees the object half assembled and a failure leaves the
+// old one as it was. Object keys under ".s3-uploads/" aren't served or listed.
+//
+// ETags are the client's content tags (see client.StatFile), not the MD5 of the content,
+// the same as for S3 objects encrypted with SSE-KMS. Only parts have MD5 ETags.
+package s3gateway
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// DefaultBucket is the bucket name every user's files are served under.
+const DefaultBucket = "sfs"
+
+// MaxObjectSize bounds single PUTs and each multipart part.
+const MaxObjectSize = 256 << 20
+
+const (
+	maxListKeys = 1000
+
+	// multipart uploads in progress at once, across users, and parts per upload
+	maxUploads = 100
+	maxParts   = 10000
+
+	// where the parts of upload ID go, as uploadPrefix + ID + "/" + part number
+	uploadPrefix = ".s3-uploads/"
+)
+
+// Gateway is an http.Handler. Requests are handled one at a time since the client
+// package shares one backend, only reading a request's body happens alongside others.
+type Gateway struct {
+	Bucket string
+	now    func() time.Time
+
+	mu      sync.Mutex
+	users   map[string]*client.User // access key (username) : session
+	secrets map[string]string       // access key : secret key
+	uploads map[string]*upload      // upload ID : parts received so far
+}
+
+type upload struct {
+	username string
+	key      string
+	parts    map[int]string // part number : ETag, the content is in partName
+}
+
+func New() *Gateway {
+	return &Gateway{
+		Bucket:  DefaultBucket,
+		now:     time.Now,
+		users:   make(map[string]*client.User),
+		secrets: make(map[string]string),
+		uploads: make(map[string]*upload),
+	}
+}
+
+// SecretService is what the secret key AddUser returns is derived for, see
+// client.User.ServiceSecret.
+const SecretService = "s3"
+
+// AddUser lets user sign requests with their username as the access key and the secret
+// key it returns, which is the same every time for the same account.
+func (g *Gateway) AddUser(user *client.User) (secretKey string, err error) {
+	secret, err := user.ServiceSecret(SecretService)
+	if err != nil {
+		return "", err
+	}
+	secretKey = hex.EncodeToString(secret)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.users[user.Username] = user
+	g.secrets[user.Username] = secretKey
+	return secretKey, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, body, s3err := g.authenticate(r)
+	if s3err != nil {
+		s3err.write(w, r)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			errMethodNotAllowed().write(w, r)
+			return
+		}
+		writeXML(w, http.StatusOK, listAllMyBucketsResult{
+			Xmlns:   s3Namespace,
+			Owner:   owner{ID: user.Username, DisplayName: user.Username},
+			Buckets: []bucketEntry{{Name: g.Bucket}},
+		})
+		return
+	}
+	if bucket != g.Bucket {
+		(&s3Error{Status: http.StatusNotFound, Code: "NoSuchBucket", Message: "the specified bucket does not exist"}).write(w, r)
+		return
+	}
+	if strings.HasPrefix(key, uploadPrefix) {
+		errAccessDenied("keys under "+uploadPrefix+" hold multipart uploads in progress").write(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s3err = g.listObjects(w, user, query)
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "":
+		s3err = errMethodNotAllowed()
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s3err = g.createMultipartUpload(w, user, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s3err = g.uploadPart(w, user, key, query, body)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s3err = g.completeMultipartUpload(w, user, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s3err = g.abortMultipartUpload(w, user, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		s3err = g.putObject(w, r, user, key, body)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s3err = g.getObject(w, r, user, key)
+	case r.Method == http.MethodDelete:
+		s3err = g.deleteObject(w, user, key)
+	default:
+		s3err = errMethodNotAllowed()
+	}
+	if s3err != nil {
+		s3err.write(w, r)
+	}
+}
+
+// checks the signature and reads the body, which the signature may cover. Only looking
+// the user up holds the lock.
+func (g *Gateway) authenticate(r *http.Request) (user *client.User, body []byte, s3err *s3Error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil, errAccessDenied("anonymous requests are not allowed")
+	}
+	a, err := parseAuthorization(header)
+	if err != nil {
+		return nil, nil, &s3Error{Status: http.StatusBadRequest, Code: "AuthorizationHeaderMalformed", Message: err.Error()}
+	}
+	g.mu.Lock()
+	user, exists := g.users[a.accessKey]
+	secret := g.secrets[a.accessKey]
+	g.mu.Unlock()
+	if !exists {
+		return nil, nil, &s3Error{Status: http.StatusForbidden, Code: "InvalidAccessKeyId", Message: "the access key ID you provided does not exist in our records"}
+	}
+	payloadHash, s3err := verifySignature(r, a, secret, g.now())
+	if s3err != nil {
+		return nil, nil, s3err
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, MaxObjectSize+1))
+	if err != nil {
+		return nil, nil, &s3Error{Status: http.StatusBadRequest, Code: "IncompleteBody", Message: err.Error()}
+	}
+	if len(body) > MaxObjectSize {
+		return nil, nil, &s3Error{Status: http.StatusBadRequest, Code: "EntityTooLarge", Message: "your proposed upload exceeds the maximum allowed size"}
+	}
+	if payloadHash != unsignedPayload && payloadHash != sha256Hex(body) {
+		return nil, nil, &s3Error{Status: http.StatusBadRequest, Code: "XAmzContentSHA256Mismatch", Message: "the provided x-amz-content-sha256 header does not match what was computed"}
+	}
+	return user, body, nil
+}
+
+func etag(stat *client.FileStat) string {
+	return `"` + stat.ETag + `"`
+}
+
+func partETag(content []byte) string {
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// The file part number of upload ID is kept in
+func partName(uploadID string, number int) string {
+	return uploadPrefix + uploadID + "/" + strconv.Itoa(number)
+}
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, user *client.User, key string, body []byte) *s3Error {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "CopyObject is not supported"}
+	}
+	err := user.StoreFile(key, body)
+	if err != nil {
+		return clientError(err)
+	}
+	stat, err := user.StatFile(key)
+	if err != nil {
+		return clientError(err)
+	}
+	w.Header().Set("ETag", etag(stat))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, user *client.User, key string) *s3Error {
+	// the tag first, one older than the content only costs a client a download
+	stat, err := user.StatFile(key)
+	if err != nil {
+		return clientError(err)
+	}
+	w.Header().Set("ETag", etag(stat))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(stat.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	content, err := user.LoadFile(key)
+	if err != nil {
+		return clientError(err)
+	}
+	// handles Range for us
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	return nil
+}
+
+func (g *Gateway) deleteObject(w http.ResponseWriter, user *client.User, key string) *s3Error {
+	err := user.DeleteFile(key)
+	// deleting something that isn't there succeeds in S3
+	if err != nil && !errors.Is(err, client.ErrNotFound) {
+		return clientError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) listObjects(w http.ResponseWriter, user *client.User, query url.Values) *s3Error {
+	if query.Get("list-type") != "2" {
+		return &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "only ListObjectsV2 is supported"}
+	}
+	maxKeys := maxListKeys
+	if raw := query.Get("max-keys"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "bad max-keys"}
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	// continuation tokens are the last key we returned, or the last common prefix and
+	// with it every key under it
+	after, afterPrefix := query.Get("start-after"), ""
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := hex.DecodeString(token)
+		if err != nil || len(decoded) == 0 || decoded[0] != 'k' && decoded[0] != 'p' {
+			return &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "bad continuation-token"}
+		}
+		after = string(decoded[1:])
+		if decoded[0] == 'p' {
+			afterPrefix = after
+		}
+	}
+
+	filenames, err := user.ListFiles()
+	if err != nil {
+		return clientError(err)
+	}
+	result := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              g.Bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	seenPrefixes := make(map[string]bool)
+	next := ""
+	for _, filename := range filenames {
+		if !strings.HasPrefix(filename, prefix) || filename <= after || strings.HasPrefix(filename, uploadPrefix) {
+			continue
+		}
+		if afterPrefix != "" && strings.HasPrefix(filename, afterPrefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(filename[len(prefix):], delimiter); i >= 0 {
+				common := filename[:len(prefix)+i+len(delimiter)]
+				if seenPrefixes[common] {
+					continue
+				}
+				if result.KeyCount == maxKeys {
+					result.IsTruncated = true
+					break
+				}
+				seenPrefixes[common] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: common})
+				result.KeyCount++
+				next = "p" + common
+				continue
+			}
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		stat, err := user.StatFile(filename)
+		if err != nil {
+			return clientError(err)
+		}
+		result.Contents = append(result.Contents, object{Key: filename, Size: stat.Size, ETag: etag(stat), StorageClass: "STANDARD"})
+		result.KeyCount++
+		next = "k" + filename
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = hex.EncodeToString([]byte(next))
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (g *Gateway) createMultipartUpload(w http.ResponseWriter, user *client.User, key string) *s3Error {
+	if len(g.uploads) >= maxUploads {
+		return &s3Error{Status: http.StatusServiceUnavailable, Code: "SlowDown", Message: "too many multipart uploads in progress, complete or abort some"}
+	}
+	uploadID := uuid.NewString()
+	g.uploads[uploadID] = &upload{username: user.Username, key: key, parts: make(map[int]string)}
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: g.Bucket, Key: key, UploadID: uploadID})
+	return nil
+}
+
+func (g *Gateway) findUpload(user *client.User, key string, uploadID string) (*upload, *s3Error) {
+	u, exists := g.uploads[uploadID]
+	if !exists || u.username != user.Username || u.key != key {
+		return nil, &s3Error{Status: http.StatusNotFound, Code: "NoSuchUpload", Message: "the specified multipart upload does not exist"}
+	}
+	return u, nil
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, user *client.User, key string, query url.Values, body []byte) *s3Error {
+	uploadID := query.Get("uploadId")
+	u, s3err := g.findUpload(user, key, uploadID)
+	if s3err != nil {
+		return s3err
+	}
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxParts {
+		return &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "part number must be an integer between 1 and 10000"}
+	}
+	err = user.StoreFile(partName(uploadID, partNumber), body)
+	if err != nil {
+		return clientError(err)
+	}
+	u.parts[partNumber] = partETag(body)
+	w.Header().Set("ETag", u.parts[partNumber])
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) completeMultipartUpload(w http.ResponseWriter, user *client.User, key string, uploadID string, body []byte) *s3Error {
+	u, s3err := g.findUpload(user, key, uploadID)
+	if s3err != nil {
+		return s3err
+	}
+	var request completeMultipartUpload
+	err := xml.Unmarshal(body, &request)
+	if err != nil || len(request.Parts) == 0 {
+		return &s3Error{Status: http.StatusBadRequest, Code: "MalformedXML", Message: "the XML you provided was not well-formed"}
+	}
+	invalidPart := &s3Error{Status: http.StatusBadRequest, Code: "InvalidPart", Message: "one or more of the specified parts could not be found"}
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			return &s3Error{Status: http.StatusBadRequest, Code: "InvalidPartOrder", Message: "the list of parts was not in ascending order"}
+		}
+		uploaded, exists := u.parts[part.PartNumber]
+		if !exists || strings.Trim(part.ETag, `"`) != strings.Trim(uploaded, `"`) {
+			return invalidPart
+		}
+	}
+
+	// first part replaces whatever was there, the rest each become an AppendBlock, and
+	// none of it shows until Commit
+	tx := user.Begin()
+	defer tx.Abort()
+	for i, part := range request.Parts {
+		content, err := tx.LoadFile(partName(uploadID, part.PartNumber))
+		if errors.Is(err, client.ErrNotFound) {
+			return invalidPart
+		}
+		if err != nil {
+			return clientError(err)
+		}
+		if i == 0 {
+			err = tx.StoreFile(key, content)
+		} else {
+			err = tx.AppendToFile(key, content)
+		}
+		if err != nil {
+			return clientError(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return clientError(err)
+	}
+	g.removeUpload(user, uploadID)
+	stat, err := user.StatFile(key)
+	if err != nil {
+		return clientError(err)
+	}
+
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:  s3Namespace,
+		Bucket: g.Bucket,
+		Key:    key,
+		ETag:   etag(stat),
+	})
+	return nil
+}
+
+func (g *Gateway) abortMultipartUpload(w http.ResponseWriter, user *client.User, key string, uploadID string) *s3Error {
+	_, s3err := g.findUpload(user, key, uploadID)
+	if s3err != nil {
+		return s3err
+	}
+	g.removeUpload(user, uploadID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Forgets an upload and deletes its parts. A part that can't be deleted now stays in the
+// user's files under uploadPrefix, out of the bucket.
+func (g *Gateway) removeUpload(user *client.User, uploadID string) {
+	for number := range g.uploads[uploadID].parts {
+		_ = user.DeleteFile(partName(uploadID, number))
+	}
+	delete(g.uploads, uploadID)
+}
+
+// maps client errors onto the closest S3 error
+func clientError(err error) *s3Error {
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		return &s3Error{Status: http.StatusNotFound, Code: "NoSuchKey", Message: err.Error()}
+	case errors.Is(err, client.ErrRevoked):
+		return errAccessDenied(err.Error())
+	case errors.Is(err, client.ErrConflict), errors.Is(err, client.ErrExists):
+		return &s3Error{Status: http.StatusConflict, Code: "OperationAborted", Message: err.Error()}
+	case errors.Is(err, client.ErrQuota):
+		return &s3Error{Status: http.StatusForbidden, Code: "QuotaExceeded", Message: err.Error()}
+	case errors.Is(err, client.ErrInvalid):
+		return &s3Error{Status: http.StatusBadRequest, Code: "InvalidRequest", Message: err.Error()}
+	}
+	return &s3Error{Status: http.StatusInternalServerError, Code: "InternalError", Message: err.Error()}
+}
@@ -0,0 +1,170 @@
+package s3gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Requests have to be signed with AWS Signature Version 4 in the Authorization header,
+// using the sfs username as the access key and the password as the secret key.
+const (
+	sigAlgorithm    = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	maxClockSkew    = 15 * time.Minute
+)
+
+type authorization struct {
+	accessKey     string
+	date          string // YYYYMMDD
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+func (a *authorization) scope() string {
+	return strings.Join([]string{a.date, a.region, a.service, "aws4_request"}, "/")
+}
+
+// parses "AWS4-HMAC-SHA256 Credential=AK/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=..."
+func parseAuthorization(header string) (*authorization, error) {
+	rest, ok := strings.CutPrefix(header, sigAlgorithm+" ")
+	if !ok {
+		return nil, fmt.Errorf("only %s is supported", sigAlgorithm)
+	}
+	var a authorization
+	for _, field := range strings.Split(rest, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Credential":
+			parts := strings.Split(value, "/")
+			if len(parts) != 5 || parts[4] != "aws4_request" {
+				return nil, fmt.Errorf("malformed credential %q", value)
+			}
+			a.accessKey, a.date, a.region, a.service = parts[0], parts[1], parts[2], parts[3]
+		case "SignedHeaders":
+			a.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			a.signature = value
+		}
+	}
+	if a.accessKey == "" || len(a.signedHeaders) == 0 || a.signature == "" {
+		return nil, fmt.Errorf("incomplete authorization header")
+	}
+	return &a, nil
+}
+
+// escapes like AWS does: everything but unreserved characters, and '/' too unless it's a path
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		awsEscape(path, true),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signature of r under a, payloadHash is the x-amz-content-sha256 header
+func signature(r *http.Request, a *authorization, secret string, amzDate string, payloadHash string) string {
+	stringToSign := strings.Join([]string{
+		sigAlgorithm,
+		amzDate,
+		a.scope(),
+		sha256Hex([]byte(canonicalRequest(r, a.signedHeaders, payloadHash))),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secret), a.date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, a.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// checks everything about the signature that doesn't need the body, the caller still has
+// to compare the body against payloadHash unless it's UNSIGNED-PAYLOAD
+func verifySignature(r *http.Request, a *authorization, secret string, now time.Time) (payloadHash string, err *s3Error) {
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, parseErr := time.Parse(amzDateFormat, amzDate)
+	if parseErr != nil || !strings.HasPrefix(amzDate, a.date) {
+		return "", errAccessDenied("missing or malformed X-Amz-Date")
+	}
+	if signedAt.Sub(now) > maxClockSkew || now.Sub(signedAt) > maxClockSkew {
+		return "", &s3Error{Status: http.StatusForbidden, Code: "RequestTimeTooSkewed", Message: "the difference between the request time and the server's time is too large"}
+	}
+	signsHost := false
+	for _, name := range a.signedHeaders {
+		signsHost = signsHost || name == "host"
+	}
+	if !signsHost {
+		return "", errAccessDenied("host must be signed")
+	}
+	payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return "", errAccessDenied("missing X-Amz-Content-Sha256")
+	}
+	if strings.HasPrefix(payloadHash, "STREAMING-") {
+		return "", &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "chunked signed payloads are not supported"}
+	}
+	expected := signature(r, a, secret, amzDate, payloadHash)
+	if !hmac.Equal([]byte(expected), []byte(a.signature)) {
+		return "", &s3Error{Status: http.StatusForbidden, Code: "SignatureDoesNotMatch", Message: "the request signature we calculated does not match the signature you provided"}
+	}
+	return payloadHash, nil
+}